@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= AGENTS ======
+
+// roles of the updater in a fleet
+const (
+	// updates containers of its own docker hosts
+	roleStandalone = "standalone"
+	// standalone one updating its hosts for a coordinator, its API must be
+	// authenticated
+	roleAgent = "agent"
+	// receives webhooks and hands updates to cfg.Agents running the repo,
+	// touches no docker of its own
+	roleCoordinator = "coordinator"
+)
+
+// updater in agent role the coordinator sends updates to, API token (if
+// any) is sent as bearer token
+type agentConfig struct {
+	name  string
+	url   string
+	token string
+}
+
+// AGENTS name=URL pairs sorted by name, with AGENT_TOKEN or per-agent
+// AGENT_<NAME>_TOKEN
+func loadAgents() ([]agentConfig, error) {
+	var agents []agentConfig
+	token := envString("AGENT_TOKEN", "")
+	for name, addr := range envMap("AGENTS") {
+		u, err := url.Parse(addr)
+		if name == "" || err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, _err("invalid agent %q=%q, expected name=http(s)://host:port", name, addr)
+		}
+		a := agentConfig{name: name, url: strings.TrimSuffix(addr, "/")}
+		a.token = envString("AGENT_"+envSuffix(name)+"_TOKEN", token)
+		agents = append(agents, a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].name < agents[j].name })
+	return agents, nil
+}
+
+// role settings fitting the rest of the config
+func checkRole(c *Config) error {
+	switch c.Role {
+	case roleStandalone:
+	case roleAgent:
+		if len(c.APITokens) == 0 && c.TLSClientCAFile == "" {
+			return _err("%s role requires API_TOKENS or TLS_CLIENT_CA_FILE, agents' API must be authenticated", roleAgent)
+		}
+	case roleCoordinator:
+		if len(c.Agents) == 0 {
+			return _err("%s role requires AGENTS", roleCoordinator)
+		}
+		if len(c.DockerHosts) > 0 {
+			return _err("DOCKER_HOSTS can't be used in %s role, add agents instead", roleCoordinator)
+		}
+		if c.PollInterval > 0 || len(c.PollSchedule) > 0 {
+			return _err("%s role doesn't poll registries, agents do", roleCoordinator)
+		}
+	default:
+		return _err("unknown ROLE %q, expected %s, %s or %s", c.Role, roleStandalone, roleAgent, roleCoordinator)
+	}
+	if c.Role != roleCoordinator && len(c.Agents) > 0 {
+		return _err("AGENTS are only used in %s role", roleCoordinator)
+	}
+	return nil
+}
+
+// client of agent requests, with client certificate and CA of agents' server
+// certificates when set
+func newAgentClient(c *Config) (*http.Client, error) {
+	tc := &tls.Config{}
+	if c.AgentCAFile != "" {
+		pool, err := loadCertPool(c.AgentCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if c.AgentCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.AgentCertFile, c.AgentKeyFile)
+		if err != nil {
+			return nil, _err("load agent client certificate error: %s", err.Error())
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Timeout: c.AgentTimeout, Transport: &http.Transport{TLSClientConfig: tc}}, nil
+}
+
+var agentClient = &http.Client{}
+
+// 400 error when name is not one of cfg.Agents, empty name means all
+func checkAgent(name string) error {
+	if name != "" && len(agentsFor(name)) == 0 {
+		return _httpErr(http.StatusBadRequest, "unknown agent %q", name)
+	}
+	return nil
+}
+
+// agents named name, every one when name is empty
+func agentsFor(name string) []agentConfig {
+	if name == "" {
+		return config().Agents
+	}
+	for _, a := range config().Agents {
+		if a.name == name {
+			return []agentConfig{a}
+		}
+	}
+	return nil
+}
+
+// calls agent API path, decoding JSON answer into result unless nil;
+// returns response status, error for statuses other than accepted ones
+func (a agentConfig) call(method, path string, query url.Values, body interface{}, trace *span, result interface{}, accepted ...int) (int, error) {
+	target := a.url + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, target, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	if trace != nil {
+		req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", trace.traceID, trace.spanID))
+	}
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	for _, code := range accepted {
+		if resp.StatusCode == code {
+			if result != nil && len(data) > 0 {
+				if err := json.Unmarshal(data, result); err != nil {
+					return resp.StatusCode, _err("unexpected answer: %s", err.Error())
+				}
+			}
+			return resp.StatusCode, nil
+		}
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &e) == nil && e.Error != "" {
+		return resp.StatusCode, _err("%s (status %d)", e.Error, resp.StatusCode)
+	}
+	return resp.StatusCode, _err("unexpected response status %s", resp.Status)
+}
+
+// containers agent would update to repo:tag
+func (a agentConfig) plan(repo, tag string, trace *span) ([]containerRef, error) {
+	var res dryRunResult
+	_, err := a.call(http.MethodGet, "/api/v1/update/plan", url.Values{"repo": {repo}, "tag": {tag}}, nil, trace, &res, http.StatusOK)
+	return res.Containers, err
+}
+
+// containers agents (agent named name if set) would update to repo:tag, with
+// their hosts prefixed with the agent name
+func planAgents(repo, tag, name string) ([]containerRef, error) {
+	refs := []containerRef{}
+	for _, a := range agentsFor(name) {
+		plan, err := a.plan(repo, tag, nil)
+		if err != nil {
+			return nil, _err("agent %s: %s", a.name, err.Error())
+		}
+		for _, ref := range plan {
+			ref.Host = a.hostName(ref.Host)
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// updates repo:tag on agent and waits for its summary, container hosts are
+// prefixed with the agent name
+func (a agentConfig) update(repo, tag string, opts updateOptions, trace *span) (*updateSummary, error) {
+	query := url.Values{"repo": {repo}, "tag": {tag}}
+	if opts.AllowDowngrade {
+		query.Set("allow_downgrade", "true")
+	}
+	method, path := http.MethodGet, "/api/v1/update"
+	var body interface{}
+	if opts.Overrides != nil {
+		method, path, body = http.MethodPost, "/api/v1/update/manual", opts.Overrides
+	}
+	summary := &updateSummary{}
+	code, err := a.call(method, path, query, body, trace, summary, http.StatusOK, http.StatusAccepted, http.StatusInternalServerError)
+	switch {
+	case err != nil:
+		return nil, err
+	case code == http.StatusAccepted:
+		// agent's own window, approval or pause
+		return nil, _err("queued by the agent, not updated")
+	}
+	for i := range summary.UpdatedContainers {
+		summary.UpdatedContainers[i].Host = a.hostName(summary.UpdatedContainers[i].Host)
+	}
+	for i := range summary.MatchedContainers {
+		summary.MatchedContainers[i].Host = a.hostName(summary.MatchedContainers[i].Host)
+	}
+	for i := range summary.SkippedContainers {
+		summary.SkippedContainers[i].Host = a.hostName(summary.SkippedContainers[i].Host)
+	}
+	for i := range summary.Containers {
+		summary.Containers[i].Host = a.hostName(summary.Containers[i].Host)
+	}
+	if code == http.StatusInternalServerError {
+		return summary, _err("%s", summary.Error)
+	}
+	return summary, nil
+}
+
+// agent name, with the docker host of agents with several
+func (a agentConfig) hostName(host string) string {
+	if host == "" {
+		return a.name
+	}
+	return a.name + "/" + host
+}
+
+// updates repo to tag on agents running it (agent named name if set): agents
+// are asked for their plan first, then updated cfg.AgentConcurrency at a
+// time; no more agents are started once an update failed on one. Summaries are merged
+// into one, recorded and notified as a local update would be
+func updateAgents(repo, tag, name string, opts updateOptions) (summary *updateSummary, err error) {
+	if err := checkRequest(repo, tag); err != nil {
+		return nil, err
+	}
+	updatesInFlight.Inc()
+	summary = newUpdateSummary(repo, tag)
+	summary.Host, summary.AllowDowngrade, summary.Overrides, summary.caller = name, opts.AllowDowngrade, opts.Overrides, opts.Caller
+	summary.span = startSpan(opts.Trace, "update", "repo", repo, "tag", tag, "agent", name)
+	defer func() {
+		updatesInFlight.Dec()
+		updatesTotal.WithLabelValues(repo, summary.outcome(err)).Inc()
+		summary.span.set("outcome", summary.outcome(err))
+		summary.span.end(err)
+		summary.log(err)
+		recordHistory(summary, err)
+		if summary.Matched > 0 && !config().ObserveOnly {
+			notifyUpdate(summary, err)
+		}
+		if err == nil && !config().ObserveOnly {
+			markUpdated(repo, tag)
+		}
+		if !config().ObserveOnly {
+			recordOutcome(repo, tag, err)
+		}
+	}()
+
+	agents := agentsFor(name)
+	var mu sync.Mutex
+	var errs []string
+	// an update failed, unreachable agents don't stop the others
+	halted := false
+	failure := func(a agentConfig, err error) {
+		mu.Lock()
+		errs = append(errs, a.name+": "+err.Error())
+		mu.Unlock()
+	}
+	// downgrades match containers plans don't list
+	affected := agents
+	if !opts.AllowDowngrade {
+		plans := make([][]containerRef, len(agents))
+		planErrs := make([]error, len(agents))
+		var wg sync.WaitGroup
+		for i, a := range agents {
+			wg.Add(1)
+			go func(i int, a agentConfig) {
+				defer wg.Done()
+				plans[i], planErrs[i] = a.plan(repo, tag, summary.span)
+			}(i, a)
+		}
+		wg.Wait()
+		affected = nil
+		for i, a := range agents {
+			switch {
+			case planErrs[i] != nil:
+				logrus.Errorf("plan of %s:%s on agent %s error: %s", repo, tag, a.name, planErrs[i])
+				failure(a, planErrs[i])
+			case len(plans[i]) == 0:
+				logrus.Infof("agent %s runs no containers to update to %s:%s, skipped", a.name, repo, tag)
+			default:
+				affected = append(affected, a)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, config().AgentConcurrency)
+	for _, a := range affected {
+		slots <- struct{}{}
+		mu.Lock()
+		stop := halted
+		mu.Unlock()
+		if stop {
+			<-slots
+			logrus.Warnf("agent %s not updated to %s:%s after a failure", a.name, repo, tag)
+			failure(a, _err("not updated after a failure on another agent"))
+			continue
+		}
+		wg.Add(1)
+		go func(a agentConfig) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			logrus.Infof("updating %s:%s on agent %s...", repo, tag, a.name)
+			s := startSpan(summary.span, "agent update", "agent", a.name)
+			res, err := a.update(repo, tag, opts, s)
+			s.end(err)
+			mu.Lock()
+			if res != nil {
+				summary.merge(res)
+			}
+			halted = halted || err != nil
+			mu.Unlock()
+			if err != nil {
+				logrus.Errorf("update of %s:%s on agent %s error: %s", repo, tag, a.name, err)
+				failure(a, err)
+			}
+		}(a)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		err = _err("%s", strings.Join(errs, "; "))
+	}
+	return summary, err
+}
+
+// rolls back container name or containers of repo on agents (agent named
+// name if set), agents without such containers answer none
+func rollbackAgents(container, repo, name string, snapshot bool) ([]rollbackResult, error) {
+	query := url.Values{}
+	if snapshot {
+		query.Set("snapshot", "true")
+	}
+	if container != "" {
+		query.Set("container", container)
+	}
+	if repo != "" {
+		query.Set("repo", repo)
+	}
+	var results []rollbackResult
+	var errs []string
+	for _, a := range agentsFor(name) {
+		var res []rollbackResult
+		code, err := a.call(http.MethodPost, "/api/v1/rollback", query, nil, nil, &res, http.StatusOK, http.StatusNotFound)
+		if err != nil {
+			errs = append(errs, a.name+": "+err.Error())
+			continue
+		}
+		if code == http.StatusNotFound {
+			continue
+		}
+		for i := range res {
+			res[i].Host = a.hostName(res[i].Host)
+		}
+		results = append(results, res...)
+	}
+	if len(errs) > 0 {
+		return results, _err("%s", strings.Join(errs, "; "))
+	}
+	return results, nil
+}
+
+type agentStatus struct {
+	Name    string       `json:"name"`
+	URL     string       `json:"url"`
+	Ready   bool         `json:"ready"`
+	Version *versionInfo `json:"version,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// whether agent is ready, with its version
+func (a agentConfig) status() agentStatus {
+	st := agentStatus{Name: a.name, URL: a.url}
+	info := &versionInfo{}
+	if _, err := a.call(http.MethodGet, "/version", nil, nil, nil, info, http.StatusOK); err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.Version = info
+	if _, err := a.call(http.MethodGet, "/ready", nil, nil, nil, nil, http.StatusOK); err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.Ready = true
+	return st
+}
+
+// agents call: GET /api/v1/agents
+func listAgents(c echo.Context) error {
+	list := make([]agentStatus, len(config().Agents))
+	var wg sync.WaitGroup
+	for i, a := range config().Agents {
+		wg.Add(1)
+		go func(i int, a agentConfig) {
+			defer wg.Done()
+			list[i] = a.status()
+		}(i, a)
+	}
+	wg.Wait()
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
+
+// liveness of agent for the coordinator's readiness
+func pingAgent(a agentConfig) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.call(http.MethodGet, "/live", nil, nil, nil, nil, http.StatusOK)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(config().ReadyTimeout):
+		return _err("no answer in %s", config().ReadyTimeout)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// updater in agent role answering plans and updates the coordinator sends
+type fakeAgent struct {
+	sync.Mutex
+	srv *httptest.Server
+	// containers the agent would update
+	plan []containerRef
+	// status and summary of update answers
+	code    int
+	summary updateSummary
+	// "METHOD path" of requests received, with their authorization
+	calls []string
+	auth  []string
+}
+
+func newFakeAgent(plan []containerRef, code int, summary updateSummary) *fakeAgent {
+	a := &fakeAgent{plan: plan, code: code, summary: summary}
+	a.srv = httptest.NewServer(http.HandlerFunc(a.serve))
+	return a
+}
+
+func (a *fakeAgent) serve(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	a.calls = append(a.calls, r.Method+" "+r.URL.Path)
+	a.auth = append(a.auth, r.Header.Get("Authorization"))
+	a.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/api/v1/update/plan":
+		json.NewEncoder(w).Encode(dryRunResult{Containers: a.plan})
+	case "/api/v1/update":
+		w.WriteHeader(a.code)
+		if a.code == http.StatusAccepted {
+			json.NewEncoder(w).Encode(map[string]string{"status": "queued until update window opens"})
+			return
+		}
+		json.NewEncoder(w).Encode(a.summary)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (a *fakeAgent) recorded(method, path string) int {
+	a.Lock()
+	defer a.Unlock()
+	n := 0
+	for _, call := range a.calls {
+		if call == method+" "+path {
+			n++
+		}
+	}
+	return n
+}
+
+// coordinator config with agents in order, named by their keys
+func withAgents(names []string, agents map[string]*fakeAgent) func() {
+	var configs []agentConfig
+	for _, name := range names {
+		configs = append(configs, agentConfig{name: name, url: agents[name].srv.URL, token: name + "-token"})
+	}
+	restore := withConfig(func(c *Config) {
+		c.Role, c.Agents, c.AgentConcurrency = roleCoordinator, configs, 1
+	})
+	return func() {
+		restore()
+		for _, a := range agents {
+			a.srv.Close()
+		}
+	}
+}
+
+func TestUpdateAgentsMergesSummaries(t *testing.T) {
+	plan := []containerRef{{Name: "app-1", Image: "org/fleet:1.0.0"}}
+	updated := updateSummary{
+		Repo: "org/fleet", Tag: "1.0.1", Matched: 1, Updated: 1,
+		UpdatedContainers: []containerRef{{Name: "app-1", Image: "org/fleet:1.0.1"}},
+		MatchedContainers: []containerRef{{Name: "app-1", Image: "org/fleet:1.0.0", Host: "edge-1"}},
+		Containers:        []containerResult{{containerRef: containerRef{Name: "app-1", Host: "edge-1"}, Status: "updated"}},
+	}
+	agents := map[string]*fakeAgent{
+		"berlin": newFakeAgent(plan, http.StatusOK, updated),
+		"paris":  newFakeAgent(plan, http.StatusOK, updated),
+		"idle":   newFakeAgent(nil, http.StatusOK, updated),
+	}
+	defer withAgents([]string{"berlin", "idle", "paris"}, agents)()
+
+	summary, err := updateAgents("org/fleet", "1.0.1", "", updateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Matched != 2 || summary.Updated != 2 {
+		t.Errorf("merged %d matched, %d updated, want 2 and 2", summary.Matched, summary.Updated)
+	}
+	hosts := map[string]bool{}
+	for _, ref := range summary.UpdatedContainers {
+		hosts[ref.Host] = true
+	}
+	if !hosts["berlin"] || !hosts["paris"] || len(hosts) != 2 {
+		t.Errorf("updated containers on %v, want agent names", hosts)
+	}
+	for _, res := range summary.Containers {
+		if res.Host != "berlin/edge-1" && res.Host != "paris/edge-1" {
+			t.Errorf("container on %q, want its docker host prefixed with the agent", res.Host)
+		}
+	}
+	if n := agents["idle"].recorded(http.MethodGet, "/api/v1/update"); n > 0 {
+		t.Error("agent without containers to update was updated")
+	}
+	for name, a := range agents {
+		a.Lock()
+		for _, auth := range a.auth {
+			if auth != "Bearer "+name+"-token" {
+				t.Errorf("agent %s got authorization %q", name, auth)
+			}
+		}
+		a.Unlock()
+	}
+
+	// one agent only
+	summary, err = updateAgents("org/fleet", "1.0.1", "paris", updateOptions{})
+	if err != nil || summary.Updated != 1 {
+		t.Errorf("update of agent paris: %+v, %v", summary, err)
+	}
+	if n := agents["berlin"].recorded(http.MethodGet, "/api/v1/update"); n != 1 {
+		t.Errorf("agent berlin updated %d times, want once", n)
+	}
+}
+
+func TestUpdateAgentsHaltAfterFailure(t *testing.T) {
+	plan := []containerRef{{Name: "app-1", Image: "org/halted:1.0.0"}}
+	failed := updateSummary{Repo: "org/halted", Tag: "1.0.1", Matched: 1, Failed: 1, Error: "container app-1: start error"}
+	agents := map[string]*fakeAgent{
+		"berlin": newFakeAgent(plan, http.StatusInternalServerError, failed),
+		"paris":  newFakeAgent(plan, http.StatusOK, updateSummary{Matched: 1, Updated: 1}),
+	}
+	defer withAgents([]string{"berlin", "paris"}, agents)()
+
+	summary, err := updateAgents("org/halted", "1.0.1", "", updateOptions{})
+	if err == nil {
+		t.Fatal("failed agent update succeeded")
+	}
+	if !strings.Contains(err.Error(), "berlin: container app-1: start error") {
+		t.Errorf("error %q lacks the agent's one", err)
+	}
+	if !strings.Contains(err.Error(), "paris: not updated after a failure") {
+		t.Errorf("error %q doesn't report the agent left out", err)
+	}
+	if n := agents["paris"].recorded(http.MethodGet, "/api/v1/update"); n > 0 {
+		t.Error("agent updated after a failure on another one")
+	}
+	if summary.Failed != 1 {
+		t.Errorf("summary of the failed agent not merged: %+v", summary)
+	}
+}
+
+func TestUpdateAgentsQueuedIsFailure(t *testing.T) {
+	plan := []containerRef{{Name: "app-1", Image: "org/queued-agent:1.0.0"}}
+	agents := map[string]*fakeAgent{
+		"berlin": newFakeAgent(plan, http.StatusAccepted, updateSummary{}),
+		"paris":  newFakeAgent(plan, http.StatusOK, updateSummary{Matched: 1, Updated: 1}),
+	}
+	defer withAgents([]string{"berlin", "paris"}, agents)()
+
+	summary, err := updateAgents("org/queued-agent", "1.0.1", "", updateOptions{})
+	if err == nil || !strings.Contains(err.Error(), "berlin: queued by the agent, not updated") {
+		t.Errorf("update queued by agent: %v, want a failure", err)
+	}
+	if n := agents["paris"].recorded(http.MethodGet, "/api/v1/update"); n > 0 {
+		t.Error("agent updated after another one queued the update")
+	}
+	if summary.Updated != 0 {
+		t.Errorf("queued update counted: %+v", summary)
+	}
+}
+
+func TestUpdateAgentsUnreachablePlan(t *testing.T) {
+	plan := []containerRef{{Name: "app-1", Image: "org/unreachable:1.0.0"}}
+	agents := map[string]*fakeAgent{
+		"berlin": newFakeAgent(plan, http.StatusOK, updateSummary{}),
+		"paris":  newFakeAgent(plan, http.StatusOK, updateSummary{Matched: 1, Updated: 1}),
+	}
+	defer withAgents([]string{"berlin", "paris"}, agents)()
+	agents["berlin"].srv.Close()
+
+	summary, err := updateAgents("org/unreachable", "1.0.1", "", updateOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), "berlin: ") {
+		t.Errorf("unreachable agent: %v, want its error", err)
+	}
+	// plans failing don't stop the others
+	if summary.Updated != 1 || agents["paris"].recorded(http.MethodGet, "/api/v1/update") != 1 {
+		t.Errorf("reachable agent not updated: %+v", summary)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= IP ALLOWLIST ======
+
+// networks from CIDRs or single addresses
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, _err("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, _err("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// client address: peer of the connection, or the one set by proxy in
+// X-Forwarded-For / X-Real-IP when proxy is trusted
+func clientIP(c echo.Context) net.IP {
+	addr := c.Request().RemoteAddr
+	if config().TrustProxyHeaders {
+		addr = c.RealIP()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// rejects requests from addresses out of nets
+func allowNetworks(nets []*net.IPNet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ip := clientIP(c)
+			for _, n := range nets {
+				if ip != nil && n.Contains(ip) {
+					return next(c)
+				}
+			}
+			req := c.Request()
+			logrus.Warnf("address not allowed, %s %s from %s rejected", req.Method, req.URL.Path, ip)
+			return _httpErr(http.StatusForbidden, "address not allowed")
+		}
+	}
+}
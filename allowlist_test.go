@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := parseNetworks([]string{"10.1.0.0/16", "192.168.1.5", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.1.0.0/16", "192.168.1.5/32", "2001:db8::1/128"}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("network %d: %s, want %s", i, n, want[i])
+		}
+	}
+	for _, s := range []string{"10.1.0.0/33", "host.example.com", "10.1.0", ""} {
+		if _, err := parseNetworks([]string{s}); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestAllowNetworks(t *testing.T) {
+	defer withConfig(func(c *Config) { c.TrustProxyHeaders = false })()
+	nets, err := parseNetworks([]string{"10.1.0.0/16", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.POST("/api/v1/update", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, allowNetworks(nets))
+	send := func(remote string, header ...string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/update", nil)
+		req.RemoteAddr = remote
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		name   string
+		remote string
+		header []string
+		code   int
+	}{
+		{"in network", "10.1.2.3:4000", nil, http.StatusOK},
+		{"single IPv6 address", "[2001:db8::1]:4000", nil, http.StatusOK},
+		{"out of network", "10.2.0.1:4000", nil, http.StatusForbidden},
+		{"other IPv6 address", "[2001:db8::2]:4000", nil, http.StatusForbidden},
+		{"unparsable peer", "unix", nil, http.StatusForbidden},
+		// headers of untrusted proxies are set by clients
+		{"forwarded for", "10.2.0.1:4000", []string{"X-Forwarded-For", "10.1.2.3"}, http.StatusForbidden},
+		{"real ip", "10.2.0.1:4000", []string{"X-Real-IP", "10.1.2.3"}, http.StatusForbidden},
+	} {
+		if code := send(tc.remote, tc.header...); code != tc.code {
+			t.Errorf("%s: HTTP %d, want %d", tc.name, code, tc.code)
+		}
+	}
+
+	config().TrustProxyHeaders = true
+	if code := send("172.17.0.1:4000", "X-Forwarded-For", "10.1.2.3, 172.17.0.1"); code != http.StatusOK {
+		t.Errorf("client of trusted proxy in network: HTTP %d", code)
+	}
+	if code := send("10.1.0.1:4000", "X-Forwarded-For", "10.2.0.1"); code != http.StatusForbidden {
+		t.Errorf("client of trusted proxy out of network: HTTP %d", code)
+	}
+}
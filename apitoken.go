@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= API TOKENS ======
+
+const callerKey = "caller"
+
+// rejects requests without one of cfg.APITokens, sent as Authorization: Bearer
+// <token> or as token query parameter (for webhooks which can't set headers);
+// name of the token is the caller of the request. Tokens are checked as
+// configured at request time, none let every request through
+func requireToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(config().APITokens) == 0 {
+			return next(c)
+		}
+		req := c.Request()
+		token := c.QueryParam("token")
+		if auth := req.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		name, ok := tokenName(token)
+		if !ok {
+			logrus.Warnf("invalid API token, %s %s from %s rejected", req.Method, req.URL.Path, c.RealIP())
+			return _httpErr(http.StatusUnauthorized, "invalid or missing API token")
+		}
+		c.Set(callerKey, name)
+		return next(c)
+	}
+}
+
+// name of given token, every one is compared to not leak timing
+func tokenName(token string) (string, bool) {
+	var name string
+	found := false
+	for t, n := range config().APITokens {
+		if validToken(token, t) {
+			name, found = n, true
+		}
+	}
+	return name, found
+}
+
+// who sent the request: API token name or client certificate common name
+func caller(c echo.Context) string {
+	if name, ok := c.Get(callerKey).(string); ok {
+		return name
+	}
+	return clientCN(c)
+}
+
+// logs caller of requests
+func logCaller(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		logrus.Infof("%s %s by %s", c.Request().Method, c.Request().URL.Path, caller(c))
+		return next(c)
+	}
+}
+
+// token=name map from "name=token" pairs, names must be unique not to
+// confuse audit logs
+func parseAPITokens(pairs map[string]string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for name, token := range pairs {
+		if token == "" {
+			return nil, _err("empty API token %s", name)
+		}
+		if other, ok := tokens[token]; ok {
+			return nil, _err("API tokens %s and %s are the same", other, name)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
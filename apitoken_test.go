@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestRequireToken(t *testing.T) {
+	defer withConfig(func(c *Config) {
+		c.APITokens = map[string]string{"ci-token": "ci", "ops-token": "ops"}
+	})()
+	records, restore := recordEntries()
+	defer restore()
+	e := echo.New()
+	e.POST("/api/v1/update/manual", func(c echo.Context) error {
+		return c.String(http.StatusOK, caller(c))
+	}, requireToken, logCaller)
+	send := func(query, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/update/manual"+query, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		name, query, auth string
+		caller            string
+	}{
+		{"bearer", "", "Bearer ci-token", "ci"},
+		{"query", "?token=ops-token", "", "ops"},
+		// webhooks which can't set headers pass it in the url
+		{"query over bearer", "?token=ops-token", "Bearer ci-token", "ops"},
+		{"missing", "", "", ""},
+		{"wrong", "", "Bearer other-token", ""},
+		{"wrong query over bearer", "?token=other-token", "Bearer ci-token", ""},
+		{"basic auth", "", "Basic Y2k6Y2ktdG9rZW4=", ""},
+		{"token prefix", "", "Bearer ci-tok", ""},
+		{"empty bearer", "", "Bearer ", ""},
+	} {
+		rec := send(tc.query, tc.auth)
+		if tc.caller == "" {
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s: HTTP %d, want 401", tc.name, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.caller {
+			t.Errorf("%s: HTTP %d, caller %q, want %q", tc.name, rec.Code, rec.Body, tc.caller)
+		}
+	}
+	if records.last("POST /api/v1/update/manual by ops") == nil {
+		t.Error("caller of request not logged")
+	}
+
+	// none configured lets every request through
+	config().APITokens = nil
+	if rec := send("", ""); rec.Code != http.StatusOK {
+		t.Errorf("no API tokens: HTTP %d", rec.Code)
+	}
+}
+
+func TestTokenName(t *testing.T) {
+	defer withConfig(func(c *Config) {
+		c.APITokens = map[string]string{"ci-token": "ci", "ops-token": "ops"}
+	})()
+	for token, want := range map[string]string{"ci-token": "ci", "ops-token": "ops"} {
+		if name, ok := tokenName(token); !ok || name != want {
+			t.Errorf("tokenName(%q) = %q, %v, want %q", token, name, ok, want)
+		}
+	}
+	for _, token := range []string{"", "ci", "CI-TOKEN", "ci-token "} {
+		if name, ok := tokenName(token); ok {
+			t.Errorf("tokenName(%q) = %q, accepted", token, name)
+		}
+	}
+}
+
+func TestAPITokensFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	defer os.Unsetenv("API_TOKENS")
+	defer os.Unsetenv("API_TOKENS_FILE")
+	load := func(env, content string) (*Config, error) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("API_TOKENS", env)
+		os.Setenv("API_TOKENS_FILE", file)
+		return loadConfig()
+	}
+
+	c, err := load("ci=ci-token", "# deploy tokens\nops = ops-token\nrelease=rel=token\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ci-token": "ci", "ops-token": "ops", "rel=token": "release"}
+	if len(c.APITokens) != len(want) {
+		t.Errorf("tokens %v, want %v", c.APITokens, want)
+	}
+	for token, name := range want {
+		if c.APITokens[token] != name {
+			t.Errorf("token of %s not loaded: %v", name, c.APITokens)
+		}
+	}
+
+	for name, tc := range map[string][2]string{
+		"name twice in file":     {"", "ops=one\nops=two\n"},
+		"name in env and file":   {"ops=one", "ops=two\n"},
+		"same token of two":      {"ci=shared", "ops=shared\n"},
+		"empty token":            {"", "ops=\n"},
+		"line without separator": {"", "ops-token\n"},
+	} {
+		if _, err := load(tc[0], tc[1]); err == nil {
+			t.Errorf("%s: tokens loaded", name)
+		}
+	}
+}
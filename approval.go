@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo"
+)
+
+// ======= APPROVALS ======
+
+// updates of containers labeled so wait for approval, like those of
+// cfg.ApprovalRepos
+const labelRequireApproval = "docker-updater.require-approval"
+
+// update held until approved through the API, or expired after
+// cfg.ApprovalTTL
+type pendingUpdate struct {
+	ID        string    `json:"id"`
+	Repo      string    `json:"repo"`
+	Tag       string    `json:"tag"`
+	Host      string    `json:"host,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// docker hub webhook callback of the first request, answered once
+	// approved or not
+	callbackURL string
+}
+
+var pending = struct {
+	sync.Mutex
+	byID map[string]*pendingUpdate
+}{byID: make(map[string]*pendingUpdate)}
+
+// whether repo's updates need approval: listed in cfg.ApprovalRepos or
+// with a labeled container on host (any when empty)
+func requiresApproval(repo, host string) bool {
+	if config().ApprovalRepos.match(repo) {
+		return true
+	}
+	clients := []*client.Client{cli}
+	if len(dockerHosts) > 0 {
+		clients = nil
+		for _, h := range hostsFor(host) {
+			clients = append(clients, h.cli)
+		}
+	}
+	wanted := normalizeRepo(repo)
+	args := filters.NewArgs()
+	args.Add("label", labelRequireApproval+"=true")
+	for _, dc := range clients {
+		// not cli of the host locked by running updates
+		containers, err := dc.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+		if err != nil {
+			logrus.Warnf("check %s label error: %s", labelRequireApproval, err)
+			continue
+		}
+		for _, cnt := range containers {
+			if cRepo, _ := splitImage(containerImage(cnt)); cRepo == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holds update arriving for repo needing approval, returns its pending
+// update or nil when it can run; one is pending per repo:tag and host
+func holdForApproval(repo, tag, host, callbackURL string) *pendingUpdate {
+	if !requiresApproval(repo, host) {
+		return nil
+	}
+	pending.Lock()
+	expirePending()
+	for _, p := range pending.byID {
+		if p.Repo == repo && p.Tag == tag && p.Host == host {
+			pending.Unlock()
+			return p
+		}
+	}
+	now := time.Now()
+	p := &pendingUpdate{ID: newJobID(), Repo: repo, Tag: tag, Host: host, CreatedAt: now, ExpiresAt: now.Add(config().ApprovalTTL), callbackURL: callbackURL}
+	pending.byID[p.ID] = p
+	pending.Unlock()
+	logrus.Infof("update %s:%s is waiting for approval (pending %s)", repo, tag, p.ID)
+	notify(notification{Event: eventPending, Repo: repo, Tag: tag, PendingID: p.ID, Time: now})
+	return p
+}
+
+// drops expired pending updates, pending must be locked
+func expirePending() {
+	for id, p := range pending.byID {
+		if time.Now().After(p.ExpiresAt) {
+			delete(pending.byID, id)
+			logrus.Infof("pending update %s:%s (%s) expired without approval", p.Repo, p.Tag, id)
+			if p.callbackURL != "" {
+				go sendHubCallback(p.callbackURL, p.Repo, p.Tag, _err("update was not approved in time"))
+			}
+		}
+	}
+}
+
+// takes pending update out, nil when not pending (anymore)
+func takePending(id string) *pendingUpdate {
+	pending.Lock()
+	defer pending.Unlock()
+	expirePending()
+	p := pending.byID[id]
+	delete(pending.byID, id)
+	return p
+}
+
+// 202 answer of held update
+func pendingAccepted(c echo.Context, p *pendingUpdate) error {
+	return c.JSONPretty(http.StatusAccepted, map[string]string{
+		"status":     "waiting for approval",
+		"pending_id": p.ID,
+	}, "  ")
+}
+
+// queues update approved by caller as a job
+func approvePending(p *pendingUpdate, caller string, trace *span) (*job, error) {
+	if !admitUpdate() {
+		return nil, _httpErr(http.StatusServiceUnavailable, "too many pending updates, retry later")
+	}
+	j := enqueueJob(p.Repo, p.Tag, p.Host, p.callbackURL, config().jobCallbackURL(p.Repo), caller, triggerApproval, trace)
+	if j == nil {
+		releaseUpdate()
+		return nil, _httpErr(http.StatusServiceUnavailable, "too many pending updates, retry later")
+	}
+	return j, nil
+}
+
+// pending list call: GET /api/v1/pending
+func listPending(c echo.Context) error {
+	pending.Lock()
+	expirePending()
+	list := make([]pendingUpdate, 0, len(pending.byID))
+	for _, p := range pending.byID {
+		list = append(list, *p)
+	}
+	pending.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
+
+// approve call: POST /api/v1/pending/:id/approve, runs the update as a job
+// right away (update windows do not apply)
+func approveUpdate(c echo.Context) error {
+	p := takePending(c.Param("id"))
+	if p == nil {
+		return _httpErr(http.StatusNotFound, "no pending update %s", c.Param("id"))
+	}
+	logrus.WithFields(logrus.Fields{
+		"audit":  "approve",
+		"repo":   p.Repo,
+		"tag":    p.Tag,
+		"host":   p.Host,
+		"caller": caller(c),
+		"ip":     clientIP(c),
+	}).Warnf("update %s:%s approved", p.Repo, p.Tag)
+	j, err := approvePending(p, caller(c), requestSpan(c))
+	if err != nil {
+		// kept for another try
+		pending.Lock()
+		pending.byID[p.ID] = p
+		pending.Unlock()
+		return err
+	}
+	return c.JSONPretty(http.StatusAccepted, map[string]string{
+		"job_id": j.ID,
+	}, "  ")
+}
+
+// reject call: POST /api/v1/pending/:id/reject
+func rejectUpdate(c echo.Context) error {
+	p := takePending(c.Param("id"))
+	if p == nil {
+		return _httpErr(http.StatusNotFound, "no pending update %s", c.Param("id"))
+	}
+	logrus.WithFields(logrus.Fields{
+		"audit":  "reject",
+		"repo":   p.Repo,
+		"tag":    p.Tag,
+		"host":   p.Host,
+		"caller": caller(c),
+		"ip":     clientIP(c),
+	}).Warnf("update %s:%s rejected", p.Repo, p.Tag)
+	if p.callbackURL != "" {
+		go sendHubCallback(p.callbackURL, p.Repo, p.Tag, _err("update was rejected"))
+	}
+	return c.JSONPretty(http.StatusOK, p, "  ")
+}
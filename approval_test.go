@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// runs approve or reject handler of pending update id
+func decidePending(h echo.HandlerFunc, id string) (int, map[string]interface{}) {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/v1/pending/"+id, nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	if err := h(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec.Code, body
+}
+
+func TestHoldForApproval(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	patterns, err := parseRepoPatterns([]string{"org/held"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withConfig(func(c *Config) { c.ApprovalRepos, c.ApprovalTTL = patterns, time.Hour })()
+	prevQueue := jobs.queue
+	jobs.queue = make(chan *job, 2)
+	defer func() { jobs.queue = prevQueue }()
+	f.addContainer("held-1", "org/held:1.0.0", nil)
+	f.pushImage("org/held:1.0.1", nil)
+	f.addContainer("labeled-1", "org/labeled:1.0.0", map[string]string{labelRequireApproval: "true"})
+	f.pushImage("org/labeled:1.0.1", nil)
+	f.addContainer("free-1", "org/free:1.0.0", map[string]string{labelRequireApproval: "false"})
+	f.pushImage("org/free:1.0.1", nil)
+
+	held := map[string]string{}
+	for _, repo := range []string{"org/held", "org/labeled"} {
+		code, body := requestUpdate(t, repo, "1.0.1")
+		id, _ := body["pending_id"].(string)
+		if code != http.StatusAccepted || id == "" {
+			t.Fatalf("%s: HTTP %d %v, want it held", repo, code, body)
+		}
+		defer takePending(id)
+		held[repo] = id
+		// held once per repo:tag
+		if _, again := requestUpdate(t, repo, "1.0.1"); again["pending_id"] != id {
+			t.Errorf("%s: second request held as %v, want %s", repo, again["pending_id"], id)
+		}
+	}
+	if calls := f.recorded("pull", "stop", "create"); len(calls) > 0 {
+		t.Errorf("held updates ran: %v", calls)
+	}
+	if code, body := requestUpdate(t, "org/free", "1.0.1"); code != http.StatusOK || body["updated"] != 1.0 {
+		t.Errorf("update not needing approval: %d %v", code, body)
+	}
+
+	// forced updates aren't held, so they are refused
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/update", nil), httptest.NewRecorder())
+	if he, ok := _upd(c, "org/held", "0.9.0", updateOptions{AllowDowngrade: true}).(*echo.HTTPError); !ok || he.Code != http.StatusConflict {
+		t.Errorf("forced update of repo needing approval: %v, want 409", he)
+	}
+
+	code, body := decidePending(approveUpdate, held["org/held"])
+	if code != http.StatusAccepted || body["job_id"] == nil {
+		t.Fatalf("approve: HTTP %d %v", code, body)
+	}
+	j := <-jobs.queue
+	releaseUpdate()
+	if j.Repo != "org/held" || j.Tag != "1.0.1" || j.Trigger != triggerApproval {
+		t.Errorf("approved job %s:%s by %s", j.Repo, j.Tag, j.Trigger)
+	}
+	if code, _ := decidePending(approveUpdate, held["org/held"]); code != http.StatusNotFound {
+		t.Errorf("second approve: HTTP %d, want 404", code)
+	}
+
+	if code, _ := decidePending(rejectUpdate, held["org/labeled"]); code != http.StatusOK {
+		t.Errorf("reject: HTTP %d", code)
+	}
+	if code, _ := decidePending(approveUpdate, held["org/labeled"]); code != http.StatusNotFound {
+		t.Errorf("approve of rejected update: HTTP %d, want 404", code)
+	}
+	if len(jobs.queue) > 0 {
+		t.Error("rejected update queued")
+	}
+}
+
+func TestPendingExpires(t *testing.T) {
+	patterns, err := parseRepoPatterns([]string{"org/expiring"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withConfig(func(c *Config) { c.ApprovalRepos, c.ApprovalTTL = patterns, time.Hour })()
+	p := holdForApproval("org/expiring", "1.0.1", "", "")
+	if p == nil {
+		t.Fatal("update not held")
+	}
+	defer takePending(p.ID)
+	pending.Lock()
+	p.ExpiresAt = time.Now().Add(-time.Second)
+	pending.Unlock()
+	if code, _ := decidePending(approveUpdate, p.ID); code != http.StatusNotFound {
+		t.Errorf("approve of expired update: HTTP %d, want 404", code)
+	}
+	if next := holdForApproval("org/expiring", "1.0.1", "", ""); next == nil || next.ID == p.ID {
+		t.Errorf("update held as %+v after its pending one expired", next)
+	} else {
+		takePending(next.ID)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= AUDIT TRAIL ======
+
+// audit log entries (those with an "audit" field: downgrades, overrides,
+// approvals, pauses, reloads...) and finished updates with their callers;
+// appended to cfg.AuditFile (JSON lines, rotated daily) when set, dropped
+// once older than cfg.AuditRetention
+
+// entries kept in memory without audit file
+const auditMemorySize = 10000
+
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Caller  string    `json:"caller,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Repo    string    `json:"repo,omitempty"`
+	Tag     string    `json:"tag,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	Outcome string    `json:"outcome,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Message string    `json:"message,omitempty"`
+	// other fields of the log entry
+	Details map[string]string `json:"details,omitempty"`
+}
+
+var auditCSVHeader = []string{"time", "action", "caller", "ip", "repo", "tag", "host", "outcome", "error", "message", "details"}
+
+func (e auditEntry) csvRecord() []string {
+	var details []string
+	for _, k := range sortedKeys(e.Details) {
+		details = append(details, k+"="+e.Details[k])
+	}
+	return []string{e.Time.Format(time.RFC3339), e.Action, e.Caller, e.IP, e.Repo, e.Tag, e.Host,
+		e.Outcome, e.Error, e.Message, strings.Join(details, ";")}
+}
+
+var auditTrail = struct {
+	sync.Mutex
+	// without audit file
+	list []auditEntry
+	file *rotatingFile
+	// nothing is recorded until setupAudit
+	on bool
+}{}
+
+// collects audit entries from logs, opening cfg.AuditFile when set
+func setupAudit() error {
+	if config().AuditFile != "" {
+		f, err := openRotatingFile(config().AuditFile, int64(config().AuditFileMaxSize), 24*time.Hour, 0)
+		if err != nil {
+			return _err("open audit file %s error: %s", config().AuditFile, err.Error())
+		}
+		auditTrail.file = f
+	}
+	auditTrail.on = true
+	logrus.AddHook(auditHook{})
+	go runAuditRetention(time.Hour)
+	return nil
+}
+
+func recordAudit(e auditEntry) {
+	auditTrail.Lock()
+	defer auditTrail.Unlock()
+	if !auditTrail.on {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if auditTrail.file != nil {
+		line, err := json.Marshal(e)
+		if err == nil {
+			_, err = auditTrail.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			// not logged, it would be audited again
+			fmt.Fprintf(os.Stderr, "write audit file %s error: %s\n", config().AuditFile, err)
+		}
+		return
+	}
+	auditTrail.list = append(auditTrail.list, e)
+	if len(auditTrail.list) > auditMemorySize {
+		auditTrail.list = auditTrail.list[len(auditTrail.list)-auditMemorySize:]
+	}
+}
+
+// records finished update with its caller
+func auditUpdate(summary *updateSummary, err error) {
+	e := auditEntry{
+		Action:  "update",
+		Caller:  summary.caller,
+		Repo:    summary.Repo,
+		Tag:     summary.Tag,
+		Host:    summary.Host,
+		Outcome: summary.outcome(err),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	recordAudit(e)
+}
+
+// turns log entries with "audit" field into audit entries
+type auditHook struct{}
+
+func (auditHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (auditHook) Fire(entry *logrus.Entry) error {
+	action, ok := entry.Data["audit"]
+	if !ok {
+		return nil
+	}
+	e := auditEntry{Time: entry.Time, Action: fmt.Sprint(action), Message: entry.Message}
+	for k, v := range entry.Data {
+		s := fmt.Sprint(v)
+		switch k {
+		case "audit":
+		case "caller":
+			e.Caller = s
+		case "ip":
+			e.IP = s
+		case "repo":
+			e.Repo = s
+		case "tag":
+			e.Tag = s
+		case "host":
+			e.Host = s
+		default:
+			if e.Details == nil {
+				e.Details = make(map[string]string)
+			}
+			e.Details[k] = s
+		}
+	}
+	recordAudit(e)
+	return nil
+}
+
+// drops entries and rotated audit files older than cfg.AuditRetention
+func runAuditRetention(interval time.Duration) {
+	for {
+		if retention := config().AuditRetention; retention > 0 {
+			pruneAudit(time.Now().Add(-retention))
+		}
+		time.Sleep(interval)
+	}
+}
+
+func pruneAudit(before time.Time) {
+	auditTrail.Lock()
+	i := 0
+	for i < len(auditTrail.list) && auditTrail.list[i].Time.Before(before) {
+		i++
+	}
+	auditTrail.list = auditTrail.list[i:]
+	auditTrail.Unlock()
+	if config().AuditFile == "" {
+		return
+	}
+	rotated, _ := filepath.Glob(config().AuditFile + ".*")
+	for _, file := range rotated {
+		// last written when rotated, holds no newer entries
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().Before(before) {
+			if err := os.Remove(file); err != nil {
+				logrus.Warnf("remove old audit file %s error: %s", file, err)
+			} else {
+				logrus.Infof("audit file %s removed, older than %s", file, config().AuditRetention)
+			}
+		}
+	}
+}
+
+// entries of audit files (rotated ones first) or memory, oldest first,
+// passed to keep
+func auditEntries(keep func(auditEntry) bool) ([]auditEntry, error) {
+	var list []auditEntry
+	if config().AuditFile == "" {
+		auditTrail.Lock()
+		for _, e := range auditTrail.list {
+			if keep(e) {
+				list = append(list, e)
+			}
+		}
+		auditTrail.Unlock()
+		return list, nil
+	}
+	files, _ := filepath.Glob(config().AuditFile + ".*")
+	// timestamps sort chronologically
+	sort.Strings(files)
+	for _, file := range append(files, config().AuditFile) {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			// rotated or removed meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1024*1024)
+		for sc.Scan() {
+			var e auditEntry
+			// a line being written is incomplete
+			if json.Unmarshal(sc.Bytes(), &e) == nil && keep(e) {
+				list = append(list, e)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, _err("read audit file %s error: %s", file, err.Error())
+		}
+	}
+	return list, nil
+}
+
+// audit export call: GET /api/v1/audit[?format=jsonl|csv][&since=RFC3339]
+// [&until=RFC3339][&action=ACTION][&caller=CALLER][&repo=REPO], oldest first
+func exportAudit(c echo.Context) error {
+	format := c.QueryParam("format")
+	switch format {
+	case "":
+		format = "jsonl"
+	case "jsonl", "csv":
+	default:
+		return _httpErr(http.StatusBadRequest, "unknown format %q, expected jsonl or csv", format)
+	}
+	var since, until time.Time
+	var err error
+	if v := c.QueryParam("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return _httpErr(http.StatusBadRequest, "invalid since %q, RFC 3339 time expected", v)
+		}
+	}
+	if v := c.QueryParam("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			return _httpErr(http.StatusBadRequest, "invalid until %q, RFC 3339 time expected", v)
+		}
+	}
+	// current audit file holds expired entries until it's rotated
+	if oldest := time.Now().Add(-config().AuditRetention); config().AuditRetention > 0 && since.Before(oldest) {
+		since = oldest
+	}
+	action, who, repo := c.QueryParam("action"), c.QueryParam("caller"), c.QueryParam("repo")
+	list, err := auditEntries(func(e auditEntry) bool {
+		return (since.IsZero() || !e.Time.Before(since)) && (until.IsZero() || e.Time.Before(until)) &&
+			(action == "" || e.Action == action) && (who == "" || e.Caller == who) && (repo == "" || e.Repo == repo)
+	})
+	if err != nil {
+		return _httpErr(http.StatusInternalServerError, "read audit trail error: %s", err.Error())
+	}
+	resp := c.Response()
+	name := "audit-" + time.Now().UTC().Format(rotatedTimeFormat)
+	if format == "csv" {
+		resp.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		resp.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+name+`.csv"`)
+		resp.WriteHeader(http.StatusOK)
+		w := csv.NewWriter(resp)
+		w.Write(auditCSVHeader)
+		for _, e := range list {
+			w.Write(e.csvRecord())
+		}
+		w.Flush()
+		return w.Error()
+	}
+	resp.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	resp.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+name+`.jsonl"`)
+	resp.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(resp)
+	for _, e := range list {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
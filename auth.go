@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= REGISTRY AUTH ======
+
+// .dockerconfigjson format, same as kubernetes image pull secrets, or
+// docker client config.json with credential helpers
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+type dockerAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// credentials by registry host
+type registryAuths map[string]types.AuthConfig
+
+// credential helpers (docker-credential-<name>) of docker config
+type credHelpers struct {
+	byHost map[string]string
+	store  string
+}
+
+// helper of registry host, empty when credentials are in the file
+func (h credHelpers) of(host string) string {
+	if helper, ok := h.byHost[host]; ok {
+		return helper
+	}
+	return h.store
+}
+
+func loadDockerConfig(file string) (registryAuths, credHelpers, error) {
+	var helpers credHelpers
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, helpers, err
+	}
+	var dc dockerConfig
+	if err := json.Unmarshal(data, &dc); err != nil {
+		return nil, helpers, _err("parse %s error: %s", file, err.Error())
+	}
+	helpers.store = dc.CredsStore
+	helpers.byHost = make(map[string]string, len(dc.CredHelpers))
+	for server, helper := range dc.CredHelpers {
+		helpers.byHost[registryHost(server)] = helper
+	}
+	auths := make(registryAuths)
+	for server, a := range dc.Auths {
+		ac := types.AuthConfig{
+			Username:      a.Username,
+			Password:      a.Password,
+			IdentityToken: a.IdentityToken,
+			RegistryToken: a.RegistryToken,
+			ServerAddress: server,
+		}
+		if a.Auth != "" && ac.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, helpers, _err("decode auth for %s error: %s", server, err.Error())
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, helpers, _err("invalid auth for %s", server)
+			}
+			ac.Username, ac.Password = parts[0], parts[1]
+		}
+		auths[registryHost(server)] = ac
+	}
+	return auths, helpers, nil
+}
+
+// "https://index.docker.io/v1/" -> "docker.io"
+func registryHost(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// credentials cache, so rotated ones are picked up without restart;
+// credentials given by helpers are kept as long
+var authCache = struct {
+	sync.Mutex
+	auths   registryAuths
+	helpers credHelpers
+	helped  registryAuths
+	expires time.Time
+}{}
+
+// credentials from cfg.RegistryAuthFile, re-read when cache TTL is expired,
+// overridden by configured cfg.RegistryAuth ones
+func currentAuths() (registryAuths, credHelpers, error) {
+	if config().RegistryAuthFile == "" {
+		return config().RegistryAuth, credHelpers{}, nil
+	}
+	authCache.Lock()
+	defer authCache.Unlock()
+	if authCache.auths != nil && time.Now().Before(authCache.expires) {
+		return authCache.auths, authCache.helpers, nil
+	}
+	auths, helpers, err := loadDockerConfig(config().RegistryAuthFile)
+	if err != nil {
+		return nil, helpers, _err("load registry auth file error: %s", err.Error())
+	}
+	for host, ac := range config().RegistryAuth {
+		auths[host] = ac
+	}
+	authCache.auths, authCache.helpers, authCache.expires = auths, helpers, time.Now().Add(config().RegistryAuthTTL)
+	authCache.helped = make(registryAuths)
+	return auths, helpers, nil
+}
+
+// credentials of host from its helper, cached with the file ones
+func helperAuth(helper, host string) (types.AuthConfig, bool, error) {
+	authCache.Lock()
+	ac, ok := authCache.helped[host]
+	authCache.Unlock()
+	if ok {
+		return ac, true, nil
+	}
+	ac, ok, err := runCredHelper(helper, host)
+	if err != nil || !ok {
+		return ac, ok, err
+	}
+	authCache.Lock()
+	if authCache.helped != nil && time.Now().Before(authCache.expires) {
+		authCache.helped[host] = ac
+	}
+	authCache.Unlock()
+	return ac, true, nil
+}
+
+// REGISTRY_AUTH credentials by registry host: "user:password" or a bare
+// registry token
+func parseRegistryAuth(m map[string]string) registryAuths {
+	auths := make(registryAuths)
+	for server, cred := range m {
+		ac := types.AuthConfig{ServerAddress: server}
+		if parts := strings.SplitN(cred, ":", 2); len(parts) == 2 {
+			ac.Username, ac.Password = parts[0], parts[1]
+		} else {
+			ac.RegistryToken = cred
+		}
+		auths[registryHost(server)] = ac
+	}
+	return auths
+}
+
+// credentials of registry domain: configured ones, given by its credential
+// helper, from the file, or a token requested from ECR for its registries
+// when cfg.ECRAuth is set
+func domainAuth(domain string) (types.AuthConfig, bool, error) {
+	auths, helpers, err := currentAuths()
+	if err != nil {
+		return types.AuthConfig{}, false, err
+	}
+	if ac, ok := config().RegistryAuth[domain]; ok {
+		return ac, true, nil
+	}
+	if helper := helpers.of(domain); helper != "" {
+		ac, ok, err := helperAuth(helper, domain)
+		if err != nil || ok {
+			return ac, ok, err
+		}
+	}
+	if ac, ok := auths[domain]; ok {
+		return ac, true, nil
+	}
+	if config().ECRAuth && isECRHost(domain) {
+		ac, err := ecrAuth(domain)
+		return ac, err == nil, err
+	}
+	return types.AuthConfig{}, false, nil
+}
+
+// encoded X-Registry-Auth for image's registry, empty when no credentials known
+func registryAuth(image string) (string, error) {
+	pn, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", _err("parse container name %s error: %s", image, err.Error())
+	}
+	ac, ok, err := domainAuth(reference.Domain(pn))
+	if err != nil || !ok {
+		return "", err
+	}
+	data, err := json.Marshal(ac)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// registry auth file of content in a temp dir, removed by the returned func
+func authFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, ".dockerconfigjson")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file, func() { os.RemoveAll(dir) }
+}
+
+// credentials registryAuth encoded for image
+func decodedAuth(t *testing.T, image string) types.AuthConfig {
+	encoded, err := registryAuth(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ac types.AuthConfig
+	if encoded == "" {
+		return ac
+	}
+	data, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &ac); err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func TestDockerConfigJSONAuth(t *testing.T) {
+	// as kubectl create secret docker-registry writes it
+	file, remove := authFile(t, `{"auths":{
+		"registry.example.com":{"username":"ci","password":"s3cret","auth":"Y2k6czNjcmV0"},
+		"https://index.docker.io/v1/":{"auth":"aHViLXVzZXI6aHViLXBhc3M="},
+		"ghcr.io":{"auth":"Z2gtdXNlcjpnaC10b2tlbg=="}
+	}}`)
+	defer remove()
+	defer withConfig(func(c *Config) {
+		c.RegistryAuthFile, c.RegistryAuthTTL, c.RegistryAuth = file, 0, nil
+	})()
+
+	for _, tc := range []struct{ image, username, password string }{
+		{"registry.example.com/team/app:1.0.1", "ci", "s3cret"},
+		{"org/app:1.0.1", "hub-user", "hub-pass"},
+		{"ghcr.io/org/tool:2", "gh-user", "gh-token"},
+		{"quay.io/org/other:1", "", ""},
+	} {
+		ac := decodedAuth(t, tc.image)
+		if ac.Username != tc.username || ac.Password != tc.password {
+			t.Errorf("credentials of %s = %s:%s, want %s:%s", tc.image, ac.Username, ac.Password, tc.username, tc.password)
+		}
+	}
+}
+
+func TestRegistryAuthRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ttl     time.Duration
+		rotated bool
+	}{
+		{"re-read on each pull", 0, true},
+		{"cached for ttl", time.Hour, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file, remove := authFile(t, `{"auths":{"registry.example.com":{"username":"ci","password":"old"}}}`)
+			defer remove()
+			defer withConfig(func(c *Config) {
+				c.RegistryAuthFile, c.RegistryAuthTTL, c.RegistryAuth = file, tc.ttl, nil
+			})()
+			authCache.auths = nil
+			defer func() { authCache.auths = nil }()
+
+			if ac := decodedAuth(t, "registry.example.com/team/app:1"); ac.Password != "old" {
+				t.Fatalf("password = %q, want old", ac.Password)
+			}
+			if err := ioutil.WriteFile(file, []byte(`{"auths":{"registry.example.com":{"username":"ci","password":"new"}}}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			want := "old"
+			if tc.rotated {
+				want = "new"
+			}
+			if ac := decodedAuth(t, "registry.example.com/team/app:1"); ac.Password != want {
+				t.Errorf("password after rotation = %q, want %q", ac.Password, want)
+			}
+			// cache expired
+			authCache.expires = time.Now().Add(-time.Second)
+			if ac := decodedAuth(t, "registry.example.com/team/app:1"); ac.Password != "new" {
+				t.Errorf("password after ttl = %q, want new", ac.Password)
+			}
+		})
+	}
+}
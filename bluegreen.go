@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+// ======= BLUE-GREEN STRATEGY ======
+
+// new (green) container is started unrouted next to the old (blue) one and
+// has to get healthy before any traffic moves: it carries cfg.BlueGreenLabels
+// over its own (traefik.enable=false by default), no nginx-proxy
+// VIRTUAL_HOST, network aliases, static IPs or host ports. Labels of a running
+// container can't change, so once green passes, routing flips by replacing
+// blue like start-first does: the routed container (same image and config)
+// takes over blue's labels and aliases before blue is removed, green is
+// dropped then
+
+// suffix of green container name while it is verified
+const greenSuffix = "-docker-updater-green"
+
+// env of nginx-proxy (and its acme companion) routing to container
+var proxyEnv = []string{"VIRTUAL_HOST", "LETSENCRYPT_HOST"}
+
+// verifies green container of inspected one, then replaces it start-first;
+// stopped containers serve nothing and are replaced right away
+func replaceBlueGreen(inspect types.ContainerJSON, repo, tag string, overrides *containerOverrides, trigger string) (types.ContainerJSON, string, bool, error) {
+	if !startRecreated(inspect) {
+		return replaceStartFirst(inspect, repo, tag, overrides, trigger)
+	}
+	if err := verifyGreen(inspect, repo, tag, overrides, trigger); err != nil {
+		return types.ContainerJSON{}, "", false, _err("container %s: %s, old one kept", strings.TrimPrefix(inspect.Name, "/"), err)
+	}
+	return replaceStartFirst(inspect, repo, tag, overrides, trigger)
+}
+
+// starts unrouted green container of inspected one, removed once it is
+// running (healthy within health wait when set) or failed to
+func verifyGreen(inspect types.ContainerJSON, repo, tag string, overrides *containerOverrides, trigger string) error {
+	fullRepo := fmt.Sprintf("%s:%s", repo, tag)
+	green := unroutedCopy(inspect)
+	contConfig := newContainerConfig(inspect, fullRepo, overrides, trigger)
+	for k, v := range config().BlueGreenLabels {
+		contConfig.Labels[k] = v
+	}
+	contConfig.Env = withoutEnv(contConfig.Env, proxyEnv)
+
+	id, err := createContainer(contConfig, green)
+	if id != "" {
+		defer func() {
+			if err := cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
+				logrus.Errorf("remove green container %s error: %s", id, err)
+			}
+		}()
+	}
+	if err != nil {
+		return _err("create green container error: %s", err.Error())
+	}
+	if err := cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		return _err("start green container error: %s", err.Error())
+	}
+	emitContainerEvent(eventTypeContainerStarted, green.Name, fullRepo)
+	logrus.Infof("verifying green container %s...", strings.TrimPrefix(green.Name, "/"))
+	if _, err := waitStarted(id, config().healthWait(repo)); err != nil {
+		return _err("green container: %s", err)
+	}
+	logrus.Infof("green container %s passed, switching routing", strings.TrimPrefix(green.Name, "/"))
+	return nil
+}
+
+// inspected container under green name, without host ports and network
+// aliases or static IPs of the old one
+func unroutedCopy(inspect types.ContainerJSON) types.ContainerJSON {
+	green := inspect
+	base := *inspect.ContainerJSONBase
+	base.Name = "/" + strings.TrimPrefix(inspect.Name, "/") + greenSuffix
+	if inspect.HostConfig != nil {
+		hostConfig := *inspect.HostConfig
+		hostConfig.PortBindings, hostConfig.PublishAllPorts = nil, false
+		base.HostConfig = &hostConfig
+	}
+	green.ContainerJSONBase = &base
+	if inspect.NetworkSettings != nil {
+		settings := *inspect.NetworkSettings
+		settings.Networks = make(map[string]*network.EndpointSettings)
+		for name, es := range inspect.NetworkSettings.Networks {
+			conf := endpointConfig(es, inspect.ID)
+			conf.Aliases, conf.IPAMConfig = nil, nil
+			settings.Networks[name] = conf
+		}
+		green.NetworkSettings = &settings
+	}
+	return green
+}
+
+// env without the given variables
+func withoutEnv(env []string, names []string) []string {
+	var kept []string
+	for _, kv := range env {
+		drop := false
+		for _, name := range names {
+			if kv == name || strings.HasPrefix(kv, name+"=") {
+				drop = true
+			}
+		}
+		if !drop {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= DOCKER HUB CALLBACK ======
+
+type hubCallback struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+}
+
+// reports update result back to docker hub webhook callback, best-effort
+func sendHubCallback(callbackURL, repo, tag string, err error) {
+	cb := hubCallback{
+		State:       "success",
+		Description: fmt.Sprintf("%s:%s updated", repo, tag),
+		Context:     "docker-updater",
+	}
+	if err != nil {
+		cb.State, cb.Description = "failure", err.Error()
+	}
+	body, mErr := json.Marshal(cb)
+	if mErr != nil {
+		logrus.Errorf("docker hub callback for %s:%s error: %s", repo, tag, mErr)
+		return
+	}
+	resp, pErr := notifyClient.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if pErr != nil {
+		logrus.Errorf("docker hub callback for %s:%s error: %s", repo, tag, pErr)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logrus.Errorf("docker hub callback for %s:%s error: unexpected response status %s", repo, tag, resp.Status)
+		return
+	}
+	logrus.Infof("docker hub callback for %s:%s sent: %s", repo, tag, cb.State)
+}
+
+// https://registry.hub.docker.com/u/<namespace>/<repo>/hook/<id>/
+func isHubCallbackURL(callbackURL string) bool {
+	u, err := url.Parse(callbackURL)
+	return err == nil && u.Scheme == "https" && (u.Host == "registry.hub.docker.com" || u.Host == "hub.docker.com")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendHubCallback(t *testing.T) {
+	var got []hubCallback
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cb hubCallback
+		if err := json.NewDecoder(r.Body).Decode(&cb); err != nil {
+			t.Errorf("callback body: %s", err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("callback content type %q", ct)
+		}
+		got = append(got, cb)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sendHubCallback(srv.URL, "org/app", "1.0.1", nil)
+	sendHubCallback(srv.URL, "org/app", "1.0.2", errors.New("pull image error"))
+	// best-effort, a refusing target is only logged
+	status = http.StatusInternalServerError
+	sendHubCallback(srv.URL, "org/app", "1.0.3", nil)
+	srv.Close()
+	sendHubCallback(srv.URL, "org/app", "1.0.4", nil)
+
+	want := []hubCallback{
+		{State: "success", Description: "org/app:1.0.1 updated", Context: "docker-updater"},
+		{State: "failure", Description: "pull image error", Context: "docker-updater"},
+		{State: "success", Description: "org/app:1.0.3 updated", Context: "docker-updater"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("callbacks = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("callback %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHubCallbackURL(t *testing.T) {
+	for _, tc := range []struct{ callbackURL, want string }{
+		{"https://registry.hub.docker.com/u/org/app/hook/2141b5bi5i5b02bec211i4eeih0242eg11000a/", "https://registry.hub.docker.com/u/org/app/hook/2141b5bi5i5b02bec211i4eeih0242eg11000a/"},
+		{"http://registry.hub.docker.com/u/org/app/hook/1/", ""},
+		{"https://attacker.example.com/hook", ""},
+		{"", ""},
+	} {
+		body := `{"callback_url": "` + tc.callbackURL + `", "push_data": {"tag": "1.0.1"}, "repository": {"repo_name": "org/app"}}`
+		if got := hubCallbackURL([]byte(body)); got != tc.want {
+			t.Errorf("callback url of %q = %q, want %q", tc.callbackURL, got, tc.want)
+		}
+	}
+}
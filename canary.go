@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= CANARY ======
+
+func (c *Config) canaryWait(repo string) time.Duration {
+	if wait, ok := c.RepoCanaryWait[repo]; ok {
+		return wait
+	}
+	return c.CanaryWait
+}
+
+// with canary wait set for repo (and more than one container) the first
+// container is updated alone, ahead of other batches
+func canaryBatches(repo string, inspects []types.ContainerJSON, size int) [][]types.ContainerJSON {
+	if config().canaryWait(repo) <= 0 || len(inspects) < 2 {
+		return planBatches(repo, inspects, size)
+	}
+	return append([][]types.ContainerJSON{inspects[:1]}, planBatches(repo, inspects[1:], size)...)
+}
+
+// watches updated canary container for repo's canary wait, it fails when it
+// stops, restarts or gets unhealthy; failed canary is rolled back to prev
+// with rollback health timeout action
+func checkCanary(repo string, prev, created types.ContainerJSON) (rolledBack bool, err error) {
+	wait := config().canaryWait(repo)
+	name := strings.TrimPrefix(prev.Name, "/")
+	logrus.Infof("observing canary container %s for %v...", name, wait)
+	deadline := time.Now().Add(wait)
+	var status string
+	for status == "" && time.Now().Before(deadline) {
+		time.Sleep(healthPollInterval)
+		inspect, err := cli.ContainerInspect(ctx, created.ID)
+		if err != nil {
+			return false, _err("inspect canary container %s error: %s", name, err.Error())
+		}
+		switch {
+		case !isRunning(inspect), inspect.State.Restarting, inspect.RestartCount > created.RestartCount:
+			status = healthExited
+		case inspect.State.Health != nil && inspect.State.Health.Status == types.Unhealthy:
+			status = healthUnhealthy
+		}
+	}
+	if status == "" {
+		logrus.Infof("canary container %s passed, updating the rest", name)
+		return false, nil
+	}
+	if config().healthTimeoutAction(repo) != healthRollback {
+		return false, _err("canary container %s is %s, update aborted", name, status)
+	}
+	if err := rollbackContainer(prev, created.ID); err != nil {
+		return false, _err("canary container %s is %s, update aborted, rollback error: %s", name, status, err.Error())
+	}
+	return true, _err("canary container %s is %s, update aborted, rolled back to previous image", name, status)
+}
+
+// checks the only updated container as canary, failed one is counted in
+// summary and dropped from updated ones when rolled back
+func canaryPassed(repo string, summary *updateSummary, updated *[]recreatedContainer) error {
+	canary := (*updated)[0]
+	if !isRunning(canary.prev) {
+		// recreated stopped, nothing to observe
+		return nil
+	}
+	created, err := cli.ContainerInspect(ctx, canary.newID)
+	if err != nil {
+		return _err("inspect canary container %s error: %s", canary.newID, err.Error())
+	}
+	rolledBack, err := checkCanary(repo, canary.prev, created)
+	if err == nil {
+		return nil
+	}
+	summary.Failed++
+	last := &summary.Containers[len(summary.Containers)-1]
+	last.Error = err.Error()
+	if rolledBack {
+		summary.Updated--
+		summary.UpdatedContainers = summary.UpdatedContainers[:len(summary.UpdatedContainers)-1]
+		last.Status = containerRolledBack
+		*updated = (*updated)[:0]
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= RELEASE CHANNELS ======
+
+// release channel container follows: version channel like "1.x" or "1.4.x"
+// (any higher tag within it) or tag name like "stable" (when that tag moves)
+const labelChannel = "docker-updater.channel"
+
+var versionChannelRe = regexp.MustCompile(`^v?\d+(\.\d+)?\.[xX*]$`)
+
+// update decision for container following channel
+func channelDecision(name, policy, channel, cTag, tag string, remote *remoteDigest, digests func() []string) bool {
+	if !versionChannelRe.MatchString(channel) {
+		if tag != channel {
+			logrus.Infof("%s follows channel %s, tag %s skipped", name, channel, tag)
+			return false
+		}
+		update := remote.changed(digests())
+		if !update {
+			logrus.Infof("%s image digest is up to date", name)
+		}
+		return update
+	}
+	c, err := semver.NewConstraint(channel)
+	if err != nil {
+		logrus.Errorf("%s has invalid %s=%s: %s", name, labelChannel, channel, err)
+		return false
+	}
+	ver, err := semver.NewVersion(tag)
+	if err != nil || !c.Check(ver) {
+		logrus.Infof("tag %s is out of %s channel %s, skipped", tag, name, channel)
+		return false
+	}
+	// container on a non-version tag joins the channel with any version of it
+	if _, err := semver.NewVersion(cTag); err != nil {
+		return true
+	}
+	return shouldUpdate(policy, cTag, tag)
+}
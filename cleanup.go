@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= IMAGE CLEANUP ======
+
+type cleanupResult struct {
+	Image    string
+	Untagged []string
+	Deleted  []string
+	Skipped  bool
+	Err      error
+}
+
+// removes images with up to cfg.CleanupConcurrency parallel calls,
+// images still used by any container (running or not) are kept
+func removeImages(images []string) []cleanupResult {
+	images = uniqueStrings(images)
+	inUse, err := imagesInUse()
+	if err != nil {
+		logrus.Errorf("unable to check images usage, cleanup skipped: %s", err)
+		return nil
+	}
+
+	results := make([]cleanupResult, len(images))
+	sem := make(chan struct{}, config().CleanupConcurrency)
+	var wg sync.WaitGroup
+	for i, image := range images {
+		if inUse[image] {
+			results[i] = cleanupResult{Image: image, Skipped: true}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = removeImage(image)
+		}(i, image)
+	}
+	wg.Wait()
+
+	for _, res := range results {
+		switch {
+		case res.Skipped:
+			logrus.Infof(" - kept (in use): %s", res.Image)
+		case res.Err != nil:
+			logrus.Errorf("remove previous image error: %s", res.Err)
+		default:
+			for _, untagged := range res.Untagged {
+				logrus.Infof(" - untagged: %s", untagged)
+			}
+			for _, deleted := range res.Deleted {
+				logrus.Infof(" - deleted: %s", deleted)
+			}
+		}
+	}
+	return results
+}
+
+func removeImage(image string) cleanupResult {
+	res := cleanupResult{Image: image}
+	rm, err := cli.ImageRemove(ctx, image, types.ImageRemoveOptions{})
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	for _, rmi := range rm {
+		if rmi.Untagged != "" {
+			res.Untagged = append(res.Untagged, rmi.Untagged)
+		}
+		if rmi.Deleted != "" {
+			res.Deleted = append(res.Deleted, rmi.Deleted)
+		}
+	}
+	return res
+}
+
+// previous images are kept explicitly or by their rollback tags
+func (c *Config) keepPreviousImage() bool {
+	return c.KeepPreviousImage || c.RollbackTags
+}
+
+// image of replaced container to remove: its own one, or the one before it
+// when previous images are kept; none with retention policy, which cleans
+// images itself
+func cleanupCandidate(replaced types.ContainerJSON) string {
+	if config().retainImages() {
+		return ""
+	}
+	if !config().keepPreviousImage() {
+		return replaced.Image
+	}
+	if replaced.Config == nil {
+		return ""
+	}
+	return replaced.Config.Labels[labelPrevImageID]
+}
+
+// image IDs referenced by existing containers, kept previous images too
+func imagesInUse() (map[string]bool, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, _err("get containers list error: %s", err.Error())
+	}
+	inUse := make(map[string]bool)
+	for _, cnt := range containers {
+		inUse[cnt.ImageID] = true
+		if config().keepPreviousImage() {
+			inUse[cnt.Labels[labelPrevImageID]] = true
+		}
+	}
+	return inUse, nil
+}
+
+func uniqueStrings(list []string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRemoveImagesParallelKeepsInUse(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.CleanupConcurrency = 3 })()
+	f.rmiDelay = 50 * time.Millisecond
+	var images []string
+	for i := 0; i < 6; i++ {
+		images = append(images, f.addImage(fmt.Sprintf("org/app:1.0.%d", i), nil).ID)
+	}
+	used := f.addContainer("app-1", "org/app:1.0.0", nil)
+
+	results := removeImages(append(images, images[1]))
+	if len(results) != len(images) {
+		t.Fatalf("results = %+v, want one per unique image", results)
+	}
+	for i, res := range results {
+		switch {
+		case res.Image != images[i]:
+			t.Errorf("result %d is of %s, want %s", i, res.Image, images[i])
+		case res.Image == used.Image:
+			if !res.Skipped || res.Err != nil {
+				t.Errorf("image in use not kept: %+v", res)
+			}
+		case res.Skipped || res.Err != nil || len(res.Deleted) != 1:
+			t.Errorf("image %s not deleted: %+v", res.Image, res)
+		}
+	}
+	if calls := f.recorded("rmi"); len(calls) != len(images)-1 {
+		t.Errorf("removals = %v, want all but the used image", calls)
+	}
+	if f.rmiPeak != 3 {
+		t.Errorf("at most %d removals at once, want 3", f.rmiPeak)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= COMMAND LINE ======
+
+const usage = `usage: docker-updater [command] [flags]
+
+commands:
+  serve     run the API server (default)
+  update    update containers of --repo to --tag and exit
+  plan      print containers which would be updated to --repo:--tag
+  rollback  recreate --container (or containers of --repo) on the previous image
+  version   print version
+
+run docker-updater <command> --help for its flags
+`
+
+// runs command of args (serve when none is given), returns exit code
+func runCommand(args []string) int {
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		return serveCommand(args)
+	case "update":
+		return updateCommand(args)
+	case "plan":
+		return planCommand(args)
+	case "rollback":
+		return rollbackCommand(args)
+	case "version":
+		return versionCommand()
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+	return 2
+}
+
+// flags every command takes, already applied by loadConfig
+func configFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "YAML config file")
+	fs.String("profile", "", "config file profile, overrides PROFILE")
+	fs.String("log-level", "", "log level, overrides LOG_LEVEL")
+	fs.String("log-format", "", "text or json, overrides LOG_FORMAT")
+}
+
+// prints v as indented JSON
+func printJSON(v interface{}) {
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintln(os.Stdout, string(out))
+}
+
+// API server until it is stopped:
+// docker-updater [serve] [--listen ADDRESS] [--config FILE] [--profile NAME] [--log-level LEVEL] [--log-format FORMAT]
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\nserve flags:\n", usage)
+		fs.PrintDefaults()
+	}
+	fs.String("listen", "", "address to listen on, overrides LISTEN_ADDRESS")
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	serve()
+	return 0
+}
+
+// one-shot update without API server:
+// docker-updater update --repo REPO --tag TAG [--host HOST] [--container ID] [--config FILE] [--profile NAME]
+// [--log-level LEVEL] [--log-format FORMAT],
+// returns exit code, non-zero when update failed
+func updateCommand(args []string) int {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	repo := fs.String("repo", "", "image repo to update")
+	tag := fs.String("tag", "", "tag to update to")
+	host := fs.String("host", "", "one of DOCKER_HOSTS to update on, all by default")
+	fs.StringVar(&onlyContainer, "container", "", "ID of the only container to update")
+	allowDowngrade := fs.Bool("allow-downgrade", false, "update to a lower version too (deliberate rollback)")
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := checkHost(*host); err != nil {
+		logrus.Errorf("update error: %s", err)
+		return 2
+	}
+	summary, err := updateHosts(normalizeRepo(*repo), *tag, *host, updateOptions{AllowDowngrade: *allowDowngrade, Caller: "cli", Trigger: triggerCLI})
+	if summary != nil {
+		printJSON(summary)
+	}
+	if err != nil {
+		logrus.Errorf("update error: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// dry run without API server:
+// docker-updater plan --repo REPO --tag TAG [--host HOST] [--check-registry] [--config FILE] [--profile NAME]
+// [--log-level LEVEL] [--log-format FORMAT],
+// prints the plan as GET /api/v1/update/plan does
+func planCommand(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	repo := fs.String("repo", "", "image repo to update")
+	tag := fs.String("tag", "", "tag to update to")
+	host := fs.String("host", "", "one of DOCKER_HOSTS to plan on, all by default")
+	checkRegistry := fs.Bool("check-registry", false, "also inspect the image manifest in the registry")
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := checkRequest(*repo, *tag); err != nil {
+		logrus.Errorf("plan error: %s", err)
+		return 2
+	}
+	if err := checkHost(*host); err != nil {
+		logrus.Errorf("plan error: %s", err)
+		return 2
+	}
+	res, err := planUpdate(*repo, *tag, *host)
+	if err != nil {
+		logrus.Errorf("plan error: %s", err)
+		return 1
+	}
+	if *checkRegistry {
+		withHost(defaultHost(), func() {
+			res.Registry = inspectRegistry(*repo + ":" + *tag)
+		})
+	}
+	printJSON(res)
+	return 0
+}
+
+// rollback without API server:
+// docker-updater rollback --container NAME | --repo REPO [--host HOST] [--snapshot] [--config FILE] [--profile NAME]
+// [--log-level LEVEL] [--log-format FORMAT],
+// non-zero exit code when nothing was rolled back or a container failed
+func rollbackCommand(args []string) int {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	name := fs.String("container", "", "name of the container to roll back")
+	repo := fs.String("repo", "", "image repo whose containers are rolled back")
+	host := fs.String("host", "", "one of DOCKER_HOSTS to roll back on, all by default")
+	snapshot := fs.Bool("snapshot", false, "recreate from the latest snapshot instead of the previous image")
+	configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*name == "") == (*repo == "") {
+		logrus.Errorf("rollback error: either --container or --repo must be set")
+		return 2
+	}
+	if *repo != "" && !config().repoAllowed(*repo) {
+		logrus.Errorf("rollback error: repo %s is not allowed", *repo)
+		return 2
+	}
+	if err := checkHost(*host); err != nil {
+		logrus.Errorf("rollback error: %s", err)
+		return 2
+	}
+	results, err := runRollback(*name, *repo, *host, *snapshot)
+	if len(results) > 0 {
+		printJSON(results)
+	}
+	if err != nil {
+		logrus.Errorf("rollback error: %s", err)
+		return 1
+	}
+	if len(results) == 0 {
+		logrus.Errorf("rollback error: no containers with previous image found")
+		return 1
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
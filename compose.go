@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// ======= COMPOSE ======
+
+// set by docker compose on service containers
+const (
+	labelComposeProject = "com.docker.compose.project"
+	labelComposeService = "com.docker.compose.service"
+)
+
+// compose project/service of container, empty for other containers
+func composeService(inspect types.ContainerJSON) string {
+	if inspect.Config == nil || inspect.Config.Labels[labelComposeService] == "" {
+		return ""
+	}
+	return inspect.Config.Labels[labelComposeProject] + "/" + inspect.Config.Labels[labelComposeService]
+}
+
+// splits containers of repo into batches of up to size ones, keeping their
+// order; a batch holds at most repo's replica batch size of each compose
+// service (one with cfg.ComposeSerial), so replicas roll out gradually;
+// containers (in dependency order) come in a later batch than ones they
+// depend on
+func planBatches(repo string, inspects []types.ContainerJSON, size int) [][]types.ContainerJSON {
+	limits := serviceReplicas(inspects)
+	for svc, replicas := range limits {
+		limits[svc] = config().replicaBatchSize(repo, replicas)
+	}
+	pending := make(map[string]bool)
+	for _, inspect := range inspects {
+		pending[strings.TrimPrefix(inspect.Name, "/")] = true
+	}
+	var batches [][]types.ContainerJSON
+	rest := inspects
+	for len(rest) > 0 {
+		var batch, later []types.ContainerJSON
+		services := make(map[string]int)
+		for _, inspect := range rest {
+			svc := composeService(inspect)
+			if len(batch) == size || svc != "" && services[svc] == limits[svc] || waitsForDependency(inspect, pending) {
+				later = append(later, inspect)
+				continue
+			}
+			services[svc]++
+			batch = append(batch, inspect)
+		}
+		for _, inspect := range batch {
+			delete(pending, strings.TrimPrefix(inspect.Name, "/"))
+		}
+		batches = append(batches, batch)
+		rest = later
+	}
+	return batches
+}
@@ -0,0 +1,1364 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= CONFIG ======
+
+// update modes
+const (
+	// recreate standalone containers
+	modeContainers = "containers"
+	// update swarm services
+	modeSwarm = "swarm"
+	// swarm on swarm managers, containers elsewhere and with DOCKER_HOSTS
+	modeAuto = "auto"
+)
+
+// pull/stop ordering
+const (
+	// pull new image, then replace containers (minimal downtime)
+	orderPullFirst = "pull-first"
+	// remove containers, then pull new image (frees disk space first)
+	orderStopFirst = "stop-first"
+)
+
+type Config struct {
+	// API server address, "none" serves on ListenSocket only
+	ListenAddress string
+	LogLevel      logrus.Level
+	// also served on unix socket, with these permissions and group
+	ListenSocket      string
+	ListenSocketMode  os.FileMode
+	ListenSocketGroup string
+	// text or json
+	LogFormat string
+	// log every API request
+	LogRequests bool
+	// also written to rotated file
+	LogFile           string
+	LogFileMaxSize    int
+	LogFileMaxAge     time.Duration
+	LogFileMaxBackups int
+	// also sent to syslog: local or udp://, tcp:// address
+	LogSyslog    string
+	LogSyslogTag string
+	// bound of waiting for running updates on SIGTERM
+	ShutdownTimeout time.Duration
+	// how often config file is checked for changes, 0 reloads on SIGHUP only
+	ConfigWatchInterval time.Duration
+	// config file profile applied, empty when none
+	Profile string
+	// audit trail file (rotated daily or once bigger), entries and rotated
+	// files are dropped after AuditRetention unless it is 0
+	AuditFile        string
+	AuditFileMaxSize int
+	AuditRetention   time.Duration
+	// updates of these repos wait for approval, pending ones expire
+	ApprovalRepos repoPatterns
+	ApprovalTTL   time.Duration
+	// consecutive failed updates of repo:tag quarantining it, 0 disables
+	QuarantineAfter int
+	// registry domains /ready checks besides docker daemons
+	ReadyRegistries []string
+	ReadyTimeout    time.Duration
+	Mode            string
+	// detect and record updates, never touch containers
+	ObserveOnly   bool
+	PullOrder     string
+	RepoPullOrder map[string]string
+	// pushed repos (and tags) mapped to images containers run
+	RepoMap repoMap
+	// HMAC secret of webhook endpoints, per-endpoint ones override it
+	WebhookSecret  string
+	WebhookSecrets map[string]string
+	// repos allowed to be updated, empty means any
+	AllowedRepos map[string]bool
+	// repos must match one of include patterns (unless empty) and none of
+	// exclude ones
+	IncludeRepos repoPatterns
+	ExcludeRepos repoPatterns
+	// serve API over HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// hosts to serve API over HTTPS for with let's encrypt certificates,
+	// cached in TLSAutocertCacheDir
+	TLSAutocertHosts    []string
+	TLSAutocertCacheDir string
+	// CA client certificates must be signed by, requires TLS
+	TLSClientCAFile string
+	// web UI at /ui
+	Dashboard bool
+	// OTLP/HTTP collector traces are exported to, none when empty
+	OTLPEndpoint    string
+	OTLPHeaders     map[string]string
+	OTelServiceName string
+	// updater's own container is updated by a helper container
+	SelfUpdate bool
+	// docker endpoints updates fan out to, DOCKER_HOST one when empty
+	DockerHosts []dockerHostConfig
+	// Updater gRPC service served too, over TLS
+	GRPC bool
+	// standalone, agent or coordinator
+	Role string
+	// updaters in agent role a coordinator hands updates to, how many are
+	// updated at once and how long one may take
+	Agents           []agentConfig
+	AgentConcurrency int
+	AgentTimeout     time.Duration
+	// CA of agents' server certificates and client certificate sent to them
+	AgentCAFile   string
+	AgentCertFile string
+	AgentKeyFile  string
+	// engine behind the docker API, podman ones are handled by their quirks
+	Engine string
+	// token=name of callers allowed to use the API, empty means no auth
+	APITokens map[string]string
+	// networks update endpoints accept requests from, empty means any
+	WebhookAllowedNets []*net.IPNet
+	// client address is taken from X-Forwarded-For / X-Real-IP
+	TrustProxyHeaders bool
+	// parallel ImageRemove calls on cleanup
+	CleanupConcurrency int
+	// previous image of updated containers is not removed, for rollback
+	KeepPreviousImage bool
+	// previous image is tagged REPO:rollback-NAME, which keeps it too
+	RollbackTags bool
+	// images of managed repos kept after updates: latest count ones and
+	// younger than age, older ones are removed every cleanup interval
+	ImageRetentionCount  int
+	ImageRetentionAge    time.Duration
+	ImageCleanupInterval time.Duration
+	// scheduled pruning of dangling images, and unused networks and
+	// volumes when enabled, in WindowsTZ
+	PruneSchedule []pollSchedule
+	PruneNetworks bool
+	PruneVolumes  bool
+	// image pulls and registry calls are retried Retries more times on
+	// transient errors, with exponential backoff
+	PullTimeout     time.Duration
+	RegistryTimeout time.Duration
+	Retries         int
+	RetryBackoff    time.Duration
+	RetryBackoffMax time.Duration
+	// pull-through caches by registry domain, registry API calls go through
+	// the proxy
+	RegistryMirrors        map[string]string
+	RegistryMirrorFallback bool
+	RegistryProxy          *url.URL
+	// failed containers don't stop the rest of an update
+	ContinueOnFailure bool
+	// updates with failed containers are run again this many times, after
+	// FailedRetryBackoff doubled for each attempt
+	FailedRetries      int
+	FailedRetryBackoff time.Duration
+	// pulls fail early when the docker data root has less bytes available,
+	// the data root is found via docker info unless set
+	MinFreeSpace   int
+	DockerDataRoot string
+	// containers removed and recreated in parallel within a batch
+	RecreateConcurrency int
+	// grace period between SIGTERM and SIGKILL on container stop
+	StopTimeout time.Duration
+	// os/arch[/variant] of pulled images, empty means daemon's default
+	// unchecked, auto checks images against the daemon's platform
+	Platform string
+	// cosign signatures images must carry to be updated to, nil disables
+	Cosign *cosignPolicy
+	// tags must be signed in their notary trust collection, whose root keys
+	// are pinned ones or trusted on first use (persisted in dir when set)
+	ContentTrust         bool
+	ContentTrustServer   string
+	ContentTrustRootKeys map[string]bool
+	ContentTrustDir      string
+	// notification target (Slack incoming webhook or generic JSON POST)
+	NotifyURL string
+	// per-repo notification targets overriding NotifyURL
+	RepoNotifyURL map[string]string
+	// per-event notification targets overriding NotifyURL
+	EventNotifyURL map[string]string
+	// finished async jobs are posted there, per-repo ones override it, and
+	// signed with the secret when set
+	JobCallbackURL     string
+	RepoJobCallbackURL map[string]string
+	JobCallbackSecret  string
+	// text/template of notification messages, default text when nil
+	NotifyTemplate *template.Template
+	// notifications are mailed too when set
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPSecurity string
+	EmailFrom    string
+	EmailTo      []string
+	EmailMode    string
+	// digests mailed, in WindowsTZ
+	EmailDigestSchedule []pollSchedule
+	// bot sending notifications with action buttons to chats, users
+	// allowed to press them (anyone in the chats when empty)
+	TelegramToken string
+	TelegramChats []string
+	TelegramUsers []string
+	// events notifications are sent for
+	NotifyEvents map[string]bool
+	// update windows and blackouts (no updates even in window), checked
+	// in WindowsTZ
+	Windows       schedule
+	RepoWindows   map[string]schedule
+	Blackouts     schedule
+	RepoBlackouts map[string]schedule
+	WindowsTZ     *time.Location
+	// update requests per second, 0 disables limiting
+	RateLimit      float64
+	RateLimitBurst int
+	// same per client address and per repo, 0 disables
+	IPRateLimit   float64
+	RepoRateLimit float64
+	// max update request body bytes, 0 disables
+	MaxBodySize int
+	// PRE_UPDATE_HOOK* and POST_UPDATE_HOOK* env commands
+	Hooks map[string]string
+	// hook commands of container labels are run
+	LabelHooks  bool
+	HookTimeout time.Duration
+	// snapshots of labeled containers kept per container
+	SnapshotKeep int
+	// drained container keeps running this long before it is stopped
+	DrainWait     time.Duration
+	RepoDrainWait map[string]time.Duration
+	// wait for recreated container health, 0 disables
+	HealthWait time.Duration
+	// healthKeep or healthRollback when not healthy in time
+	HealthTimeoutAction     string
+	RepoHealthWait          map[string]time.Duration
+	RepoHealthTimeoutAction map[string]string
+	// new image runs as temporary container before any is replaced, 0
+	// disables; command run in it by sh -c, image's own one when empty
+	SmokeTestTimeout     time.Duration
+	RepoSmokeTestTimeout map[string]time.Duration
+	SmokeTestCommand     string
+	RepoSmokeTestCommand map[string]string
+	// rollbackModeContainer or rollbackModeAll
+	RollbackMode string
+	// max containers of a repo replaced at once: "N" or "P%", empty means all
+	MaxUnavailable     string
+	RepoMaxUnavailable map[string]string
+	// first container is observed this long before the rest is updated
+	CanaryWait     time.Duration
+	RepoCanaryWait map[string]time.Duration
+	// recreate, start-first or blue-green, per-repo overrides
+	UpdateStrategy     string
+	RepoUpdateStrategy map[string]string
+	// labels keeping reverse proxies off blue-green's green container
+	BlueGreenLabels map[string]string
+	// pushed or highest, per-repo overrides
+	TagMode     string
+	RepoTagMode map[string]string
+	// replicas of a compose service are replaced one at a time
+	ComposeSerial bool
+	// max replicas of a compose service replaced at once: "N" or "P%" of
+	// the service's ones, empty means all
+	ReplicaMaxUnavailable     string
+	RepoReplicaMaxUnavailable map[string]string
+	// wait between batches of an update
+	BatchPause     time.Duration
+	RepoBatchPause map[string]time.Duration
+	// failed containers an update goes on past: "N" or "P%", empty means
+	// CONTINUE_ON_FAILURE decides
+	MaxFailures     string
+	RepoMaxFailures map[string]string
+	// consider stopped containers too, recreated stopped (keep) or started
+	IncludeStopped bool
+	StoppedPolicy  string
+	// only containers labeled docker-updater.enable=true are updated
+	OptIn bool
+	// which prerelease tags semver tags may move to, per repo overrides
+	PrereleasePolicy     string
+	RepoPrereleasePolicy map[string]string
+	// semver tags may move to other build metadata
+	IgnoreMetadata bool
+	// repeated requests for just updated repo:tag are skipped
+	UpdateCooldown time.Duration
+	// repos are updated once per interval at most, per-repo overrides
+	UpdateThrottle     time.Duration
+	RepoUpdateThrottle map[string]time.Duration
+	// repeated webhook deliveries (same push) are skipped within the window
+	WebhookDedupWindow time.Duration
+	// registry polling interval, 0 disables polling
+	PollInterval time.Duration
+	// scheduled registry checks, in WindowsTZ
+	PollSchedule []pollSchedule
+	// rolling tags, matching ones are updated when digest differs
+	TagMatch *regexp.Regexp
+	// registry credentials file, re-read on use or after RegistryAuthTTL
+	RegistryAuthFile string
+	RegistryAuthTTL  time.Duration
+	// credentials by registry host, take precedence over file ones
+	RegistryAuth registryAuths
+	// tokens of ecr registries are requested with aws credentials, these
+	// keys or role ones from ecs or ec2 metadata
+	ECRAuth            bool
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	// pub/sub push tokens must be issued for this audience (and service
+	// account when set), empty disables the check
+	PubSubAudience       string
+	PubSubServiceAccount string
+	// update history kept in memory and, when set, in file
+	HistorySize int
+	HistoryFile string
+	// accepted updates not finished yet, replayed on startup
+	UpdateQueueFile string
+	// webhooks defined in config by name
+	CustomWebhooks map[string]customAdapter
+	// async update jobs
+	JobWorkers   int
+	JobQueueSize int
+	JobRetention time.Duration
+	// pending (sync and async) updates accepted at once, 0 means unlimited
+	MaxQueue int
+	// pauseQueue or pauseReject, for updates requested while paused
+	PauseMode string
+	// replicas share leases, jobs and history in redis when set
+	HARedisURL  string
+	HALeaseTTL  time.Duration
+	HAKeyPrefix string
+	// max wait for the lease of a repo another replica updates
+	HALockWait time.Duration
+}
+
+// *Config in effect, replaced as a whole by reloadConfig; read it through
+// config() so request handlers can run while config reloads
+var currentConfig atomic.Value
+
+func config() *Config {
+	return currentConfig.Load().(*Config)
+}
+
+// docker client settings
+var dockerEnv = []string{"DOCKER_HOST", "DOCKER_API_VERSION", "DOCKER_CERT_PATH", "DOCKER_TLS_VERIFY"}
+
+func init() {
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.Panicf("unable to load config: %s", err.Error())
+	}
+	currentConfig.Store(cfg)
+	setupLogging()
+	setupRegistryClient()
+	initDocker()
+	if cfg.Role == roleCoordinator {
+		if agentClient, err = newAgentClient(cfg); err != nil {
+			logrus.Panicf("unable to init agent client: %s", err.Error())
+		}
+		// agents find out their own mode
+		if cfg.Mode == modeAuto {
+			cfg.Mode = modeContainers
+		}
+	}
+	cfg.Mode = resolveMode(cfg.Mode)
+	initEngines(cfg.Engine)
+	if cfg.Mode == modeSwarm && len(dockerHosts) > 0 {
+		logrus.Panicf("DOCKER_HOSTS can't be used in %s mode", modeSwarm)
+	}
+}
+
+func loadConfig() (*Config, error) {
+	if file := configFilePath(); file != "" {
+		var err error
+		if fileConfig, err = loadConfigFile(file); err != nil {
+			return nil, _err("load config file error: %s", err.Error())
+		}
+		logrus.Infof("config file %s loaded", file)
+		if name := profileName(fileConfig); name != "" {
+			logrus.Infof("config profile %s applied", name)
+		}
+	} else if name := profileName(nil); name != "" {
+		return nil, _err("profile %q selected, but no config file defines profiles", name)
+	}
+	// docker client reads them from env only
+	for _, name := range dockerEnv {
+		if v := envString(name, ""); v != "" && os.Getenv(name) == "" {
+			os.Setenv(name, v)
+		}
+	}
+	c := &Config{
+		ListenAddress:  flagOrEnv("listen", "LISTEN_ADDRESS", ":8084"),
+		Profile:        flagOrEnv("profile", "PROFILE", ""),
+		Mode:           envString("MODE", modeContainers),
+		PullOrder:      envString("PULL_ORDER", orderPullFirst),
+		RepoPullOrder:  envRepoMap("REPO_PULL_ORDER"),
+		TLSCertFile:    envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:     envString("TLS_KEY_FILE", ""),
+		NotifyURL:      envString("NOTIFY_URL", ""),
+		WebhookSecret:  envString("WEBHOOK_SECRET", ""),
+		WebhookSecrets: envMap("WEBHOOK_SECRETS"),
+		RepoNotifyURL:  envRepoMap("REPO_NOTIFY_URL"),
+		EventNotifyURL: envMap("EVENT_NOTIFY_URL"),
+
+		PubSubAudience:       envString("PUBSUB_AUDIENCE", ""),
+		PubSubServiceAccount: envString("PUBSUB_SERVICE_ACCOUNT", ""),
+	}
+	var err error
+	if c.LogLevel, err = logrus.ParseLevel(flagOrEnv("log-level", "LOG_LEVEL", "info")); err != nil {
+		return nil, _err("LOG_LEVEL: %s", err.Error())
+	}
+	switch c.LogFormat = flagOrEnv("log-format", "LOG_FORMAT", logText); c.LogFormat {
+	case logText, logJSON:
+	default:
+		return nil, _err("LOG_FORMAT: unknown format %s", c.LogFormat)
+	}
+	if c.LogRequests, err = envBool("LOG_REQUESTS", false); err != nil {
+		return nil, err
+	}
+	c.LogFile = envString("LOG_FILE", "")
+	if c.LogFileMaxSize, err = envInt("LOG_FILE_MAX_SIZE", 100<<20); err != nil {
+		return nil, err
+	}
+	if c.LogFileMaxAge, err = envDuration("LOG_FILE_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if c.LogFileMaxBackups, err = envInt("LOG_FILE_MAX_BACKUPS", 5); err != nil {
+		return nil, err
+	}
+	if c.LogFileMaxSize < 0 || c.LogFileMaxAge < 0 || c.LogFileMaxBackups < 0 {
+		return nil, _err("LOG_FILE_MAX_SIZE, LOG_FILE_MAX_AGE and LOG_FILE_MAX_BACKUPS can't be negative")
+	}
+	c.LogSyslog = envString("LOG_SYSLOG", "")
+	c.LogSyslogTag = envString("LOG_SYSLOG_TAG", "docker-updater")
+	if c.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if c.ConfigWatchInterval, err = envDuration("CONFIG_WATCH_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+	c.AuditFile = envString("AUDIT_FILE", "")
+	if c.AuditFileMaxSize, err = envInt("AUDIT_FILE_MAX_SIZE", 100<<20); err != nil {
+		return nil, err
+	}
+	if c.AuditRetention, err = envDuration("AUDIT_RETENTION", 0); err != nil {
+		return nil, err
+	}
+	if c.ApprovalRepos, err = parseRepoPatterns(envList("APPROVAL_REPOS")); err != nil {
+		return nil, err
+	}
+	if c.ApprovalTTL, err = envDuration("APPROVAL_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if c.ApprovalTTL <= 0 {
+		return nil, _err("APPROVAL_TTL must be positive")
+	}
+	if c.QuarantineAfter, err = envInt("QUARANTINE_AFTER", 0); err != nil {
+		return nil, err
+	}
+	c.ReadyRegistries = envList("READY_REGISTRIES")
+	if c.ReadyTimeout, err = envDuration("READY_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if c.ReadyTimeout <= 0 {
+		return nil, _err("READY_TIMEOUT must be positive")
+	}
+	c.NotifyEvents = make(map[string]bool)
+	events := envList("NOTIFY_EVENTS")
+	if len(events) == 0 {
+		events = []string{eventUpdated, eventFailed, eventObserved, eventQuarantined, eventPending}
+	}
+	for _, event := range events {
+		switch event {
+		case eventStarted, eventUpdated, eventFailed, eventObserved, eventQuarantined, eventPending:
+			c.NotifyEvents[event] = true
+		default:
+			return nil, _err("unknown notification event %q", event)
+		}
+	}
+	targets := append(mapValues(c.RepoNotifyURL), mapValues(c.EventNotifyURL)...)
+	for _, target := range append(targets, c.NotifyURL) {
+		for _, t := range notifyTargets(target) {
+			if err := checkNotifyURL(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.JobCallbackURL = envString("JOB_CALLBACK_URL", "")
+	c.RepoJobCallbackURL = envRepoMap("REPO_JOB_CALLBACK_URL")
+	c.JobCallbackSecret = envString("JOB_CALLBACK_SECRET", "")
+	for _, target := range append(mapValues(c.RepoJobCallbackURL), c.JobCallbackURL) {
+		if target == "" {
+			continue
+		}
+		if err := checkCallbackURL(target); err != nil {
+			return nil, _err("job callback: %s", err.Error())
+		}
+	}
+	if c.NotifyTemplate, err = parseNotifyTemplate(envString("NOTIFY_TEMPLATE", "")); err != nil {
+		return nil, _err("NOTIFY_TEMPLATE: %s", err.Error())
+	}
+	c.SMTPHost = envString("SMTP_HOST", "")
+	if c.SMTPPort, err = envInt("SMTP_PORT", 587); err != nil {
+		return nil, err
+	}
+	c.SMTPUsername = envString("SMTP_USERNAME", "")
+	c.SMTPPassword = envString("SMTP_PASSWORD", "")
+	switch c.SMTPSecurity = envString("SMTP_SECURITY", smtpStartTLS); c.SMTPSecurity {
+	case smtpStartTLS, smtpTLS, smtpNone:
+	default:
+		return nil, _err("SMTP_SECURITY: unknown value %s", c.SMTPSecurity)
+	}
+	c.EmailFrom = envString("EMAIL_FROM", "")
+	c.EmailTo = envList("EMAIL_TO")
+	if c.SMTPHost != "" && (c.EmailFrom == "" || len(c.EmailTo) == 0) {
+		return nil, _err("EMAIL_FROM and EMAIL_TO must be set with SMTP_HOST")
+	}
+	switch c.EmailMode = envString("EMAIL_MODE", emailEvent); c.EmailMode {
+	case emailEvent, emailDigest:
+	default:
+		return nil, _err("EMAIL_MODE: unknown mode %s", c.EmailMode)
+	}
+	if c.EmailDigestSchedule, err = parsePollSchedule(envString("EMAIL_DIGEST_SCHEDULE", "* 08:00")); err != nil {
+		return nil, err
+	}
+	for _, ps := range c.EmailDigestSchedule {
+		if ps.repos != nil {
+			return nil, _err("EMAIL_DIGEST_SCHEDULE entries can't list repos")
+		}
+	}
+	c.TelegramToken = envString("TELEGRAM_BOT_TOKEN", "")
+	c.TelegramChats = envList("TELEGRAM_CHAT_IDS")
+	c.TelegramUsers = envList("TELEGRAM_ALLOWED_USERS")
+	if c.TelegramToken != "" && len(c.TelegramChats) == 0 {
+		return nil, _err("TELEGRAM_CHAT_IDS must be set with TELEGRAM_BOT_TOKEN")
+	}
+	if c.KeepPreviousImage, err = envBool("KEEP_PREVIOUS_IMAGE", false); err != nil {
+		return nil, err
+	}
+	if c.RollbackTags, err = envBool("ROLLBACK_TAGS", false); err != nil {
+		return nil, err
+	}
+	if c.ImageRetentionCount, err = envInt("IMAGE_RETENTION_COUNT", 0); err != nil {
+		return nil, err
+	}
+	if c.ImageRetentionAge, err = envDuration("IMAGE_RETENTION_AGE", 0); err != nil {
+		return nil, err
+	}
+	if c.ImageCleanupInterval, err = envDuration("IMAGE_CLEANUP_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	if c.ImageRetentionCount < 0 || c.ImageRetentionAge < 0 || c.ImageCleanupInterval <= 0 {
+		return nil, _err("IMAGE_RETENTION_COUNT and IMAGE_RETENTION_AGE can't be negative, IMAGE_CLEANUP_INTERVAL must be positive")
+	}
+	if c.PruneSchedule, err = parsePollSchedule(envString("PRUNE_SCHEDULE", "")); err != nil {
+		return nil, err
+	}
+	for _, ps := range c.PruneSchedule {
+		if ps.repos != nil {
+			return nil, _err("PRUNE_SCHEDULE entries can't list repos")
+		}
+	}
+	if c.PruneNetworks, err = envBool("PRUNE_NETWORKS", false); err != nil {
+		return nil, err
+	}
+	if c.PruneVolumes, err = envBool("PRUNE_VOLUMES", false); err != nil {
+		return nil, err
+	}
+	if c.PullTimeout, err = envDuration("PULL_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if c.RegistryTimeout, err = envDuration("REGISTRY_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if c.Retries, err = envInt("RETRIES", 2); err != nil {
+		return nil, err
+	}
+	if c.RetryBackoff, err = envDuration("RETRY_BACKOFF", time.Second); err != nil {
+		return nil, err
+	}
+	if c.RetryBackoffMax, err = envDuration("RETRY_BACKOFF_MAX", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if c.PullTimeout < 0 || c.RegistryTimeout <= 0 || c.Retries < 0 || c.RetryBackoff < 0 || c.RetryBackoffMax < c.RetryBackoff {
+		return nil, _err("PULL_TIMEOUT and RETRIES can't be negative, REGISTRY_TIMEOUT must be positive, RETRY_BACKOFF_MAX can't be less than RETRY_BACKOFF")
+	}
+	c.RegistryMirrors = parseMirrors(envMap("REGISTRY_MIRRORS"))
+	if c.RegistryMirrorFallback, err = envBool("REGISTRY_MIRROR_FALLBACK", true); err != nil {
+		return nil, err
+	}
+	if c.RegistryProxy, err = parseProxyURL("REGISTRY_PROXY"); err != nil {
+		return nil, err
+	}
+	if c.ContinueOnFailure, err = envBool("CONTINUE_ON_FAILURE", false); err != nil {
+		return nil, err
+	}
+	if c.FailedRetries, err = envInt("FAILED_UPDATE_RETRIES", 0); err != nil {
+		return nil, err
+	}
+	if c.FailedRetryBackoff, err = envDuration("FAILED_UPDATE_RETRY_BACKOFF", time.Minute); err != nil {
+		return nil, err
+	}
+	if c.FailedRetries < 0 || c.FailedRetryBackoff <= 0 {
+		return nil, _err("FAILED_UPDATE_RETRIES can't be negative, FAILED_UPDATE_RETRY_BACKOFF must be positive")
+	}
+	if c.MinFreeSpace, err = envInt("MIN_FREE_SPACE", 0); err != nil {
+		return nil, err
+	}
+	c.DockerDataRoot = envString("DOCKER_DATA_ROOT", "")
+	if c.CleanupConcurrency, err = envInt("CLEANUP_CONCURRENCY", 4); err != nil {
+		return nil, err
+	}
+	if c.CleanupConcurrency < 1 {
+		return nil, _err("CLEANUP_CONCURRENCY must be positive")
+	}
+	if c.RecreateConcurrency, err = envInt("RECREATE_CONCURRENCY", 1); err != nil {
+		return nil, err
+	}
+	if c.RecreateConcurrency < 1 {
+		return nil, _err("RECREATE_CONCURRENCY must be positive")
+	}
+	keys, roots := envList("COSIGN_PUBLIC_KEYS"), envString("COSIGN_FULCIO_ROOTS", "")
+	if len(keys) > 0 || roots != "" {
+		if c.Cosign, err = loadCosignPolicy(keys, roots, envList("COSIGN_REKOR_KEYS"), envList("COSIGN_IDENTITIES"), envString("COSIGN_OIDC_ISSUER", "")); err != nil {
+			return nil, err
+		}
+	}
+	if c.ContentTrust, err = envBool("CONTENT_TRUST", false); err != nil {
+		return nil, err
+	}
+	c.ContentTrustServer = envString("CONTENT_TRUST_SERVER", "")
+	c.ContentTrustRootKeys = make(map[string]bool)
+	for _, id := range envList("CONTENT_TRUST_ROOT_KEYS") {
+		c.ContentTrustRootKeys[id] = true
+	}
+	c.ContentTrustDir = envString("CONTENT_TRUST_DIR", "")
+	c.Platform = envString("PLATFORM", "")
+	if err := validatePlatform(c.Platform); err != nil {
+		return nil, err
+	}
+	if c.StopTimeout, err = envDuration("STOP_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return nil, _err("both TLS_CERT_FILE and TLS_KEY_FILE must be set to enable TLS")
+	}
+	c.TLSAutocertHosts = envList("TLS_AUTOCERT_HOSTS")
+	c.TLSAutocertCacheDir = envString("TLS_AUTOCERT_CACHE_DIR", "")
+	if len(c.TLSAutocertHosts) > 0 && c.TLSCertFile != "" {
+		return nil, _err("TLS_AUTOCERT_HOSTS and TLS_CERT_FILE can't be set both")
+	}
+	c.ListenSocket = envString("LISTEN_SOCKET", "")
+	mode, err := strconv.ParseUint(envString("LISTEN_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, _err("LISTEN_SOCKET_MODE: invalid permissions %q, expected octal like 0660", envString("LISTEN_SOCKET_MODE", ""))
+	}
+	c.ListenSocketMode = os.FileMode(mode)
+	c.ListenSocketGroup = envString("LISTEN_SOCKET_GROUP", "")
+	if c.ListenAddress == listenNone {
+		if c.ListenSocket == "" {
+			return nil, _err("LISTEN_ADDRESS=%s requires LISTEN_SOCKET", listenNone)
+		}
+		if c.TLSCertFile != "" || len(c.TLSAutocertHosts) > 0 {
+			return nil, _err("TLS is served on LISTEN_ADDRESS only, it can't be %s", listenNone)
+		}
+	}
+	if c.SelfUpdate, err = envBool("SELF_UPDATE", false); err != nil {
+		return nil, err
+	}
+	if c.DockerHosts, err = loadDockerHosts(); err != nil {
+		return nil, err
+	}
+	switch c.Engine = envString("ENGINE", engineAuto); c.Engine {
+	case engineAuto, engineDocker, enginePodman:
+	default:
+		return nil, _err("unknown engine %q, expected %s, %s or %s", c.Engine, engineAuto, engineDocker, enginePodman)
+	}
+	tokens := envMap("API_TOKENS")
+	if file := envString("API_TOKENS_FILE", ""); file != "" {
+		lines, err := readList(file)
+		if err != nil {
+			return nil, _err("read API tokens file %s error: %s", file, err.Error())
+		}
+		for _, l := range lines {
+			parts := strings.SplitN(l, "=", 2)
+			if len(parts) != 2 {
+				return nil, _err("API tokens file %s: malformed line, expected name=token", file)
+			}
+			name := strings.TrimSpace(parts[0])
+			if _, ok := tokens[name]; ok {
+				return nil, _err("API token %s is defined twice", name)
+			}
+			tokens[name] = strings.TrimSpace(parts[1])
+		}
+	}
+	if c.APITokens, err = parseAPITokens(tokens); err != nil {
+		return nil, err
+	}
+	if c.WebhookAllowedNets, err = parseNetworks(envList("WEBHOOK_ALLOWED_IPS")); err != nil {
+		return nil, err
+	}
+	if c.TrustProxyHeaders, err = envBool("TRUST_PROXY_HEADERS", false); err != nil {
+		return nil, err
+	}
+	c.TLSClientCAFile = envString("TLS_CLIENT_CA_FILE", "")
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" && len(c.TLSAutocertHosts) == 0 {
+		return nil, _err("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+	}
+	if c.GRPC, err = envBool("GRPC", false); err != nil {
+		return nil, err
+	}
+	if c.GRPC && c.TLSCertFile == "" && len(c.TLSAutocertHosts) == 0 {
+		return nil, _err("GRPC requires TLS_CERT_FILE or TLS_AUTOCERT_HOSTS, gRPC is served over HTTP/2 with TLS only")
+	}
+	c.Role = envString("ROLE", roleStandalone)
+	if c.Agents, err = loadAgents(); err != nil {
+		return nil, err
+	}
+	if c.AgentConcurrency, err = envInt("AGENT_CONCURRENCY", 1); err != nil {
+		return nil, err
+	}
+	if c.AgentConcurrency < 1 {
+		return nil, _err("AGENT_CONCURRENCY must be positive")
+	}
+	if c.AgentTimeout, err = envDuration("AGENT_TIMEOUT", time.Hour); err != nil {
+		return nil, err
+	}
+	c.AgentCAFile = envString("AGENT_CA_FILE", "")
+	c.AgentCertFile = envString("AGENT_CERT_FILE", "")
+	c.AgentKeyFile = envString("AGENT_KEY_FILE", "")
+	if (c.AgentCertFile == "") != (c.AgentKeyFile == "") {
+		return nil, _err("both AGENT_CERT_FILE and AGENT_KEY_FILE must be set to send a client certificate")
+	}
+	if c.Dashboard, err = envBool("DASHBOARD", true); err != nil {
+		return nil, err
+	}
+	c.OTLPEndpoint = envString("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	c.OTLPHeaders = envMap("OTEL_EXPORTER_OTLP_HEADERS")
+	c.OTelServiceName = envString("OTEL_SERVICE_NAME", "docker-updater")
+	if c.IncludeRepos, err = parseRepoPatterns(envList("INCLUDE_REPOS")); err != nil {
+		return nil, err
+	}
+	if c.ExcludeRepos, err = parseRepoPatterns(envList("EXCLUDE_REPOS")); err != nil {
+		return nil, err
+	}
+	allowed := envList("ALLOWED_REPOS")
+	if file := envString("ALLOWED_REPOS_FILE", ""); file != "" {
+		fromFile, err := readList(file)
+		if err != nil {
+			return nil, _err("read allowed repos file %s error: %s", file, err.Error())
+		}
+		allowed = append(allowed, fromFile...)
+	}
+	if len(allowed) > 0 {
+		c.AllowedRepos = make(map[string]bool)
+		for _, repo := range allowed {
+			c.AllowedRepos[normalizeRepo(repo)] = true
+		}
+		logrus.Infof("updates restricted to repos: %s", strings.Join(allowed, ", "))
+	}
+	if c.RateLimit, err = envFloat("RATE_LIMIT", 0); err != nil {
+		return nil, err
+	}
+	if c.RateLimitBurst, err = envInt("RATE_LIMIT_BURST", 1); err != nil {
+		return nil, err
+	}
+	if c.IPRateLimit, err = envFloat("IP_RATE_LIMIT", 0); err != nil {
+		return nil, err
+	}
+	if c.RepoRateLimit, err = envFloat("REPO_RATE_LIMIT", 0); err != nil {
+		return nil, err
+	}
+	if c.MaxBodySize, err = envInt("MAX_BODY_SIZE", 1<<20); err != nil {
+		return nil, err
+	}
+	if c.MaxBodySize < 0 {
+		return nil, _err("MAX_BODY_SIZE can't be negative")
+	}
+	if c.RateLimit < 0 || c.IPRateLimit < 0 || c.RepoRateLimit < 0 || c.RateLimitBurst < 1 {
+		return nil, _err("RATE_LIMIT must not be negative and RATE_LIMIT_BURST must be positive")
+	}
+	c.Hooks = make(map[string]string)
+	for name, command := range fileConfig {
+		if isHookOption(name) {
+			c.Hooks[name] = command
+		}
+	}
+	for _, kv := range os.Environ() {
+		if parts := strings.SplitN(kv, "=", 2); isHookOption(parts[0]) {
+			c.Hooks[parts[0]] = parts[1]
+		}
+	}
+	if c.HookTimeout, err = envDuration("HOOK_TIMEOUT", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if c.LabelHooks, err = envBool("LABEL_HOOKS", false); err != nil {
+		return nil, err
+	}
+	if c.SnapshotKeep, err = envInt("SNAPSHOT_KEEP", 3); err != nil {
+		return nil, err
+	}
+	if c.SnapshotKeep < 1 {
+		return nil, _err("SNAPSHOT_KEEP must be positive")
+	}
+	if c.DrainWait, err = envDuration("DRAIN_WAIT", 0); err != nil {
+		return nil, err
+	}
+	c.RepoDrainWait = make(map[string]time.Duration)
+	for repo, v := range envRepoMap("REPO_DRAIN_WAIT") {
+		if c.RepoDrainWait[repo], err = time.ParseDuration(v); err != nil {
+			return nil, _err("REPO_DRAIN_WAIT: repo %s: invalid duration %q", repo, v)
+		}
+	}
+	if c.HealthWait, err = envDuration("HEALTH_WAIT", 0); err != nil {
+		return nil, err
+	}
+	c.RepoHealthWait = make(map[string]time.Duration)
+	for repo, v := range envRepoMap("REPO_HEALTH_WAIT") {
+		if c.RepoHealthWait[repo], err = time.ParseDuration(v); err != nil {
+			return nil, _err("REPO_HEALTH_WAIT: repo %s: invalid duration %q", repo, v)
+		}
+	}
+	c.HealthTimeoutAction = envString("HEALTH_TIMEOUT_ACTION", healthKeep)
+	c.RepoHealthTimeoutAction = envRepoMap("REPO_HEALTH_TIMEOUT_ACTION")
+	for _, action := range append([]string{c.HealthTimeoutAction}, mapValues(c.RepoHealthTimeoutAction)...) {
+		if action != healthKeep && action != healthRollback {
+			return nil, _err("unknown health timeout action %q, expected %s or %s", action, healthKeep, healthRollback)
+		}
+	}
+	if c.SmokeTestTimeout, err = envDuration("SMOKE_TEST_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	c.RepoSmokeTestTimeout = make(map[string]time.Duration)
+	for repo, v := range envRepoMap("REPO_SMOKE_TEST_TIMEOUT") {
+		if c.RepoSmokeTestTimeout[repo], err = time.ParseDuration(v); err != nil {
+			return nil, _err("REPO_SMOKE_TEST_TIMEOUT: repo %s: invalid duration %q", repo, v)
+		}
+	}
+	c.SmokeTestCommand = envString("SMOKE_TEST_COMMAND", "")
+	c.RepoSmokeTestCommand = envRepoMap("REPO_SMOKE_TEST_COMMAND")
+	c.RollbackMode = envString("ROLLBACK_MODE", rollbackModeContainer)
+	if c.RollbackMode != rollbackModeContainer && c.RollbackMode != rollbackModeAll {
+		return nil, _err("unknown ROLLBACK_MODE %q, expected %s or %s", c.RollbackMode, rollbackModeContainer, rollbackModeAll)
+	}
+	if c.CanaryWait, err = envDuration("CANARY_WAIT", 0); err != nil {
+		return nil, err
+	}
+	c.RepoCanaryWait = make(map[string]time.Duration)
+	for repo, v := range envRepoMap("REPO_CANARY_WAIT") {
+		if c.RepoCanaryWait[repo], err = time.ParseDuration(v); err != nil {
+			return nil, _err("REPO_CANARY_WAIT: repo %s: invalid duration %q", repo, v)
+		}
+	}
+	c.UpdateStrategy = envString("UPDATE_STRATEGY", strategyRecreate)
+	c.RepoUpdateStrategy = envRepoMap("REPO_UPDATE_STRATEGY")
+	for _, v := range append([]string{c.UpdateStrategy}, mapValues(c.RepoUpdateStrategy)...) {
+		if v != strategyRecreate && v != strategyStartFirst && v != strategyBlueGreen {
+			return nil, _err("unknown update strategy %q, expected %s, %s or %s", v, strategyRecreate, strategyStartFirst, strategyBlueGreen)
+		}
+	}
+	if c.BlueGreenLabels = envMap("BLUE_GREEN_LABELS"); envString("BLUE_GREEN_LABELS", "") == "" {
+		c.BlueGreenLabels = map[string]string{"traefik.enable": "false"}
+	}
+	c.TagMode = envString("UPDATE_TAG_MODE", tagModePushed)
+	c.RepoTagMode = envRepoMap("REPO_UPDATE_TAG_MODE")
+	for _, v := range append([]string{c.TagMode}, mapValues(c.RepoTagMode)...) {
+		if err := validateTagMode(v); err != nil {
+			return nil, err
+		}
+	}
+	if c.ComposeSerial, err = envBool("COMPOSE_SERIAL", false); err != nil {
+		return nil, err
+	}
+	c.MaxUnavailable = envString("MAX_UNAVAILABLE", "")
+	c.RepoMaxUnavailable = envRepoMap("REPO_MAX_UNAVAILABLE")
+	for _, v := range append([]string{c.MaxUnavailable}, mapValues(c.RepoMaxUnavailable)...) {
+		if _, err := parseMaxUnavailable(v, 1); err != nil {
+			return nil, err
+		}
+	}
+	c.ReplicaMaxUnavailable = envString("REPLICA_MAX_UNAVAILABLE", "")
+	c.RepoReplicaMaxUnavailable = envRepoMap("REPO_REPLICA_MAX_UNAVAILABLE")
+	for _, v := range append([]string{c.ReplicaMaxUnavailable}, mapValues(c.RepoReplicaMaxUnavailable)...) {
+		if _, err := parseMaxUnavailable(v, 1); err != nil {
+			return nil, err
+		}
+	}
+	if c.BatchPause, err = envDuration("BATCH_PAUSE", 0); err != nil {
+		return nil, err
+	}
+	c.RepoBatchPause = make(map[string]time.Duration)
+	for repo, v := range envRepoMap("REPO_BATCH_PAUSE") {
+		if c.RepoBatchPause[repo], err = time.ParseDuration(v); err != nil {
+			return nil, _err("REPO_BATCH_PAUSE: repo %s: invalid duration %q", repo, v)
+		}
+	}
+	c.MaxFailures = envString("MAX_FAILURES", "")
+	c.RepoMaxFailures = envRepoMap("REPO_MAX_FAILURES")
+	for _, v := range append([]string{c.MaxFailures}, mapValues(c.RepoMaxFailures)...) {
+		if v == "" {
+			continue
+		}
+		if _, err := parseMaxFailures(v, 1); err != nil {
+			return nil, err
+		}
+	}
+	if c.ObserveOnly, err = envBool("OBSERVE_ONLY", false); err != nil {
+		return nil, err
+	}
+	if c.IncludeStopped, err = envBool("INCLUDE_STOPPED", false); err != nil {
+		return nil, err
+	}
+	c.StoppedPolicy = envString("STOPPED_POLICY", stoppedKeep)
+	if err := validateStoppedPolicy(c.StoppedPolicy); err != nil {
+		return nil, _err("STOPPED_POLICY: %s", err.Error())
+	}
+	if c.OptIn, err = envBool("OPT_IN", false); err != nil {
+		return nil, err
+	}
+	allowPrerelease, err := envBool("ALLOW_PRERELEASE", false)
+	if err != nil {
+		return nil, err
+	}
+	c.PrereleasePolicy = prereleaseExact
+	if allowPrerelease {
+		c.PrereleasePolicy = prereleaseAllow
+	}
+	c.PrereleasePolicy = envString("PRERELEASE_POLICY", c.PrereleasePolicy)
+	c.RepoPrereleasePolicy = envRepoMap("REPO_PRERELEASE_POLICY")
+	for _, v := range append([]string{c.PrereleasePolicy}, mapValues(c.RepoPrereleasePolicy)...) {
+		if !isPrereleasePolicy(v) {
+			return nil, _err("unknown prerelease policy %q, expected %s, %s, %s or %s", v,
+				prereleaseExact, prereleaseStableOnly, prereleaseAllow, prereleaseTrackRC)
+		}
+	}
+	if c.IgnoreMetadata, err = envBool("IGNORE_METADATA", false); err != nil {
+		return nil, err
+	}
+	if c.PollInterval, err = envDuration("POLL_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if c.PollSchedule, err = parsePollSchedule(envString("POLL_SCHEDULE", "")); err != nil {
+		return nil, err
+	}
+	if c.UpdateCooldown, err = envDuration("UPDATE_COOLDOWN", 0); err != nil {
+		return nil, err
+	}
+	if c.UpdateThrottle, err = envDuration("UPDATE_THROTTLE", 0); err != nil {
+		return nil, err
+	}
+	c.RepoUpdateThrottle = make(map[string]time.Duration)
+	for repo, v := range envRepoMap("REPO_UPDATE_THROTTLE") {
+		if c.RepoUpdateThrottle[repo], err = time.ParseDuration(v); err != nil {
+			return nil, _err("REPO_UPDATE_THROTTLE: repo %s: invalid duration %q", repo, v)
+		}
+	}
+	if c.WebhookDedupWindow, err = envDuration("WEBHOOK_DEDUP_WINDOW", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if v := envString("TAG_MATCH", ""); v != "" {
+		if c.TagMatch, err = regexp.Compile(v); err != nil {
+			return nil, _err("invalid TAG_MATCH %q: %s", v, err.Error())
+		}
+	}
+	c.RegistryAuthFile = envString("REGISTRY_AUTH_FILE", dockerClientConfig())
+	if c.RegistryAuthFile != "" {
+		// fail fast on broken file, it's re-read later anyway
+		if _, _, err = loadDockerConfig(c.RegistryAuthFile); err != nil {
+			return nil, _err("load registry auth file error: %s", err.Error())
+		}
+	}
+	c.RegistryAuth = parseRegistryAuth(envMap("REGISTRY_AUTH"))
+	if c.RegistryAuthTTL, err = envDuration("REGISTRY_AUTH_TTL", 0); err != nil {
+		return nil, err
+	}
+	if c.ECRAuth, err = envBool("ECR_AUTH", false); err != nil {
+		return nil, err
+	}
+	c.AWSAccessKeyID = envString("AWS_ACCESS_KEY_ID", "")
+	c.AWSSecretAccessKey = envString("AWS_SECRET_ACCESS_KEY", "")
+	c.AWSSessionToken = envString("AWS_SESSION_TOKEN", "")
+	if (c.AWSAccessKeyID == "") != (c.AWSSecretAccessKey == "") {
+		return nil, _err("both AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	c.HistoryFile = envString("HISTORY_FILE", "")
+	c.UpdateQueueFile = envString("UPDATE_QUEUE_FILE", "")
+	if c.HistorySize, err = envInt("HISTORY_SIZE", 1000); err != nil {
+		return nil, err
+	}
+	if c.HistorySize < 1 {
+		return nil, _err("HISTORY_SIZE must be positive")
+	}
+	if c.CustomWebhooks, err = loadCustomWebhooks(envList("CUSTOM_WEBHOOKS")); err != nil {
+		return nil, err
+	}
+	if c.JobWorkers, err = envInt("JOB_WORKERS", 2); err != nil {
+		return nil, err
+	}
+	if c.JobQueueSize, err = envInt("JOB_QUEUE_SIZE", 100); err != nil {
+		return nil, err
+	}
+	if c.JobWorkers < 1 || c.JobQueueSize < 1 {
+		return nil, _err("JOB_WORKERS and JOB_QUEUE_SIZE must be positive")
+	}
+	c.HARedisURL = envString("HA_REDIS_URL", "")
+	if c.HARedisURL != "" {
+		if _, err := newRedisClient(c.HARedisURL); err != nil {
+			return nil, _err("HA_REDIS_URL: %s", err.Error())
+		}
+	}
+	if c.HALeaseTTL, err = envDuration("HA_LEASE_TTL", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if c.HALeaseTTL < 3*time.Second {
+		return nil, _err("HA_LEASE_TTL must be 3s at least")
+	}
+	if c.HALockWait, err = envDuration("HA_LOCK_WAIT", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if c.HALockWait <= 0 {
+		return nil, _err("HA_LOCK_WAIT must be positive")
+	}
+	c.HAKeyPrefix = envString("HA_KEY_PREFIX", "docker-updater:")
+	if c.MaxQueue, err = envInt("MAX_QUEUE", 0); err != nil {
+		return nil, err
+	}
+	if c.MaxQueue < 0 {
+		return nil, _err("MAX_QUEUE must not be negative")
+	}
+	c.PauseMode = envString("PAUSE_MODE", pauseQueue)
+	if c.PauseMode != pauseQueue && c.PauseMode != pauseReject {
+		return nil, _err("unknown PAUSE_MODE %q, expected %s or %s", c.PauseMode, pauseQueue, pauseReject)
+	}
+	if c.JobRetention, err = envDuration("JOB_RETENTION", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if c.Windows, err = parseSchedule(envString("UPDATE_WINDOWS", "")); err != nil {
+		return nil, err
+	}
+	c.RepoWindows = make(map[string]schedule)
+	for repo, sch := range envRepoMap("REPO_UPDATE_WINDOWS") {
+		if c.RepoWindows[repo], err = parseSchedule(sch); err != nil {
+			return nil, _err("repo %s: %s", repo, err.Error())
+		}
+	}
+	if c.Blackouts, err = parseSchedule(envString("UPDATE_BLACKOUTS", "")); err != nil {
+		return nil, err
+	}
+	c.RepoBlackouts = make(map[string]schedule)
+	for repo, sch := range envRepoMap("REPO_UPDATE_BLACKOUTS") {
+		if c.RepoBlackouts[repo], err = parseSchedule(sch); err != nil {
+			return nil, _err("repo %s: %s", repo, err.Error())
+		}
+	}
+	if c.WindowsTZ, err = time.LoadLocation(envString("UPDATE_WINDOWS_TZ", "Local")); err != nil {
+		return nil, _err("load update windows time zone error: %s", err.Error())
+	}
+	if c.Mode != modeContainers && c.Mode != modeSwarm && c.Mode != modeAuto {
+		return nil, _err("unknown mode %q, expected %s, %s or %s", c.Mode, modeContainers, modeSwarm, modeAuto)
+	}
+	if err := validatePullOrder(c.PullOrder); err != nil {
+		return nil, err
+	}
+	if c.RepoMap, err = parseRepoMap(envMap("REPO_MAP")); err != nil {
+		return nil, err
+	}
+	for repo, order := range c.RepoPullOrder {
+		if err := validatePullOrder(order); err != nil {
+			return nil, _err("repo %s: %s", repo, err.Error())
+		}
+	}
+	if err := checkRole(c); err != nil {
+		return nil, err
+	}
+	if unknown := unknownFileOptions(); len(unknown) > 0 {
+		return nil, _err("unknown config file options: %s", strings.Join(unknown, ", "))
+	}
+	return c, nil
+}
+
+func isHookOption(name string) bool {
+	for _, prefix := range []string{"PRE_UPDATE_HOOK", "POST_UPDATE_HOOK", "DRAIN_HOOK", "REGISTER_HOOK"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pull/stop ordering for repo: per-repo override or global default
+func (c *Config) pullOrder(repo string) string {
+	if order, ok := c.RepoPullOrder[repo]; ok {
+		return order
+	}
+	return c.PullOrder
+}
+
+// notification target for repo's event: per-repo override, per-event one
+// or global one
+func (c *Config) notifyURL(repo, event string) string {
+	if target, ok := c.RepoNotifyURL[repo]; ok {
+		return target
+	}
+	if target, ok := c.EventNotifyURL[event]; ok {
+		return target
+	}
+	return c.NotifyURL
+}
+
+// whether updates of repo are allowed at t: per-repo windows or global ones
+func (c *Config) windowOpen(repo string, t time.Time) bool {
+	sch, ok := c.RepoWindows[repo]
+	if !ok {
+		sch = c.Windows
+	}
+	t = t.In(c.WindowsTZ)
+	// global and repo blackouts both apply
+	return sch.open(t) && !c.Blackouts.active(t) && !c.RepoBlackouts[repo].active(t)
+}
+
+func (c *Config) healthWait(repo string) time.Duration {
+	if wait, ok := c.RepoHealthWait[repo]; ok {
+		return wait
+	}
+	return c.HealthWait
+}
+
+func (c *Config) smokeTestTimeout(repo string) time.Duration {
+	if timeout, ok := c.RepoSmokeTestTimeout[repo]; ok {
+		return timeout
+	}
+	return c.SmokeTestTimeout
+}
+
+func (c *Config) smokeTestCommand(repo string) string {
+	if command, ok := c.RepoSmokeTestCommand[repo]; ok {
+		return command
+	}
+	return c.SmokeTestCommand
+}
+
+func (c *Config) healthTimeoutAction(repo string) string {
+	if action, ok := c.RepoHealthTimeoutAction[repo]; ok {
+		return action
+	}
+	return c.HealthTimeoutAction
+}
+
+func (c *Config) updateStrategy(repo string) string {
+	if strategy, ok := c.RepoUpdateStrategy[repo]; ok {
+		return strategy
+	}
+	return c.UpdateStrategy
+}
+
+// containers of repo replaced at once out of total matched
+func (c *Config) batchSize(repo string, total int) int {
+	v, ok := c.RepoMaxUnavailable[repo]
+	if !ok {
+		v = c.MaxUnavailable
+	}
+	size, _ := parseMaxUnavailable(v, total)
+	return size
+}
+
+// "N" or "P%" of total, at least 1; empty means total
+func parseMaxUnavailable(v string, total int) (int, error) {
+	if v == "" {
+		return total, nil
+	}
+	if strings.HasSuffix(v, "%") {
+		p, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil || p <= 0 || p > 100 {
+			return 0, _err("invalid max unavailable %q", v)
+		}
+		if size := total * p / 100; size > 1 {
+			return size, nil
+		}
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, _err("invalid max unavailable %q", v)
+	}
+	return n, nil
+}
+
+// whether both tags are rolling ones matching TAG_MATCH
+func (c *Config) tagMatch(cTag, tag string) bool {
+	return c.TagMatch != nil && c.TagMatch.MatchString(cTag) && c.TagMatch.MatchString(tag)
+}
+
+// secret of webhook endpoint (hub, gitlab, ...), empty means unsigned
+func (c *Config) webhookSecret(endpoint string) string {
+	if secret, ok := c.WebhookSecrets[endpoint]; ok {
+		return secret
+	}
+	return c.WebhookSecret
+}
+
+func (c *Config) repoAllowed(repo string) bool {
+	return (len(c.AllowedRepos) == 0 || c.AllowedRepos[repo]) &&
+		(len(c.IncludeRepos) == 0 || c.IncludeRepos.match(repo)) && !c.ExcludeRepos.match(repo)
+}
+
+func validatePullOrder(order string) error {
+	switch order {
+	case orderPullFirst, orderStopFirst:
+		return nil
+	}
+	return _err("unknown pull order %q, expected %s or %s", order, orderPullFirst, orderStopFirst)
+}
+
+var platformRe = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// "os/arch" or "os/arch/variant", e.g. linux/arm64 or linux/arm/v7
+func validatePlatform(platform string) error {
+	if platform != "" && platform != platformAuto && !platformRe.MatchString(platform) {
+		return _err("invalid platform %q, expected os/arch[/variant]", platform)
+	}
+	return nil
+}
+
+// ======= ENV HELPERS ======
+
+// env var, then config file option, then def
+// command line flag takes precedence over env
+func flagOrEnv(flag, name, def string) string {
+	if v := flagValue(flag); v != "" {
+		return v
+	}
+	return envString(name, def)
+}
+
+func envString(name, def string) string {
+	knownOptions[name] = true
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	if v := strings.TrimSpace(fileConfig[name]); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) (int, error) {
+	v := envString(name, "")
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, _err("%s: invalid integer %q", name, v)
+	}
+	return i, nil
+}
+
+func envBool(name string, def bool) (bool, error) {
+	v := envString(name, "")
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, _err("%s: invalid boolean %q", name, v)
+	}
+	return b, nil
+}
+
+func envFloat(name string, def float64) (float64, error) {
+	v := envString(name, "")
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, _err("%s: invalid number %q", name, v)
+	}
+	return f, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := envString(name, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, _err("%s: invalid duration %q", name, v)
+	}
+	return d, nil
+}
+
+// comma-separated list: "a,b,c"
+func envList(name string) []string {
+	return splitList(envString(name, ""))
+}
+
+// comma-separated values, empty ones dropped
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// comma-separated key=value pairs: "a=1,b=2"
+func envMap(name string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range envList(name) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			logrus.Warnf("%s: skipping malformed pair %q", name, kv)
+			continue
+		}
+		m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return m
+}
+
+// envMap of per-repo values, keyed by normalized repo
+func envRepoMap(name string) map[string]string {
+	m := make(map[string]string)
+	for repo, v := range envMap(name) {
+		m[normalizeRepo(repo)] = v
+	}
+	return m
+}
+
+func mapValues(m map[string]string) []string {
+	var values []string
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// one value per line, empty lines and # comments are skipped
+func readList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var list []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v := strings.TrimSpace(sc.Text()); v != "" && !strings.HasPrefix(v, "#") {
+			list = append(list, v)
+		}
+	}
+	return list, sc.Err()
+}
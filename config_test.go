@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllowedReposNormalized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "repos")
+	if err := ioutil.WriteFile(file, []byte("# from file\ndocker.io/org/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ALLOWED_REPOS", "library/nginx,ghcr.io/org/tool")
+	os.Setenv("ALLOWED_REPOS_FILE", file)
+	defer os.Unsetenv("ALLOWED_REPOS")
+	defer os.Unsetenv("ALLOWED_REPOS_FILE")
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"nginx", "library/nginx", "docker.io/library/nginx", "org/app", "docker.io/org/app", "ghcr.io/org/tool"} {
+		key, _ := mapRepo(repo, latest)
+		if !c.repoAllowed(key) {
+			t.Errorf("repo %s is not allowed", repo)
+		}
+	}
+	for _, repo := range []string{"redis", "org/other", "ghcr.io/org/app"} {
+		key, _ := mapRepo(repo, latest)
+		if c.repoAllowed(key) {
+			t.Errorf("repo %s is allowed", repo)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ======= CONFIG FILE ======
+
+// options read from config file by env name, env vars take precedence
+var fileConfig = make(map[string]string)
+
+// env names looked up while loading config
+var knownOptions = make(map[string]bool)
+
+// --config flag or CONFIG_FILE env
+func configFilePath() string {
+	if path := flagValue("config"); path != "" {
+		return path
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// value of --name (or -name) command line flag, empty when not given
+func flagValue(name string) string {
+	args := os.Args[1:]
+	for i, arg := range args {
+		switch {
+		case (arg == "--"+name || arg == "-"+name) && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--"+name+"="):
+			return strings.TrimPrefix(arg, "--"+name+"=")
+		case strings.HasPrefix(arg, "-"+name+"="):
+			return strings.TrimPrefix(arg, "-"+name+"=")
+		}
+	}
+	return ""
+}
+
+// YAML mapping of options named as env vars, in any case; lists and maps
+// stand for comma-separated env values:
+//
+//	health_wait: 30s
+//	allowed_repos: [org/app, org/web]
+//	repo_health_wait: {org/app: 1m}
+func loadConfigFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, _err("parse %s error: %s", file, err.Error())
+	}
+	if fileProfiles, err = parseProfiles(raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for key, v := range raw {
+		name := strings.ToUpper(key)
+		if values[name], err = configValue(v); err != nil {
+			return nil, _err("%s: %s", key, err.Error())
+		}
+	}
+	if err := applyProfile(values, fileProfiles, file); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			if !isScalar(item) {
+				return "", _err("list items must be scalars")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		var pairs []string
+		for k, item := range v {
+			if !isScalar(item) {
+				return "", _err("map values must be scalars")
+			}
+			pairs = append(pairs, fmt.Sprintf("%v=%v", k, item))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case []interface{}, map[interface{}]interface{}:
+		return false
+	}
+	return true
+}
+
+// config file options (of any profile) which are not known to loadConfig,
+// typos mostly
+func unknownFileOptions() []string {
+	var unknown []string
+	for name := range fileConfig {
+		if !knownOptions[name] && !isHookOption(name) {
+			unknown = append(unknown, name)
+		}
+	}
+	for _, profile := range profileNames(fileProfiles) {
+		if profile == profileName(fileConfig) {
+			// merged into fileConfig
+			continue
+		}
+		for name := range fileProfiles[profile] {
+			if !knownOptions[name] && !isHookOption(name) {
+				unknown = append(unknown, profile+": "+name)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= VERSION CONSTRAINTS ======
+
+// semver constraint tags must satisfy to be updated to, e.g. "~1.4" or
+// ">=2.0 <3.0"
+const labelConstraint = "docker-updater.constraint"
+
+// like semver.NewConstraint, but space separates ANDed comparisons too:
+// ">=2.0 <3.0 || ~4.1" is ">=2.0, <3.0 || ~4.1"
+func parseConstraint(s string) (*semver.Constraints, error) {
+	var alts []string
+	for _, alt := range strings.Split(s, "||") {
+		var parts []string
+		for _, f := range strings.Fields(strings.Replace(alt, ",", " ", -1)) {
+			// operator separated from its version: ">= 2.0"
+			if n := len(parts); n > 0 && strings.Trim(parts[n-1], "=<>!~^") == "" {
+				parts[n-1] += f
+				continue
+			}
+			parts = append(parts, f)
+		}
+		alts = append(alts, strings.Join(parts, ", "))
+	}
+	return semver.NewConstraint(strings.Join(alts, " || "))
+}
+
+// whether constraint label (if any) allows tag, invalid constraint or
+// non-semver tag never does
+func constraintAllows(name string, labels map[string]string, tag string) bool {
+	s := labels[labelConstraint]
+	if s == "" {
+		return true
+	}
+	c, err := parseConstraint(s)
+	if err != nil {
+		logrus.Errorf("%s has invalid %s=%s: %s", name, labelConstraint, s, err)
+		return false
+	}
+	ver, err := semver.NewVersion(tag)
+	if err != nil || !c.Check(ver) {
+		logrus.Infof("tag %s doesn't satisfy %s constraint %s, skipped", tag, name, s)
+		return false
+	}
+	return true
+}
+
+// whether constraint and version channel labels allow tag, without logging,
+// for picking candidates among registry tags
+func tagAllowed(labels map[string]string, tag string) bool {
+	ver, err := semver.NewVersion(tag)
+	if err != nil {
+		return labels[labelConstraint] == ""
+	}
+	if s := labels[labelConstraint]; s != "" {
+		if c, err := parseConstraint(s); err != nil || !c.Check(ver) {
+			return false
+		}
+	}
+	if ch := labels[labelChannel]; versionChannelRe.MatchString(ch) {
+		if c, err := semver.NewConstraint(ch); err != nil || !c.Check(ver) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/docker/docker/api/types"
+	"github.com/labstack/echo"
+)
+
+// ======= MANAGED CONTAINERS ======
+
+// prefix of labels setting update policy of containers
+const labelPrefix = "docker-updater."
+
+// managed container state
+type managedContainer struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Host    string   `json:"host,omitempty"`
+	Image   string   `json:"image"`
+	Repo    string   `json:"repo"`
+	Tag     string   `json:"tag"`
+	Digests []string `json:"digests"`
+	// semver of tag, empty when tag is not a version
+	Version string            `json:"version,omitempty"`
+	State   string            `json:"state"`
+	Labels  map[string]string `json:"labels"`
+	// finish of the latest update of container in history, nil if unknown
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// managed containers call: GET /api/v1/containers[?repo=REPO][&host=HOST],
+// containers the updater would update, sorted by host and name
+func listContainers(c echo.Context) error {
+	host, err := requestHost(c)
+	if err != nil {
+		return err
+	}
+	repo := c.QueryParam("repo")
+	if repo != "" {
+		repo = normalizeRepo(repo)
+	}
+	updated := lastContainerUpdates()
+	list := []managedContainer{}
+	eachHost(host, func() {
+		containers, listErr := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+		if listErr != nil {
+			err = _err("get containers list error: %s", listErr.Error())
+			return
+		}
+		digests := make(map[string][]string)
+		for _, cnt := range containers {
+			if !managed(cnt.Labels) || isSelf(cnt.ID) || cnt.Labels[labelSwarmService] != "" {
+				continue
+			}
+			cRepo, cTag := splitImage(containerImage(cnt))
+			if repo != "" && cRepo != repo {
+				continue
+			}
+			mc := managedContainer{
+				ID:     cnt.ID,
+				Host:   currentHost,
+				Image:  cnt.Image,
+				Repo:   cRepo,
+				Tag:    cTag,
+				State:  cnt.State,
+				Labels: make(map[string]string),
+			}
+			if len(cnt.Names) > 0 {
+				mc.Name = strings.TrimPrefix(cnt.Names[0], "/")
+			}
+			if ver, err := semver.NewVersion(cTag); err == nil {
+				mc.Version = ver.String()
+			}
+			for k, v := range cnt.Labels {
+				if strings.HasPrefix(k, labelPrefix) {
+					mc.Labels[k] = v
+				}
+			}
+			d, ok := digests[cnt.ImageID]
+			if !ok {
+				d = imageDigests(cnt.ImageID)
+				digests[cnt.ImageID] = d
+			}
+			mc.Digests = append([]string{}, d...)
+			if at, ok := updated[currentHost+"/"+mc.Name]; ok {
+				mc.UpdatedAt = &at
+			}
+			list = append(list, mc)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Host != list[j].Host {
+			return list[i].Host < list[j].Host
+		}
+		return list[i].Name < list[j].Name
+	})
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
+
+// finish of the latest update by host/name of updated containers in history
+func lastContainerUpdates() map[string]time.Time {
+	updated := make(map[string]time.Time)
+	for _, e := range historyEntries() {
+		for _, ref := range e.Containers {
+			updated[ref.Host+"/"+ref.Name] = e.FinishedAt
+		}
+	}
+	return updated
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ======= COOLDOWN ======
+
+// completion time of last successful update by repo:tag
+var lastUpdates = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+func markUpdated(repo, tag string) {
+	if config().UpdateCooldown <= 0 {
+		return
+	}
+	lastUpdates.Lock()
+	defer lastUpdates.Unlock()
+	for key, at := range lastUpdates.at {
+		if time.Since(at) > config().UpdateCooldown {
+			delete(lastUpdates.at, key)
+		}
+	}
+	lastUpdates.at[repo+":"+tag] = time.Now()
+}
+
+// whether repo:tag was updated within cfg.UpdateCooldown
+func inCooldown(repo, tag string) bool {
+	lastUpdates.Lock()
+	defer lastUpdates.Unlock()
+	at, ok := lastUpdates.at[repo+":"+tag]
+	return ok && time.Since(at) < config().UpdateCooldown
+}
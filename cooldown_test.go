@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// runs update request of repo:tag, returns response code and body
+func requestUpdate(t *testing.T, repo, tag string) (int, map[string]interface{}) {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/update?repo="+repo+"&tag="+tag, nil), rec)
+	if err := _upd(c, repo, tag, updateOptions{}); err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, map[string]interface{}{"error": he.Message}
+		}
+		t.Fatal(err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, body
+}
+
+func TestUpdateCooldown(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.UpdateCooldown = 30 * time.Second })()
+	f.addContainer("app-1", "org/cooled:1.0.0", nil)
+	f.pushImage("org/cooled:1.0.1", nil)
+
+	if code, body := requestUpdate(t, "org/cooled", "1.0.1"); code != http.StatusOK || body["updated"] != 1.0 {
+		t.Fatalf("first update: %d %v", code, body)
+	}
+	pulls := len(f.recorded("pull"))
+	if code, body := requestUpdate(t, "org/cooled", "1.0.1"); code != http.StatusOK || body["status"] != "cooldown, skipped" {
+		t.Fatalf("update within cooldown: %d %v", code, body)
+	}
+	if len(f.recorded("pull")) != pulls {
+		t.Error("update within cooldown pulled the image")
+	}
+
+	// same tag pushed again once the cooldown is over
+	rebuilt := f.pushImage("org/cooled:1.0.1", nil)
+	rebuilt.ID, rebuilt.RepoDigests = newImageID("rebuilt"), []string{"org/cooled@" + newImageID("rebuilt#digest")}
+	lastUpdates.Lock()
+	lastUpdates.at["org/cooled:1.0.1"] = time.Now().Add(-31 * time.Second)
+	lastUpdates.Unlock()
+	if code, body := requestUpdate(t, "org/cooled", "1.0.1"); code != http.StatusOK || body["updated"] != 1.0 {
+		t.Fatalf("update after cooldown: %d %v", code, body)
+	}
+	if len(f.recorded("pull")) != pulls+1 {
+		t.Error("update after cooldown did not run")
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+)
+
+// ======= COSIGN SIGNATURES ======
+
+// cosign signature manifest annotations
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+// fulcio certificate extension with OIDC issuer of signer's identity
+var fulcioIssuerOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+const signatureManifestTypes = "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+
+// keys and keyless identities images must be signed by
+type cosignPolicy struct {
+	keys []crypto.PublicKey
+	// fulcio roots and intermediates of keyless signing certificates
+	roots         *x509.CertPool
+	intermediates []*x509.Certificate
+	// rekor keys transparency log entries of keyless signatures are signed
+	// with
+	rekorKeys []crypto.PublicKey
+	// allowed certificate email or URI subjects, and OIDC issuer when set
+	identities map[string]bool
+	issuer     string
+}
+
+func (p *cosignPolicy) enabled() bool {
+	return p != nil && (len(p.keys) > 0 || p.roots != nil)
+}
+
+func loadCosignPolicy(keyFiles []string, rootsFile string, rekorKeyFiles, identities []string, issuer string) (*cosignPolicy, error) {
+	p := &cosignPolicy{identities: make(map[string]bool), issuer: issuer}
+	var err error
+	if p.keys, err = loadPublicKeys(keyFiles, "cosign"); err != nil {
+		return nil, err
+	}
+	if rootsFile != "" {
+		data, err := ioutil.ReadFile(rootsFile)
+		if err != nil {
+			return nil, _err("read fulcio roots %s error: %s", rootsFile, err.Error())
+		}
+		p.roots = x509.NewCertPool()
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, _err("parse fulcio certificate in %s error: %s", rootsFile, err.Error())
+			}
+			if cert.Subject.String() == cert.Issuer.String() {
+				p.roots.AddCert(cert)
+			} else {
+				p.intermediates = append(p.intermediates, cert)
+			}
+		}
+		if len(identities) == 0 {
+			return nil, _err("COSIGN_IDENTITIES must be set for keyless verification")
+		}
+		if len(rekorKeyFiles) == 0 {
+			return nil, _err("COSIGN_REKOR_KEYS must be set for keyless verification")
+		}
+		if p.rekorKeys, err = loadPublicKeys(rekorKeyFiles, "rekor"); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range identities {
+		p.identities[id] = true
+	}
+	return p, nil
+}
+
+// PEM public keys of files, of kind (cosign, rekor) for errors
+func loadPublicKeys(files []string, kind string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, _err("read %s key %s error: %s", kind, file, err.Error())
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, _err("no PEM public key in %s", file)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, _err("parse %s key %s error: %s", kind, file, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+type ociManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// cosign simple signing payload
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifies registry image of fullRepo is signed as cfg.Cosign requires,
+// returns its signed digest; every decision is logged as an audit entry
+func verifyImageSignature(fullRepo string) (string, error) {
+	if !config().Cosign.enabled() {
+		return "", nil
+	}
+	repo, tag := splitImage(fullRepo)
+	digest, err := (&remoteDigest{image: fullRepo}).get()
+	if err == nil {
+		err = config().Cosign.verify(repo, digest)
+	}
+	entry := logrus.WithFields(logrus.Fields{
+		"audit":  "signature",
+		"repo":   repo,
+		"tag":    tag,
+		"digest": digest,
+	})
+	if err != nil {
+		entry.WithField("error", err.Error()).Error("image signature rejected")
+		return "", _err("signature verification of %s failed: %s", fullRepo, err.Error())
+	}
+	entry.Info("image signature verified")
+	return digest, nil
+}
+
+// whether any signature attached to digest of repo (tag sha256-<hex>.sig)
+// is valid
+func (p *cosignPolicy) verify(repo, digest string) error {
+	r, err := newRegistryRepo(repo)
+	if err != nil {
+		return err
+	}
+	sigTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	resp, err := r.get(r.base+"/v2/"+r.path+"/manifests/"+sigTag, signatureManifestTypes)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return _err("image is not signed")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return _err("get signatures: unexpected response status %s", resp.Status)
+	}
+	if err != nil {
+		return _err("get signatures: %s", err.Error())
+	}
+	var m ociManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return _err("parse signatures manifest: %s", err.Error())
+	}
+	var errs []string
+	for _, layer := range m.Layers {
+		if err := p.verifyLayer(r, digest, layer.Digest, layer.Annotations); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		return nil
+	}
+	if len(errs) == 0 {
+		return _err("no signatures found")
+	}
+	return _err("no valid signature: %s", strings.Join(errs, "; "))
+}
+
+func (p *cosignPolicy) verifyLayer(r *registryRepo, digest, layerDigest string, annotations map[string]string) error {
+	sig, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return _err("layer %s has no signature", layerDigest)
+	}
+	resp, err := r.get(r.base+"/v2/"+r.path+"/blobs/"+layerDigest, "")
+	if err != nil {
+		return err
+	}
+	payload, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return _err("get signed payload %s error: %s %v", layerDigest, resp.Status, err)
+	}
+	sum := sha256.Sum256(payload)
+	if "sha256:"+hex.EncodeToString(sum[:]) != layerDigest {
+		return _err("signed payload %s digest mismatch", layerDigest)
+	}
+	var pl cosignPayload
+	if err := json.Unmarshal(payload, &pl); err != nil {
+		return _err("parse signed payload %s error: %s", layerDigest, err.Error())
+	}
+	if pl.Critical.Image.DockerManifestDigest != digest {
+		return _err("signature %s is for %s", layerDigest, pl.Critical.Image.DockerManifestDigest)
+	}
+	for _, key := range p.keys {
+		if verifyWithKey(key, sum[:], sig) {
+			return nil
+		}
+	}
+	if certPEM := annotations[cosignCertificateAnnotation]; certPEM != "" && p.roots != nil {
+		signedAt, err := p.tlogTime(annotations[cosignBundleAnnotation], certPEM, sig, sum[:])
+		if err != nil {
+			return _err("signature %s: %s", layerDigest, err.Error())
+		}
+		key, err := p.keylessKey(certPEM, annotations[cosignChainAnnotation], signedAt)
+		if err != nil {
+			return _err("signature %s: %s", layerDigest, err.Error())
+		}
+		if verifyWithKey(key, sum[:], sig) {
+			return nil
+		}
+	}
+	return _err("signature %s doesn't match any trusted key or identity", layerDigest)
+}
+
+// rekor bundle cosign attaches to keyless signatures
+type rekorBundle struct {
+	SignedEntryTimestamp []byte
+	Payload              rekorPayload
+}
+
+// transparency log entry, fields in canonical (sorted) order as the signed
+// entry timestamp is made over their JSON
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedrekord entry of a signature
+type rekorEntry struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// time sig (of hashed payload, made with certificate certPEM) was logged in
+// rekor at, proven by the bundle's signed entry timestamp; keyless
+// signatures without one are rejected, so are entries of other signatures
+func (p *cosignPolicy) tlogTime(bundleJSON, certPEM string, sig, hashed []byte) (time.Time, error) {
+	if bundleJSON == "" {
+		return time.Time{}, _err("keyless signature has no transparency log proof")
+	}
+	var b rekorBundle
+	if err := json.Unmarshal([]byte(bundleJSON), &b); err != nil {
+		return time.Time{}, _err("parse transparency log bundle error: %s", err.Error())
+	}
+	signed, err := json.Marshal(b.Payload)
+	if err != nil {
+		return time.Time{}, _err("encode transparency log entry error: %s", err.Error())
+	}
+	sum := sha256.Sum256(signed)
+	trusted := false
+	for _, key := range p.rekorKeys {
+		if trusted = verifyWithKey(key, sum[:], b.SignedEntryTimestamp); trusted {
+			break
+		}
+	}
+	if !trusted {
+		return time.Time{}, _err("transparency log entry timestamp doesn't match any rekor key")
+	}
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return time.Time{}, _err("invalid transparency log entry body")
+	}
+	var entry rekorEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, _err("parse transparency log entry error: %s", err.Error())
+	}
+	hash := entry.Spec.Data.Hash
+	if entry.Kind != "hashedrekord" || hash.Algorithm != "sha256" || hash.Value != hex.EncodeToString(hashed) ||
+		!bytes.Equal(entry.Spec.Signature.Content, sig) || !samePEM(string(entry.Spec.Signature.PublicKey.Content), certPEM) {
+		return time.Time{}, _err("transparency log entry is not of this signature")
+	}
+	return time.Unix(b.Payload.IntegratedTime, 0), nil
+}
+
+// whether PEM blocks a and b hold the same bytes
+func samePEM(a, b string) bool {
+	ba, _ := pem.Decode([]byte(a))
+	bb, _ := pem.Decode([]byte(b))
+	return ba != nil && bb != nil && bytes.Equal(ba.Bytes, bb.Bytes)
+}
+
+// public key of signing certificate chained to fulcio roots and issued to
+// an allowed identity; certificates are short-lived, so the chain is checked
+// as of signedAt, the time the signature was logged at
+func (p *cosignPolicy) keylessKey(certPEM, chainPEM string, signedAt time.Time) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, _err("invalid signing certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, _err("parse signing certificate error: %s", err.Error())
+	}
+	if signedAt.Before(cert.NotBefore) || signedAt.After(cert.NotAfter) {
+		return nil, _err("signature logged at %s, out of signing certificate validity (%s to %s)",
+			signedAt.UTC().Format(time.RFC3339), cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	// attached chain only helps building the chain to trusted roots
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(chainPEM))
+	for _, c := range p.intermediates {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, _err("signing certificate is not trusted: %s", err.Error())
+	}
+	if p.issuer != "" && certIssuer(cert) != p.issuer {
+		return nil, _err("signing certificate issuer %q is not %s", certIssuer(cert), p.issuer)
+	}
+	subjects := cert.EmailAddresses
+	for _, u := range cert.URIs {
+		subjects = append(subjects, u.String())
+	}
+	for _, s := range subjects {
+		if p.identities[s] {
+			return cert.PublicKey, nil
+		}
+	}
+	return nil, _err("signing identity %s is not allowed", strings.Join(subjects, ", "))
+}
+
+// OIDC issuer fulcio recorded in certificate
+func certIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerOID) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+func verifyWithKey(key crypto.PublicKey, hashed, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var es struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return false
+		}
+		return ecdsa.Verify(k, hashed, es.R, es.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, sig) == nil
+	}
+	return false
+}
+
+// pulled image of fullRepo must be the verified digest, the tag may have
+// moved since
+func checkVerifiedDigest(fullRepo, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	names, err := digestNames(fullRepo)
+	if err != nil {
+		return _err("parse container name %s error: %s", fullRepo, err.Error())
+	}
+	for _, d := range imageDigests(fullRepo) {
+		dn, err := reference.ParseNormalizedNamed(d)
+		if err != nil || !strings.HasSuffix(d, "@"+digest) {
+			continue
+		}
+		for _, name := range names {
+			if dn.Name() == name {
+				return nil
+			}
+		}
+	}
+	return _err("pulled image %s is not the verified %s", fullRepo, digest)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ASN.1 ECDSA signature of hashed
+func signHashed(t *testing.T, key *ecdsa.PrivateKey, hashed []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, key, hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// fulcio-like root and short-lived code signing certificate of email
+type keylessSigner struct {
+	root    *x509.Certificate
+	rootPEM string
+	cert    *x509.Certificate
+	certPEM string
+	key     *ecdsa.PrivateKey
+}
+
+func newKeylessSigner(t *testing.T, email string, notBefore time.Time) *keylessSigner {
+	rootKey := newECKey(t)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio test root"},
+		NotBefore:             notBefore.Add(-24 * time.Hour),
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+	s := &keylessSigner{root: root, key: newECKey(t)}
+	s.rootPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}))
+	leafTmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerOID, Value: []byte("https://accounts.example.com")}},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, root, &s.key.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cert, _ = x509.ParseCertificate(leafDER)
+	s.certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}))
+	return s
+}
+
+// rekor bundle of sig logged at integrated, its entry timestamp signed with
+// rekor key
+func rekorBundleJSON(t *testing.T, rekor *ecdsa.PrivateKey, certPEM string, sig, hashed []byte, integrated time.Time) string {
+	var entry rekorEntry
+	entry.Kind = "hashedrekord"
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(hashed)
+	entry.Spec.Signature.Content = sig
+	entry.Spec.Signature.PublicKey.Content = []byte(certPEM)
+	body, _ := json.Marshal(entry)
+	b := rekorBundle{Payload: rekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: integrated.Unix(),
+		LogID:          strings.Repeat("ab", 32),
+		LogIndex:       42,
+	}}
+	signed, _ := json.Marshal(b.Payload)
+	sum := sha256.Sum256(signed)
+	b.SignedEntryTimestamp = signHashed(t, rekor, sum[:])
+	data, _ := json.Marshal(b)
+	return string(data)
+}
+
+func TestKeylessSignatureTransparencyLog(t *testing.T) {
+	issued := time.Now().Add(-time.Hour).Truncate(time.Second)
+	signer := newKeylessSigner(t, "dev@example.com", issued)
+	other := newKeylessSigner(t, "dev@example.com", issued)
+	rekor, forger := newECKey(t), newECKey(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(signer.root)
+	p := &cosignPolicy{
+		roots:      roots,
+		rekorKeys:  []crypto.PublicKey{&rekor.PublicKey},
+		identities: map[string]bool{"dev@example.com": true},
+		issuer:     "https://accounts.example.com",
+	}
+	hashed := sha256.Sum256([]byte(`{"critical":{}}`))
+	sig := signHashed(t, signer.key, hashed[:])
+	otherSig := signHashed(t, signer.key, hashed[:])
+	logged := issued.Add(time.Minute)
+
+	bundle := rekorBundleJSON(t, rekor, signer.certPEM, sig, hashed[:], logged)
+	signedAt, err := p.tlogTime(bundle, signer.certPEM, sig, hashed[:])
+	if err != nil || !signedAt.Equal(logged) {
+		t.Fatalf("tlogTime = %v, %v, want %v", signedAt, err, logged)
+	}
+	// certificate expired since, it was valid when logged
+	key, err := p.keylessKey(signer.certPEM, "", signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyWithKey(key, hashed[:], sig) {
+		t.Error("signature doesn't verify with the certificate key")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		bundle string
+	}{
+		{"no bundle", ""},
+		{"malformed bundle", "{"},
+		{"timestamp of another key", rekorBundleJSON(t, forger, signer.certPEM, sig, hashed[:], logged)},
+		{"entry of another signature", rekorBundleJSON(t, rekor, signer.certPEM, otherSig, hashed[:], logged)},
+		{"entry of another certificate", rekorBundleJSON(t, rekor, other.certPEM, sig, hashed[:], logged)},
+		{"entry of another payload", rekorBundleJSON(t, rekor, signer.certPEM, sig, make([]byte, 32), logged)},
+		{"moved integrated time", strings.Replace(bundle, `"integratedTime":`, `"integratedTime":1`, 1)},
+	} {
+		if _, err := p.tlogTime(tc.bundle, signer.certPEM, sig, hashed[:]); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+
+	for _, at := range []time.Time{issued.Add(-time.Minute), issued.Add(11 * time.Minute)} {
+		if _, err := p.keylessKey(signer.certPEM, "", at); err == nil {
+			t.Errorf("signature logged at %s, out of certificate validity, accepted", at)
+		}
+	}
+	p.identities = map[string]bool{"ops@example.com": true}
+	if _, err := p.keylessKey(signer.certPEM, "", signedAt); err == nil {
+		t.Error("signature of another identity accepted")
+	}
+}
+
+func TestKeylessPolicyRequiresRekorKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cosign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer := newKeylessSigner(t, "dev@example.com", time.Now())
+	rootsFile := filepath.Join(dir, "fulcio.pem")
+	ioutil.WriteFile(rootsFile, []byte(signer.rootPEM), 0600)
+	rekorDER, _ := x509.MarshalPKIXPublicKey(&newECKey(t).PublicKey)
+	rekorFile := filepath.Join(dir, "rekor.pub")
+	ioutil.WriteFile(rekorFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rekorDER}), 0600)
+
+	if _, err := loadCosignPolicy(nil, rootsFile, nil, []string{"dev@example.com"}, ""); err == nil {
+		t.Error("keyless policy without rekor keys loaded")
+	}
+	p, err := loadCosignPolicy(nil, rootsFile, []string{rekorFile}, []string{"dev@example.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.rekorKeys) != 1 || !p.enabled() {
+		t.Errorf("policy %+v", p)
+	}
+}
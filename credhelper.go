@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= CREDENTIAL HELPERS ======
+
+// credentials managed by docker login are read from docker client config
+// like docker does: per-registry credHelpers, then credsStore, then auths
+
+const credHelperTimeout = 30 * time.Second
+
+// helpers answer it when they have nothing for the server
+const credentialsNotFound = "credentials not found in native keychain"
+
+// docker client config.json ($DOCKER_CONFIG or ~/.docker), empty when
+// there is none
+func dockerClientConfig() string {
+	dir := envString("DOCKER_CONFIG", "")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	file := filepath.Join(dir, "config.json")
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	return file
+}
+
+// credentials of registry host from docker-credential-<helper>, not ok
+// when helper has none
+func runCredHelper(helper, host string) (types.AuthConfig, bool, error) {
+	server := host
+	// docker login stores docker hub credentials under its v1 address
+	if host == "docker.io" {
+		server = "https://index.docker.io/v1/"
+	}
+	helperCtx, cancel := context.WithTimeout(ctx, credHelperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(helperCtx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, credentialsNotFound) {
+			return types.AuthConfig{}, false, nil
+		}
+		return types.AuthConfig{}, false, _err("credential helper %s for %s error: %s %s", helper, host, err.Error(), out)
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return types.AuthConfig{}, false, _err("credential helper %s for %s: parse output error: %s", helper, host, err.Error())
+	}
+	logrus.Debugf("credentials for %s given by credential helper %s", host, helper)
+	ac := types.AuthConfig{ServerAddress: server}
+	// identity token, exchanged for registry tokens by docker
+	if creds.Username == "<token>" {
+		ac.IdentityToken = creds.Secret
+	} else {
+		ac.Username, ac.Password = creds.Username, creds.Secret
+	}
+	return ac, true, nil
+}
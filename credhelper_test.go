@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// docker-credential-fake answering registry.example.com and docker hub,
+// recording servers asked for in dir/calls, and a failing
+// docker-credential-broken, both in PATH until the returned func is called
+func fakeCredHelpers(t *testing.T, dir string) func() {
+	scripts := map[string]string{
+		"docker-credential-fake": `#!/bin/sh
+read server
+echo "$server" >> ` + filepath.Join(dir, "calls") + `
+case "$server" in
+registry.example.com) echo '{"Username": "ci", "Secret": "s3cret"}' ;;
+https://index.docker.io/v1/) echo '{"Username": "<token>", "Secret": "identity-token"}' ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`,
+		"docker-credential-broken": "#!/bin/sh\necho keychain locked >&2\nexit 1\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestCredHelpers(t *testing.T) {
+	file, remove := authFile(t, `{
+		"auths": {"ghcr.io": {"auth": "Z2gtdXNlcjpnaC10b2tlbg=="}},
+		"credHelpers": {"registry.example.com": "fake", "locked.example.com": "broken"},
+		"credsStore": "fake"
+	}`)
+	defer remove()
+	dir := filepath.Dir(file)
+	defer fakeCredHelpers(t, dir)()
+	defer withConfig(func(c *Config) {
+		c.RegistryAuthFile, c.RegistryAuthTTL, c.RegistryAuth = file, 0, nil
+	})()
+
+	if ac := decodedAuth(t, "registry.example.com/team/app:1.0.1"); ac.Username != "ci" || ac.Password != "s3cret" {
+		t.Errorf("credentials of registry helper: %+v", ac)
+	}
+	// docker hub ones are asked for by the docker login address
+	if ac := decodedAuth(t, "org/app:1.0.1"); ac.IdentityToken != "identity-token" || ac.Username != "" {
+		t.Errorf("identity token of store: %+v", ac)
+	}
+	// the store has none, the file has
+	if ac := decodedAuth(t, "ghcr.io/org/tool:2"); ac.Username != "gh-user" || ac.Password != "gh-token" {
+		t.Errorf("credentials of file: %+v", ac)
+	}
+	if _, err := registryAuth("locked.example.com/app:1"); err == nil || !strings.Contains(err.Error(), "keychain locked") {
+		t.Errorf("failing helper: %v, want its error", err)
+	}
+
+	// configured ones take precedence
+	config().RegistryAuth = parseRegistryAuth(map[string]string{"registry.example.com": "env-user:env-pass"})
+	if ac := decodedAuth(t, "registry.example.com/team/app:1.0.1"); ac.Username != "env-user" {
+		t.Errorf("configured credentials replaced by helper ones: %+v", ac)
+	}
+	config().RegistryAuth = nil
+
+	// helpers run once while the file ones are cached
+	defer func() {
+		authCache.Lock()
+		authCache.auths = nil
+		authCache.Unlock()
+	}()
+	config().RegistryAuthTTL = time.Hour
+	calls := filepath.Join(dir, "calls")
+	os.Remove(calls)
+	for i := 0; i < 3; i++ {
+		decodedAuth(t, "registry.example.com/team/app:1.0.1")
+	}
+	if b, _ := ioutil.ReadFile(calls); strings.Count(string(b), "registry.example.com") != 1 {
+		t.Errorf("helper asked %q, want once", b)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// ======= CUSTOM WEBHOOKS ======
+
+// webhook defined in config, repo and tag are go templates executed on the
+// decoded json payload, e.g. {{.image.name}} or {{index .images 0 | repo}}
+type customAdapter struct {
+	repo, tag *template.Template
+}
+
+// names are used in endpoint path: /api/v1/update/custom/<name>
+var customNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var customFuncs = template.FuncMap{
+	"repo": func(image interface{}) string { repo, _ := splitRef(image); return repo },
+	"tag":  func(image interface{}) string { _, tag := splitRef(image); return tag },
+}
+
+// CUSTOM_WEBHOOK_<NAME>_REPO and CUSTOM_WEBHOOK_<NAME>_TAG for each name
+func loadCustomWebhooks(names []string) (map[string]customAdapter, error) {
+	webhooks := make(map[string]customAdapter)
+	for _, name := range names {
+		if !customNameRe.MatchString(name) {
+			return nil, _err("invalid custom webhook name %q", name)
+		}
+		prefix := "CUSTOM_WEBHOOK_" + envSuffix(name)
+		var a customAdapter
+		var err error
+		if a.repo, err = customTemplate(prefix + "_REPO"); err != nil {
+			return nil, err
+		}
+		if a.tag, err = customTemplate(prefix + "_TAG"); err != nil {
+			return nil, err
+		}
+		webhooks[name] = a
+	}
+	return webhooks, nil
+}
+
+func customTemplate(option string) (*template.Template, error) {
+	text := envString(option, "")
+	if text == "" {
+		return nil, _err("%s must be set", option)
+	}
+	t, err := template.New(option).Funcs(customFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, _err("invalid %s: %s", option, err.Error())
+	}
+	return t, nil
+}
+
+func (a customAdapter) Extract(body []byte) (string, string, error) {
+	var payload interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// keep numeric tags like 1.10 as sent
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return "", "", err
+	}
+	repo, err := execCustom(a.repo, payload)
+	if err != nil {
+		return "", "", err
+	}
+	tag, err := execCustom(a.tag, payload)
+	if err != nil {
+		return "", "", err
+	}
+	return repo, tag, nil
+}
+
+func execCustom(t *template.Template, payload interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, payload); err != nil {
+		return "", _err("%s error: %s", t.Name(), err.Error())
+	}
+	// missing keys of generic maps render as <no value>
+	return strings.TrimSpace(strings.Replace(buf.String(), "<no value>", "", -1)), nil
+}
+
+// "registry:5000/app:1.2" -> "registry:5000/app", "1.2", empty for missing key
+func splitRef(v interface{}) (string, string) {
+	image, _ := v.(string)
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
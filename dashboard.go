@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// ======= DASHBOARD ======
+
+// single page served at /ui, working against /api/v1 from the browser with
+// the API token (if any) typed in by the operator and kept in local storage
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>docker-updater</title>
+<style>
+body { font: 14px sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 20px; } h2 { font-size: 16px; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+button { font-size: 12px; }
+.success, .ok, .running, .updated { color: #187a18; }
+.failed, .failure, .exited { color: #b01c1c; }
+.queued, .noop { color: #777; }
+#error { color: #b01c1c; }
+#pulls { font: 12px monospace; max-height: 12em; overflow-y: auto; background: #f8f8f8; padding: 4px; }
+</style>
+</head>
+<body>
+<h1>docker-updater <small id="version"></small></h1>
+<p>
+  API token <input id="token" type="password" size="30">
+  <button onclick="saveToken()">Save</button>
+  <span id="error"></span>
+</p>
+
+<h2>Containers <button onclick="loadContainers()">Refresh</button></h2>
+<table><thead><tr><th>Name</th><th>Host</th><th>Image</th><th>Tag</th><th>State</th><th>Updated</th><th></th></tr></thead>
+<tbody id="containers"></tbody></table>
+
+<h2>Available updates <button onclick="loadOutdated()">Check registry</button></h2>
+<table><thead><tr><th>Name</th><th>Host</th><th>Repo</th><th>Tag</th><th>Available</th><th></th></tr></thead>
+<tbody id="outdated"><tr><td colspan="6">not checked yet</td></tr></tbody></table>
+
+<h2>Jobs</h2>
+<table><thead><tr><th>Job</th><th>Update</th><th>Status</th><th>Created</th><th>Finished</th><th>Error</th></tr></thead>
+<tbody id="jobs"></tbody></table>
+
+<h2>Pulls</h2>
+<div id="pulls"></div>
+
+<h2>History</h2>
+<table><thead><tr><th>Started</th><th>Repo</th><th>Tag</th><th>Outcome</th><th>Updated</th><th>Failed</th><th>Error</th></tr></thead>
+<tbody id="history"></tbody></table>
+
+<script>
+var token = localStorage.getItem("docker-updater-token") || "";
+document.getElementById("token").value = token;
+
+function saveToken() {
+  token = document.getElementById("token").value;
+  localStorage.setItem("docker-updater-token", token);
+  refresh();
+  watchPulls();
+}
+
+function esc(v) {
+  return String(v === undefined || v === null ? "" : v).replace(/[&<>"']/g, function (c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+  });
+}
+
+function time(v) {
+  return v ? new Date(v).toLocaleString() : "";
+}
+
+function api(method, path) {
+  var headers = {};
+  if (token) { headers["Authorization"] = "Bearer " + token; }
+  return fetch("/api/v1" + path, {method: method, headers: headers}).then(function (resp) {
+    return resp.json().then(function (body) {
+      if (!resp.ok) { throw new Error(body.error || resp.statusText); }
+      document.getElementById("error").textContent = "";
+      return body;
+    });
+  }).catch(function (err) {
+    document.getElementById("error").textContent = err.message;
+    throw err;
+  });
+}
+
+function rows(id, list, colspan, row) {
+  document.getElementById(id).innerHTML = list.length ? list.map(row).join("") :
+    '<tr><td colspan="' + colspan + '">none</td></tr>';
+}
+
+function hostParam(host) {
+  return host ? "&host=" + encodeURIComponent(host) : "";
+}
+
+function loadContainers() {
+  api("GET", "/containers").then(function (list) {
+    rows("containers", list, 7, function (c) {
+      return "<tr><td>" + esc(c.name) + "</td><td>" + esc(c.host) + "</td><td>" + esc(c.image) +
+        "</td><td>" + esc(c.tag) + '</td><td class="' + esc(c.state) + '">' + esc(c.state) +
+        "</td><td>" + esc(time(c.updated_at)) + '</td><td><button data-name="' + esc(c.name) +
+        '" data-host="' + esc(c.host) + '" onclick="rollback(this)">Rollback</button></td></tr>';
+    });
+  });
+}
+
+function loadOutdated() {
+  document.getElementById("outdated").innerHTML = '<tr><td colspan="6">checking...</td></tr>';
+  api("GET", "/outdated").then(function (list) {
+    rows("outdated", list, 6, function (c) {
+      return "<tr><td>" + esc(c.name) + "</td><td>" + esc(c.host) + "</td><td>" + esc(c.repo) +
+        "</td><td>" + esc(c.tag) + "</td><td>" + esc(c.available) + '</td><td><button data-repo="' +
+        esc(c.repo) + '" data-tag="' + esc(c.available) + '" data-host="' + esc(c.host) +
+        '" onclick="update(this)">Update</button></td></tr>';
+    });
+  });
+}
+
+function loadJobs() {
+  api("GET", "/jobs").then(function (list) {
+    rows("jobs", list.slice(0, 20), 6, function (j) {
+      var what = j.batch ? "batch of " + j.batch.length : j.repo + ":" + j.tag;
+      return "<tr><td>" + esc(j.job_id.substr(0, 8)) + "</td><td>" + esc(what) + '</td><td class="' +
+        esc(j.status) + '">' + esc(j.status) + "</td><td>" + esc(time(j.created_at)) + "</td><td>" +
+        esc(time(j.finished_at)) + "</td><td>" + esc(j.error) + "</td></tr>";
+    });
+  });
+}
+
+function loadHistory() {
+  api("GET", "/history").then(function (list) {
+    rows("history", list.slice(0, 50), 7, function (e) {
+      return "<tr><td>" + esc(time(e.started_at)) + "</td><td>" + esc(e.repo) + "</td><td>" + esc(e.tag) +
+        '</td><td class="' + esc(e.outcome) + '">' + esc(e.outcome) + "</td><td>" + esc(e.updated) +
+        "</td><td>" + esc(e.failed) + "</td><td>" + esc(e.error) + "</td></tr>";
+    });
+  });
+}
+
+function update(btn) {
+  var repo = btn.getAttribute("data-repo"), tag = btn.getAttribute("data-tag");
+  if (!confirm("Update " + repo + " to " + tag + "?")) { return; }
+  api("GET", "/update?async=true&repo=" + encodeURIComponent(repo) + "&tag=" + encodeURIComponent(tag) +
+    hostParam(btn.getAttribute("data-host"))).then(loadJobs);
+}
+
+function rollback(btn) {
+  var name = btn.getAttribute("data-name");
+  if (!confirm("Roll back " + name + " to its previous image?")) { return; }
+  api("POST", "/rollback?container=" + encodeURIComponent(name) + hostParam(btn.getAttribute("data-host")))
+    .then(function (results) {
+      alert(results.map(function (r) { return r.container + ": " + r.status + (r.error ? " (" + r.error + ")" : ""); }).join("\n"));
+      refresh();
+    });
+}
+
+var pulls;
+function watchPulls() {
+  if (pulls) { pulls.close(); }
+  pulls = new EventSource("/api/v1/pulls/events" + (token ? "?token=" + encodeURIComponent(token) : ""));
+  pulls.onmessage = function (msg) {
+    var e = JSON.parse(msg.data), box = document.getElementById("pulls");
+    var line = document.createElement("div");
+    line.textContent = time(e.time) + " " + (e.host ? e.host + " " : "") + e.image + " " +
+      (e.layer ? e.layer + " " : "") + e.status + (e.total ? " " + e.current + "/" + e.total : "") +
+      (e.error ? " " + e.error : "");
+    box.appendChild(line);
+    while (box.childNodes.length > 200) { box.removeChild(box.firstChild); }
+    box.scrollTop = box.scrollHeight;
+  };
+}
+
+function refresh() {
+  loadContainers();
+  loadJobs();
+  loadHistory();
+}
+
+fetch("/version").then(function (r) { return r.json(); }).then(function (v) {
+  document.getElementById("version").textContent = v.version;
+});
+refresh();
+watchPulls();
+setInterval(loadJobs, 3000);
+setInterval(function () { loadContainers(); loadHistory(); }, 30000);
+</script>
+</body>
+</html>
+`
+
+// dashboard call: GET /ui
+func dashboard(c echo.Context) error {
+	return c.HTML(http.StatusOK, dashboardHTML)
+}
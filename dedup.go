@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= WEBHOOK DEDUPLICATION ======
+
+// receipt time of recent webhook deliveries by key
+var seenDeliveries = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// docker hub delivery key, payload hash when push time is missing
+func pushKey(repo, tag string, pushedAt int64, body []byte) string {
+	if pushedAt == 0 {
+		return payloadKey(body)
+	}
+	return fmt.Sprintf("%s:%s@%d", repo, tag, pushedAt)
+}
+
+// registries resend the same payload on retries
+func payloadKey(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// whether delivery key was received within cfg.WebhookDedupWindow, records
+// it otherwise
+func duplicateDelivery(key string) bool {
+	if config().WebhookDedupWindow <= 0 {
+		return false
+	}
+	seenDeliveries.Lock()
+	defer seenDeliveries.Unlock()
+	for k, at := range seenDeliveries.at {
+		if time.Since(at) > config().WebhookDedupWindow {
+			delete(seenDeliveries.at, k)
+		}
+	}
+	if _, ok := seenDeliveries.at[key]; ok {
+		return true
+	}
+	seenDeliveries.at[key] = time.Now()
+	return false
+}
+
+func duplicate(c echo.Context, what string) error {
+	logrus.Infof("duplicate webhook delivery of %s, skipped", what)
+	return c.JSONPretty(http.StatusOK, map[string]string{
+		"status": "duplicate, skipped",
+	}, "  ")
+}
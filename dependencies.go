@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= DEPENDENCIES ======
+
+// comma-separated names of containers the labeled one depends on: they are
+// updated before it, and it is restarted after them when not updated itself
+const labelDependsOn = "docker-updater.depends-on"
+
+func dependsOn(labels map[string]string) []string {
+	var names []string
+	for _, name := range strings.Split(labels[labelDependsOn], ",") {
+		if name = strings.TrimPrefix(strings.TrimSpace(name), "/"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func inspectLabels(inspect types.ContainerJSON) map[string]string {
+	if inspect.Config == nil {
+		return nil
+	}
+	return inspect.Config.Labels
+}
+
+// indexes of containers (by name and labels) with dependencies first,
+// otherwise keeping their order; dependencies on others are ignored
+func dependencyOrder(names []string, labels []map[string]string) ([]int, error) {
+	known := make(map[string]bool)
+	for _, name := range names {
+		known[name] = true
+	}
+	placed := make(map[string]bool)
+	done := make([]bool, len(names))
+	var order []int
+	for len(order) < len(names) {
+		progress := false
+		for i, name := range names {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for _, dep := range dependsOn(labels[i]) {
+				if known[dep] && !placed[dep] && dep != name {
+					ready = false
+				}
+			}
+			if ready {
+				done[i], placed[name], progress = true, true, true
+				order = append(order, i)
+				// earliest ready one next, from the start
+				break
+			}
+		}
+		if !progress {
+			var cycle []string
+			for i, name := range names {
+				if !done[i] {
+					cycle = append(cycle, name)
+				}
+			}
+			return nil, _err("dependency cycle between containers %s", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// matched containers in dependency order, whether any of them depends on
+// another one
+func orderByDependencies(inspects []types.ContainerJSON) ([]types.ContainerJSON, bool, error) {
+	names := make([]string, len(inspects))
+	labels := make([]map[string]string, len(inspects))
+	known := make(map[string]bool)
+	for i, inspect := range inspects {
+		names[i], labels[i] = strings.TrimPrefix(inspect.Name, "/"), inspectLabels(inspect)
+		known[names[i]] = true
+	}
+	order, err := dependencyOrder(names, labels)
+	if err != nil {
+		return nil, false, err
+	}
+	related := false
+	ordered := make([]types.ContainerJSON, len(inspects))
+	for i, j := range order {
+		ordered[i] = inspects[j]
+		for _, dep := range dependsOn(labels[j]) {
+			related = related || known[dep] && dep != names[j]
+		}
+	}
+	return ordered, related, nil
+}
+
+// whether container depends on one not in previous batches
+func waitsForDependency(inspect types.ContainerJSON, pending map[string]bool) bool {
+	name := strings.TrimPrefix(inspect.Name, "/")
+	for _, dep := range dependsOn(inspectLabels(inspect)) {
+		if pending[dep] && dep != name {
+			return true
+		}
+	}
+	return false
+}
+
+// running containers depending on updated ones (directly or through others)
+// but not updated themselves, in dependency order
+func findDependents(inspects []types.ContainerJSON) ([]types.Container, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, _err("get containers list error: %s", err.Error())
+	}
+	affected := make(map[string]bool)
+	for _, inspect := range inspects {
+		affected[strings.TrimPrefix(inspect.Name, "/")] = true
+	}
+	updated := len(affected)
+	var dependents []types.Container
+	for found := true; found; {
+		found = false
+		for _, cnt := range containers {
+			name := containerName(cnt)
+			if affected[name] {
+				continue
+			}
+			for _, dep := range dependsOn(cnt.Labels) {
+				if affected[dep] {
+					affected[name], found = true, true
+					dependents = append(dependents, cnt)
+					break
+				}
+			}
+		}
+	}
+	if len(dependents) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(dependents))
+	labels := make([]map[string]string, len(dependents))
+	for i, cnt := range dependents {
+		names[i], labels[i] = containerName(cnt), cnt.Labels
+	}
+	order, err := dependencyOrder(names, labels)
+	if err != nil {
+		return nil, err
+	}
+	ordered := make([]types.Container, len(dependents))
+	for i, j := range order {
+		ordered[i] = dependents[j]
+	}
+	logrus.Infof("%d containers depend on %d updated ones, restarted after them", len(ordered), updated)
+	return ordered, nil
+}
+
+func containerName(cnt types.Container) string {
+	if len(cnt.Names) == 0 {
+		return cnt.ID
+	}
+	return strings.TrimPrefix(cnt.Names[0], "/")
+}
+
+// restarts dependents one by one, stopping at the first failure
+func restartDependents(dependents []types.Container) error {
+	for _, cnt := range dependents {
+		inspect, err := cli.ContainerInspect(ctx, cnt.ID)
+		if err != nil {
+			return _err("inspect dependent container %s error: %s", containerName(cnt), err.Error())
+		}
+		if !isRunning(inspect) {
+			continue
+		}
+		logrus.Infof("restarting dependent container %s...", containerName(cnt))
+		timeout := stopTimeout(inspect)
+		if err := cli.ContainerRestart(ctx, cnt.ID, &timeout); err != nil {
+			return _err("restart dependent container %s error: %s", containerName(cnt), err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// ======= DIGESTS ======
+
+// tag of digest-pinned containers, image reference is repo@sha256:...
+const labelTag = "docker-updater.tag"
+
+// registry digest of image, resolved once on first use
+type remoteDigest struct {
+	image    string
+	digest   string
+	err      error
+	resolved bool
+}
+
+func (r *remoteDigest) get() (string, error) {
+	if r.resolved {
+		return r.digest, r.err
+	}
+	r.resolved = true
+	pn, err := reference.ParseNormalizedNamed(registryRef(r.image))
+	if err != nil {
+		r.err = _err("parse container name %s error: %s", r.image, err.Error())
+		return "", r.err
+	}
+	auth, err := registryAuth(pn.String())
+	if err != nil {
+		r.err = err
+		return "", r.err
+	}
+	var dist registry.DistributionInspect
+	err = retry("registry inspect of "+r.image, func() error {
+		inspectCtx, cancel := context.WithTimeout(ctx, config().RegistryTimeout)
+		defer cancel()
+		dist, err = cli.DistributionInspect(inspectCtx, pn.String(), auth)
+		return err
+	})
+	if err != nil {
+		r.err = _err("inspect %s in registry error: %s", r.image, err.Error())
+		return "", r.err
+	}
+	r.digest = dist.Descriptor.Digest.String()
+	return r.digest, nil
+}
+
+// whether none of local repo digests (repo@sha256:...) is the registry one,
+// unresolvable registry digest counts as changed
+func (r *remoteDigest) changed(local []string) bool {
+	differs, err := r.differs(local)
+	if err != nil {
+		logrus.Warnf("%s, assuming image changed", err)
+		return true
+	}
+	return differs
+}
+
+// whether none of local repo digests is the registry one
+func (r *remoteDigest) differs(local []string) (bool, error) {
+	digest, err := r.get()
+	if err != nil {
+		return false, err
+	}
+	for _, d := range local {
+		if strings.HasSuffix(d, "@"+digest) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// repo digests of local image
+func imageDigests(imageID string) []string {
+	img, _, err := cli.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		logrus.Warnf("inspect image %s error: %s", imageID, err)
+		return nil
+	}
+	return img.RepoDigests
+}
+
+// repo@sha256:... reference of just pulled fullRepo, so new containers run
+// exactly that image; the tag itself when no repo digest is known
+func pinnedImage(fullRepo string) string {
+	names, err := digestNames(fullRepo)
+	if err != nil {
+		return fullRepo
+	}
+	digests := imageDigests(fullRepo)
+	for _, name := range names {
+		for _, d := range digests {
+			dn, err := reference.ParseNormalizedNamed(d)
+			if err != nil {
+				continue
+			}
+			if _, ok := dn.(reference.Canonical); ok && dn.Name() == name {
+				return d
+			}
+		}
+	}
+	logrus.Warnf("no repo digest of %s found, container image is not pinned", fullRepo)
+	return fullRepo
+}
+
+// names repo digests of fullRepo may have: its own, and its mirror's one,
+// which is the only one of images pulled through the mirror
+func digestNames(fullRepo string) ([]string, error) {
+	pn, err := reference.ParseNormalizedNamed(fullRepo)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{pn.Name()}
+	if ref, ok := mirrored(fullRepo); ok {
+		if mn, err := reference.ParseNormalizedNamed(ref); err == nil {
+			names = append(names, mn.Name())
+		}
+	}
+	return names, nil
+}
+
+// image reference container was created from, tag of pinned ones
+func containerImage(cnt types.Container) string {
+	if tag, ok := cnt.Labels[labelTag]; ok && (strings.Contains(cnt.Image, "@") || isSnapshotImage(cnt.Image)) {
+		return tag
+	}
+	return cnt.Image
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestRecreatedContainerPinnedToDigest(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	pushed := f.pushImage("org/app:1.0.1", nil)
+
+	if _, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := f.container("app-1")
+	if c.Config.Image != pushed.RepoDigests[0] {
+		t.Errorf("created with image %s, want %s", c.Config.Image, pushed.RepoDigests[0])
+	}
+	if c.Config.Labels[labelTag] != "org/app:1.0.1" {
+		t.Errorf("%s = %q, want org/app:1.0.1", labelTag, c.Config.Labels[labelTag])
+	}
+
+	// the pinned container is still matched by its tag
+	next := f.pushImage("org/app:1.0.2", nil)
+	summary, err := updateContainer("org/app", "1.0.2", updateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Updated != 1 || summary.OldTags["1.0.1"] != true {
+		t.Fatalf("updated = %d from %v, want the pinned 1.0.1 container", summary.Updated, summary.OldTags)
+	}
+	if c := f.container("app-1"); c.Config.Image != next.RepoDigests[0] {
+		t.Errorf("created with image %s, want %s", c.Config.Image, next.RepoDigests[0])
+	}
+}
+
+func TestPinnedImageWithoutRepoDigest(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	// built locally, never pushed
+	img := f.addImage("org/local:1.0.0", nil)
+	img.RepoDigests = nil
+	if pinned := pinnedImage("org/local:1.0.0"); pinned != "org/local:1.0.0" {
+		t.Errorf("pinnedImage = %s, want the tag itself", pinned)
+	}
+	if pinned := pinnedImage("org/missing:1.0.0"); pinned != "org/missing:1.0.0" {
+		t.Errorf("pinnedImage of missing image = %s, want the tag itself", pinned)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= DISK SPACE ======
+
+// fails before pulling when the docker data root has less than
+// cfg.MinFreeSpace bytes available; the data root must be visible at the
+// same path (mounted into the updater container), so only local daemons are
+// checked unless cfg.DockerDataRoot is set
+func checkDiskSpace() error {
+	if config().MinFreeSpace <= 0 {
+		return nil
+	}
+	path := config().DockerDataRoot
+	if path == "" {
+		if !strings.HasPrefix(cli.DaemonHost(), "unix://") {
+			return nil
+		}
+		info, err := cli.Info(ctx)
+		if err != nil {
+			return _err("docker info error: %s", err.Error())
+		}
+		path = info.DockerRootDir
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		logrus.Warnf("can't check free space of docker data root %s, is it mounted? %s", path, err)
+		return nil
+	}
+	free := int64(st.Bavail) * int64(st.Bsize)
+	if free < int64(config().MinFreeSpace) {
+		return _err("not enough disk space on docker data root %s: %s available, %s required",
+			path, byteSize(free), byteSize(int64(config().MinFreeSpace)))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= DRAIN ======
+
+// load-balanced containers are drained before they are stopped: the drain
+// hook takes the old one out of its balancer (e.g. marks the backend down
+// through Traefik, HAProxy or Consul API), then it keeps serving open
+// connections for the drain wait; the register hook puts the new one in once
+// it is up (and healthy), or the old one back when its update is aborted
+
+func (c *Config) drainWait(repo string) time.Duration {
+	if wait, ok := c.RepoDrainWait[repo]; ok {
+		return wait
+	}
+	return c.DrainWait
+}
+
+// runs drain hook of running inspected container and waits for its
+// connections to drain; an error leaves the container registered back
+func drainContainer(repo, tag string, inspect types.ContainerJSON) error {
+	if !isRunning(inspect) {
+		return nil
+	}
+	if err := runHook(hookDrain, repo, tag, inspect, inspect); err != nil {
+		registerContainer(repo, tag, inspect, inspect)
+		return err
+	}
+	if wait := config().drainWait(repo); wait > 0 {
+		logrus.Infof("draining container %s for %v...", strings.TrimPrefix(inspect.Name, "/"), wait)
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// runs register hook of owner (the old container) for running inspected
+// container, errors are only logged
+func registerContainer(repo, tag string, inspect, owner types.ContainerJSON) {
+	if !isRunning(inspect) {
+		return
+	}
+	if err := runHook(hookRegister, repo, tag, inspect, owner); err != nil {
+		logrus.Errorln(err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/labstack/echo"
+)
+
+// ======= DRY RUN ======
+
+type dryRunResult struct {
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// containers with their current images, all moving to Pull
+	Containers []containerRef `json:"containers"`
+	// image which would be pulled, empty when nothing is updated
+	Pull     string         `json:"pull,omitempty"`
+	Registry *registryCheck `json:"registry,omitempty"`
+}
+type containerRef struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// health wait outcome of updated container, empty when not waited
+	Health string `json:"health,omitempty"`
+	// one of DOCKER_HOSTS container runs on
+	Host string `json:"host,omitempty"`
+}
+type registryCheck struct {
+	Image      string   `json:"image"`
+	Reachable  bool     `json:"reachable"`
+	Authorized bool     `json:"authorized"`
+	Digest     string   `json:"digest,omitempty"`
+	Platforms  []string `json:"platforms,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// reports containers which would be updated without touching them,
+// optionally checking the image manifest is reachable and authorized
+func dryRun(c echo.Context, repo, tag string, checkRegistry bool) error {
+	repo, tag = mapRepo(repo, tag)
+	if err := checkRequest(repo, tag); err != nil {
+		return err
+	}
+	host, err := requestHost(c)
+	if err != nil {
+		return err
+	}
+	res, err := planUpdate(repo, tag, host)
+	if err != nil {
+		return err
+	}
+	if checkRegistry {
+		withHost(defaultHost(), func() {
+			res.Registry = inspectRegistry(fmt.Sprintf("%s:%s", repo, tag))
+		})
+	}
+	return c.JSONPretty(http.StatusOK, res, "  ")
+}
+
+// containers of repo on host (every one when empty) which would be updated
+// to tag
+func planUpdate(repo, tag, host string) (res dryRunResult, err error) {
+	var fullRepo = fmt.Sprintf("%s:%s", repo, tag)
+	logrus.Infof("dry run for repo %s...", fullRepo)
+	res = dryRunResult{
+		Repo:       repo,
+		Tag:        tag,
+		Containers: []containerRef{},
+	}
+	if config().Role == roleCoordinator {
+		res.Containers, err = planAgents(repo, tag, host)
+	} else {
+		eachHost(host, func() {
+			var toUpdate []types.Container
+			if toUpdate, err = matchContainers(repo, tag, newUpdateSummary(repo, tag)); err == nil {
+				res.Containers = append(res.Containers, containerRefs(toUpdate)...)
+			} else if currentHost != "" {
+				err = _err("host %s: %s", currentHost, err.Error())
+			}
+		})
+	}
+	if err != nil {
+		return res, err
+	}
+	if len(res.Containers) > 0 {
+		res.Pull = fullRepo
+	}
+	return res, nil
+}
+
+// update plan call: GET /api/v1/update/plan?repo=REPO&tag=TAG[&check_registry=true]
+func updPlan(c echo.Context) error {
+	return dryRun(c, c.QueryParam("repo"), c.QueryParam("tag"), c.QueryParam("check_registry") == "true")
+}
+
+func containerRefs(containers []types.Container) []containerRef {
+	refs := []containerRef{}
+	for _, cnt := range containers {
+		var name string
+		if len(cnt.Names) > 0 {
+			name = strings.TrimPrefix(cnt.Names[0], "/")
+		}
+		refs = append(refs, containerRef{
+			ID:    cnt.ID,
+			Name:  name,
+			Image: cnt.Image,
+			Host:  currentHost,
+		})
+	}
+	return refs
+}
+
+func inspectRef(inspect types.ContainerJSON) containerRef {
+	ref := containerRef{ID: inspect.ID, Name: strings.TrimPrefix(inspect.Name, "/"), Host: currentHost}
+	if inspect.Config != nil {
+		ref.Image = inspect.Config.Image
+	}
+	return ref
+}
+
+// manifest check via daemon without pulling
+func inspectRegistry(fullRepo string) *registryCheck {
+	check := &registryCheck{Image: fullRepo}
+	pn, err := reference.ParseNormalizedNamed(registryRef(fullRepo))
+	if err != nil {
+		check.Error = fmt.Sprintf("parse container name %s error: %s", fullRepo, err.Error())
+		return check
+	}
+	auth, err := registryAuth(pn.String())
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	dist, err := cli.DistributionInspect(ctx, pn.String(), auth)
+	if err != nil {
+		check.Error = err.Error()
+		if isAuthErr(err) {
+			// registry answered, but refused us
+			check.Reachable = true
+		}
+		logrus.Warnf("registry check for %s failed: %s", fullRepo, err)
+		return check
+	}
+	check.Reachable = true
+	check.Authorized = true
+	check.Digest = dist.Descriptor.Digest.String()
+	for _, p := range dist.Platforms {
+		platform := p.OS + "/" + p.Architecture
+		if p.Variant != "" {
+			platform += "/" + p.Variant
+		}
+		check.Platforms = append(check.Platforms, platform)
+	}
+	logrus.Infof("registry check for %s passed, digest %s", fullRepo, check.Digest)
+	return check
+}
+
+func isAuthErr(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"unauthorized", "denied", "authentication required", "forbidden"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
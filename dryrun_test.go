@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestDryRunCheckRegistry(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		status     int
+		reachable  bool
+		authorized bool
+	}{
+		{"reachable", 0, true, true},
+		{"unauthorized", http.StatusUnauthorized, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			f.addContainer("app-1", "org/app:1.0.0", nil)
+			pushed := f.pushImage("org/app:1.0.1", nil)
+			if tc.status != 0 {
+				f.distStatus["docker.io/org/app:1.0.1"] = tc.status
+			}
+
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/update/plan", nil), rec)
+			if err := dryRun(c, "org/app", "1.0.1", true); err != nil {
+				t.Fatal(err)
+			}
+			var res dryRunResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Containers) != 1 || res.Containers[0].Name != "app-1" || res.Pull != "org/app:1.0.1" {
+				t.Errorf("plan = %+v, want app-1 moving to org/app:1.0.1", res)
+			}
+			check := res.Registry
+			if check == nil {
+				t.Fatal("no registry check in result")
+			}
+			if check.Reachable != tc.reachable || check.Authorized != tc.authorized {
+				t.Errorf("registry check = %+v, want reachable %v, authorized %v", check, tc.reachable, tc.authorized)
+			}
+			if tc.authorized && check.Digest != pushed.RepoDigests[0][len("org/app@"):] {
+				t.Errorf("digest = %s, want %s", check.Digest, pushed.RepoDigests[0])
+			}
+			if !tc.authorized && check.Error == "" {
+				t.Error("no error of refused registry check")
+			}
+			if calls := f.recorded(); len(calls) != 0 {
+				t.Errorf("dry run touched docker: %v", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= ECR AUTH ======
+
+// ecr registry tokens are valid for 12 hours, so they are requested with
+// aws credentials (configured keys, ecs task role or ec2 instance role) and
+// requested again before they expire
+
+// <account>.dkr.ecr.<region>.amazonaws.com(.cn)
+var ecrHostRe = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.(amazonaws\.com(?:\.cn)?)$`)
+
+// tokens and role credentials are refreshed once they expire within it
+const ecrRefreshBefore = 30 * time.Minute
+
+const (
+	imdsURL    = "http://169.254.169.254/latest"
+	ecsCredURL = "http://169.254.170.2"
+)
+
+var ecrClient = &http.Client{Timeout: 10 * time.Second}
+
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+type ecrToken struct {
+	ac      types.AuthConfig
+	expires time.Time
+}
+
+// tokens by registry host and role credentials, guarded together so a
+// refresh is done once
+var ecrCache = struct {
+	sync.Mutex
+	tokens map[string]ecrToken
+	creds  *awsCredentials
+}{tokens: make(map[string]ecrToken)}
+
+func isECRHost(domain string) bool {
+	return ecrHostRe.MatchString(domain)
+}
+
+// credentials of ecr registry domain, cached until they are about to expire
+func ecrAuth(domain string) (types.AuthConfig, error) {
+	m := ecrHostRe.FindStringSubmatch(domain)
+	if m == nil {
+		return types.AuthConfig{}, _err("%s is not an ECR registry", domain)
+	}
+	account, region, suffix := m[1], m[2], m[3]
+	ecrCache.Lock()
+	defer ecrCache.Unlock()
+	if t, ok := ecrCache.tokens[domain]; ok && time.Until(t.expires) > ecrRefreshBefore {
+		return t.ac, nil
+	}
+	creds, err := currentAWSCredentials()
+	if err != nil {
+		return types.AuthConfig{}, _err("aws credentials error: %s", err.Error())
+	}
+	t, err := getAuthorizationToken(creds, account, region, suffix)
+	if err != nil {
+		return types.AuthConfig{}, _err("ECR token for %s error: %s", domain, err.Error())
+	}
+	t.ac.ServerAddress = domain
+	ecrCache.tokens[domain] = t
+	logrus.Infof("ECR token for %s obtained, valid until %s", domain, t.expires.Format(time.RFC3339))
+	return t.ac, nil
+}
+
+// ecr GetAuthorizationToken call of the registry account
+func getAuthorizationToken(creds *awsCredentials, account, region, suffix string) (ecrToken, error) {
+	body, _ := json.Marshal(map[string][]string{"registryIds": {account}})
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://api.ecr.%s.%s/", region, suffix), bytes.NewReader(body))
+	if err != nil {
+		return ecrToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+	signAWSRequest(req, body, creds, region, "ecr", time.Now())
+	resp, err := ecrClient.Do(req)
+	if err != nil {
+		return ecrToken{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ecrToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &e)
+		return ecrToken{}, _err("unexpected response status %s: %s %s", resp.Status, e.Type, e.Message)
+	}
+	var result struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return ecrToken{}, err
+	}
+	if len(result.AuthorizationData) == 0 {
+		return ecrToken{}, _err("no authorization data returned")
+	}
+	ad := result.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(ad.AuthorizationToken)
+	if err != nil {
+		return ecrToken{}, _err("decode authorization token error: %s", err.Error())
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return ecrToken{}, _err("invalid authorization token")
+	}
+	return ecrToken{
+		ac:      types.AuthConfig{Username: parts[0], Password: parts[1]},
+		expires: time.Unix(int64(ad.ExpiresAt), 0),
+	}, nil
+}
+
+// signature version 4 of a request with its body
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, sha256Hex(body),
+	}, "\n")
+	scope := strings.Join([]string{day, region, service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonical))}, "\n")
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// configured keys, or role credentials from ecs or ec2 metadata which are
+// cached until they are about to expire; ecrCache must be locked
+func currentAWSCredentials() (*awsCredentials, error) {
+	if config().AWSAccessKeyID != "" {
+		return &awsCredentials{AccessKeyID: config().AWSAccessKeyID, SecretAccessKey: config().AWSSecretAccessKey, Token: config().AWSSessionToken}, nil
+	}
+	if c := ecrCache.creds; c != nil && time.Until(c.Expiration) > ecrRefreshBefore {
+		return c, nil
+	}
+	var (
+		c   *awsCredentials
+		err error
+	)
+	if uri, full := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"), os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" || full != "" {
+		if full == "" {
+			full = ecsCredURL + uri
+		}
+		c, err = fetchAWSCredentials(full, map[string]string{"Authorization": os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")})
+	} else {
+		c, err = instanceRoleCredentials()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ecrCache.creds = c
+	return c, nil
+}
+
+// credentials of ec2 instance role, over metadata service v2
+func instanceRoleCredentials() (*awsCredentials, error) {
+	req, err := http.NewRequest("PUT", imdsURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := ecrClient.Do(req)
+	if err != nil {
+		return nil, _err("no configured AWS keys and instance metadata is unavailable: %s", err.Error())
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, _err("instance metadata token: unexpected response status %s", resp.Status)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	rolesURL := imdsURL + "/meta-data/iam/security-credentials/"
+	req, err = http.NewRequest("GET", rolesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	resp, err = ecrClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if resp.StatusCode != http.StatusOK || role == "" {
+		return nil, _err("no IAM role attached to the instance")
+	}
+	return fetchAWSCredentials(rolesURL+role, headers)
+}
+
+// credentials document of ecs or ec2 metadata
+func fetchAWSCredentials(url string, headers map[string]string) (*awsCredentials, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range headers {
+		if v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	resp, err := ecrClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, _err("role credentials: unexpected response status %s", resp.Status)
+	}
+	var c awsCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, _err("parse role credentials error: %s", err.Error())
+	}
+	if c.AccessKeyID == "" {
+		return nil, _err("no role credentials returned")
+	}
+	return &c, nil
+}
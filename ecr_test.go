@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// get-vanilla of the aws signature version 4 test suite
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("authorization\n%s\nwant\n%s", got, want)
+	}
+
+	creds.Token = "session-token"
+	signAWSRequest(req, nil, creds, "us-east-1", "service", time.Now())
+	if req.Header.Get("X-Amz-Security-Token") != "session-token" || !strings.Contains(req.Header.Get("Authorization"), "x-amz-security-token") {
+		t.Errorf("session token not signed: %s", req.Header.Get("Authorization"))
+	}
+}
+
+func TestECRAuth(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var ids map[string][]string
+		json.Unmarshal(body, &ids)
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		if r.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" || len(ids["registryIds"]) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if ids["registryIds"][0] == "999999999999" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "AccessDeniedException", "message": "not authorized"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"authorizationData": []map[string]interface{}{{
+			"authorizationToken": base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password")),
+			"expiresAt":          float64(time.Now().Add(12 * time.Hour).Unix()),
+		}}})
+	}))
+	defer srv.Close()
+	defer redirectClient(ecrClient, srv)()
+	defer withConfig(func(c *Config) {
+		c.ECRAuth, c.AWSAccessKeyID, c.AWSSecretAccessKey, c.AWSSessionToken = true, "AKIDEXAMPLE", "secret-key", ""
+		c.RegistryAuthFile, c.RegistryAuth = "", nil
+	})()
+	defer func() {
+		ecrCache.Lock()
+		ecrCache.tokens = make(map[string]ecrToken)
+		ecrCache.Unlock()
+	}()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests)
+	}
+
+	const registry = "123456789012.dkr.ecr.eu-west-1.amazonaws.com"
+	ac := decodedAuth(t, registry+"/app:1.0.1")
+	if ac.Username != "AWS" || ac.Password != "ecr-password" || ac.ServerAddress != registry {
+		t.Fatalf("ecr credentials: %+v", ac)
+	}
+	mu.Lock()
+	r := requests[0]
+	mu.Unlock()
+	if r.Host != "api.ecr.eu-west-1.amazonaws.com" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/ecr/aws4_request") {
+		t.Errorf("token request to %s, authorization %s", r.Host, r.Header.Get("Authorization"))
+	}
+	decodedAuth(t, registry+"/other:2")
+	if n := count(); n != 1 {
+		t.Errorf("%d token requests for a valid token, want 1", n)
+	}
+
+	// tokens about to expire are requested again
+	ecrCache.Lock()
+	tok := ecrCache.tokens[registry]
+	tok.expires = time.Now().Add(ecrRefreshBefore / 2)
+	ecrCache.tokens[registry] = tok
+	ecrCache.Unlock()
+	decodedAuth(t, registry+"/app:1.0.1")
+	if n := count(); n != 2 {
+		t.Errorf("%d token requests after the token expired, want 2", n)
+	}
+
+	if _, err := registryAuth("999999999999.dkr.ecr.eu-west-1.amazonaws.com/app:1"); err == nil || !strings.Contains(err.Error(), "AccessDeniedException") {
+		t.Errorf("denied token request: %v, want its error", err)
+	}
+	// not ecr hosts, only similar
+	for _, image := range []string{"123456789012.dkr.ecr.eu-west-1.amazonaws.com.example.com/app:1", "12345.dkr.ecr.eu-west-1.amazonaws.com/app:1"} {
+		if ac := decodedAuth(t, image); ac.Password != "" {
+			t.Errorf("ecr credentials sent to %s", image)
+		}
+	}
+}
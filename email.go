@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= EMAIL ======
+
+// how notifications are mailed
+const (
+	// one mail per notification
+	emailEvent = "event"
+	// notifications collected and mailed on cfg.EmailDigestSchedule
+	emailDigest = "digest"
+)
+
+// SMTP connection security
+const (
+	smtpStartTLS = "starttls"
+	// implicit TLS, usually port 465
+	smtpTLS  = "tls"
+	smtpNone = "none"
+)
+
+// notifications waiting for the next digest
+var digest = struct {
+	sync.Mutex
+	pending []notification
+}{}
+
+func emailEnabled() bool {
+	return config().SMTPHost != "" && len(config().EmailTo) > 0
+}
+
+// mails notification right away or keeps it for the digest
+func mailNotification(n notification) {
+	if !emailEnabled() {
+		return
+	}
+	if config().EmailMode == emailDigest {
+		digest.Lock()
+		digest.pending = append(digest.pending, n)
+		digest.Unlock()
+		return
+	}
+	go func() {
+		text, err := notificationText(n)
+		if err == nil {
+			err = sendMail(fmt.Sprintf("[docker-updater] %s:%s %s", n.Repo, n.Tag, n.Event), text)
+		}
+		if err != nil {
+			logrus.Errorf("email notification for %s:%s error: %s", n.Repo, n.Tag, err)
+		}
+	}()
+}
+
+func runDigests(schedules []pollSchedule) {
+	runSchedule("email digest", schedules, func(pollSchedule) {
+		if err := sendDigest(); err != nil {
+			logrus.Errorf("email digest error: %s", err)
+		}
+	})
+}
+
+// mails pending notifications, nothing when there are none; they are kept
+// for the next digest when sending fails
+func sendDigest() error {
+	digest.Lock()
+	pending := digest.pending
+	digest.pending = nil
+	digest.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	subject, body := digestText(pending)
+	if err := sendMail(subject, body); err != nil {
+		digest.Lock()
+		digest.pending = append(pending, digest.pending...)
+		digest.Unlock()
+		return err
+	}
+	logrus.Infof("email digest of %d notifications sent", len(pending))
+	return nil
+}
+
+// "3 containers updated, 1 failed" subject, one line per notification
+func digestText(pending []notification) (string, string) {
+	counts := make(map[string]int)
+	var body bytes.Buffer
+	for _, n := range pending {
+		switch n.Event {
+		case eventUpdated, eventStarted, eventObserved:
+			// containers of the update
+			counts[n.Event] += len(n.Containers)
+		default:
+			counts[n.Event]++
+		}
+		text, err := notificationText(n)
+		if err != nil {
+			text = err.Error()
+		}
+		fmt.Fprintf(&body, "%s %s\n", n.Time.In(config().WindowsTZ).Format("2006-01-02 15:04"), text)
+	}
+	var events []string
+	for event := range counts {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	var parts []string
+	for _, event := range events {
+		what := ""
+		switch event {
+		case eventUpdated, eventStarted, eventObserved:
+			what = "containers "
+			if counts[event] == 1 {
+				what = "container "
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%d %s%s", counts[event], what, event))
+	}
+	return "[docker-updater] " + strings.Join(parts, ", "), body.String()
+}
+
+func sendMail(subject, body string) error {
+	addr := net.JoinHostPort(config().SMTPHost, strconv.Itoa(config().SMTPPort))
+	tc := &tls.Config{ServerName: config().SMTPHost}
+	var c *smtp.Client
+	if config().SMTPSecurity == smtpTLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tc)
+		if err != nil {
+			return _err("connect to %s error: %s", addr, err.Error())
+		}
+		if c, err = smtp.NewClient(conn, config().SMTPHost); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+		if err != nil {
+			return _err("connect to %s error: %s", addr, err.Error())
+		}
+		if c, err = smtp.NewClient(conn, config().SMTPHost); err != nil {
+			conn.Close()
+			return err
+		}
+		if config().SMTPSecurity == smtpStartTLS {
+			if err := c.StartTLS(tc); err != nil {
+				c.Close()
+				return _err("STARTTLS error: %s", err.Error())
+			}
+		}
+	}
+	defer c.Close()
+	if config().SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", config().SMTPUsername, config().SMTPPassword, config().SMTPHost)); err != nil {
+			return _err("SMTP auth error: %s", err.Error())
+		}
+	}
+	if err := c.Mail(config().EmailFrom); err != nil {
+		return err
+	}
+	for _, to := range config().EmailTo {
+		if err := c.Rcpt(to); err != nil {
+			return _err("recipient %s: %s", to, err.Error())
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mailMessage(subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func mailMessage(subject, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config().EmailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config().EmailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return msg.Bytes()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+)
+
+// ======= UPDATE EVENTS ======
+
+// update event types
+const (
+	eventTypeStarted          = "update_started"
+	eventTypeMatched          = "containers_matched"
+	eventTypePullStarted      = "pull_started"
+	eventTypePullFinished     = "pull_finished"
+	eventTypeContainerRemoved = "container_removed"
+	eventTypeContainerCreated = "container_created"
+	eventTypeContainerStarted = "container_started"
+	eventTypeFinished         = "update_finished"
+	eventTypeFailed           = "update_failed"
+)
+
+// step of an update, repo is set from image when empty
+type updateEvent struct {
+	Type       string         `json:"type"`
+	Repo       string         `json:"repo,omitempty"`
+	Tag        string         `json:"tag,omitempty"`
+	Image      string         `json:"image,omitempty"`
+	Container  string         `json:"container,omitempty"`
+	Containers []containerRef `json:"containers,omitempty"`
+	Host       string         `json:"host,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Time       time.Time      `json:"time"`
+}
+
+var updateEvents = newEventHub()
+
+func emitEvent(e updateEvent) {
+	if e.Repo == "" && e.Image != "" {
+		e.Repo, _ = splitImage(e.Image)
+	}
+	e.Host, e.Time = currentHost, time.Now()
+	updateEvents.publish(e)
+}
+
+// event of container step, name without leading slash
+func emitContainerEvent(typ, name, image string) {
+	emitEvent(updateEvent{Type: typ, Container: strings.TrimPrefix(name, "/"), Image: image})
+}
+
+// update events stream call: GET /api/v1/events/ws[?repo=REPO], websocket
+// with an updateEvent JSON message per event (of repo) until client leaves
+func eventsWS(c echo.Context) error {
+	repo := c.QueryParam("repo")
+	if repo != "" {
+		repo = normalizeRepo(repo)
+	}
+	ws := websocket.Server{
+		// browsers' origin is not checked, API tokens guard the endpoint
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+			// incoming messages are ignored, reading detects disconnect
+			gone := make(chan struct{})
+			go func() {
+				defer close(gone)
+				var msg string
+				for websocket.Message.Receive(conn, &msg) == nil {
+				}
+			}()
+			ch := updateEvents.subscribe()
+			defer updateEvents.unsubscribe(ch)
+			for {
+				select {
+				case <-gone:
+					return
+				case e := <-ch:
+					ue, ok := e.(updateEvent)
+					if !ok || repo != "" && ue.Repo != repo {
+						continue
+					}
+					if err := websocket.JSON.Send(conn, ue); err != nil {
+						logrus.Debugf("send event to %s error: %s", c.RealIP(), err)
+						return
+					}
+				}
+			}
+		},
+	}
+	ws.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= GRPC API ======
+
+// Updater service of proto/updater.proto served by the API server over
+// HTTP/2 (TLS only, plain HTTP/2 is not supported by net/http): requests
+// and responses are length-prefixed protobuf messages, status is sent in
+// trailers. Messages are few and flat, so they are encoded by hand
+
+const grpcService = "/docker_updater.v1.Updater/"
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// error with gRPC status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// status of API errors, HTTP ones are mapped by code
+func grpcStatus(err error) (int, string) {
+	switch e := err.(type) {
+	case nil:
+		return grpcOK, ""
+	case *grpcError:
+		return e.code, e.msg
+	case *echo.HTTPError:
+		msg := e.Error()
+		if s, ok := e.Message.(string); ok {
+			msg = s
+		}
+		switch e.Code {
+		case http.StatusBadRequest:
+			return grpcInvalidArgument, msg
+		case http.StatusUnauthorized:
+			return grpcUnauthenticated, msg
+		case http.StatusForbidden:
+			return grpcPermissionDenied, msg
+		case http.StatusNotFound:
+			return grpcNotFound, msg
+		case http.StatusConflict:
+			return grpcFailedPrecondition, msg
+		case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+			return grpcResourceExhausted, msg
+		case http.StatusServiceUnavailable:
+			return grpcUnavailable, msg
+		}
+		return grpcInternal, msg
+	}
+	return grpcUnknown, err.Error()
+}
+
+// gRPC call: request message and stream of response messages
+type grpcCall struct {
+	c        echo.Context
+	req      pbMessage
+	deadline <-chan time.Time
+}
+
+// writes response message and flushes it to the client
+func (g *grpcCall) send(msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := g.c.Response().Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	g.c.Response().Flush()
+	return nil
+}
+
+// gRPC method handler, answered with given status
+type grpcMethod func(g *grpcCall) error
+
+func registerGRPC(e *echo.Echo, mw ...echo.MiddlewareFunc) {
+	for name, m := range map[string]grpcMethod{
+		"Update": grpcUpdate,
+		"Plan":   grpcPlan,
+		"GetJob": grpcGetJob,
+	} {
+		e.POST(grpcService+name, grpcHandler(m), append([]echo.MiddlewareFunc{grpcErrors}, mw...)...)
+	}
+	logrus.Infof("gRPC API enabled (%s*)", grpcService)
+}
+
+func isGRPC(req *http.Request) bool {
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// answers gRPC requests rejected by middleware in front of the methods
+// (allowed networks, rate limits) with the status only, as gRPC clients
+// don't read HTTP errors
+func grpcErrors(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil || c.Response().Committed || !isGRPC(c.Request()) {
+			return err
+		}
+		code, msg := grpcStatus(err)
+		h := c.Response().Header()
+		h.Set("Content-Type", "application/grpc")
+		h.Set("Grpc-Status", strconv.Itoa(code))
+		h.Set("Grpc-Message", url.PathEscape(msg))
+		c.Response().WriteHeader(http.StatusOK)
+		return nil
+	}
+}
+
+func grpcHandler(m grpcMethod) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !isGRPC(req) {
+			return _httpErr(http.StatusUnsupportedMediaType, "gRPC requests only (HTTP/2, application/grpc)")
+		}
+		h := c.Response().Header()
+		h.Set("Content-Type", "application/grpc")
+		h.Set("Trailer", "Grpc-Status, Grpc-Message")
+		c.Response().WriteHeader(http.StatusOK)
+		g := &grpcCall{c: c}
+		err := g.authorize()
+		if err == nil {
+			err = g.readRequest()
+		}
+		if err == nil {
+			if timeout, ok := grpcTimeout(req.Header.Get("Grpc-Timeout")); ok {
+				g.deadline = time.After(timeout)
+			}
+			err = m(g)
+		}
+		code, msg := grpcStatus(err)
+		if code != grpcOK {
+			logrus.Warnf("gRPC %s from %s failed: %s", req.URL.Path, c.RealIP(), msg)
+		}
+		h.Set("Grpc-Status", strconv.Itoa(code))
+		h.Set("Grpc-Message", url.PathEscape(msg))
+		return nil
+	}
+}
+
+// API token from authorization metadata, when API_TOKENS are set
+func (g *grpcCall) authorize() error {
+	if len(config().APITokens) == 0 {
+		return nil
+	}
+	name, ok := tokenName(strings.TrimPrefix(g.c.Request().Header.Get("Authorization"), "Bearer "))
+	if !ok {
+		return &grpcError{grpcUnauthenticated, "invalid or missing API token"}
+	}
+	g.c.Set(callerKey, name)
+	return nil
+}
+
+// single uncompressed request message
+func (g *grpcCall) readRequest() error {
+	body, err := ioutil.ReadAll(io.LimitReader(g.c.Request().Body, 1<<20))
+	if err != nil {
+		return &grpcError{grpcInternal, err.Error()}
+	}
+	if len(body) < 5 {
+		return &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if body[0] != 0 {
+		return &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	if int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return &grpcError{grpcInvalidArgument, "one request message expected"}
+	}
+	if g.req, err = parsePB(body[5:]); err != nil {
+		return &grpcError{grpcInvalidArgument, "malformed request message: " + err.Error()}
+	}
+	return nil
+}
+
+// grpc-timeout value, e.g. 30S or 500m
+func grpcTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	unit, ok := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}[v[len(v)-1]]
+	return time.Duration(n) * unit, ok
+}
+
+// Update: runs the update as GET /api/v1/update does
+func grpcUpdate(g *grpcCall) error {
+	repo, tag, host := g.req.str(1), g.req.str(2), g.req.str(3)
+	repo, tag = mapRepo(repo, tag)
+	opts := updateOptions{AllowDowngrade: g.req.boolean(4), Trace: requestSpan(g.c), Caller: caller(g.c), Trigger: triggerManual}
+	if err := checkRequest(repo, tag); err != nil {
+		return err
+	}
+	if err := checkHost(host); err != nil {
+		return err
+	}
+	if err := checkPaused(); err != nil {
+		return err
+	}
+	if err := checkForced(repo, host, opts); err != nil {
+		return err
+	}
+	if opts.AllowDowngrade {
+		logrus.WithFields(logrus.Fields{
+			"audit":  "downgrade",
+			"repo":   repo,
+			"tag":    tag,
+			"host":   host,
+			"caller": caller(g.c),
+			"ip":     clientIP(g.c),
+		}).Warn("forced downgrade requested")
+	}
+	if err := checkRepoRate(repo); err != nil {
+		return err
+	}
+	if inCooldown(repo, tag) {
+		return g.send(pbProgressStatus("cooldown, skipped", ""))
+	}
+	if p := holdForApproval(repo, tag, host, ""); p != nil {
+		return g.send(pbProgressStatus("waiting for approval", p.ID))
+	}
+	if deferUpdate(repo, tag, host) {
+		return g.send(pbProgressStatus(queuedStatus(repo), ""))
+	}
+	if !admitUpdate() {
+		return &grpcError{grpcUnavailable, "too many pending updates, retry later"}
+	}
+	events := updateEvents.subscribe()
+	defer updateEvents.unsubscribe(events)
+	type result struct {
+		summary *updateSummary
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer releaseUpdate()
+		summary, err := runUpdate(repo, tag, host, opts)
+		done <- result{summary, err}
+	}()
+	wanted := normalizeRepo(repo)
+	for {
+		select {
+		case e := <-events:
+			// events of a concurrent update of another tag are not ours
+			if ue, ok := e.(updateEvent); ok && normalizeRepo(ue.Repo) == wanted && (ue.Tag == "" || ue.Tag == tag) {
+				if err := g.send(pbProgressEvent(ue)); err != nil {
+					return &grpcError{grpcCanceled, "client gone, update continues"}
+				}
+			}
+		case r := <-done:
+			if r.summary == nil {
+				return r.err
+			}
+			return g.send(pbProgressSummary(r.summary))
+		case <-g.deadline:
+			return &grpcError{grpcDeadlineExceeded, "deadline exceeded, update continues"}
+		case <-g.c.Request().Context().Done():
+			return &grpcError{grpcCanceled, "client gone, update continues"}
+		}
+	}
+}
+
+// Plan: as GET /api/v1/update/plan without registry check
+func grpcPlan(g *grpcCall) error {
+	repo, tag, host := g.req.str(1), g.req.str(2), g.req.str(3)
+	repo, tag = mapRepo(repo, tag)
+	if err := checkRequest(repo, tag); err != nil {
+		return err
+	}
+	if err := checkHost(host); err != nil {
+		return err
+	}
+	res, err := planUpdate(repo, tag, host)
+	if err != nil {
+		return err
+	}
+	var b pbBuffer
+	b.str(1, res.Repo)
+	b.str(2, res.Tag)
+	for _, ref := range res.Containers {
+		b.msg(3, pbContainer(ref))
+	}
+	b.str(4, res.Pull)
+	return g.send(b)
+}
+
+// GetJob: as GET /api/v1/jobs/:id
+func grpcGetJob(g *grpcCall) error {
+	j, ok := getJob(g.req.str(1))
+	if !ok {
+		return &grpcError{grpcNotFound, "job " + g.req.str(1) + " not found"}
+	}
+	var b pbBuffer
+	b.str(1, j.ID)
+	b.str(2, j.Repo)
+	b.str(3, j.Tag)
+	b.str(4, j.Host)
+	b.str(5, j.Status)
+	b.str(6, j.Error)
+	b.msg(7, pbTimestamp(&j.CreatedAt))
+	b.msg(8, pbTimestamp(j.StartedAt))
+	b.msg(9, pbTimestamp(j.FinishedAt))
+	return g.send(b)
+}
+
+func pbProgressStatus(status, pendingID string) pbBuffer {
+	var b pbBuffer
+	b.str(3, status)
+	b.str(4, pendingID)
+	return b
+}
+
+func pbProgressEvent(e updateEvent) pbBuffer {
+	var ev pbBuffer
+	ev.str(1, e.Type)
+	ev.str(2, e.Repo)
+	ev.str(3, e.Tag)
+	ev.str(4, e.Image)
+	ev.str(5, e.Container)
+	for _, ref := range e.Containers {
+		ev.msg(6, pbContainer(ref))
+	}
+	ev.str(7, e.Host)
+	ev.str(8, e.Error)
+	ev.msg(9, pbTimestamp(&e.Time))
+	var b pbBuffer
+	b.msg(1, ev)
+	return b
+}
+
+func pbProgressSummary(s *updateSummary) pbBuffer {
+	var sum pbBuffer
+	sum.str(1, s.Repo)
+	sum.str(2, s.Tag)
+	sum.str(3, s.Host)
+	sum.varint(4, uint64(s.Matched))
+	sum.varint(5, uint64(s.Updated))
+	sum.varint(6, uint64(s.Skipped))
+	sum.varint(7, uint64(s.Failed))
+	for _, ref := range s.UpdatedContainers {
+		sum.msg(8, pbContainer(ref))
+	}
+	for _, r := range s.Containers {
+		var res pbBuffer
+		res.msg(1, pbContainer(r.containerRef))
+		res.str(2, r.OldImageID)
+		res.str(3, r.NewImageID)
+		res.str(4, r.Status)
+		res.str(5, r.Error)
+		sum.msg(9, res)
+	}
+	sum.double(10, s.PullDuration)
+	sum.double(11, s.Duration)
+	sum.str(12, s.Outcome)
+	sum.str(13, s.Error)
+	var b pbBuffer
+	b.msg(2, sum)
+	return b
+}
+
+func pbContainer(ref containerRef) pbBuffer {
+	var b pbBuffer
+	b.str(1, ref.ID)
+	b.str(2, ref.Name)
+	b.str(3, ref.Image)
+	b.str(4, ref.Health)
+	b.str(5, ref.Host)
+	return b
+}
+
+// google.protobuf.Timestamp, empty for nil
+func pbTimestamp(t *time.Time) pbBuffer {
+	var b pbBuffer
+	if t == nil || t.IsZero() {
+		return b
+	}
+	b.varint(1, uint64(t.Unix()))
+	b.varint(2, uint64(t.Nanosecond()))
+	return b
+}
+
+// ======= PROTOBUF ======
+
+// encoded message, proto3 defaults (empty, zero) are omitted
+type pbBuffer []byte
+
+func (b *pbBuffer) key(field, wireType int) {
+	*b = appendVarint(*b, uint64(field<<3|wireType))
+}
+
+func (b *pbBuffer) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, 0)
+	*b = appendVarint(*b, v)
+}
+
+func (b *pbBuffer) boolean(field int, v bool) {
+	if v {
+		b.varint(field, 1)
+	}
+}
+
+func (b *pbBuffer) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, 1)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	*b = append(*b, buf[:]...)
+}
+
+func (b *pbBuffer) bytes(field int, v []byte) {
+	b.key(field, 2)
+	*b = appendVarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *pbBuffer) str(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// embedded message, set even when empty unless nil
+func (b *pbBuffer) msg(field int, m pbBuffer) {
+	if m != nil {
+		b.bytes(field, m)
+	}
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// decoded message: last varint or length-delimited value by field number
+type pbMessage map[int]pbValue
+
+type pbValue struct {
+	n uint64
+	b []byte
+}
+
+func (m pbMessage) str(field int) string {
+	return string(m[field].b)
+}
+
+func (m pbMessage) boolean(field int) bool {
+	return m[field].n != 0
+}
+
+func parsePB(data []byte) (pbMessage, error) {
+	m := make(pbMessage)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, _err("invalid field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, _err("invalid varint of field %d", field)
+			}
+			m[field], data = pbValue{n: v}, data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, _err("truncated field %d", field)
+			}
+			m[field], data = pbValue{n: binary.LittleEndian.Uint64(data)}, data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return nil, _err("truncated field %d", field)
+			}
+			m[field], data = pbValue{b: data[n : n+int(l)]}, data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return nil, _err("truncated field %d", field)
+			}
+			m[field], data = pbValue{n: uint64(binary.LittleEndian.Uint32(data))}, data[4:]
+		default:
+			return nil, _err("unsupported wire type of field %d", field)
+		}
+	}
+	return m, nil
+}
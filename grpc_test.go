@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// length-prefixed gRPC frame of msg
+func grpcFrame(flags byte, msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// posts body to gRPC method of e, from remote address
+func grpcRequest(e *echo.Echo, method, remote string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, grpcService+method, bytes.NewReader(body))
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.RemoteAddr = remote
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// gRPC status of response, from trailers or a trailers-only response
+func grpcCode(t *testing.T, rec *httptest.ResponseRecorder) int {
+	res := rec.Result()
+	v := res.Trailer.Get("Grpc-Status")
+	if v == "" {
+		v = res.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		t.Fatalf("no gRPC status (HTTP %d, %q)", res.StatusCode, rec.Body.String())
+	}
+	return code
+}
+
+func TestPBRoundTrip(t *testing.T) {
+	var inner pbBuffer
+	inner.str(1, "app-1")
+	var b pbBuffer
+	b.str(1, "org/app")
+	b.varint(2, 300)
+	b.boolean(3, true)
+	b.double(4, 2.5)
+	b.msg(5, inner)
+	b.msg(6, pbBuffer{})
+	// defaults are omitted
+	b.str(7, "")
+	b.varint(8, 0)
+	b.boolean(9, false)
+	b.double(10, 0)
+	b.msg(11, nil)
+
+	m, err := parsePB(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.str(1) != "org/app" || m[2].n != 300 || !m.boolean(3) || math.Float64frombits(m[4].n) != 2.5 {
+		t.Errorf("decoded %+v", m)
+	}
+	nested, err := parsePB(m[5].b)
+	if err != nil || nested.str(1) != "app-1" {
+		t.Errorf("nested message %+v, %v", nested, err)
+	}
+	if v, ok := m[6]; !ok || len(v.b) != 0 {
+		t.Errorf("empty message not kept: %+v", m)
+	}
+	for field := 7; field <= 11; field++ {
+		if _, ok := m[field]; ok {
+			t.Errorf("default of field %d encoded", field)
+		}
+	}
+
+	// fixed32 of other encoders and repeated fields, the last one wins
+	fixed := append(pbBuffer{}, 5<<3|5, 1, 0, 0, 0)
+	fixed.str(1, "first")
+	fixed.str(1, "last")
+	if m, err := parsePB(fixed); err != nil || m[5].n != 1 || m.str(1) != "last" {
+		t.Errorf("decoded %+v, %v", m, err)
+	}
+}
+
+func TestParsePBMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"truncated key":     {0x80},
+		"truncated varint":  {1 << 3, 0x80},
+		"truncated fixed64": {1<<3 | 1, 0, 0},
+		"truncated bytes":   {1<<3 | 2, 5, 'a'},
+		"truncated fixed32": {1<<3 | 5, 0},
+		"start group":       {1<<3 | 3},
+	} {
+		if _, err := parsePB(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestGRPCFraming(t *testing.T) {
+	e := echo.New()
+	e.POST(grpcService+"Echo", grpcHandler(func(g *grpcCall) error {
+		var b pbBuffer
+		b.str(1, g.req.str(1))
+		if err := g.send(b); err != nil {
+			return err
+		}
+		return g.send(b)
+	}), grpcErrors)
+	var msg pbBuffer
+	msg.str(1, "hello")
+
+	rec := grpcRequest(e, "Echo", "192.0.2.1:1234", grpcFrame(0, msg))
+	if code := grpcCode(t, rec); code != grpcOK {
+		t.Fatalf("status %d: %s", code, rec.Result().Trailer.Get("Grpc-Message"))
+	}
+	body := rec.Body.Bytes()
+	for n := 0; n < 2; n++ {
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(msg) {
+			t.Fatalf("response message %d frame % x", n, body)
+		}
+		if m, err := parsePB(body[5 : 5+len(msg)]); err != nil || m.str(1) != "hello" {
+			t.Errorf("response message %d: %+v, %v", n, m, err)
+		}
+		body = body[5+len(msg):]
+	}
+	if len(body) != 0 {
+		t.Errorf("trailing response bytes % x", body)
+	}
+
+	for _, tc := range []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{"empty", nil, grpcInvalidArgument},
+		{"short prefix", []byte{0, 0, 0}, grpcInvalidArgument},
+		{"compressed", grpcFrame(1, msg), grpcUnimplemented},
+		{"two messages", append(grpcFrame(0, msg), grpcFrame(0, msg)...), grpcInvalidArgument},
+		{"short message", grpcFrame(0, msg)[:len(msg)+3], grpcInvalidArgument},
+		{"malformed message", grpcFrame(0, []byte{1<<3 | 2, 9}), grpcInvalidArgument},
+	} {
+		if code := grpcCode(t, grpcRequest(e, "Echo", "192.0.2.1:1234", tc.body)); code != tc.code {
+			t.Errorf("%s: status %d, want %d", tc.name, code, tc.code)
+		}
+	}
+
+	// plain HTTP requests get HTTP errors
+	req := httptest.NewRequest(http.MethodPost, grpcService+"Echo", bytes.NewReader(grpcFrame(0, msg)))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("HTTP/1.1 request: HTTP %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestGRPCUpdateGuards(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	defer withConfig(func(c *Config) {
+		c.WebhookAllowedNets = []*net.IPNet{allowed}
+		c.TrustProxyHeaders = false
+		c.RateLimit, c.IPRateLimit, c.RateLimitBurst = 0, 0.001, 1
+		c.MaxBodySize = 64
+		c.APITokens = nil
+	})()
+	e := echo.New()
+	registerGRPC(e, updateGuards()...)
+	var req pbBuffer
+	req.str(1, "no-such-job")
+	frame := grpcFrame(0, req)
+
+	if code := grpcCode(t, grpcRequest(e, "GetJob", "192.0.2.1:1234", frame)); code != grpcPermissionDenied {
+		t.Errorf("request out of allowed networks: status %d, want %d", code, grpcPermissionDenied)
+	}
+	if code := grpcCode(t, grpcRequest(e, "GetJob", "10.0.0.1:1234", frame)); code != grpcNotFound {
+		t.Errorf("allowed request: status %d, want %d", code, grpcNotFound)
+	}
+	if code := grpcCode(t, grpcRequest(e, "GetJob", "10.0.0.1:1234", frame)); code != grpcResourceExhausted {
+		t.Errorf("request over the rate limit: status %d, want %d", code, grpcResourceExhausted)
+	}
+	if code := grpcCode(t, grpcRequest(e, "GetJob", "10.0.0.2:1234", grpcFrame(0, make([]byte, 100)))); code != grpcResourceExhausted {
+		t.Errorf("request over max body size: status %d, want %d", code, grpcResourceExhausted)
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for v, want := range map[string]time.Duration{
+		"30S": 30 * time.Second, "500m": 500 * time.Millisecond, "2H": 2 * time.Hour,
+		"1M": time.Minute, "10u": 10 * time.Microsecond, "7n": 7 * time.Nanosecond,
+	} {
+		if got, ok := grpcTimeout(v); !ok || got != want {
+			t.Errorf("grpcTimeout(%q) = %v, %v, want %v", v, got, ok, want)
+		}
+	}
+	for _, v := range []string{"", "S", "10", "-1S", "10x"} {
+		if _, ok := grpcTimeout(v); ok {
+			t.Errorf("grpcTimeout(%q) accepted", v)
+		}
+	}
+}
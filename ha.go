@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ======= HIGH AVAILABILITY ======
+
+// replicas sharing cfg.HARedisURL run each update (and rollback) of a repo
+// under a lease, so only one of them runs it at a time; the replica holding
+// the leader lease alone runs registry polls, image retention, pruning and
+// the telegram bot, the other one stays hot standby serving the API. Jobs
+// and history are kept in redis, so both replicas report them all
+
+// lease values are compared before renewal and release, a replica never
+// drops a lease another one took over
+const (
+	leaseRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`
+	leaseReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+)
+
+// unfinished jobs are kept this long, plus cfg.JobRetention
+const haJobTTL = 24 * time.Hour
+
+var ha = struct {
+	sync.Mutex
+	redis *redisClient
+	// lease value of this replica
+	id     string
+	leader bool
+}{}
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "docker_updater_leader",
+	Help: "1 while the replica holds the leader lease (always without HA).",
+})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// connects to cfg.HARedisURL and starts leader election, nothing without it
+func setupHA() error {
+	if config().HARedisURL == "" {
+		leaderGauge.Set(1)
+		return nil
+	}
+	client, err := newRedisClient(config().HARedisURL)
+	if err != nil {
+		return err
+	}
+	if _, err := client.do("PING"); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	ha.redis, ha.id = client, host+"-"+hex.EncodeToString(b)
+	logrus.Infof("high availability: replica %s, leases of %s in redis %s", ha.id, config().HALeaseTTL, client.addr)
+	go runLeaderElection(config().HALeaseTTL / 3)
+	return nil
+}
+
+func haEnabled() bool {
+	return ha.redis != nil
+}
+
+func haKey(parts ...string) string {
+	return config().HAKeyPrefix + strings.Join(parts, ":")
+}
+
+// whether this replica runs background work: the leader, or any without HA
+func isLeader() bool {
+	if !haEnabled() {
+		return true
+	}
+	ha.Lock()
+	defer ha.Unlock()
+	return ha.leader
+}
+
+func ttlMillis() string {
+	return strconv.FormatInt(int64(config().HALeaseTTL/time.Millisecond), 10)
+}
+
+// takes lease unless another replica holds it
+func takeLease(key string) (bool, error) {
+	reply, err := ha.redis.do("SET", key, ha.id, "NX", "PX", ttlMillis())
+	return reply == "OK", err
+}
+
+// extends lease while this replica holds it
+func renewLease(key string) (bool, error) {
+	reply, err := ha.redis.do("EVAL", leaseRenewScript, "1", key, ha.id, ttlMillis())
+	return reply == int64(1), err
+}
+
+func releaseLease(key string) {
+	if _, err := ha.redis.do("EVAL", leaseReleaseScript, "1", key, ha.id); err != nil {
+		logrus.Warnf("release lease %s error: %s", key, err)
+	}
+}
+
+// holds the leader lease while it can, renewing it every interval
+func runLeaderElection(every time.Duration) {
+	key := haKey("leader")
+	for {
+		leader := isLeader()
+		var ok bool
+		var err error
+		if leader {
+			ok, err = renewLease(key)
+		} else {
+			ok, err = takeLease(key)
+		}
+		if err != nil {
+			logrus.Errorf("leader lease error: %s", err)
+		}
+		switch {
+		case ok && !leader:
+			logrus.Warnf("replica %s is the leader now", ha.id)
+		case !ok && leader:
+			logrus.Warnf("replica %s lost the leader lease, standing by", ha.id)
+		}
+		ha.Lock()
+		ha.leader = ok
+		ha.Unlock()
+		if ok {
+			leaderGauge.Set(1)
+		} else {
+			leaderGauge.Set(0)
+		}
+		time.Sleep(every)
+	}
+}
+
+// hands leadership over on shutdown
+func resignLeader() {
+	if !isLeader() || !haEnabled() {
+		return
+	}
+	ha.Lock()
+	ha.leader = false
+	ha.Unlock()
+	releaseLease(haKey("leader"))
+}
+
+// waits up to cfg.HALockWait for repo's lease, held (renewed) until the
+// returned release is called; the returned context is canceled once the
+// lease is lost, so the update stops before replacing more containers.
+// A no-op without HA
+func lockRepoLease(repo string) (context.Context, func(), error) {
+	if !haEnabled() {
+		return ctx, func() {}, nil
+	}
+	key := haKey("lock", repo)
+	deadline := time.Now().Add(config().HALockWait)
+	for waiting := false; ; waiting = true {
+		ok, err := takeLease(key)
+		if err != nil {
+			return nil, nil, _err("lock repo %s error: %s", repo, err.Error())
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, _err("repo %s is still being updated by another replica after %v, giving up", repo, config().HALockWait)
+		}
+		if !waiting {
+			logrus.Infof("repo %s is being updated by another replica, waiting for it to finish...", repo)
+		}
+		time.Sleep(time.Second)
+	}
+	leaseCtx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(config().HALeaseTTL / 3)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				if ok, err := renewLease(key); !ok {
+					logrus.Errorf("lease of repo %s lost (%v), another replica may update it, update stopped", repo, err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return leaseCtx, func() {
+		close(stop)
+		cancel()
+		releaseLease(key)
+	}, nil
+}
+
+// error once the update may not replace more containers, its repo lease
+// being lost; checked before each container (or batch) is replaced
+func (s *updateSummary) stopped() error {
+	if s.ctx == nil || s.ctx.Err() == nil {
+		return nil
+	}
+	return _err("update of repo %s stopped, its repo lease was lost", s.Repo)
+}
+
+// stores job snapshot for all replicas
+func haSaveJob(j job) {
+	if !haEnabled() {
+		return
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return
+	}
+	ttl := config().JobRetention + haJobTTL
+	if j.FinishedAt != nil {
+		ttl = config().JobRetention
+	}
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	if _, err = ha.redis.do("SET", haKey("job", j.ID), string(data), "PX", ms); err == nil {
+		_, err = ha.redis.do("ZADD", haKey("jobs"), strconv.FormatInt(j.CreatedAt.UnixNano(), 10), j.ID)
+	}
+	if err != nil {
+		logrus.Warnf("store job %s error: %s", j.ID, err)
+	}
+}
+
+func haJob(id string) (job, bool) {
+	reply, err := ha.redis.do("GET", haKey("job", id))
+	if err != nil {
+		logrus.Warnf("get job %s error: %s", id, err)
+	}
+	var j job
+	data, ok := reply.(string)
+	return j, ok && json.Unmarshal([]byte(data), &j) == nil
+}
+
+// jobs of all replicas, newest first; expired ones are dropped from the
+// index
+func haJobs() ([]job, error) {
+	reply, err := ha.redis.do("ZREVRANGE", haKey("jobs"), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	ids := redisStrings(reply)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = haKey("job", id)
+	}
+	if reply, err = ha.redis.do(append([]string{"MGET"}, keys...)...); err != nil {
+		return nil, err
+	}
+	var list []job
+	var expired []string
+	for i, data := range redisStrings(reply) {
+		var j job
+		if data == "" || json.Unmarshal([]byte(data), &j) != nil {
+			expired = append(expired, ids[i])
+			continue
+		}
+		list = append(list, j)
+	}
+	if len(expired) > 0 {
+		ha.redis.do(append([]string{"ZREM", haKey("jobs")}, expired...)...)
+	}
+	return list, nil
+}
+
+// appends entry to the shared history, latest cfg.HistorySize are kept
+func haRecordHistory(e historyEntry) {
+	if !haEnabled() {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	key := haKey("history")
+	if _, err = ha.redis.do("RPUSH", key, string(data)); err == nil {
+		_, err = ha.redis.do("LTRIM", key, strconv.Itoa(-config().HistorySize), "-1")
+	}
+	if err != nil {
+		logrus.Warnf("store history entry error: %s", err)
+	}
+}
+
+// shared history, oldest first
+func haHistory() ([]historyEntry, error) {
+	reply, err := ha.redis.do("LRANGE", haKey("history"), "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	var list []historyEntry
+	for _, data := range redisStrings(reply) {
+		var e historyEntry
+		if json.Unmarshal([]byte(data), &e) == nil {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
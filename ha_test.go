@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redis serving the lease commands of replicas
+type fakeRedis struct {
+	sync.Mutex
+	ln   net.Listener
+	keys map[string]string
+}
+
+func newFakeRedis(t *testing.T) (*fakeRedis, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{ln: ln, keys: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	client, err := newRedisClient("redis://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := ha.redis
+	ha.redis, ha.id = client, "replica-a"
+	return r, func() {
+		ha.redis = prev
+		client.close()
+		ln.Close()
+	}
+}
+
+// gives lease key to another replica
+func (r *fakeRedis) set(key, id string) {
+	r.Lock()
+	defer r.Unlock()
+	r.keys[key] = id
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readRESP(br)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, r.reply(args))
+	}
+}
+
+func readRESP(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) reply(args []string) string {
+	r.Lock()
+	defer r.Unlock()
+	switch {
+	case args[0] == "PING":
+		return "+PONG\r\n"
+	case args[0] == "SET" && len(args) > 3 && args[3] == "NX":
+		if _, ok := r.keys[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		r.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case args[0] == "EVAL":
+		// renewal and release both require the lease to be ours
+		key, id := args[3], args[4]
+		if r.keys[key] != id {
+			return ":0\r\n"
+		}
+		if args[1] == leaseReleaseScript {
+			delete(r.keys, key)
+		}
+		return ":1\r\n"
+	}
+	return "+OK\r\n"
+}
+
+func TestRepoLeaseWaitBounded(t *testing.T) {
+	r, restore := newFakeRedis(t)
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.HALeaseTTL, c.HALockWait, c.HAKeyPrefix = 3*time.Second, time.Second, "test:"
+	})()
+	r.set(haKey("lock", "org/app"), "replica-b")
+
+	start := time.Now()
+	if _, _, err := lockRepoLease("org/app"); err == nil {
+		t.Fatal("lease of another replica taken")
+	}
+	if waited := time.Since(start); waited > 3*time.Second {
+		t.Errorf("waited %v for the lease, HA_LOCK_WAIT is %v", waited, config().HALockWait)
+	}
+}
+
+func TestRepoLeaseLostStopsUpdate(t *testing.T) {
+	r, restore := newFakeRedis(t)
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.HALeaseTTL, c.HALockWait, c.HAKeyPrefix = 3*time.Second, time.Second, "test:"
+	})()
+	leaseCtx, release, err := lockRepoLease("org/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if leaseCtx.Err() != nil {
+		t.Fatal("lease context done right away")
+	}
+	// lease expired and another replica took it over
+	r.set(haKey("lock", "org/app"), "replica-b")
+	select {
+	case <-leaseCtx.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("lease context not canceled once renewal failed")
+	}
+
+	for _, strategy := range []string{strategyRecreate, strategyStartFirst} {
+		t.Run(strategy, func(t *testing.T) {
+			f, restoreDocker := newFakeDocker(t)
+			defer restoreDocker()
+			defer withConfig(func(c *Config) {
+				c.UpdateStrategy, c.RepoUpdateStrategy = strategy, nil
+			})()
+			f.addContainer("app-1", "org/app:1.0.0", nil)
+			f.addContainer("app-2", "org/app:1.0.0", nil)
+			f.pushImage("org/app:1.0.1", nil)
+
+			if _, err := updateContainer("org/app", "1.0.1", updateOptions{Ctx: leaseCtx}); err == nil {
+				t.Error("update went on after its lease was lost")
+			}
+			if calls := f.recorded("stop", "remove", "create"); len(calls) > 0 {
+				t.Errorf("containers replaced without the lease: %v", calls)
+			}
+		})
+	}
+
+	// with the lease held the update goes on
+	f, restoreDocker := newFakeDocker(t)
+	defer restoreDocker()
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	f.pushImage("org/app:1.0.1", nil)
+	if _, err := updateContainer("org/app", "1.0.1", updateOptions{Ctx: context.Background()}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= HEALTH ======
+
+// what to do when recreated container is not healthy in time
+const (
+	// keep new container running, warn
+	healthKeep = "keep"
+	// restore previous container
+	healthRollback = "rollback"
+)
+
+// what to roll back when a container failed
+const (
+	// only the failed container
+	rollbackModeContainer = "container"
+	// all containers recreated by the update
+	rollbackModeAll = "all"
+)
+
+// health wait outcomes
+const (
+	healthNone      = "none"
+	healthOK        = "healthy"
+	healthUnhealthy = "unhealthy"
+	healthExited    = "exited"
+	healthTimeout   = "timeout"
+)
+
+const healthPollInterval = 2 * time.Second
+
+// polls container until it reports health status or timeout expires,
+// container without healthcheck must keep running until timeout
+func waitHealthy(id string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return "", _err("inspect container %s error: %s", id, err.Error())
+		}
+		switch {
+		case inspect.State == nil:
+		// crash loop under restart policy counts as exited too
+		case !inspect.State.Running, inspect.State.Restarting, inspect.RestartCount > 0:
+			return healthExited, nil
+		case inspect.State.Health == nil:
+			if time.Now().After(deadline) {
+				return healthNone, nil
+			}
+		case inspect.State.Health.Status == types.Healthy:
+			return healthOK, nil
+		case inspect.State.Health.Status == types.Unhealthy:
+			return healthUnhealthy, nil
+		}
+		if time.Now().After(deadline) {
+			return healthTimeout, nil
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
+// waits for recreated container health when configured for repo and applies
+// the repo's timeout action, returns health status (empty when not waited)
+// and error when container was rolled back
+func checkHealth(repo string, prev, created types.ContainerJSON) (string, error) {
+	wait, action := config().healthWait(repo), config().healthTimeoutAction(repo)
+	if wait <= 0 {
+		return "", nil
+	}
+	name := strings.TrimPrefix(created.Name, "/")
+	logrus.Infof("waiting up to %v for container %s to become healthy...", wait, name)
+	status, err := waitHealthy(created.ID, wait)
+	if err != nil {
+		return "", err
+	}
+	switch status {
+	case healthOK, healthNone:
+		logrus.Infof("container %s health: %s", name, status)
+		return status, nil
+	}
+	if action == healthKeep {
+		logrus.Warnf("container %s health: %s, keeping it running (%s action)", name, status, action)
+		return status, nil
+	}
+	logrus.Warnf("container %s health: %s, rolling back (%s action)", name, status, action)
+	if err := rollbackContainer(prev, created.ID); err != nil {
+		return status, _err("container %s is %s, rollback error: %s", name, status, err.Error())
+	}
+	return status, _err("container %s is %s, rolled back to previous image", name, status)
+}
+
+// replaces container newID (if any) with one recreated from prev inspect data
+func rollbackContainer(prev types.ContainerJSON, newID string) error {
+	if newID != "" {
+		if err := cli.ContainerRemove(ctx, newID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			return _err("remove container %s error: %s", newID, err.Error())
+		}
+	}
+	contConfig := *prev.Config
+	// previous tag could be moved to the new image (e.g. latest)
+	if img, _, err := cli.ImageInspectWithRaw(ctx, contConfig.Image); err != nil || img.ID != prev.Image {
+		contConfig.Image = prev.Image
+	}
+	restored, err := createContainer(&contConfig, prev)
+	if err != nil {
+		return _err("create previous container error: %s", err.Error())
+	}
+	if isRunning(prev) {
+		if err := cli.ContainerStart(ctx, restored, types.ContainerStartOptions{}); err != nil {
+			return _err("start previous container error: %s", err.Error())
+		}
+	}
+	logrus.Infof("container %s rolled back to image %s", strings.TrimPrefix(prev.Name, "/"), contConfig.Image)
+	return nil
+}
+
+// previous container and the one replacing it, if created
+type recreatedContainer struct {
+	prev  types.ContainerJSON
+	newID string
+}
+
+// removed containers not recreated yet
+func removedContainers(inspects []types.ContainerJSON) []recreatedContainer {
+	var removed []recreatedContainer
+	for _, inspect := range inspects {
+		removed = append(removed, recreatedContainer{prev: inspect})
+	}
+	return removed
+}
+
+// in ROLLBACK_MODE=all (or for a dependency group) restores previous
+// containers of all recreated ones after update failed with err, returns err
+// with rollback outcome
+func rollbackAll(recreated []recreatedContainer, summary *updateSummary, err error) error {
+	if !summary.allOrNothing() || len(recreated) == 0 {
+		return err
+	}
+	mode := config().RollbackMode + " rollback mode"
+	if config().RollbackMode != rollbackModeAll {
+		mode = "dependency group"
+	}
+	logrus.Warnf("%s, rolling back %d containers (%s)...", err, len(recreated), mode)
+	var errs []string
+	for _, r := range recreated {
+		if rErr := rollbackContainer(r.prev, r.newID); rErr != nil {
+			logrus.Errorf("rollback container %s error: %s", strings.TrimPrefix(r.prev.Name, "/"), rErr)
+			errs = append(errs, rErr.Error())
+		}
+	}
+	summary.Updated, summary.UpdatedContainers = 0, []containerRef{}
+	for i := range summary.Containers {
+		if summary.Containers[i].Status == containerUpdated {
+			summary.Containers[i].Status = containerRolledBack
+		}
+	}
+	if len(errs) > 0 {
+		return _err("%s, rollback error: %s", err, strings.Join(errs, "; "))
+	}
+	return _err("%s, all containers rolled back to previous image", err)
+}
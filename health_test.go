@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestHealthTimeoutAction(t *testing.T) {
+	for _, tc := range []struct {
+		action   string
+		updated  bool
+		imageOld bool
+	}{
+		{healthKeep, true, false},
+		{healthRollback, false, true},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			defer withConfig(func(c *Config) {
+				// over at the first health poll
+				c.HealthWait, c.RepoHealthWait = time.Nanosecond, nil
+				c.HealthTimeoutAction, c.RepoHealthTimeoutAction = healthKeep, map[string]string{"org/app": tc.action}
+			})()
+			old := f.addContainer("app-1", "org/app:1.0.0", nil)
+			pushed := f.pushImage("org/app:1.0.1", nil)
+			// never gets healthy
+			f.health[pushed.ID] = types.Starting
+
+			summary, err := updateContainer("org/app", "1.0.1", updateOptions{})
+			if tc.updated != (err == nil) {
+				t.Fatalf("update error = %v", err)
+			}
+			if tc.updated && (summary.Updated != 1 || summary.UpdatedContainers[0].Health != healthTimeout) {
+				t.Errorf("updated containers = %+v, want app-1 kept with %s health", summary.UpdatedContainers, healthTimeout)
+			}
+			if !tc.updated && summary.Failed != 1 {
+				t.Errorf("failed = %d, want 1", summary.Failed)
+			}
+			c := f.container("app-1")
+			if c == nil || !c.State.Running {
+				t.Fatalf("app-1 not running after %s: %+v", tc.action, c)
+			}
+			if imageOld := c.Image == old.Image; imageOld != tc.imageOld {
+				t.Errorf("app-1 runs image %s, previous %s, new %s", c.Image, old.Image, pushed.ID)
+			}
+		})
+	}
+}
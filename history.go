@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= UPDATE HISTORY ======
+
+// single update attempt
+type historyEntry struct {
+	Repo    string   `json:"repo"`
+	Tag     string   `json:"tag"`
+	OldTags []string `json:"old_tags"`
+	// containers (or services) running the new image
+	Containers []containerRef `json:"containers"`
+	Matched    int            `json:"matched"`
+	Updated    int            `json:"updated"`
+	Failed     int            `json:"failed"`
+	Outcome    string         `json:"outcome"`
+	Downgrade  bool           `json:"downgrade,omitempty"`
+	Caller     string         `json:"caller,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+}
+
+// latest cfg.HistorySize entries, oldest first; all of them are appended to
+// cfg.HistoryFile (JSON lines) when set, which is compacted once it holds
+// twice as many
+var history = struct {
+	sync.Mutex
+	list []historyEntry
+	// entries in file
+	lines int
+}{}
+
+// reads entries kept in history file, broken lines are skipped
+func loadHistory() error {
+	if config().HistoryFile == "" {
+		return nil
+	}
+	f, err := os.Open(config().HistoryFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	history.Lock()
+	defer history.Unlock()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		history.lines++
+		var e historyEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			logrus.Warnf("history file %s line %d skipped: %s", config().HistoryFile, history.lines, err)
+			continue
+		}
+		history.list = append(history.list, e)
+	}
+	if len(history.list) > config().HistorySize {
+		history.list = history.list[len(history.list)-config().HistorySize:]
+	}
+	logrus.Infof("%d history entries loaded from %s", len(history.list), config().HistoryFile)
+	return sc.Err()
+}
+
+func recordHistory(summary *updateSummary, err error) {
+	e := historyEntry{
+		Repo:       summary.Repo,
+		Tag:        summary.Tag,
+		OldTags:    []string{},
+		Containers: summary.UpdatedContainers,
+		Matched:    summary.Matched,
+		Updated:    summary.Updated,
+		Failed:     summary.Failed,
+		Outcome:    summary.outcome(err),
+		Downgrade:  summary.AllowDowngrade,
+		Caller:     summary.caller,
+		StartedAt:  summary.Start,
+		FinishedAt: time.Now(),
+	}
+	for t := range summary.OldTags {
+		e.OldTags = append(e.OldTags, t)
+	}
+	sort.Strings(e.OldTags)
+	if err != nil {
+		e.Error = err.Error()
+		e.Failed = summary.Matched - summary.Updated
+	}
+	auditUpdate(summary, err)
+	haRecordHistory(e)
+	history.Lock()
+	defer history.Unlock()
+	history.list = append(history.list, e)
+	if len(history.list) > config().HistorySize {
+		history.list = history.list[len(history.list)-config().HistorySize:]
+	}
+	if config().HistoryFile == "" {
+		return
+	}
+	var wErr error
+	if history.lines >= 2*config().HistorySize {
+		wErr = writeHistory(history.list, os.O_TRUNC)
+		history.lines = len(history.list)
+	} else {
+		wErr = writeHistory([]historyEntry{e}, os.O_APPEND)
+		history.lines++
+	}
+	if wErr != nil {
+		logrus.Errorf("write history file %s error: %s", config().HistoryFile, wErr)
+	}
+}
+
+// appends entries to or (with os.O_TRUNC) replaces history file content
+func writeHistory(entries []historyEntry, mode int) error {
+	f, err := os.OpenFile(config().HistoryFile, os.O_CREATE|os.O_WRONLY|mode, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// history entries, of all replicas with HA, oldest first
+func historyEntries() []historyEntry {
+	if haEnabled() {
+		shared, err := haHistory()
+		if err == nil {
+			return shared
+		}
+		logrus.Warnf("get shared history error: %s, using local one", err)
+	}
+	history.Lock()
+	defer history.Unlock()
+	return append([]historyEntry(nil), history.list...)
+}
+
+// history call: GET /api/v1/history[?repo=REPO][&since=RFC3339][&until=RFC3339],
+// newest first
+func listHistory(c echo.Context) error {
+	repo := c.QueryParam("repo")
+	var since, until time.Time
+	var err error
+	if v := c.QueryParam("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return _httpErr(http.StatusBadRequest, "invalid since %q, RFC 3339 time expected", v)
+		}
+	}
+	if v := c.QueryParam("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			return _httpErr(http.StatusBadRequest, "invalid until %q, RFC 3339 time expected", v)
+		}
+	}
+	list := []historyEntry{}
+	entries := historyEntries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if (repo == "" || e.Repo == repo) && (since.IsZero() || !e.StartedAt.Before(since)) &&
+			(until.IsZero() || e.StartedAt.Before(until)) {
+			list = append(list, e)
+		}
+	}
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= HOOKS ======
+
+const (
+	labelPreUpdate  = "docker-updater.pre-update"
+	labelPostUpdate = "docker-updater.post-update"
+	labelDrain      = "docker-updater.drain"
+	labelRegister   = "docker-updater.register"
+)
+
+const (
+	hookPre  = "pre-update"
+	hookPost = "post-update"
+	// take old container out of its load balancer before it is stopped
+	hookDrain = "drain"
+	// put new container (or the kept old one) back in
+	hookRegister = "register"
+)
+
+// labels setting host commands, never taken from images
+var hookLabels = []string{labelPreUpdate, labelPostUpdate, labelDrain, labelRegister}
+
+func isHookLabel(name string) bool {
+	for _, label := range hookLabels {
+		if name == label {
+			return true
+		}
+	}
+	return false
+}
+
+// label of inspected container set when it was run (docker run --label,
+// compose labels), empty when it is missing or has the value its image gives
+// it: images are built by whoever pushes them, so their labels must not run
+// commands on the updater host
+func runtimeLabel(inspect types.ContainerJSON, name string) string {
+	if inspect.Config == nil || inspect.Config.Labels[name] == "" {
+		return ""
+	}
+	img, _, err := cli.ImageInspectWithRaw(ctx, inspect.Image)
+	if err != nil {
+		logrus.Warnf("inspect image of container %s error: %s, its %s label is ignored", strings.TrimPrefix(inspect.Name, "/"), err, name)
+		return ""
+	}
+	if img.Config != nil && img.Config.Labels[name] == inspect.Config.Labels[name] {
+		return ""
+	}
+	return inspect.Config.Labels[name]
+}
+
+// hook command: run-time label of the owner container (the old one, also
+// for hooks of its replacement) when cfg.LabelHooks is set, then repo env,
+// then global env
+func hookCommand(kind, repo string, owner types.ContainerJSON) string {
+	label, envPrefix := labelPreUpdate, "PRE_UPDATE_HOOK"
+	switch kind {
+	case hookPost:
+		label, envPrefix = labelPostUpdate, "POST_UPDATE_HOOK"
+	case hookDrain:
+		label, envPrefix = labelDrain, "DRAIN_HOOK"
+	case hookRegister:
+		label, envPrefix = labelRegister, "REGISTER_HOOK"
+	}
+	if config().LabelHooks {
+		if cmd := runtimeLabel(owner, label); cmd != "" {
+			return cmd
+		}
+	}
+	if cmd, ok := config().Hooks[envPrefix+"_"+envSuffix(repo)]; ok {
+		return cmd
+	}
+	return config().Hooks[envPrefix]
+}
+
+// runs hook command of owner for inspected container on the updater host
+// with update details in env, output is logged; the updater's own env (API
+// tokens, secrets) is not passed on, but PATH and HOME
+func runHook(kind, repo, tag string, inspect, owner types.ContainerJSON) error {
+	command := hookCommand(kind, repo, owner)
+	if command == "" {
+		return nil
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+	logrus.Infof("running %s hook for container %s: %s", kind, name, command)
+
+	hookCtx, cancel := context.WithTimeout(ctx, config().HookTimeout)
+	defer cancel()
+	cmd := exec.Command("sh", "-c", command)
+	// own process group, so commands the hook started die with it and don't
+	// keep its output open past the timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + os.Getenv("HOME"),
+		"UPDATER_HOOK=" + kind,
+		"UPDATER_REPO=" + repo,
+		"UPDATER_TAG=" + tag,
+		"UPDATER_CONTAINER=" + name,
+		"UPDATER_CONTAINER_ID=" + inspect.ID,
+		"UPDATER_DOCKER_HOST=" + currentHost,
+		"UPDATER_IMAGE=" + inspectImage(inspect),
+		"UPDATER_IPS=" + strings.Join(containerIPs(inspect), ","),
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-hookCtx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			err = _err("timed out after %s", config().HookTimeout)
+		}
+	}
+	if out := strings.TrimSpace(stdout.String()); out != "" {
+		logrus.Infof("%s hook stdout: %s", kind, out)
+	}
+	if out := strings.TrimSpace(stderr.String()); out != "" {
+		logrus.Warnf("%s hook stderr: %s", kind, out)
+	}
+	if err != nil {
+		return _err("%s hook for container %s error: %s", kind, name, err.Error())
+	}
+	return nil
+}
+
+func inspectImage(inspect types.ContainerJSON) string {
+	if inspect.Config == nil {
+		return ""
+	}
+	return inspect.Config.Image
+}
+
+// network:address of container on each of its networks, sorted, for
+// registering it in service discovery
+func containerIPs(inspect types.ContainerJSON) []string {
+	var ips []string
+	if inspect.NetworkSettings == nil {
+		return ips
+	}
+	for name, es := range inspect.NetworkSettings.Networks {
+		if es != nil && es.IPAddress != "" {
+			ips = append(ips, name+":"+es.IPAddress)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// "org/my-app" -> "ORG_MY_APP"
+func envSuffix(repo string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, repo)
+}
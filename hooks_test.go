@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuntimeLabel(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	f.addImage("org/labeled:1.0.0", map[string]string{labelPreUpdate: "image-cmd"})
+	f.addContainer("inherited-1", "org/labeled:1.0.0", nil)
+	f.addContainer("same-1", "org/labeled:1.0.0", map[string]string{labelPreUpdate: "image-cmd"})
+	f.addContainer("run-1", "org/labeled:1.0.0", map[string]string{labelPreUpdate: "run-cmd"})
+	f.addContainer("plain-1", "org/plain:1.0.0", map[string]string{labelPreUpdate: "run-cmd"})
+	f.addContainer("orphan-1", "org/orphan:1.0.0", map[string]string{labelPreUpdate: "run-cmd"})
+	f.Lock()
+	orphan := f.images["org/orphan:1.0.0"]
+	for ref, img := range f.images {
+		if img == orphan {
+			delete(f.images, ref)
+		}
+	}
+	f.Unlock()
+
+	for name, want := range map[string]string{
+		// images are built by whoever pushes them
+		"inherited-1": "",
+		"same-1":      "",
+		"run-1":       "run-cmd",
+		"plain-1":     "run-cmd",
+		// image can't be told apart
+		"orphan-1": "",
+	} {
+		if got := runtimeLabel(*f.container(name), labelPreUpdate); got != want {
+			t.Errorf("%s: label %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHookCommand(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.LabelHooks = false
+		c.Hooks = map[string]string{
+			"PRE_UPDATE_HOOK":         "global-pre",
+			"PRE_UPDATE_HOOK_ORG_APP": "app-pre",
+			"POST_UPDATE_HOOK":        "global-post",
+		}
+	})()
+	f.addImage("org/app:1.0.0", map[string]string{labelPostUpdate: "image-post"})
+	run := *f.addContainer("app-1", "org/app:1.0.0", map[string]string{labelPreUpdate: "label-pre"})
+
+	check := func(kind, repo, want string) {
+		if got := hookCommand(kind, repo, run); got != want {
+			t.Errorf("LABEL_HOOKS %v, %s hook of %s: %q, want %q", config().LabelHooks, kind, repo, got, want)
+		}
+	}
+	check(hookPre, "org/app", "app-pre")
+	check(hookPre, "org/other", "global-pre")
+	check(hookPost, "org/app", "global-post")
+	check(hookDrain, "org/app", "")
+
+	config().LabelHooks = true
+	check(hookPre, "org/app", "label-pre")
+	// label of the image isn't taken
+	check(hookPost, "org/app", "global-post")
+}
+
+func TestRunHook(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "env")
+	os.Setenv("UPDATER_TEST_SECRET", "secret-token")
+	defer os.Unsetenv("UPDATER_TEST_SECRET")
+	defer withConfig(func(c *Config) {
+		c.LabelHooks, c.HookTimeout = false, 5*time.Second
+		c.Hooks = map[string]string{
+			"PRE_UPDATE_HOOK":          "env > " + out,
+			"POST_UPDATE_HOOK":         "exit 2",
+			"DRAIN_HOOK":               "sleep 5",
+			"PRE_UPDATE_HOOK_ORG_NONE": "",
+		}
+	})()
+	inspect := *f.addContainer("app-1", "org/app:1.0.0", nil)
+
+	if err := runHook(hookPre, "org/app", "1.0.1", inspect, inspect); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := string(b)
+	for _, v := range []string{"UPDATER_HOOK=pre-update", "UPDATER_REPO=org/app", "UPDATER_TAG=1.0.1", "UPDATER_CONTAINER=app-1", "UPDATER_CONTAINER_ID=" + inspect.ID, "UPDATER_IMAGE=org/app:1.0.0"} {
+		if !strings.Contains(env, v+"\n") {
+			t.Errorf("hook env lacks %s:\n%s", v, env)
+		}
+	}
+	if strings.Contains(env, "secret-token") {
+		t.Error("updater env passed to the hook")
+	}
+
+	if err := runHook(hookPost, "org/app", "1.0.1", inspect, inspect); err == nil || !strings.Contains(err.Error(), "post-update hook for container app-1") {
+		t.Errorf("failing hook: %v, want its error", err)
+	}
+	config().HookTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if err := runHook(hookDrain, "org/app", "1.0.1", inspect, inspect); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("hanging hook: %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("waited %v for a hook with a 100ms timeout", waited)
+	}
+	// empty repo command turns the global one off
+	if err := runHook(hookPre, "org/none", "1.0.1", inspect, inspect); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPushedImageHooks(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "ran")
+	defer withConfig(func(c *Config) {
+		c.LabelHooks, c.HookTimeout, c.Hooks = true, 5*time.Second, map[string]string{}
+	})()
+	labels := func() map[string]string {
+		all := make(map[string]string)
+		for _, label := range hookLabels {
+			all[label] = "touch " + marker
+		}
+		return all
+	}
+	f.addImage("org/pushed-hooks:1.0.0", labels())
+	f.addContainer("app-1", "org/pushed-hooks:1.0.0", nil)
+	f.pushImage("org/pushed-hooks:1.0.1", labels())
+
+	summary, err := updateContainer("org/pushed-hooks", "1.0.1", updateOptions{})
+	if err != nil || summary.Updated != 1 {
+		t.Fatalf("update: %+v, %v", summary, err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("hook labels of pushed images ran a host command")
+	}
+
+	// the same label set with docker run does
+	f.addContainer("run-1", "org/run-hooks:1.0.0", map[string]string{labelPreUpdate: "touch " + marker})
+	f.pushImage("org/run-hooks:1.0.1", nil)
+	if _, err := updateContainer("org/run-hooks", "1.0.1", updateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("run-time hook label didn't run its command")
+	}
+}
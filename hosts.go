@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/labstack/echo"
+)
+
+// ======= DOCKER HOSTS ======
+
+// docker endpoint of DOCKER_HOSTS, certificates (ca.pem, cert.pem, key.pem)
+// of tcp ones are in certPath
+type dockerHostConfig struct {
+	name      string
+	addr      string
+	certPath  string
+	tlsVerify bool
+}
+
+type dockerHost struct {
+	name string
+	cli  *client.Client
+}
+
+// hosts of DOCKER_HOSTS, empty when the single DOCKER_HOST one is used
+var dockerHosts []*dockerHost
+
+// cli is switched to the host being worked with, one at a time
+var hostLock sync.Mutex
+
+// name of the host cli points to, empty with single host
+var currentHost string
+
+// DOCKER_HOSTS name=address pairs sorted by name, with per-host
+// DOCKER_HOST_<NAME>_CERT_PATH and DOCKER_HOST_<NAME>_TLS_VERIFY
+func loadDockerHosts() ([]dockerHostConfig, error) {
+	var hosts []dockerHostConfig
+	for name, addr := range envMap("DOCKER_HOSTS") {
+		if name == "" || addr == "" {
+			return nil, _err("invalid docker host %q=%q", name, addr)
+		}
+		h := dockerHostConfig{name: name, addr: addr}
+		prefix := "DOCKER_HOST_" + envSuffix(name)
+		h.certPath = envString(prefix+"_CERT_PATH", "")
+		var err error
+		if h.tlsVerify, err = envBool(prefix+"_TLS_VERIFY", h.certPath != ""); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].name < hosts[j].name })
+	return hosts, nil
+}
+
+func newHostClient(h dockerHostConfig) (*client.Client, error) {
+	var httpClient *http.Client
+	if h.certPath != "" {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             filepath.Join(h.certPath, "ca.pem"),
+			CertFile:           filepath.Join(h.certPath, "cert.pem"),
+			KeyFile:            filepath.Join(h.certPath, "key.pem"),
+			InsecureSkipVerify: !h.tlsVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		httpClient = &http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsc},
+			CheckRedirect: client.CheckRedirect,
+		}
+	}
+	return client.NewClient(h.addr, envString("DOCKER_API_VERSION", api.DefaultVersion), httpClient, nil)
+}
+
+// runs f with cli of host h, nil host runs f right away (single host)
+func withHost(h *dockerHost, f func()) {
+	if h == nil {
+		f()
+		return
+	}
+	hostLock.Lock()
+	defer hostLock.Unlock()
+	prevCli, prevHost := cli, currentHost
+	cli, currentHost = h.cli, h.name
+	defer func() {
+		cli, currentHost = prevCli, prevHost
+	}()
+	f()
+}
+
+// runs f with cli of every host (host named host if set) in turn
+func eachHost(host string, f func()) {
+	if len(dockerHosts) == 0 {
+		f()
+		return
+	}
+	for _, h := range hostsFor(host) {
+		withHost(h, f)
+	}
+}
+
+// hosts named host, every one when host is empty
+func hostsFor(host string) []*dockerHost {
+	if host == "" {
+		return dockerHosts
+	}
+	for _, h := range dockerHosts {
+		if h.name == host {
+			return []*dockerHost{h}
+		}
+	}
+	return nil
+}
+
+// 400 error when host is not one of DOCKER_HOSTS, empty host means all
+func checkHost(host string) error {
+	if config().Role == roleCoordinator {
+		return checkAgent(host)
+	}
+	if host != "" && len(hostsFor(host)) == 0 {
+		return _httpErr(http.StatusBadRequest, "unknown docker host %q", host)
+	}
+	return nil
+}
+
+// host request targets from host query parameter, checked
+func requestHost(c echo.Context) (string, error) {
+	host := c.QueryParam("host")
+	return host, checkHost(host)
+}
+
+// first of DOCKER_HOSTS, nil with single host
+func defaultHost() *dockerHost {
+	if len(dockerHosts) == 0 {
+		return nil
+	}
+	return dockerHosts[0]
+}
+
+// updateContainer on every host (host named host if set) one by one,
+// summaries merged (errors of hosts are joined); nil summary means request
+// is rejected
+func updateHosts(repo, tag, host string, opts updateOptions) (*updateSummary, error) {
+	if config().Role == roleCoordinator {
+		return updateAgents(repo, tag, host, opts)
+	}
+	if len(dockerHosts) == 0 {
+		return updateToHighest(repo, tag, opts)
+	}
+	merged := newUpdateSummary(repo, tag)
+	merged.Host, merged.AllowDowngrade, merged.Overrides = host, opts.AllowDowngrade, opts.Overrides
+	var errs []string
+	for _, h := range hostsFor(host) {
+		var summary *updateSummary
+		var err error
+		withHost(h, func() {
+			logrus.Infof("updating %s:%s on docker host %s...", repo, tag, h.name)
+			summary, err = updateToHighest(repo, tag, opts)
+		})
+		if summary == nil {
+			return nil, err
+		}
+		if err != nil {
+			errs = append(errs, h.name+": "+err.Error())
+		}
+		merged.merge(summary)
+	}
+	var err error
+	if len(errs) > 0 {
+		err = _err("%s", strings.Join(errs, "; "))
+	}
+	merged.finish(err)
+	return merged, err
+}
+
+// docker clients of DOCKER_HOSTS, cli is the first one between updates
+func initDockerHosts(hosts []dockerHostConfig) {
+	for _, h := range hosts {
+		c, err := newHostClient(h)
+		if err != nil {
+			logrus.Panicf("unable to init docker client of host %s: %s", h.name, err.Error())
+		}
+		if envString("DOCKER_API_VERSION", "") == "" {
+			c.NegotiateAPIVersion(ctx)
+		}
+		dockerHosts = append(dockerHosts, &dockerHost{name: h.name, cli: c})
+		logrus.Infof("docker host %s: %s", h.name, h.addr)
+	}
+	cli = dockerHosts[0].cli
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= JOB CALLBACKS ======
+
+// finished async jobs are posted (job JSON, as GET /api/v1/jobs/:id returns
+// it) to the callback_url of their request, or the per-repo or global
+// configured one, so ci pipelines don't have to poll
+
+// context key of callback_url from request body
+const callbackURLKey = "callback_url"
+
+// header with HMAC-SHA256 of the body keyed by cfg.JobCallbackSecret
+const jobSignatureHeader = "X-Updater-Signature"
+
+func checkCallbackURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return _err("invalid callback URL %q, http(s) URL expected", target)
+	}
+	return nil
+}
+
+// callback_url of request c, from its body (see peekCallbackURL) or query
+func requestCallbackURL(c echo.Context) string {
+	if v, ok := c.Get(callbackURLKey).(string); ok && v != "" {
+		return v
+	}
+	return c.QueryParam("callback_url")
+}
+
+// callback_url of a JSON object body, which is kept for binding
+func peekCallbackURL(c echo.Context) error {
+	req := c.Request()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var v struct {
+		CallbackURL string `json:"callback_url"`
+	}
+	// other bodies are left to binding
+	if json.Unmarshal(body, &v) == nil && v.CallbackURL != "" {
+		c.Set(callbackURLKey, v.CallbackURL)
+	}
+	return nil
+}
+
+// result callback of job for repo (empty for batches) queued by c: requested
+// one, per-repo or global one
+func jobCallbackURL(c echo.Context, repo string) (string, error) {
+	if target := requestCallbackURL(c); target != "" {
+		if err := checkCallbackURL(target); err != nil {
+			return "", _httpErr(http.StatusBadRequest, "callback_url: %s", err.Error())
+		}
+		return target, nil
+	}
+	return config().jobCallbackURL(repo), nil
+}
+
+// per-repo job callback or global one
+func (c *Config) jobCallbackURL(repo string) string {
+	if target, ok := c.RepoJobCallbackURL[repo]; ok && repo != "" {
+		return target
+	}
+	return c.JobCallbackURL
+}
+
+// posts finished job to its result callback, retried like registry calls
+func sendJobResult(j job) {
+	body, err := json.Marshal(j)
+	if err != nil {
+		logrus.Errorf("job %s callback error: %s", j.ID, err)
+		return
+	}
+	err = retry("job "+j.ID+" callback", func() error {
+		req, err := http.NewRequest("POST", j.ResultURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if config().JobCallbackSecret != "" {
+			mac := hmac.New(sha256.New, []byte(config().JobCallbackSecret))
+			mac.Write(body)
+			req.Header.Set(jobSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := notifyClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return _err("unexpected response status %s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("job %s callback error: %s", j.ID, err)
+		return
+	}
+	logrus.Infof("job %s result sent to callback", j.ID)
+}
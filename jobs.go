@@ -0,0 +1,476 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= JOBS ======
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobSuccess = "success"
+	jobFailed  = "failed"
+)
+
+// asynchronous update
+type job struct {
+	ID         string     `json:"job_id"`
+	Repo       string     `json:"repo"`
+	Tag        string     `json:"tag"`
+	Host       string     `json:"host,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// pairs of a batch job (with empty repo and tag), and their results
+	// once finished
+	Batch   []repoTag     `json:"batch,omitempty"`
+	Results []batchResult `json:"results,omitempty"`
+	// docker hub webhook callback
+	CallbackURL string `json:"-"`
+	// posted the finished job
+	ResultURL string `json:"-"`
+	// who queued it
+	Caller string `json:"caller,omitempty"`
+	// what started it (webhook, manual, approval)
+	Trigger string `json:"trigger,omitempty"`
+	// span of the queuing request, parent of the update ones
+	trace *span
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID  map[string]*job
+	queue chan *job
+}{byID: make(map[string]*job)}
+
+// starts n workers processing the jobs queue, synchronous updates share
+// their n update slots
+func startJobWorkers(n, queueSize int) {
+	updateSlots = make(chan struct{}, n)
+	jobs.queue = make(chan *job, queueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range jobs.queue {
+				runJob(j)
+			}
+		}()
+	}
+}
+
+// queues update, returns nil when queue is full
+func enqueueJob(repo, tag, host, callbackURL, resultURL, caller, trigger string, trace *span) *job {
+	j := &job{
+		ID:          newJobID(),
+		Repo:        repo,
+		Tag:         tag,
+		Host:        host,
+		Status:      jobQueued,
+		CreatedAt:   time.Now(),
+		CallbackURL: callbackURL,
+		ResultURL:   resultURL,
+		Caller:      caller,
+		Trigger:     trigger,
+		trace:       trace,
+	}
+	if !queueJob(j) {
+		return nil
+	}
+	logrus.Infof("job %s queued: %s:%s", j.ID, repo, tag)
+	return j
+}
+
+// queues batch of updates as one job, returns nil when queue is full
+func enqueueBatchJob(pairs []repoTag, host, resultURL, caller, trigger string, trace *span) *job {
+	j := &job{
+		ID:        newJobID(),
+		Host:      host,
+		Status:    jobQueued,
+		CreatedAt: time.Now(),
+		Batch:     pairs,
+		ResultURL: resultURL,
+		Caller:    caller,
+		Trigger:   trigger,
+		trace:     trace,
+	}
+	if !queueJob(j) {
+		return nil
+	}
+	logrus.Infof("job %s queued: batch of %d updates", j.ID, len(pairs))
+	return j
+}
+
+func queueJob(j *job) bool {
+	jobs.Lock()
+	pruneJobs()
+	jobs.byID[j.ID] = j
+	jobs.Unlock()
+	snapshot := *j
+	select {
+	case jobs.queue <- j:
+		haSaveJob(snapshot)
+		acceptJob(snapshot)
+		return true
+	default:
+		jobs.Lock()
+		delete(jobs.byID, j.ID)
+		jobs.Unlock()
+		return false
+	}
+}
+
+// whether job updates repo, itself or as one of its batch
+func (j *job) updatesRepo(repo string) bool {
+	if j.Repo == repo {
+		return true
+	}
+	for _, p := range j.Batch {
+		if p.Repo == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// updates running at once, nil means unlimited
+var updateSlots chan struct{}
+
+// updateHosts in a free update slot, after updates of repo requested
+// earlier finished; while paused it is rejected or queued, quarantined
+// repo:tag is rejected
+func runUpdate(repo, tag, host string, opts updateOptions) (summary *updateSummary, err error) {
+	if isPaused() {
+		if config().PauseMode == pauseReject {
+			return nil, errPaused()
+		}
+		deferUpdate(repo, tag, host)
+		return nil, _err("updates are paused, %s:%s queued until resumed", repo, tag)
+	}
+	if err := checkQuarantine(repo, tag); err != nil {
+		return nil, err
+	}
+	lockRepo(repo)
+	defer unlockRepo(repo)
+	leaseCtx, release, err := lockRepoLease(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	opts.Ctx = leaseCtx
+	markUpdateStarted(repo)
+	if slotErr := withUpdateSlot(func() {
+		summary, err = updateHosts(repo, tag, host, opts)
+	}); slotErr != nil {
+		return nil, slotErr
+	}
+	retryFailed(repo, tag, host, opts, summary)
+	return summary, err
+}
+
+// updates of the same repo run one by one in request order, queues of
+// waiting ones by repo; repo is locked while it has an entry
+var repoQueues = struct {
+	sync.Mutex
+	waiting map[string][]chan struct{}
+}{waiting: make(map[string][]chan struct{})}
+
+func lockRepo(repo string) {
+	repoQueues.Lock()
+	queue, locked := repoQueues.waiting[repo]
+	if !locked {
+		repoQueues.waiting[repo] = nil
+		repoQueues.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	repoQueues.waiting[repo] = append(queue, turn)
+	repoQueues.Unlock()
+	logrus.Infof("update of repo %s is running, waiting for it to finish...", repo)
+	<-turn
+}
+
+// passes lock to the next waiting update, if any
+func unlockRepo(repo string) {
+	repoQueues.Lock()
+	defer repoQueues.Unlock()
+	queue := repoQueues.waiting[repo]
+	if len(queue) == 0 {
+		delete(repoQueues.waiting, repo)
+		return
+	}
+	repoQueues.waiting[repo] = queue[1:]
+	close(queue[0])
+}
+
+// runs f once an update slot is free, unless shutting down meanwhile
+func withUpdateSlot(f func()) error {
+	if updateSlots != nil {
+		updateSlots <- struct{}{}
+		defer func() { <-updateSlots }()
+	}
+	if !beginUpdate() {
+		return errShuttingDown()
+	}
+	defer endUpdate()
+	configLock.RLock()
+	defer configLock.RUnlock()
+	f()
+	return nil
+}
+
+// admitted updates not finished yet, both waiting and running ones
+var pendingUpdates = struct {
+	sync.Mutex
+	n int
+}{}
+
+// admits update unless cfg.MaxQueue updates are already pending,
+// admitted ones must be released when finished
+func admitUpdate() bool {
+	pendingUpdates.Lock()
+	defer pendingUpdates.Unlock()
+	if shuttingDown() || config().MaxQueue > 0 && pendingUpdates.n >= config().MaxQueue {
+		return false
+	}
+	pendingUpdates.n++
+	return true
+}
+
+func releaseUpdate() {
+	pendingUpdates.Lock()
+	pendingUpdates.n--
+	pendingUpdates.Unlock()
+}
+
+// 503 asking client to retry later
+func overloaded(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", retryAfter)
+	return _httpErr(http.StatusServiceUnavailable, "too many pending updates, retry later")
+}
+
+// seconds
+const retryAfter = "30"
+
+func runJob(j *job) {
+	if config().UpdateQueueFile != "" && shuttingDown() {
+		releaseUpdate()
+		logrus.Infof("job %s left queued for replay, updater is shutting down", j.ID)
+		return
+	}
+	now := time.Now()
+	jobs.Lock()
+	j.Status, j.StartedAt = jobRunning, &now
+	running := *j
+	jobs.Unlock()
+	haSaveJob(running)
+
+	var err error
+	var results []batchResult
+	if len(j.Batch) > 0 {
+		results = runBatch(j.Batch, j.Host, j.Caller, j.Trigger, j.trace)
+		err = batchError(results)
+	} else {
+		_, err = runUpdate(j.Repo, j.Tag, j.Host, updateOptions{Trace: j.trace, Caller: j.Caller, Trigger: j.Trigger})
+	}
+	releaseUpdate()
+	if leftForReplay(err, results) {
+		jobs.Lock()
+		j.Status, j.StartedAt = jobQueued, nil
+		queued := *j
+		jobs.Unlock()
+		haSaveJob(queued)
+		logrus.Infof("job %s stopped by shutdown, left queued for replay", j.ID)
+		return
+	}
+
+	now = time.Now()
+	jobs.Lock()
+	j.Status, j.FinishedAt, j.Results = jobSuccess, &now, results
+	if err != nil {
+		j.Status, j.Error = jobFailed, err.Error()
+	}
+	finished := *j
+	jobs.Unlock()
+	logrus.Infof("job %s %s", j.ID, j.Status)
+	haSaveJob(finished)
+	finishAccepted(j.ID, err)
+
+	if j.ResultURL != "" {
+		go sendJobResult(finished)
+	}
+	if j.CallbackURL != "" {
+		sendHubCallback(j.CallbackURL, j.Repo, j.Tag, err)
+	}
+}
+
+// whether job refused by shutdown stays in the update queue file, without
+// callbacks, for replay after restart; without queue file it fails as usual
+func leftForReplay(err error, results []batchResult) bool {
+	if config().UpdateQueueFile == "" {
+		return false
+	}
+	if err == errShutdown {
+		return true
+	}
+	for _, res := range results {
+		if res.Error == errShutdown.Error() {
+			return true
+		}
+	}
+	return false
+}
+
+// error counting failed updates of a batch, nil when none failed
+func batchError(results []batchResult) error {
+	failed := 0
+	for _, res := range results {
+		if res.Status == "failed" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return _err("%d of %d updates failed", failed, len(results))
+	}
+	return nil
+}
+
+// drops finished jobs older than cfg.JobRetention, jobs must be locked
+func pruneJobs() {
+	for id, j := range jobs.byID {
+		if j.FinishedAt != nil && time.Since(*j.FinishedAt) > config().JobRetention {
+			delete(jobs.byID, id)
+		}
+	}
+}
+
+// job snapshot safe to serialize, of other replicas too with HA
+func getJob(id string) (job, bool) {
+	jobs.Lock()
+	j, ok := jobs.byID[id]
+	var snapshot job
+	if ok {
+		snapshot = *j
+	}
+	jobs.Unlock()
+	if !ok && haEnabled() {
+		return haJob(id)
+	}
+	return snapshot, ok
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Panicf("unable to generate job id: %s", err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// jobs list call: GET /api/v1/jobs[?repo=REPO][&status=STATUS], newest first
+func listJobs(c echo.Context) error {
+	repo, status := c.QueryParam("repo"), c.QueryParam("status")
+	list := []job{}
+	jobs.Lock()
+	pruneJobs()
+	all := make([]job, 0, len(jobs.byID))
+	for _, j := range jobs.byID {
+		all = append(all, *j)
+	}
+	jobs.Unlock()
+	if haEnabled() {
+		if shared, err := haJobs(); err != nil {
+			logrus.Warnf("list shared jobs error: %s, listing local ones", err)
+		} else {
+			all = shared
+		}
+	}
+	for _, j := range all {
+		if (repo == "" || j.updatesRepo(repo)) && (status == "" || j.Status == status) {
+			list = append(list, j)
+		}
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].CreatedAt.After(list[k].CreatedAt)
+	})
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
+
+// job status call: GET /api/v1/jobs/:id
+func jobStatus(c echo.Context) error {
+	j, ok := getJob(c.Param("id"))
+	if !ok {
+		return _httpErr(http.StatusNotFound, "job %s not found", c.Param("id"))
+	}
+	return c.JSONPretty(http.StatusOK, j, "  ")
+}
+
+// queues update and responds with 202 and job ID, result is reported
+// to callbackURL if set
+func _updAsync(c echo.Context, repo, tag, callbackURL string) error {
+	repo, tag = mapRepo(repo, tag)
+	resultURL, err := jobCallbackURL(c, repo)
+	if err != nil {
+		return err
+	}
+	// requests not turned into a job are answered right away
+	answer := func(err error) {
+		if callbackURL != "" {
+			go sendHubCallback(callbackURL, repo, tag, err)
+		}
+	}
+	if err := checkRequest(repo, tag); err != nil {
+		answer(err)
+		return err
+	}
+	host, err := requestHost(c)
+	if err != nil {
+		answer(err)
+		return err
+	}
+	if err := checkRepoRate(repo); err != nil {
+		answer(err)
+		return err
+	}
+	if err := checkPaused(); err != nil {
+		answer(err)
+		return err
+	}
+	if inCooldown(repo, tag) {
+		answer(nil)
+		return c.JSONPretty(http.StatusOK, map[string]string{
+			"status": "cooldown, skipped",
+		}, "  ")
+	}
+	if p := holdForApproval(repo, tag, host, callbackURL); p != nil {
+		return pendingAccepted(c, p)
+	}
+	if deferUpdate(repo, tag, host) {
+		deferCallback(repo, host, callbackURL)
+		return c.JSONPretty(http.StatusAccepted, map[string]string{
+			"status": queuedStatus(repo),
+		}, "  ")
+	}
+	if !admitUpdate() {
+		answer(_err("updater overloaded"))
+		return overloaded(c)
+	}
+	j := enqueueJob(repo, tag, host, callbackURL, resultURL, caller(c), requestTrigger(c), requestSpan(c))
+	if j == nil {
+		releaseUpdate()
+		answer(_err("updater overloaded"))
+		return overloaded(c)
+	}
+	return c.JSONPretty(http.StatusAccepted, map[string]string{
+		"job_id": j.ID,
+	}, "  ")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestMaxQueueSheds(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.MaxQueue = 2 })()
+	f.pullGate = make(chan struct{})
+	for i := 0; i < 4; i++ {
+		f.addContainer(fmt.Sprintf("app-%d", i), fmt.Sprintf("org/queued-%d:1.0.0", i), nil)
+		f.pushImage(fmt.Sprintf("org/queued-%d:1.0.1", i), nil)
+	}
+	request := func(i int) *httptest.ResponseRecorder {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/update", nil), rec)
+		if err := _upd(c, fmt.Sprintf("org/queued-%d", i), "1.0.1", updateOptions{}); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	// both slots taken by updates waiting for their pulls
+	var wg sync.WaitGroup
+	admitted := make([]*httptest.ResponseRecorder, 2)
+	for i := range admitted {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			admitted[i] = request(i)
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pendingUpdates.Lock()
+		n := pendingUpdates.n
+		pendingUpdates.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(f.pullGate)
+			t.Fatalf("%d updates pending, want 2", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 2; i < 4; i++ {
+		rec := request(i)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request over capacity: %d, Retry-After %q, want 503 with retry hint", rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+	close(f.pullGate)
+	wg.Wait()
+	for i, rec := range admitted {
+		if rec.Code != http.StatusOK {
+			t.Errorf("admitted request %d: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	if !admitUpdate() {
+		t.Fatal("slots not released")
+	}
+	releaseUpdate()
+}
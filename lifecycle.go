@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ======= LIFECYCLE HOOKS ======
+
+// commands run inside the old container before it's stopped and inside the
+// new one once it's up, e.g. flushing caches or running migrations; a failure
+// aborts the update of the container
+const (
+	labelLifecyclePre  = "docker-updater.lifecycle.pre-update"
+	labelLifecyclePost = "docker-updater.lifecycle.post-update"
+	// lifecycle commands timeout, HOOK_TIMEOUT by default
+	labelLifecycleTimeout = "docker-updater.lifecycle.timeout"
+)
+
+// runs lifecycle command of kind set by inspected container's label in it,
+// running containers only
+func runLifecycleHook(kind string, inspect types.ContainerJSON) error {
+	if inspect.Config == nil || !isRunning(inspect) {
+		return nil
+	}
+	label := labelLifecyclePre
+	if kind == hookPost {
+		label = labelLifecyclePost
+	}
+	command := inspect.Config.Labels[label]
+	if command == "" {
+		return nil
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+	timeout := config().HookTimeout
+	if v := inspect.Config.Labels[labelLifecycleTimeout]; v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			timeout = d
+		} else {
+			logrus.Warnf("container %s has invalid %s=%s, using default", name, labelLifecycleTimeout, v)
+		}
+	}
+	logrus.Infof("running %s lifecycle command in container %s: %s", kind, name, command)
+	if err := execInContainer(inspect.ID, command, timeout); err != nil {
+		return _err("%s lifecycle command in container %s error: %s", kind, name, err.Error())
+	}
+	return nil
+}
+
+// runs shell command in container, output is logged; non-zero exit code is
+// an error
+func execInContainer(id, command string, timeout time.Duration) error {
+	execCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	exec, err := cli.ContainerExecCreate(execCtx, id, types.ExecConfig{
+		Cmd:          []string{"sh", "-c", command},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return _err("create exec error: %s", err.Error())
+	}
+	resp, err := cli.ContainerExecAttach(execCtx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return _err("start exec error: %s", err.Error())
+	}
+	defer resp.Close()
+	var stdout, stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(&stdout, &stderr, resp.Reader)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-execCtx.Done():
+		// the command itself can't be stopped through the API
+		return _err("timed out after %v", timeout)
+	}
+	if out := strings.TrimSpace(stdout.String()); out != "" {
+		logrus.Infof("lifecycle command stdout: %s", out)
+	}
+	if out := strings.TrimSpace(stderr.String()); out != "" {
+		logrus.Warnf("lifecycle command stderr: %s", out)
+	}
+	if err != nil {
+		return _err("read exec output error: %s", err.Error())
+	}
+	inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return _err("inspect exec error: %s", err.Error())
+	}
+	if inspect.ExitCode != 0 {
+		return _err("exit code %d", inspect.ExitCode)
+	}
+	return nil
+}
+
+// restores previous container of created one after its post-update
+// lifecycle command failed with err
+func lifecycleRollback(prev, created types.ContainerJSON, err error) error {
+	if rbErr := rollbackContainer(prev, created.ID); rbErr != nil {
+		return _err("%s, rollback error: %s", err, rbErr)
+	}
+	return _err("%s, rolled back to previous image", err)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.HookTimeout = 5 * time.Second })()
+	f.exits = map[string]int{"sh -c migrate": 3, "sh -c sleep 60": -1}
+	f.addContainer("cache-1", "org/cache:1.0.0", map[string]string{
+		labelLifecyclePre:  "flush",
+		labelLifecyclePost: "warm up",
+	})
+	f.addContainer("db-1", "org/db:1.0.0", map[string]string{labelLifecyclePost: "migrate"})
+	f.addContainer("slow-1", "org/slow:1.0.0", map[string]string{
+		labelLifecyclePre:     "sleep 60",
+		labelLifecycleTimeout: "100ms",
+	})
+	f.addContainer("plain-1", "org/plain:1.0.0", nil)
+	f.addContainer("stopped-1", "org/stopped:1.0.0", map[string]string{labelLifecyclePre: "flush"})
+	f.container("stopped-1").State.Running = false
+
+	inspect := func(name string) types.ContainerJSON {
+		return *f.container(name)
+	}
+	if err := runLifecycleHook(hookPre, inspect("cache-1")); err != nil {
+		t.Error(err)
+	}
+	if err := runLifecycleHook(hookPost, inspect("cache-1")); err != nil {
+		t.Error(err)
+	}
+	if err := runLifecycleHook(hookPost, inspect("db-1")); err == nil || !strings.Contains(err.Error(), "exit code 3") {
+		t.Errorf("failing command: %v, want its exit code", err)
+	}
+	// pre-update label of db-1 isn't set
+	if err := runLifecycleHook(hookPre, inspect("db-1")); err != nil {
+		t.Error(err)
+	}
+	start := time.Now()
+	if err := runLifecycleHook(hookPre, inspect("slow-1")); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("hanging command: %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("waited %v for a command with a 100ms timeout", waited)
+	}
+	for _, name := range []string{"plain-1", "stopped-1"} {
+		if err := runLifecycleHook(hookPre, inspect(name)); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	want := []string{"exec cache-1 flush", "exec cache-1 warm up", "exec db-1 migrate", "exec slow-1 sleep 60"}
+	if calls := f.recorded("exec"); strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("execs %v, want %v", calls, want)
+	}
+}
+
+func TestLifecycleHooksInUpdate(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.HookTimeout = 5 * time.Second })()
+	f.exits = map[string]int{"sh -c drain-fails": 1, "sh -c migrate-fails": 1}
+
+	// failing pre-update command leaves the old container as it is
+	f.addContainer("api-1", "org/lifecycle-pre:1.0.0", map[string]string{labelLifecyclePre: "drain-fails"})
+	f.pushImage("org/lifecycle-pre:1.0.1", nil)
+	if summary, _ := updateContainer("org/lifecycle-pre", "1.0.1", updateOptions{}); summary == nil || summary.Updated > 0 {
+		t.Errorf("update went on after its pre-update command failed: %+v", summary)
+	}
+	if calls := f.recorded("stop", "remove", "create"); len(calls) > 0 {
+		t.Errorf("container replaced after its pre-update command failed: %v", calls)
+	}
+
+	// failing post-update command rolls the container back
+	f.addContainer("worker-1", "org/lifecycle-post:1.0.0", map[string]string{labelLifecyclePost: "migrate-fails"})
+	f.pushImage("org/lifecycle-post:1.0.1", nil)
+	if _, err := updateContainer("org/lifecycle-post", "1.0.1", updateOptions{}); err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Errorf("failing post-update command: %v, want a rollback", err)
+	}
+	if c := f.container("worker-1"); c == nil || c.Config.Image != "org/lifecycle-post:1.0.0" {
+		t.Errorf("container after rollback: %+v", c)
+	}
+}
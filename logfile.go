@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= LOG OUTPUTS ======
+
+// log destinations besides stdout: cfg.LogFile and cfg.LogSyslog
+func setupLogOutputs() error {
+	if config().LogFile != "" {
+		f, err := openRotatingFile(config().LogFile, int64(config().LogFileMaxSize), config().LogFileMaxAge, config().LogFileMaxBackups)
+		if err != nil {
+			return _err("open log file %s error: %s", config().LogFile, err.Error())
+		}
+		logrus.SetOutput(io.MultiWriter(os.Stdout, f))
+	}
+	if config().LogSyslog != "" {
+		hook, err := newSyslogHook(config().LogSyslog, config().LogSyslogTag)
+		if err != nil {
+			return _err("connect to syslog %s error: %s", config().LogSyslog, err.Error())
+		}
+		logrus.AddHook(hook)
+	}
+	return nil
+}
+
+// log file renamed to <name>.<time> once bigger than maxSize or older than
+// maxAge (when set), keeping maxBackups renamed ones
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+const rotatedTimeFormat = "20060102-150405"
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// age of an existing file is unknown, counted from its last write
+	r.f, r.size, r.created = f, info.Size(), info.ModTime()
+	if r.size == 0 {
+		r.created = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize ||
+		r.maxAge > 0 && time.Since(r.created) > r.maxAge) {
+		if err := r.rotate(); err != nil {
+			// keep writing to the current file rather than losing logs
+			fmt.Fprintf(os.Stderr, "rotate log file %s error: %s\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	rotated := r.path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		r.f = old
+		return err
+	}
+	old.Close()
+	r.removeBackups()
+	return nil
+}
+
+// drops rotated files beyond maxBackups, oldest first
+func (r *rotatingFile) removeBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	// timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > r.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "remove old log file %s error: %s\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// sends entries, formatted as on stdout, to syslog (journald reads the
+// local socket)
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+// "local" for the local syslog socket, or udp://HOST:PORT, tcp://HOST:PORT
+func newSyslogHook(addr, tag string) (*syslogHook, error) {
+	network, raddr := "", ""
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" || u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, _err("address must be local, udp://HOST:PORT or tcp://HOST:PORT")
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHook{w: w}, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.w.Crit(line)
+	case logrus.ErrorLevel:
+		return h.w.Err(line)
+	case logrus.WarnLevel:
+		return h.w.Warning(line)
+	case logrus.InfoLevel:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= LOGGING ======
+
+// log formats
+const (
+	logText = "text"
+	// one JSON object per line, for Loki, ELK and the like
+	logJSON = "json"
+)
+
+func setupLogging() {
+	applyLogSettings()
+	if err := setupLogOutputs(); err != nil {
+		logrus.Panicf("unable to set up logging: %s", err.Error())
+	}
+}
+
+// level and format, applied again on config reload
+func applyLogSettings() {
+	logrus.SetLevel(config().LogLevel)
+	if config().LogFormat == logJSON {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
+// polled endpoints, logged at debug level not to flood logs
+var quietPaths = []string{"/probe", "/live", "/ready", "/metrics", "/version"}
+
+// logs every request once done: method, path, route, status, latency,
+// caller and client ip
+func logRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		req := c.Request()
+		status := responseStatus(c, err)
+		entry := logrus.WithFields(logrus.Fields{
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"route":      c.Path(),
+			"status":     status,
+			"latency_ms": time.Since(start).Nanoseconds() / int64(time.Millisecond),
+			"bytes":      c.Response().Size,
+			"caller":     caller(c),
+			"ip":         clientIP(c),
+		})
+		if s := requestSpan(c); s != nil {
+			entry = entry.WithField("trace_id", s.traceID)
+		}
+		if err != nil {
+			entry = entry.WithField("error", err.Error())
+		}
+		switch {
+		case status >= 500:
+			entry.Error("request failed")
+		case status >= 400:
+			entry.Warn("request rejected")
+		case isQuietPath(req.URL.Path):
+			entry.Debug("request")
+		default:
+			entry.Info("request")
+		}
+		return err
+	}
+}
+
+func isQuietPath(path string) bool {
+	for _, p := range quietPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// status the response is sent with, errors are answered by the error
+// handler after the middleware returns
+func responseStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
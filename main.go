@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Masterminds/semver"
@@ -12,29 +14,45 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/labstack/echo"
-	"io"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runs API server until it is stopped
+func serve() {
 
 	// initialize web server
 	e := echo.New()
 	e.HideBanner = true
+	if config().LogRequests {
+		e.Use(logRequests)
+	}
 	e.HTTPErrorHandler = func(err error, c echo.Context) {
 		if !c.Response().Committed {
+			code, msg := http.StatusInternalServerError, err.Error()
+			if he, ok := err.(*echo.HTTPError); ok {
+				code, msg = he.Code, fmt.Sprint(he.Message)
+			}
 			if c.Request().Method == "HEAD" {
 				err = c.NoContent(
-					http.StatusInternalServerError,
+					code,
 				)
 			} else {
 				err = c.JSONPretty(
-					http.StatusInternalServerError,
+					code,
 					map[string]string{
-						"error": err.Error(),
+						"error": msg,
 					},
 					"  ",
 				)
@@ -45,52 +63,386 @@ func main() {
 		}
 	}
 
-	v1 := e.Group("/api/v1")
-	updGroup := v1.Group("/update")
+	// API tokens may be set by a config reload
+	v1 := e.Group("/api/v1", requireToken)
+	// logging callers of updates and rollbacks
+	var audit []echo.MiddlewareFunc
+	if config().TLSClientCAFile != "" || len(config().APITokens) > 0 {
+		audit = append(audit, logCaller)
+	}
+	startTracing()
+	// gRPC methods share the guards (and so the rate limits) of updates
+	guards := updateGuards()
+	updGroup := v1.Group("/update", append(append([]echo.MiddlewareFunc{traceRequest}, audit...), guards...)...)
+	if config().RepoRateLimit > 0 {
+		repoLimits = newBucketSet(config().RepoRateLimit, config().RateLimitBurst)
+	}
 	updGroup.GET("", updManual)
-	updGroup.POST("", updByHook)
+	updGroup.POST("/manual", updManual)
+	updGroup.GET("/plan", updPlan)
+	updGroup.POST("", updByHook, countWebhook("hub"), verifySignature("hub"))
+	updGroup.POST("/batch", updBatch, countWebhook("batch"), verifySignature("batch"))
+	updGroup.POST("/hub", updByHook, countWebhook("hub"), verifySignature("hub"))
+	updGroup.POST("/gitlab", updByAdapter(gitlabAdapter{}), countWebhook("gitlab"), verifySignature("gitlab"))
+	updGroup.POST("/harbor", updByAdapter(harborAdapter{}), countWebhook("harbor"), verifySignature("harbor"))
+	updGroup.POST("/quay", updByMultiAdapter(quayAdapter{}), countWebhook("quay"), verifySignature("quay"))
+	updGroup.POST("/acr", updByAdapter(acrAdapter{}), countWebhook("acr"), verifySignature("acr"))
+	updGroup.POST("/pubsub", updByPubSub, countWebhook("pubsub"))
+	updGroup.POST("/ecr", updByECR, countWebhook("ecr"), verifySignature("ecr"))
+	updGroup.POST("/registry", updByMultiAdapter(distributionAdapter{}), countWebhook("registry"), verifySignature("registry"))
+	for name, a := range config().CustomWebhooks {
+		ep := "custom/" + name
+		updGroup.POST("/"+ep, updByAdapter(a), countWebhook(ep), verifySignature(ep))
+	}
 
-	// http probe
-	e.GET("/probe", probe)
+	if err := setupHA(); err != nil {
+		logrus.Panicf("high availability error: %s", err.Error())
+	}
+	startJobWorkers(config().JobWorkers, config().JobQueueSize)
+	if err := loadUpdateQueue(); err != nil {
+		logrus.Panicf("load update queue file error: %s", err.Error())
+	}
+	v1.GET("/jobs", listJobs)
+	v1.GET("/jobs/:id", jobStatus)
+	v1.GET("/observations", listObservations)
+	if err := loadHistory(); err != nil {
+		logrus.Panicf("load history file error: %s", err.Error())
+	}
+	v1.GET("/history", listHistory)
+	if err := setupAudit(); err != nil {
+		logrus.Panicf("audit trail error: %s", err.Error())
+	}
+	v1.GET("/audit", exportAudit)
+	v1.GET("/containers", listContainers)
+	v1.GET("/openapi.json", openAPIHandler)
+	v1.GET("/outdated", listOutdated)
+	v1.GET("/pulls/events", pullProgress)
+	v1.GET("/events/ws", eventsWS)
+	v1.POST("/rollback", rollback, append([]echo.MiddlewareFunc{traceRequest}, audit...)...)
+	admin := v1.Group("/admin", audit...)
+	admin.GET("/pause", pauseStatus)
+	admin.POST("/pause", pauseUpdates)
+	admin.POST("/resume", resumeUpdates)
+	admin.POST("/reload", reloadHandler)
+	v1.GET("/pending", listPending)
+	v1.POST("/pending/:id/approve", approveUpdate, audit...)
+	v1.POST("/pending/:id/reject", rejectUpdate, audit...)
+	if config().Role == roleCoordinator {
+		v1.GET("/agents", listAgents)
+	}
+	v1.GET("/quarantine", listQuarantine)
+	v1.POST("/quarantine/release", releaseQuarantine, audit...)
+
+	go runDeferredUpdates(time.Minute)
+	go runUpdateQueueReplay(time.Minute)
+	if config().PollInterval > 0 {
+		go runPoller(config().PollInterval)
+	}
+	// coordinator has no images of its own
+	if config().retainImages() && config().Role != roleCoordinator {
+		go runRetention(config().ImageCleanupInterval)
+	}
+	if len(config().PollSchedule) > 0 {
+		go runScheduledPolls(config().PollSchedule)
+	}
+	if len(config().PruneSchedule) > 0 && config().Role != roleCoordinator {
+		go runPruning(config().PruneSchedule)
+	}
+	if emailEnabled() && config().EmailMode == emailDigest {
+		go runDigests(config().EmailDigestSchedule)
+	}
+	if telegramEnabled() {
+		go runTelegramBot()
+	}
 
-	address := ":8084"
-	logrus.Infof("starting docker-updater API server on %s", address)
-	logrus.Fatal(e.Start(address))
+	if config().GRPC {
+		registerGRPC(e, append([]echo.MiddlewareFunc{traceRequest}, guards...)...)
+	}
 
-}
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 
-func probe(c echo.Context) error {
-	return c.String(http.StatusOK, "OK")
+	// http probes
+	e.GET("/live", live)
+	e.HEAD("/live", live)
+	e.GET("/ready", ready)
+	e.HEAD("/ready", ready)
+	e.GET("/probe", ready)
+	e.HEAD("/probe", ready)
+	e.GET("/version", versionHandler)
+	if config().Dashboard {
+		e.GET("/ui", dashboard)
+	}
+
+	go watchConfig()
+	done := make(chan struct{})
+	go handleShutdown(e, done)
+	if err := startServer(e); err != http.ErrServerClosed {
+		logrus.Fatal(err)
+	}
+	<-done
+	logrus.Info("docker-updater stopped")
 }
 
-// testing update call: GET /api/v1/update?repo=REPO&tag=TAG
+// testing update call: GET /api/v1/update?repo=REPO&tag=TAG[&dry_run=true[&check_registry=true]][&async=true][&host=HOST][&allow_downgrade=true]
 func updManual(c echo.Context) error {
-	return _upd(c, c.QueryParam("repo"), c.QueryParam("tag"))
+	repo, tag := c.QueryParam("repo"), c.QueryParam("tag")
+	if c.QueryParam("dry_run") == "true" {
+		return dryRun(c, repo, tag, c.QueryParam("check_registry") == "true")
+	}
+	opts := updateOptions{AllowDowngrade: c.QueryParam("allow_downgrade") == "true" || c.QueryParam("force") == "true"}
+	if c.Request().Method == http.MethodPost {
+		if err := peekCallbackURL(c); err != nil {
+			return err
+		}
+		overrides := &containerOverrides{}
+		if err := c.Bind(overrides); err != nil {
+			return err
+		}
+		if err := overrides.validate(); err != nil {
+			return err
+		}
+		if !overrides.empty() {
+			opts.Overrides = overrides
+		}
+	}
+	if c.QueryParam("async") == "true" {
+		if opts.AllowDowngrade {
+			return _httpErr(http.StatusBadRequest, "allow_downgrade can't be used with async")
+		}
+		if opts.Overrides != nil {
+			return _httpErr(http.StatusBadRequest, "overrides can't be used with async")
+		}
+		return _updAsync(c, repo, tag, "")
+	}
+	if requestCallbackURL(c) != "" {
+		return _httpErr(http.StatusBadRequest, "callback_url can only be used with async")
+	}
+	return _upd(c, repo, tag, opts)
 }
 
-// prod update call: POST /api/v1/update
+// prod update call: POST /api/v1/update, processed asynchronously
 func updByHook(c echo.Context) error {
-	var p push
-	if err := c.Bind(&p); err != nil {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+	}
+	var a WebhookAdapter = hubAdapter{}
+	if isHarborPayload(body) {
+		a = harborAdapter{}
+	}
+	repo, tag, err := a.Extract(body)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+	}
+	p, _ := parsePush(body)
+	if duplicateDelivery(pushKey(repo, tag, p.Data.PushedAt, body)) {
+		return duplicate(c, repo+":"+tag)
+	}
+	return _updAsync(c, repo, tag, hubCallbackURL(body))
+}
+
+// batch update call: POST /api/v1/update/batch with [{"repo": REPO, "tag": TAG[, "host": HOST]}, ...]
+// or {"updates": [...], "callback_url": URL}
+func updBatch(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+	}
+	var pairs []repoTag
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var req struct {
+			Updates     []repoTag `json:"updates"`
+			CallbackURL string    `json:"callback_url"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+		}
+		pairs = req.Updates
+		c.Set(callbackURLKey, req.CallbackURL)
+	} else if err := json.Unmarshal(body, &pairs); err != nil {
+		return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+	}
+	return _updBatch(c, pairs, false)
+}
+
+// with async=true the batch is queued as one job, its pairs done one by one
+// and their results reported by the job
+// queues pairs as one job when async (by default or given as async query
+// parameter), runs them right away otherwise
+func _updBatch(c echo.Context, pairs []repoTag, async bool) error {
+	host, err := requestHost(c)
+	if err != nil {
 		return err
 	}
-	return _upd(c, p.Repository.RepoName, p.Data.Tag)
+	if v := c.QueryParam("async"); v != "" {
+		async = v == "true"
+	}
+	if requestCallbackURL(c) != "" && !async {
+		return _httpErr(http.StatusBadRequest, "callback_url can only be used with async")
+	}
+	resultURL, err := jobCallbackURL(c, "")
+	if err != nil {
+		return err
+	}
+	if !admitUpdate() {
+		return overloaded(c)
+	}
+	if async {
+		j := enqueueBatchJob(pairs, host, resultURL, caller(c), requestTrigger(c), requestSpan(c))
+		if j == nil {
+			releaseUpdate()
+			return overloaded(c)
+		}
+		return c.JSONPretty(http.StatusAccepted, map[string]string{
+			"job_id": j.ID,
+		}, "  ")
+	}
+	defer releaseUpdate()
+	id := acceptUpdate("", "", host, pairs, caller(c), requestTrigger(c))
+	results := runBatch(pairs, host, caller(c), requestTrigger(c), requestSpan(c))
+	finishAccepted(id, batchError(results))
+	return c.JSONPretty(http.StatusOK, results, "  ")
 }
 
-func _upd(c echo.Context, repo, tag string) error {
-	if err := updateContainer(repo, tag); err != nil {
+// updates pairs one by one for caller, pairs without host are done on host
+func runBatch(pairs []repoTag, host, caller, trigger string, trace *span) []batchResult {
+	results := make([]batchResult, 0, len(pairs))
+	for _, p := range pairs {
+		if p.Host == "" {
+			p.Host = host
+		}
+		p.Repo, p.Tag = mapRepo(p.Repo, p.Tag)
+		res := batchResult{Repo: p.Repo, Tag: p.Tag, Host: p.Host, Status: "ok"}
+		if err := checkRequest(p.Repo, p.Tag); err != nil {
+			res.Status, res.Error = "failed", err.Error()
+		} else if err := checkHost(p.Host); err != nil {
+			res.Status, res.Error = "failed", err.Error()
+		} else if err := checkRepoRate(p.Repo); err != nil {
+			res.Status, res.Error = "skipped", err.Error()
+		} else if err := checkPaused(); err != nil {
+			res.Status, res.Error = "skipped", err.Error()
+		} else if inCooldown(p.Repo, p.Tag) {
+			res.Status = "skipped"
+		} else if held := holdForApproval(p.Repo, p.Tag, p.Host, ""); held != nil {
+			res.Status, res.PendingID = "pending", held.ID
+		} else if deferUpdate(p.Repo, p.Tag, p.Host) {
+			res.Status = "queued"
+		} else if _, err := runUpdate(p.Repo, p.Tag, p.Host, updateOptions{Trace: trace, Caller: caller, Trigger: trigger}); err != nil {
+			res.Status, res.Error = "failed", err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func _upd(c echo.Context, repo, tag string, opts updateOptions) error {
+	opts.Trace, opts.Caller, opts.Trigger = requestSpan(c), caller(c), requestTrigger(c)
+	repo, tag = mapRepo(repo, tag)
+	if err := checkRequest(repo, tag); err != nil {
+		return err
+	}
+	host, err := requestHost(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPaused(); err != nil {
+		return err
+	}
+	if err := checkForced(repo, host, opts); err != nil {
+		return err
+	}
+	if opts.AllowDowngrade {
+		logrus.WithFields(logrus.Fields{
+			"audit":  "downgrade",
+			"repo":   repo,
+			"tag":    tag,
+			"host":   host,
+			"caller": caller(c),
+			"ip":     clientIP(c),
+		}).Warn("forced downgrade requested")
+	}
+	if opts.Overrides != nil {
+		logrus.WithFields(logrus.Fields{
+			"audit":     "overrides",
+			"repo":      repo,
+			"tag":       tag,
+			"host":      host,
+			"caller":    caller(c),
+			"ip":        clientIP(c),
+			"env":       sortedKeys(opts.Overrides.Env),
+			"unset_env": opts.Overrides.UnsetEnv,
+			"cmd":       opts.Overrides.Cmd,
+			"labels":    sortedKeys(opts.Overrides.Labels),
+		}).Warn("config overrides requested")
+	}
+	if err := checkRepoRate(repo); err != nil {
+		return err
+	}
+	if inCooldown(repo, tag) {
+		return c.JSONPretty(http.StatusOK, map[string]string{
+			"status": "cooldown, skipped",
+		}, "  ")
+	}
+	if p := holdForApproval(repo, tag, host, ""); p != nil {
+		return pendingAccepted(c, p)
+	}
+	if deferUpdate(repo, tag, host) {
+		return c.JSONPretty(http.StatusAccepted, map[string]string{
+			"status": queuedStatus(repo),
+		}, "  ")
+	}
+	if !admitUpdate() {
+		return overloaded(c)
+	}
+	// forced and overridden ones are not replayed
+	id := ""
+	if !opts.AllowDowngrade && opts.Overrides == nil {
+		id = acceptUpdate(repo, tag, host, nil, opts.Caller, opts.Trigger)
+	}
+	summary, err := runUpdate(repo, tag, host, opts)
+	finishAccepted(id, err)
+	releaseUpdate()
+	if err != nil && summary == nil {
 		return err
-	} else {
-		return c.String(http.StatusOK, "OK")
 	}
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+	}
+	if c.Request().Method == "HEAD" {
+		return c.NoContent(status)
+	}
+	return c.JSONPretty(status, summary, "  ")
+}
+
+// 409 error when forced (or overridden) update would have to wait, queued
+// updates are not forced nor overridden
+func checkForced(repo, host string, opts updateOptions) error {
+	if !opts.AllowDowngrade && opts.Overrides == nil {
+		return nil
+	}
+	if isPaused() {
+		return _httpErr(http.StatusConflict, "updates are paused, forced update is not queued")
+	}
+	if !config().windowOpen(repo, time.Now()) {
+		return _httpErr(http.StatusConflict, "repo %s is out of update window, forced update is not queued", repo)
+	}
+	if requiresApproval(repo, host) {
+		return _httpErr(http.StatusConflict, "updates of repo %s need approval, forced update is not held", repo)
+	}
+	if until, ok := throttled(repo, time.Now()); ok {
+		return _httpErr(http.StatusConflict, "repo %s is throttled until %s, forced update is not queued", repo, until.Format(time.RFC3339))
+	}
+	return nil
 }
 
 // ======= STRUCTURES ======
 
 // docker hub hook payload
 type push struct {
-	Data       pushData   `json:"push_data"`
-	Repository repository `json:"repository"`
+	CallbackURL string     `json:"callback_url"`
+	Data        pushData   `json:"push_data"`
+	Repository  repository `json:"repository"`
 }
 type pushData struct {
 	PushedAt int64  `json:"pushed_at"`
@@ -102,6 +454,23 @@ type repository struct {
 	IsTrusted bool   `json:"is_trusted"`
 }
 
+// batch update request item
+type repoTag struct {
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// one of DOCKER_HOSTS to update on, all when empty
+	Host string `json:"host,omitempty"`
+}
+type batchResult struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag"`
+	Host   string `json:"host,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// of update waiting for approval, with pending status
+	PendingID string `json:"pending_id,omitempty"`
+}
+
 // ======= ACTIONS ======
 
 var cli *client.Client
@@ -109,154 +478,810 @@ var ctx context.Context
 
 const latest = "latest"
 
-func init() {
+// grace period of the container on stop, e.g. "2m"
+const labelStopTimeout = "docker-updater.stop-timeout"
+
+// docker client configured by DOCKER_* env (or config file options)
+func initDocker() {
+	ctx = context.Background()
+	if len(config().DockerHosts) > 0 {
+		initDockerHosts(config().DockerHosts)
+		return
+	}
 	var err error
 	cli, err = client.NewEnvClient()
 	if err != nil {
 		logrus.Panicf("unable to init docker client: %s", err.Error())
 	}
-	ctx = context.Background()
+	cli.NegotiateAPIVersion(ctx)
 }
 
-func updateContainer(repo, tag string) error {
+var tagRe = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+
+func checkRequest(repo, tag string) error {
+	if strings.TrimSpace(repo) == "" || strings.TrimSpace(tag) == "" {
+		return _httpErr(http.StatusBadRequest, "repo and tag must be filled")
+	}
+	if !tagRe.MatchString(tag) {
+		return _httpErr(http.StatusBadRequest, "invalid tag %q", tag)
+	}
+	if !config().repoAllowed(repo) {
+		logrus.Warnf("repo %s is not in allowed repos list, skipped", repo)
+		return _httpErr(http.StatusForbidden, "repo %s is not allowed", repo)
+	}
+	return nil
+}
+
+// how one update deviates from the usual ones
+type updateOptions struct {
+	// lower versions are allowed too, a deliberate rollback
+	AllowDowngrade bool
+	// applied to recreated containers, not supported in swarm mode
+	Overrides *containerOverrides
+	// parent of the update span, e.g. the webhook request's one
+	Trace *span
+	// who requested it, recorded in history and audit trail
+	Caller string
+	// what started it (webhook, manual...), labeled on recreated containers
+	Trigger string
+	// retries of an update with failed containers count from 1
+	Attempt int
+	// done when no more containers may be replaced, e.g. once the repo
+	// lease is lost; nil never is
+	Ctx context.Context
+}
+
+// updates containers (or services in swarm mode) of repo to tag, summary is
+// nil only when request is rejected
+func updateContainer(repo, tag string, opts updateOptions) (summary *updateSummary, err error) {
 
 	defer func() {
 		logrus.Infof("===========")
 	}()
 
-	if repo == "" || tag == "" {
-		return _err("repo and tag must be filled")
+	if err := checkRequest(repo, tag); err != nil {
+		return nil, err
+	}
+
+	updatesInFlight.Inc()
+	summary = newUpdateSummary(repo, tag)
+	summary.AllowDowngrade, summary.Overrides, summary.caller = opts.AllowDowngrade, opts.Overrides, opts.Caller
+	summary.trigger = opts.Trigger
+	summary.ctx = opts.Ctx
+	if summary.trigger == "" {
+		summary.trigger = triggerManual
+	}
+	summary.span = startSpan(opts.Trace, "update", "repo", repo, "tag", tag, "docker.host", currentHost)
+	emitEvent(updateEvent{Type: eventTypeStarted, Repo: repo, Tag: tag})
+	defer func() {
+		e := updateEvent{Type: eventTypeFinished, Repo: repo, Tag: tag, Containers: summary.UpdatedContainers}
+		if err != nil {
+			e.Type, e.Error = eventTypeFailed, err.Error()
+		}
+		emitEvent(e)
+		updatesInFlight.Dec()
+		updatesTotal.WithLabelValues(repo, summary.outcome(err)).Inc()
+		summary.span.set("outcome", summary.outcome(err))
+		summary.span.end(err)
+		summary.log(err)
+		recordHistory(summary, err)
+		if err == nil && !config().ObserveOnly {
+			markUpdated(repo, tag)
+		}
+		if !config().ObserveOnly {
+			recordOutcome(repo, tag, err)
+		}
+	}()
+
+	if config().Mode == modeSwarm {
+		if summary.Overrides != nil {
+			return summary, _err("config overrides are not supported in swarm mode")
+		}
+		return summary, updateServices(repo, tag, summary)
 	}
 
 	var fullRepo = fmt.Sprintf("%s:%s", repo, tag)
 	logrus.Infof("updating repo %s...", fullRepo)
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	listSpan := startSpan(summary.span, "list containers")
+	toUpdate, err := matchContainers(repo, tag, summary)
+	listSpan.set("matched", strconv.Itoa(len(toUpdate)))
+	listSpan.end(err)
 	if err != nil {
-		return _err("get containers list error: %s", err.Error())
+		return summary, err
+	}
+	defer func() {
+		if err == nil && summary.selfUpdate && !config().ObserveOnly {
+			if selfErr := startSelfUpdate(repo, tag); selfErr != nil {
+				logrus.Errorf("self-update error: %s", selfErr)
+			}
+		}
+	}()
+	emitEvent(updateEvent{Type: eventTypeMatched, Repo: repo, Tag: tag, Containers: containerRefs(toUpdate)})
+	if len(toUpdate) == 0 {
+		logrus.Infof("no containers should be updated with image %s found, skipped", fullRepo)
+		return summary, nil
+	}
+	if config().ObserveOnly {
+		observe(repo, tag, containerRefs(toUpdate))
+		return summary, nil
+	}
+	defer func() {
+		notifyUpdate(summary, err)
+	}()
+	notifyStarted(summary, containerRefs(toUpdate))
+
+	var inspects []types.ContainerJSON
+	for _, cnt := range toUpdate {
+		inspect, err := cli.ContainerInspect(ctx, cnt.ID)
+		if err != nil {
+			return summary, _err("inspect container %s error: %s", cnt.ID, err.Error())
+		}
+		inspects = append(inspects, inspect)
+	}
+	// dependencies are updated first and dependents restarted after them,
+	// all or nothing
+	var related bool
+	if inspects, related, err = orderByDependencies(inspects); err != nil {
+		return summary, err
+	}
+	if summary.dependents, err = findDependents(inspects); err != nil {
+		return summary, err
+	}
+	summary.dependencyGroup = related || len(summary.dependents) > 0
+
+	// before any container is touched
+	registrySpan := startSpan(summary.span, "check image", "image", fullRepo)
+	if err := checkManifestPlatform(fullRepo); err != nil {
+		registrySpan.end(err)
+		return summary, err
+	}
+	summary.verifiedDigest, err = verifyImage(fullRepo)
+	registrySpan.end(err)
+	if err != nil {
+		return summary, err
+	}
+
+	order, strategy := config().pullOrder(repo), config().updateStrategy(repo)
+	if strategy == strategyStartFirst || strategy == strategyBlueGreen {
+		// old containers run until replaced, nothing to free first
+		order = orderPullFirst
+	}
+	if config().smokeTestTimeout(repo) > 0 {
+		// image is tested before any container is removed
+		order = orderPullFirst
+	}
+	logrus.Infof("using %s order and %s strategy for repo %s", order, strategy, repo)
+	if order == orderPullFirst {
+		if err := summary.pull(fullRepo); err != nil {
+			return summary, err
+		}
+		smokeSpan := startSpan(summary.span, "smoke test")
+		err := smokeTest(repo, fullRepo, inspects[0])
+		smokeSpan.end(err)
+		if err != nil {
+			return summary, err
+		}
+	}
+	if strategy == strategyStartFirst || strategy == strategyBlueGreen {
+		return summary, startFirstUpdate(inspects, repo, tag, summary)
+	}
+
+	// at most batchSize containers are down at once, each batch must pass
+	// health check before the next one is touched
+	var prevImages []string
+	var failures []string
+	// containers on new image, for ROLLBACK_MODE=all
+	var updated []recreatedContainer
+	done := 0
+	canaryFailed := false
+	for n, batch := range canaryBatches(repo, inspects, config().batchSize(repo, len(inspects))) {
+		if len(failures) > 0 && (canaryFailed || !summary.continueOnFailure()) {
+			if summary.failuresExceeded() {
+				logrus.Warnf("%d containers of repo %s failed, over max failures, rollout aborted", failedCount(summary), repo)
+			}
+			logrus.Warnf("%d containers left not updated to keep quorum", len(inspects)-done)
+			break
+		}
+		if n > 0 {
+			pauseBatch(repo, len(inspects)-done)
+		}
+		if err := summary.stopped(); err != nil {
+			logrus.Warnf("%d containers left not updated", len(inspects)-done)
+			return summary, err
+		}
+		done += len(batch)
+		removeSpan := startSpan(summary.span, "remove containers", "count", strconv.Itoa(len(batch)))
+		batch, err := removeContainers(batch, repo, tag)
+		removeSpan.end(err)
+		if err != nil {
+			// removed ones of the batch are down too
+			return summary, rollbackAll(append(updated, removedContainers(batch)...), summary, err)
+		}
+		if order == orderStopFirst && n == 0 {
+			if err := summary.pull(fullRepo); err != nil {
+				return summary, rollbackAll(append(updated, removedContainers(batch)...), summary, err)
+			}
+		}
+
+		logrus.Infof("recreating %d containers...", len(batch))
+		var errs []string
+		for i, res := range recreateContainers(batch, repo, tag, summary.Overrides, summary.trigger, summary.span) {
+			switch {
+			case res.err != nil:
+				errs = append(errs, res.err.Error())
+				summary.containerFailed(batch[i], res.created, res.err)
+				if summary.continueOnFailure() {
+					summary.Failed++
+					restoreFailed(batch[i], res.id)
+					continue
+				}
+				updated = append(updated, recreatedContainer{prev: batch[i], newID: res.id})
+			case res.unhealthy != nil:
+				summary.Failed++
+				summary.containerFailed(batch[i], res.created, res.unhealthy)
+				failures = append(failures, res.unhealthy.Error())
+			default:
+				summary.containerUpdated(batch[i], res.created, res.health)
+				updated = append(updated, recreatedContainer{prev: batch[i], newID: res.id})
+				if img := cleanupCandidate(batch[i]); img != "" && res.created.Image != batch[i].Image {
+					prevImages = append(prevImages, img)
+				}
+			}
+		}
+		if len(errs) > 0 && !summary.continueOnFailure() {
+			return summary, rollbackAll(updated, summary, _err("%s", strings.Join(errs, "; ")))
+		}
+		failures = append(failures, errs...)
+		if n == 0 && config().canaryWait(repo) > 0 && len(inspects) > 1 {
+			if len(failures) == 0 && len(updated) == 1 {
+				if err := canaryPassed(repo, summary, &updated); err != nil {
+					failures = append(failures, err.Error())
+				}
+			}
+			// a failed canary calls the rest off
+			canaryFailed = len(failures) > 0
+		}
+	}
+
+	if len(failures) == 0 {
+		if err := restartDependents(summary.dependents); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 && summary.allOrNothing() {
+		return summary, rollbackAll(updated, summary, _err("updating containers for repo %s failed: %s", fullRepo, strings.Join(failures, "; ")))
+	}
+
+	if len(prevImages) > 0 {
+		logrus.Infof("clearing previous not actual images for %s...", fullRepo)
+		removeImages(prevImages)
+	}
+
+	if len(failures) > 0 {
+		return summary, _err("updating containers for repo %s failed: %s", fullRepo, strings.Join(failures, "; "))
+	}
+
+	logrus.Infof("updating containers for repo %s done!", fullRepo)
+	return summary, nil
+
+}
+
+// containers of repo which should be updated to tag (running ones unless
+// stopped are included),
+// matched and skipped ones are counted in summary
+func matchContainers(repo, tag string, summary *updateSummary) ([]types.Container, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, _err("get containers list error: %s", err.Error())
 	}
 
 	var toUpdate []types.Container
 	var containerImages []string
+	remote := &remoteDigest{image: fmt.Sprintf("%s:%s", repo, tag)}
+	wanted := normalizeRepo(repo)
 	for _, cnt := range containers {
+		if !includeContainer(cnt) {
+			continue
+		}
 		containerImages = append(containerImages, cnt.Image)
-		iParts := strings.Split(cnt.Image, ":")
-		var cRepo, cTag = iParts[0], ""
-		if len(iParts) > 1 {
-			cTag = iParts[1]
+		cRepo, cTag := splitImage(containerImage(cnt))
+		if _, ok := cnt.Labels[labelSmokeTest]; ok || cRepo != wanted {
+			continue
 		}
+		ref := containerRefs([]types.Container{cnt})[0]
 		if cTag == "" {
-			cTag = latest
-		}
-		if cRepo == repo {
-			var upd bool
-			var cVer, ver *semver.Version
-			var vErr error
-			if cTag == latest {
-				upd = tag == cTag
+			logrus.Infof("container %s image %s is pinned by digest without %s label, skipped", cnt.ID, cnt.Image, labelTag)
+			summary.skip(ref, "pinned by digest without "+labelTag+" label")
+			continue
+		}
+		if !managed(cnt.Labels) {
+			logrus.Infof("container %s is not managed (%s), skipped", cnt.ID, labelEnable)
+			summary.skip(ref, "not managed")
+			continue
+		}
+		if onlyContainer != "" && !strings.HasPrefix(cnt.ID, onlyContainer) {
+			continue
+		}
+		if isSelf(cnt.ID) {
+			if !config().SelfUpdate {
+				logrus.Warnf("container %s is the updater itself, self-update skipped", cnt.ID)
+				summary.skip(ref, "updater itself, self-update disabled")
+			} else if wantUpdate("container "+cnt.ID, cRepo, cnt.Labels, cTag, tag, remote, func() []string { return imageDigests(cnt.ImageID) }) {
+				logrus.Infof("container %s is the updater itself, it is updated after others", cnt.ID)
+				summary.skip(ref, "updater itself, updated after others by a helper container")
+				summary.selfUpdate = true
 			} else {
-				if cVer, vErr = semver.NewVersion(cTag); vErr != nil {
-					logrus.Errorf("error parsing existing container tag %s: %s", cTag, vErr)
-					continue
-				}
-				if ver, vErr = semver.NewVersion(tag); vErr != nil {
-					logrus.Errorf("error parsing existing container tag %s: %s", tag, vErr)
-					continue
-				}
-				upd =
-					cVer.Prerelease() == ver.Prerelease() &&
-						cVer.Metadata() == ver.Metadata() &&
-						cVer.LessThan(ver)
-			}
-			if upd {
-				c := cnt
-				toUpdate = append(toUpdate, c)
-				logrus.Infof("to update %s:%s -> %s", cRepo, cVer.String(), ver.String())
+				summary.skip(ref, "no update needed")
 			}
+			continue
+		}
+		if cnt.Labels[labelSwarmService] != "" {
+			logrus.Infof("container %s is a swarm service task, skipped (use %s mode)", cnt.ID, modeSwarm)
+			summary.skip(ref, "swarm service task")
+			continue
+		}
+		digests := func() []string { return imageDigests(cnt.ImageID) }
+		if wantUpdate("container "+cnt.ID, cRepo, cnt.Labels, cTag, tag, remote, digests) ||
+			summary.AllowDowngrade && wantDowngrade("container "+cnt.ID, cRepo, cnt.Labels, cTag, tag) {
+			c := cnt
+			toUpdate = append(toUpdate, c)
+			summary.Matched++
+			summary.OldTags[cTag] = true
+			summary.MatchedContainers = append(summary.MatchedContainers, ref)
+			logrus.Infof("to update %s:%s -> %s", cRepo, cTag, tag)
+		} else {
+			// pinned, constrained, not newer or same digest
+			summary.skip(ref, "no update needed")
 		}
 	}
 	if len(containerImages) > 0 {
 		logrus.Infof("existing containers images: %s", strings.Join(containerImages, ", "))
 	}
-	if len(toUpdate) == 0 {
-		logrus.Infof("no containers should be updated with image %s found, skipped", fullRepo)
-		return nil
+	return toUpdate, nil
+}
+
+// image reference to repo in familiar form (nginx, org/app,
+// registry.local:5000/app) and tag; tag defaults to latest and is empty for
+// references by digest only (repo@sha256:...)
+func splitImage(image string) (string, string) {
+	named, err := parseRepoName(image)
+	if err != nil {
+		return image, latest
+	}
+	repo := reference.FamiliarName(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		return repo, tagged.Tag()
 	}
+	if _, ok := named.(reference.Digested); ok {
+		return repo, ""
+	}
+	return repo, latest
+}
+
+// repo in splitImage form, so docker.io/library/nginx is nginx
+func normalizeRepo(repo string) string {
+	named, err := parseRepoName(repo)
+	if err != nil {
+		return repo
+	}
+	return reference.FamiliarName(named)
+}
+
+// other names of docker hub, index.docker.io is normalized by reference
+var hubAliases = []string{"registry-1.docker.io/", "registry.hub.docker.com/"}
+
+// normalized (docker.io/library/nginx) name of image reference or repo,
+// docker hub aliases included
+func parseRepoName(ref string) (reference.Named, error) {
+	for _, alias := range hubAliases {
+		if strings.HasPrefix(ref, alias) {
+			ref = "docker.io/" + strings.TrimPrefix(ref, alias)
+			break
+		}
+	}
+	return reference.ParseNormalizedNamed(ref)
+}
+
+// whether tag is a lower version than cTag, prerelease and metadata rules are
+// those of shouldUpdate
+func isDowngrade(policy, cTag, tag string) bool {
+	cVer, err := semver.NewVersion(cTag)
+	if err != nil {
+		return false
+	}
+	ver, err := semver.NewVersion(tag)
+	if err != nil {
+		return false
+	}
+	if !prereleaseAllowed(policy, cVer, ver) {
+		return false
+	}
+	if !config().IgnoreMetadata && cVer.Metadata() != ver.Metadata() {
+		return false
+	}
+	return ver.LessThan(cVer)
+}
+
+// whether image with tag cTag should be updated to tag, prerelease tags as
+// policy allows
+func shouldUpdate(policy, cTag, tag string) bool {
+	if cTag == latest {
+		return tag == cTag
+	}
+	cVer, err := semver.NewVersion(cTag)
+	if err != nil {
+		logrus.Errorf("error parsing existing container tag %s: %s", cTag, err)
+		return false
+	}
+	ver, err := semver.NewVersion(tag)
+	if err != nil {
+		logrus.Errorf("error parsing existing container tag %s: %s", tag, err)
+		return false
+	}
+	if !prereleaseAllowed(policy, cVer, ver) {
+		return false
+	}
+	if !config().IgnoreMetadata && cVer.Metadata() != ver.Metadata() {
+		return false
+	}
+	return cVer.LessThan(ver)
+}
 
+func pullImage(fullRepo string) error {
 	pn, err := reference.ParseNormalizedNamed(fullRepo)
 	if err != nil {
 		return _err("parse container name %s error: %s", fullRepo, err.Error())
 	}
+	if err := checkDiskSpace(); err != nil {
+		return err
+	}
 	logrus.Infof("pulling repo %s...", fullRepo)
+	emitEvent(updateEvent{Type: eventTypePullStarted, Image: fullRepo})
 	pullStart := time.Now()
-	out, err := cli.ImagePull(ctx, pn.String(), types.ImagePullOptions{})
-	if err != nil {
-		return _err("pull image %s error: %s", fullRepo, err.Error())
+	pull := func(ref, auth string) error {
+		return retry("pull of "+ref, func() error {
+			pullCtx, cancel := ctx, context.CancelFunc(func() {})
+			if config().PullTimeout > 0 {
+				pullCtx, cancel = context.WithTimeout(ctx, config().PullTimeout)
+			}
+			defer cancel()
+			out, err := cli.ImagePull(pullCtx, ref, types.ImagePullOptions{
+				RegistryAuth: auth,
+				Platform:     pullPlatform(),
+			})
+			if err != nil {
+				return _err("pull image %s error: %s", ref, err.Error())
+			}
+			defer func() {
+				if err := out.Close(); err != nil {
+					logrus.Errorf("error closing image pooling: %s", err)
+				}
+			}()
+			return readPullProgress(fullRepo, out)
+		})
 	}
-	defer func() {
-		if err := out.Close(); err != nil {
-			logrus.Errorf("error closing image pooling: %s", err)
+	done, err := pullMirrored(pn.String(), pull)
+	if !done {
+		var auth string
+		if auth, err = registryAuth(fullRepo); err == nil {
+			err = pull(pn.String(), auth)
 		}
-	}()
-	_, _ = io.Copy(ioutil.Discard, out)
+	}
+	if err != nil {
+		return err
+	}
 	logrus.Infof("repo %s pulled for %v", fullRepo, time.Since(pullStart))
+	emitEvent(updateEvent{Type: eventTypePullFinished, Image: fullRepo})
+	repo, _ := splitImage(fullRepo)
+	observeSince(pullDuration, repo, pullStart)
+	return checkPlatform(fullRepo)
+}
 
-	logrus.Infof("restarting %d containers...", len(toUpdate))
-	for _, cnt := range toUpdate {
-		inspect, err := cli.ContainerInspect(ctx, cnt.ID)
-		if err != nil {
-			return _err("inspect container %s error: %s", cnt.ID, err.Error())
+// new containers are created from the pulled tag, so it must be of
+// target platform
+func checkPlatform(fullRepo string) error {
+	platform := targetPlatform()
+	if platform == "" {
+		return nil
+	}
+	img, _, err := cli.ImageInspectWithRaw(ctx, fullRepo)
+	if err != nil {
+		return _err("inspect image %s error: %s", fullRepo, err.Error())
+	}
+	if !strings.HasPrefix(platform+"/", img.Os+"/"+img.Architecture+"/") {
+		return _err("pulled image %s is %s/%s, expected %s", fullRepo, img.Os, img.Architecture, platform)
+	}
+	return nil
+}
+
+// removes containers whose pre-update hook passed with up to
+// cfg.RecreateConcurrency parallel workers, each one running its hooks first;
+// returns removed ones in given order, and errors of all failed removals
+func removeContainers(inspects []types.ContainerJSON, repo, tag string) ([]types.ContainerJSON, error) {
+	logrus.Infof("removing %d containers...", len(inspects))
+	ok := make([]bool, len(inspects))
+	errs := make([]error, len(inspects))
+	sem := make(chan struct{}, config().RecreateConcurrency)
+	var wg sync.WaitGroup
+	for i, inspect := range inspects {
+		wg.Add(1)
+		go func(i int, inspect types.ContainerJSON) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := runHook(hookPre, repo, tag, inspect, inspect); err != nil {
+				logrus.Errorf("%s, container update aborted", err)
+				return
+			}
+			if err := drainContainer(repo, tag, inspect); err != nil {
+				logrus.Errorf("%s, container update aborted", err)
+				return
+			}
+			if err := runLifecycleHook(hookPre, inspect); err != nil {
+				logrus.Errorf("%s, container update aborted", err)
+				registerContainer(repo, tag, inspect, inspect)
+				return
+			}
+			if err := snapshotContainer(inspect); err != nil {
+				logrus.Errorf("%s, container update aborted", err)
+				registerContainer(repo, tag, inspect, inspect)
+				return
+			}
+			if errs[i] = removeContainer(inspect); errs[i] == nil {
+				ok[i] = true
+			}
+		}(i, inspect)
+	}
+	wg.Wait()
+	var removed []types.ContainerJSON
+	var failed []string
+	for i, inspect := range inspects {
+		if ok[i] {
+			removed = append(removed, inspect)
+		} else if errs[i] != nil {
+			failed = append(failed, errs[i].Error())
 		}
-		prevImageId := inspect.Image
-		if err = cli.ContainerRemove(ctx, cnt.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
-			return _err("remove container %s error: %s", cnt.ID, err.Error())
+	}
+	if len(failed) > 0 {
+		return removed, _err("%s", strings.Join(failed, "; "))
+	}
+	return removed, nil
+}
+
+// stops container gracefully (its stop signal, SIGTERM by default, then
+// SIGKILL after stopTimeout) and removes it, forced removal covers a failed
+// stop; podman kills containers on forced removal right away, so failed stop
+// fails there
+func removeContainer(inspect types.ContainerJSON) error {
+	podman := isPodman()
+	if isRunning(inspect) {
+		timeout := stopTimeout(inspect)
+		if err := cli.ContainerStop(ctx, inspect.ID, &timeout); err != nil {
+			if podman {
+				return _err("stop container %s error: %s", inspect.ID, err.Error())
+			}
+			logrus.Warnf("stop container %s error: %s, removing it forcibly", inspect.ID, err)
 		}
-		var contConfig *container.Config
-		if inspect.Config != nil {
-			contConfig = inspect.Config
+	}
+	if err := cli.ContainerRemove(ctx, inspect.ID, types.ContainerRemoveOptions{Force: !podman}); err != nil {
+		return _err("remove container %s error: %s", inspect.ID, err.Error())
+	}
+	if inspect.Config != nil {
+		emitContainerEvent(eventTypeContainerRemoved, inspect.Name, inspect.Config.Image)
+	}
+	return nil
+}
+
+// docker-updater.stop-timeout label, then container's own stop timeout
+// (docker run --stop-timeout), then cfg.StopTimeout
+func stopTimeout(inspect types.ContainerJSON) time.Duration {
+	if inspect.Config == nil {
+		return config().StopTimeout
+	}
+	if v := inspect.Config.Labels[labelStopTimeout]; v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err == nil && timeout >= 0 {
+			return timeout
 		}
-		contConfig.Image = strings.TrimSuffix(fullRepo, ":"+latest)
+		logrus.Warnf("container %s has invalid %s=%s, using default", inspect.ID, labelStopTimeout, v)
+	}
+	if inspect.Config.StopTimeout != nil {
+		return time.Duration(*inspect.Config.StopTimeout) * time.Second
+	}
+	return config().StopTimeout
+}
+
+type recreateResult struct {
+	created types.ContainerJSON
+	// created container, possibly left after error
+	id  string
+	err error
+	// health check failed, container was rolled back
+	unhealthy error
+	// health wait outcome, empty when not waited
+	health string
+}
 
-		var networkingConfig *network.NetworkingConfig
-		if inspect.NetworkSettings != nil && inspect.NetworkSettings.Networks != nil {
-			networkingConfig = &network.NetworkingConfig{
-				EndpointsConfig: inspect.NetworkSettings.Networks,
+// recreates removed containers with up to cfg.RecreateConcurrency parallel
+// workers, each one checked for health and followed by post-update hook
+func recreateContainers(inspects []types.ContainerJSON, repo, tag string, overrides *containerOverrides, trigger string, trace *span) []recreateResult {
+	fullRepo := fmt.Sprintf("%s:%s", repo, tag)
+	results := make([]recreateResult, len(inspects))
+	sem := make(chan struct{}, config().RecreateConcurrency)
+	var wg sync.WaitGroup
+	for i, inspect := range inspects {
+		wg.Add(1)
+		go func(i int, inspect types.ContainerJSON) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			defer observeSince(recreateDuration, repo, time.Now())
+			s := startSpan(trace, "recreate container", "container", strings.TrimPrefix(inspect.Name, "/"))
+			defer func() {
+				if results[i].err != nil {
+					s.end(results[i].err)
+				} else {
+					s.end(results[i].unhealthy)
+				}
+			}()
+			created, err := recreateContainer(inspect, fullRepo, overrides, trigger)
+			results[i].created = created
+			if created.ContainerJSONBase != nil {
+				results[i].id = created.ID
 			}
-		}
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			if !startRecreated(inspect) {
+				logrus.Infof("container %s was not running, recreated stopped", inspect.Name)
+			} else if results[i].health, err = checkHealth(repo, inspect, created); err != nil {
+				logrus.Errorln(err)
+				results[i].unhealthy = err
+				return
+			}
+			if err := runLifecycleHook(hookPost, created); err != nil {
+				logrus.Errorln(err)
+				results[i].unhealthy = lifecycleRollback(inspect, created, err)
+				return
+			}
+			if err := runHook(hookPost, repo, tag, created, inspect); err != nil {
+				logrus.Errorln(err)
+			}
+			registerContainer(repo, tag, created, inspect)
+		}(i, inspect)
+	}
+	wg.Wait()
+	return results
+}
 
-		created, err := cli.ContainerCreate(ctx, contConfig, inspect.HostConfig, networkingConfig, inspect.Name)
-		if err != nil {
-			return _err("create new container error: %s", err.Error())
+// create and start a new container from the removed one's inspect data
+func recreateContainer(inspect types.ContainerJSON, fullRepo string, overrides *containerOverrides, trigger string) (types.ContainerJSON, error) {
+	id, err := createContainer(newContainerConfig(inspect, fullRepo, overrides, trigger), inspect)
+	if err != nil {
+		var failed types.ContainerJSON
+		if id != "" {
+			failed.ContainerJSONBase = &types.ContainerJSONBase{ID: id}
 		}
-		if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
-			return _err("start new container error: %s", err.Error())
+		return failed, _err("create new container error: %s", err.Error())
+	}
+	// stopped container stays stopped unless its policy starts it
+	if startRecreated(inspect) {
+		if err := cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+			failed := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: id}}
+			return failed, _err("start new container error: %s", err.Error())
 		}
+		emitContainerEvent(eventTypeContainerStarted, inspect.Name, fullRepo)
+	}
 
-		inspect, err = cli.ContainerInspect(ctx, created.ID)
-		if prevImageId != inspect.Image {
-			logrus.Infof("clearing previous not actual images for %s...", fullRepo)
-			rm, err := cli.ImageRemove(ctx, prevImageId, types.ImageRemoveOptions{})
-			if err != nil {
-				logrus.Errorf("remove previous image error: %s", err)
-			} else {
-				for _, rmi := range rm {
-					if rmi.Untagged != "" {
-						logrus.Infof(" - untagged: %s", rmi.Untagged)
-					}
-					if rmi.Deleted != "" {
-						logrus.Infof(" - deleted: %s", rmi.Deleted)
-					}
+	return cli.ContainerInspect(ctx, id)
+}
+
+// config of container replacing inspected one on fullRepo image for
+// trigger, with overrides (if any) applied
+func newContainerConfig(inspect types.ContainerJSON, fullRepo string, overrides *containerOverrides, trigger string) *container.Config {
+	// copy to keep previous config intact for rollback
+	contConfig := &container.Config{}
+	if inspect.Config != nil {
+		prevConfig := *inspect.Config
+		contConfig = &prevConfig
+	}
+	contConfig.Image = pinnedImage(fullRepo)
+	contConfig.Labels = previousLabels(inspect, trigger)
+	contConfig.Labels[labelTag] = strings.TrimSuffix(fullRepo, ":"+latest)
+	overrides.apply(contConfig)
+	return contConfig
+}
+
+// creates container like inspected one with given config, keeping its labels
+// (given config ones take precedence), restart policy, anonymous volumes and
+// networks; docker attaches a single network on create, others are connected
+// afterwards with their aliases, links and static IPs
+func createContainer(contConfig *container.Config, inspect types.ContainerJSON) (string, error) {
+	labels := make(map[string]string)
+	if inspect.Config != nil {
+		for k, v := range inspect.Config.Labels {
+			// ones an image baked in are not passed on as run-time ones
+			if isHookLabel(k) && runtimeLabel(inspect, k) == "" {
+				continue
+			}
+			labels[k] = v
+		}
+	}
+	for k, v := range contConfig.Labels {
+		labels[k] = v
+	}
+	contConfig.Labels = labels
+	hostConfig := &container.HostConfig{}
+	if inspect.HostConfig != nil {
+		prevHostConfig := *inspect.HostConfig
+		hostConfig = &prevHostConfig
+		hostConfig.RestartPolicy = inspect.HostConfig.RestartPolicy
+		keepAnonymousVolumes(hostConfig, inspect)
+	}
+
+	var networkingConfig *network.NetworkingConfig
+	extra := make(map[string]*network.EndpointSettings)
+	if inspect.NetworkSettings != nil && len(inspect.NetworkSettings.Networks) > 0 && !(isPodman() && isPodmanPrivateNetwork(hostConfig.NetworkMode)) {
+		primary := hostConfig.NetworkMode.NetworkName()
+		if hostConfig.NetworkMode.IsDefault() {
+			// docker CLI default, attached to bridge on create
+			primary = "bridge"
+		}
+		if isPodman() && (hostConfig.NetworkMode.IsBridge() || hostConfig.NetworkMode.IsDefault()) {
+			primary = podmanDefaultNetwork
+		}
+		for name, es := range inspect.NetworkSettings.Networks {
+			es = endpointConfig(es, inspect.ID)
+			if name == primary || len(inspect.NetworkSettings.Networks) == 1 {
+				networkingConfig = &network.NetworkingConfig{
+					EndpointsConfig: map[string]*network.EndpointSettings{name: es},
 				}
+			} else {
+				extra[name] = es
 			}
 		}
+	}
 
+	created, err := cli.ContainerCreate(ctx, contConfig, hostConfig, networkingConfig, inspect.Name)
+	if err != nil {
+		return "", err
+	}
+	emitContainerEvent(eventTypeContainerCreated, inspect.Name, contConfig.Image)
+	for name, es := range extra {
+		if err := cli.NetworkConnect(ctx, name, created.ID, es); err != nil {
+			return created.ID, _err("connect to network %s error: %s", name, err.Error())
+		}
 	}
+	return created.ID, nil
+}
 
-	logrus.Infof("updating containers for repo %s done!", fullRepo)
-	return nil
+// user settings of container's network endpoint, without operational data of
+// the old endpoint and the alias docker adds for old container ID
+func endpointConfig(es *network.EndpointSettings, id string) *network.EndpointSettings {
+	conf := &network.EndpointSettings{}
+	if es == nil {
+		return conf
+	}
+	conf.IPAMConfig, conf.Links, conf.DriverOpts = es.IPAMConfig, es.Links, es.DriverOpts
+	for _, alias := range es.Aliases {
+		if len(id) < 12 || alias != id[:12] {
+			conf.Aliases = append(conf.Aliases, alias)
+		}
+	}
+	return conf
+}
 
+func isRunning(inspect types.ContainerJSON) bool {
+	return inspect.State != nil && inspect.State.Running
 }
 
 func _err(format string, args ...interface{}) error {
 	var msg = fmt.Sprintf(format, args...)
 	return errors.New(msg)
 }
+
+func _httpErr(code int, format string, args ...interface{}) error {
+	return echo.NewHTTPError(code, fmt.Sprintf(format, args...))
+}
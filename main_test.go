@@ -0,0 +1,899 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/labstack/echo"
+)
+
+// ======= FAKE DOCKER ======
+
+// docker engine API of containers and images kept in memory; every call
+// changing them is recorded as "<action> <name>", e.g. "stop app-1"
+type fakeDocker struct {
+	sync.Mutex
+	t   *testing.T
+	srv *httptest.Server
+	// in creation order
+	containers []*types.ContainerJSON
+	// by reference and ID
+	images map[string]*types.ImageInspect
+	// image a pull of the reference gets, pulls of others fail
+	registry map[string]*types.ImageInspect
+	// registry replies of DistributionInspect other than 200 by reference
+	distStatus map[string]int
+	// health status containers of an image (by ID) report once started
+	health map[string]string
+	calls  []string
+	nextID int
+	// stop timeout (seconds) containers were stopped with, and whether they
+	// were removed forcibly, by name
+	stopTimeouts map[string]string
+	forced       map[string]bool
+	// image removals take that long, the most of them at once is recorded
+	rmiDelay           time.Duration
+	rmiActive, rmiPeak int
+	// pulls wait until it is closed
+	pullGate chan struct{}
+	// version components of the engine serving the API
+	components []string
+	// exit codes of waited containers and of execs by command, negative
+	// ones never exit
+	exits map[string]int
+	// commands of created execs, by exec ID
+	execs []string
+	// containers removed so far
+	removed []*types.ContainerJSON
+	// daemon is a swarm manager
+	swarmManager bool
+}
+
+// fake docker the global client talks to until the returned func restores it
+func newFakeDocker(t *testing.T) (*fakeDocker, func()) {
+	f := &fakeDocker{
+		t:            t,
+		images:       make(map[string]*types.ImageInspect),
+		registry:     make(map[string]*types.ImageInspect),
+		distStatus:   make(map[string]int),
+		health:       make(map[string]string),
+		stopTimeouts: make(map[string]string),
+		forced:       make(map[string]bool),
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	c, err := client.NewClient("tcp://"+strings.TrimPrefix(f.srv.URL, "http://"), "1.35", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevCli, prevPodman := cli, podmanHosts[currentHost]
+	cli, podmanHosts[currentHost] = c, false
+	return f, func() {
+		cli, podmanHosts[currentHost] = prevCli, prevPodman
+		f.srv.Close()
+	}
+}
+
+// sets cfg fields for a test, the returned func restores them
+func withConfig(set func(c *Config)) func() {
+	cfg := config()
+	prev := *cfg
+	set(cfg)
+	return func() { *cfg = prev }
+}
+
+// transport of client sending its requests to srv instead of their host,
+// which srv still gets in r.Host; the returned func restores the client
+func redirectClient(client *http.Client, srv *httptest.Server) func() {
+	prev := client.Transport
+	client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		r := *req
+		u := *req.URL
+		u.Scheme, u.Host = "http", strings.TrimPrefix(srv.URL, "http://")
+		r.URL = &u
+		return http.DefaultTransport.RoundTrip(&r)
+	})
+	return func() { client.Transport = prev }
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func containerID(n int) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprint(n))))
+}
+
+func newImageID(ref string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ref)))
+}
+
+// image of ref, present locally and (as pulled) in the registry
+func (f *fakeDocker) addImage(ref string, labels map[string]string) *types.ImageInspect {
+	f.Lock()
+	defer f.Unlock()
+	img := f.newImage(ref, labels)
+	f.store(ref, img)
+	return img
+}
+
+// img known locally by ref, ID and repo digests
+func (f *fakeDocker) store(ref string, img *types.ImageInspect) {
+	f.images[ref], f.images[img.ID] = img, img
+	for _, d := range img.RepoDigests {
+		f.images[d] = img
+	}
+}
+
+// image pulls of ref get
+func (f *fakeDocker) pushImage(ref string, labels map[string]string) *types.ImageInspect {
+	f.Lock()
+	defer f.Unlock()
+	img := f.newImage(ref+"#pushed", labels)
+	img.RepoTags = []string{ref}
+	repo, _ := splitImage(ref)
+	img.RepoDigests = []string{repo + "@" + newImageID(ref+"#digest")}
+	f.registry[ref] = img
+	return img
+}
+
+func (f *fakeDocker) newImage(seed string, labels map[string]string) *types.ImageInspect {
+	repo, _ := splitImage(seed)
+	return &types.ImageInspect{
+		ID:           newImageID(seed),
+		RepoTags:     []string{strings.TrimSuffix(seed, "#pushed")},
+		RepoDigests:  []string{repo + "@" + newImageID(seed+"#digest")},
+		Os:           "linux",
+		Architecture: "amd64",
+		Config:       &container.Config{Labels: labels},
+	}
+}
+
+// running container of image ref (added with addImage unless present),
+// labels are the run-time ones
+func (f *fakeDocker) addContainer(name, ref string, labels map[string]string) *types.ContainerJSON {
+	f.Lock()
+	img, ok := f.images[ref]
+	f.Unlock()
+	if !ok {
+		img = f.addImage(ref, nil)
+	}
+	f.Lock()
+	defer f.Unlock()
+	all := make(map[string]string)
+	for k, v := range img.Config.Labels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	f.nextID++
+	c := &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         containerID(f.nextID),
+			Name:       "/" + name,
+			Image:      img.ID,
+			State:      &types.ContainerState{Status: "running", Running: true},
+			HostConfig: &container.HostConfig{NetworkMode: "default"},
+		},
+		Config: &container.Config{Image: ref, Labels: all},
+		NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: fmt.Sprintf("172.17.0.%d", f.nextID+1)},
+		}},
+	}
+	f.containers = append(f.containers, c)
+	return c
+}
+
+// recorded calls, optionally only those starting with one of prefixes
+func (f *fakeDocker) recorded(prefixes ...string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var calls []string
+	for _, call := range f.calls {
+		if len(prefixes) == 0 {
+			calls = append(calls, call)
+			continue
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(call, p) {
+				calls = append(calls, call)
+				break
+			}
+		}
+	}
+	return calls
+}
+
+// container by ID, ID prefix or name
+func (f *fakeDocker) container(ref string) *types.ContainerJSON {
+	f.Lock()
+	defer f.Unlock()
+	return f.find(ref)
+}
+
+func (f *fakeDocker) find(ref string) *types.ContainerJSON {
+	for _, c := range f.containers {
+		if c.ID == ref || strings.HasPrefix(c.ID, ref) && len(ref) >= 12 || c.Name == "/"+strings.TrimPrefix(ref, "/") {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *fakeDocker) record(action, name string) {
+	f.calls = append(f.calls, action+" "+strings.TrimPrefix(name, "/"))
+}
+
+// whether labels match every "key" or "key=value" of label filter
+func matchLabels(labels map[string]string, filter map[string]bool) bool {
+	for f := range filter {
+		kv := strings.SplitN(f, "=", 2)
+		v, ok := labels[kv[0]]
+		if !ok || len(kv) == 2 && v != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/v1.") {
+		path = path[strings.Index(path[1:], "/")+1:]
+	}
+	if f.rmiDelay > 0 && r.Method == http.MethodDelete && strings.HasPrefix(path, "/images/") {
+		f.Lock()
+		if f.rmiActive++; f.rmiActive > f.rmiPeak {
+			f.rmiPeak = f.rmiActive
+		}
+		f.Unlock()
+		time.Sleep(f.rmiDelay)
+		f.Lock()
+		f.rmiActive--
+		f.Unlock()
+	}
+	if f.pullGate != nil && path == "/images/create" {
+		<-f.pullGate
+	}
+	f.Lock()
+	defer f.Unlock()
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(code int, format string, args ...interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf(format, args...)})
+	}
+	switch {
+	case path == "/_ping":
+		w.Write([]byte("OK"))
+	case path == "/version":
+		v := types.Version{Version: "17.12.1-ce", APIVersion: "1.35"}
+		for _, name := range f.components {
+			v.Components = append(v.Components, types.ComponentVersion{Name: name, Version: v.Version})
+		}
+		reply(v)
+	case path == "/info":
+		var info types.Info
+		info.Swarm.ControlAvailable = f.swarmManager
+		reply(info)
+	case path == "/containers/json":
+		var filters map[string]map[string]bool
+		if v := r.URL.Query().Get("filters"); v != "" {
+			if err := json.Unmarshal([]byte(v), &filters); err != nil {
+				fail(http.StatusBadRequest, "%s", err)
+				return
+			}
+		}
+		var list []types.Container
+		for _, c := range f.containers {
+			if !matchLabels(c.Config.Labels, filters["label"]) {
+				continue
+			}
+			list = append(list, types.Container{
+				ID: c.ID, Names: []string{c.Name}, Image: c.Config.Image, ImageID: c.Image,
+				Labels: c.Config.Labels, State: c.State.Status,
+			})
+		}
+		reply(list)
+	case path == "/containers/create":
+		var body struct {
+			*container.Config
+			HostConfig       *container.HostConfig
+			NetworkingConfig *network.NetworkingConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fail(http.StatusBadRequest, "%s", err)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Query().Get("name"), "/")
+		if f.find(name) != nil {
+			fail(http.StatusConflict, "name %s is in use", name)
+			return
+		}
+		img, ok := f.images[body.Config.Image]
+		if !ok {
+			fail(http.StatusNotFound, "no such image: %s", body.Config.Image)
+			return
+		}
+		labels := make(map[string]string)
+		for k, v := range img.Config.Labels {
+			labels[k] = v
+		}
+		for k, v := range body.Config.Labels {
+			labels[k] = v
+		}
+		body.Config.Labels = labels
+		f.nextID++
+		c := &types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:         containerID(f.nextID),
+				Name:       "/" + name,
+				Image:      img.ID,
+				State:      &types.ContainerState{Status: "created"},
+				HostConfig: body.HostConfig,
+			},
+			Config:          body.Config,
+			NetworkSettings: &types.NetworkSettings{Networks: map[string]*network.EndpointSettings{}},
+		}
+		if body.NetworkingConfig != nil {
+			for n, es := range body.NetworkingConfig.EndpointsConfig {
+				c.NetworkSettings.Networks[n] = es
+			}
+		}
+		f.containers = append(f.containers, c)
+		f.record("create", name)
+		reply(container.ContainerCreateCreatedBody{ID: c.ID})
+	case strings.HasPrefix(path, "/containers/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/containers/"), "/")
+		c := f.find(parts[0])
+		if c == nil {
+			fail(http.StatusNotFound, "no such container: %s", parts[0])
+			return
+		}
+		action := ""
+		if len(parts) > 1 {
+			action = parts[1]
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			for i, other := range f.containers {
+				if other == c {
+					f.containers = append(f.containers[:i], f.containers[i+1:]...)
+					f.removed = append(f.removed, c)
+					break
+				}
+			}
+			f.record("remove", c.Name)
+			f.forced[strings.TrimPrefix(c.Name, "/")] = r.URL.Query().Get("force") == "1"
+			w.WriteHeader(http.StatusNoContent)
+		case action == "json":
+			reply(c)
+		case action == "start":
+			c.State.Running, c.State.Status = true, "running"
+			if status, ok := f.health[c.Image]; ok {
+				c.State.Health = &types.Health{Status: status}
+			}
+			f.record("start", c.Name)
+			w.WriteHeader(http.StatusNoContent)
+		case action == "stop" || action == "kill":
+			c.State.Running, c.State.Status = false, "exited"
+			f.record(action, c.Name)
+			f.stopTimeouts[strings.TrimPrefix(c.Name, "/")] = r.URL.Query().Get("t")
+			w.WriteHeader(http.StatusNoContent)
+		case action == "wait":
+			code := f.exits[strings.Join(c.Config.Cmd, " ")]
+			if code < 0 {
+				f.Unlock()
+				<-r.Context().Done()
+				f.Lock()
+				return
+			}
+			reply(container.ContainerWaitOKBody{StatusCode: int64(code)})
+		case action == "exec":
+			var body types.ExecConfig
+			json.NewDecoder(r.Body).Decode(&body)
+			f.execs = append(f.execs, strings.Join(body.Cmd, " "))
+			f.record("exec", c.Name+" "+body.Cmd[len(body.Cmd)-1])
+			reply(types.IDResponse{ID: strconv.Itoa(len(f.execs) - 1)})
+		case action == "rename":
+			name := strings.TrimPrefix(r.URL.Query().Get("name"), "/")
+			f.record("rename", c.Name+" "+name)
+			c.Name = "/" + name
+			w.WriteHeader(http.StatusNoContent)
+		case action == "restart" || action == "pause" || action == "unpause":
+			f.record(action, c.Name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			fail(http.StatusNotImplemented, "%s %s not faked", r.Method, path)
+		}
+	case strings.HasPrefix(path, "/exec/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/exec/"), "/")
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n >= len(f.execs) || len(parts) < 2 {
+			fail(http.StatusNotFound, "no such exec: %s", parts[0])
+			return
+		}
+		command := f.execs[n]
+		code := f.exits[command]
+		switch parts[1] {
+		case "start":
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				f.t.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			buf.Flush()
+			if code < 0 {
+				// until the client gives up
+				f.Unlock()
+				ioutil.ReadAll(conn)
+				f.Lock()
+				return
+			}
+			stdcopy.NewStdWriter(conn, stdcopy.Stdout).Write([]byte("ran " + command + "\n"))
+		case "json":
+			reply(types.ContainerExecInspect{ExecID: parts[0], ExitCode: code})
+		default:
+			fail(http.StatusNotImplemented, "%s %s not faked", r.Method, path)
+		}
+	case strings.HasPrefix(path, "/networks/") && strings.HasSuffix(path, "/connect"):
+		var body types.NetworkConnect
+		json.NewDecoder(r.Body).Decode(&body)
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/networks/"), "/connect")
+		if c := f.find(body.Container); c != nil {
+			c.NetworkSettings.Networks[name] = body.EndpointConfig
+			f.record("connect", c.Name+" "+name)
+		}
+		w.WriteHeader(http.StatusOK)
+	case path == "/images/create":
+		ref := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		f.record("pull", ref)
+		img, ok := f.registry[ref]
+		if !ok {
+			fail(http.StatusNotFound, "manifest for %s not found", ref)
+			return
+		}
+		if prev, ok := f.images[ref]; ok && prev.ID != img.ID {
+			prev.RepoTags = nil
+		}
+		f.store(ref, img)
+		reply(map[string]string{"status": "Status: Downloaded newer image for " + ref})
+	case path == "/images/json":
+		var list []types.ImageSummary
+		seen := make(map[string]bool)
+		for _, img := range f.images {
+			if !seen[img.ID] {
+				seen[img.ID] = true
+				list = append(list, types.ImageSummary{ID: img.ID, RepoTags: img.RepoTags, RepoDigests: img.RepoDigests, Labels: img.Config.Labels})
+			}
+		}
+		reply(list)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		ref := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		img, ok := f.images[ref]
+		if !ok {
+			img, ok = f.images[strings.TrimPrefix(ref, "docker.io/")]
+		}
+		if !ok {
+			fail(http.StatusNotFound, "no such image: %s", ref)
+			return
+		}
+		reply(img)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/tag"):
+		ref := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/tag")
+		img, ok := f.images[ref]
+		if !ok {
+			fail(http.StatusNotFound, "no such image: %s", ref)
+			return
+		}
+		target := r.URL.Query().Get("repo") + ":" + r.URL.Query().Get("tag")
+		img.RepoTags = append(img.RepoTags, target)
+		f.images[target] = img
+		f.record("tag", ref+" "+target)
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "/images/") && r.Method == http.MethodDelete:
+		ref := strings.TrimPrefix(path, "/images/")
+		img, ok := f.images[ref]
+		if !ok {
+			fail(http.StatusNotFound, "no such image: %s", ref)
+			return
+		}
+		for _, c := range f.containers {
+			if c.Image == img.ID {
+				fail(http.StatusConflict, "image %s is being used by container %s", ref, c.ID)
+				return
+			}
+		}
+		for k, other := range f.images {
+			if other == img {
+				delete(f.images, k)
+			}
+		}
+		f.record("rmi", ref)
+		reply([]types.ImageDeleteResponseItem{{Deleted: img.ID}})
+	case strings.HasPrefix(path, "/distribution/"):
+		ref := strings.TrimSuffix(strings.TrimPrefix(path, "/distribution/"), "/json")
+		if code, ok := f.distStatus[ref]; ok {
+			fail(code, "%s: distribution inspect of %s", strings.ToLower(http.StatusText(code)), ref)
+			return
+		}
+		img, ok := f.registry[ref]
+		if !ok {
+			img, ok = f.registry[strings.TrimPrefix(ref, "docker.io/")]
+		}
+		if !ok {
+			fail(http.StatusNotFound, "manifest unknown")
+			return
+		}
+		d := img.RepoDigests[0][strings.Index(img.RepoDigests[0], "@")+1:]
+		reply(map[string]interface{}{"Descriptor": map[string]interface{}{
+			"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": d, "size": 1024,
+		}})
+	default:
+		f.t.Logf("fake docker: %s %s not faked", r.Method, path)
+		fail(http.StatusNotImplemented, "%s %s not faked", r.Method, path)
+	}
+}
+
+// ======= UPDATES ======
+
+// index of call among calls, -1 when missing
+func callIndex(calls []string, call string) int {
+	for i, c := range calls {
+		if c == call {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPullOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		global   string
+		repo     map[string]string
+		sequence []string
+	}{
+		{"pull first", orderPullFirst, nil, []string{"pull org/app:1.0.1", "stop app-1", "remove app-1", "create app-1"}},
+		{"stop first", orderStopFirst, nil, []string{"stop app-1", "remove app-1", "pull org/app:1.0.1", "create app-1"}},
+		{"repo stop first", orderPullFirst, map[string]string{"org/app": orderStopFirst}, []string{"stop app-1", "remove app-1", "pull org/app:1.0.1", "create app-1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			defer withConfig(func(c *Config) {
+				c.PullOrder, c.RepoPullOrder = tc.global, tc.repo
+			})()
+			f.addContainer("app-1", "org/app:1.0.0", nil)
+			f.pushImage("org/app:1.0.1", nil)
+			if _, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			calls := f.recorded("pull", "stop", "remove", "create")
+			if len(calls) != len(tc.sequence) {
+				t.Fatalf("calls = %v, want %v", calls, tc.sequence)
+			}
+			for i := range calls {
+				if calls[i] != tc.sequence[i] {
+					t.Fatalf("calls = %v, want %v", calls, tc.sequence)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowedRepos(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed map[string]bool
+		repo    string
+		code    int
+	}{
+		{"allowed", map[string]bool{"org/app": true}, "org/app", 0},
+		{"disallowed", map[string]bool{"org/app": true}, "org/other", http.StatusForbidden},
+		{"empty list", nil, "org/other", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			defer withConfig(func(c *Config) { c.AllowedRepos = tc.allowed })()
+			f.addContainer("app-1", tc.repo+":1.0.0", nil)
+			f.pushImage(tc.repo+":1.0.1", nil)
+			summary, err := updateContainer(tc.repo, "1.0.1", updateOptions{})
+			if tc.code != 0 {
+				if he, ok := err.(*echo.HTTPError); !ok || he.Code != tc.code {
+					t.Fatalf("error = %v, want HTTP %d", err, tc.code)
+				}
+				if calls := f.recorded(); len(calls) != 0 {
+					t.Fatalf("docker called for disallowed repo: %v", calls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Updated != 1 {
+				t.Fatalf("updated = %d, want 1", summary.Updated)
+			}
+		})
+	}
+}
+
+func TestCheckRequestTag(t *testing.T) {
+	for _, tc := range []struct {
+		tag  string
+		code int
+	}{
+		{"", http.StatusBadRequest},
+		{"   ", http.StatusBadRequest},
+		{"1.0 ", http.StatusBadRequest},
+		{"v1/2", http.StatusBadRequest},
+		{"1.0:rc", http.StatusBadRequest},
+		{"-rc1", http.StatusBadRequest},
+		{"1.0.1", 0},
+		{"latest", 0},
+		{"stable_2024-01.1", 0},
+	} {
+		err := checkRequest("org/app", tc.tag)
+		if tc.code == 0 {
+			if err != nil {
+				t.Errorf("tag %q: %s", tc.tag, err)
+			}
+			continue
+		}
+		if he, ok := err.(*echo.HTTPError); !ok || he.Code != tc.code {
+			t.Errorf("tag %q: error = %v, want HTTP %d", tc.tag, err, tc.code)
+		}
+	}
+}
+
+func TestCheckRequestMalformedTagSkipsDocker(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	if _, err := updateContainer("org/app", "bad tag!", updateOptions{}); err == nil {
+		t.Fatal("malformed tag accepted")
+	}
+	if calls := f.recorded(); len(calls) != 0 {
+		t.Fatalf("docker called for malformed tag: %v", calls)
+	}
+}
+
+func TestWantUpdateMutableTagDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		changed bool
+	}{
+		{"same digest", false},
+		{"new digest", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			f.addContainer("app-1", "org/app:latest", nil)
+			pushed := f.pushImage("org/app:latest", nil)
+			if tc.changed {
+				pushed.RepoDigests = []string{"org/app@" + newImageID("org/app:latest#rebuilt")}
+			}
+			summary, err := updateContainer("org/app", latest, updateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pulls := f.recorded("pull")
+			if tc.changed && (summary.Updated != 1 || len(pulls) != 1) {
+				t.Fatalf("updated = %d, pulls = %v, want the changed image pulled and container updated", summary.Updated, pulls)
+			}
+			if !tc.changed && (summary.Matched != 0 || len(pulls) != 0) {
+				t.Fatalf("matched = %d, pulls = %v, want unchanged image skipped", summary.Matched, pulls)
+			}
+		})
+	}
+}
+
+// most containers stopped and not started again at once along calls
+func maxDown(calls []string) int {
+	down, max := 0, 0
+	for _, call := range calls {
+		switch {
+		case strings.HasPrefix(call, "stop "):
+			if down++; down > max {
+				max = down
+			}
+		case strings.HasPrefix(call, "start "):
+			down--
+		}
+	}
+	return max
+}
+
+func TestMaxUnavailableKeepsQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		maxUnavailable string
+		size           int
+	}{
+		{"1", 1},
+		{"50%", 2},
+		{"", 4},
+	} {
+		t.Run("max unavailable "+tc.maxUnavailable, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			defer withConfig(func(c *Config) {
+				c.MaxUnavailable, c.RepoMaxUnavailable = tc.maxUnavailable, nil
+				c.HealthWait, c.RepoHealthWait = time.Nanosecond, nil
+			})()
+			for i := 1; i <= 4; i++ {
+				f.addContainer(fmt.Sprintf("app-%d", i), "org/app:1.0.0", nil)
+			}
+			pushed := f.pushImage("org/app:1.0.1", nil)
+			f.health[pushed.ID] = types.Healthy
+
+			summary, err := updateContainer("org/app", "1.0.1", updateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Updated != 4 {
+				t.Errorf("updated = %d, want all 4", summary.Updated)
+			}
+			if down := maxDown(f.recorded("stop", "start")); down != tc.size {
+				t.Errorf("%d replicas down at once, want %d", down, tc.size)
+			}
+		})
+	}
+}
+
+func TestUnhealthyBatchStopsRollout(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.MaxUnavailable, c.RepoMaxUnavailable = "1", nil
+		c.HealthWait, c.RepoHealthWait = time.Nanosecond, nil
+		c.HealthTimeoutAction, c.RepoHealthTimeoutAction = healthRollback, nil
+		c.ContinueOnFailure, c.MaxFailures, c.RepoMaxFailures = false, "", nil
+	})()
+	for i := 1; i <= 3; i++ {
+		f.addContainer(fmt.Sprintf("app-%d", i), "org/app:1.0.0", nil)
+	}
+	pushed := f.pushImage("org/app:1.0.1", nil)
+	f.health[pushed.ID] = types.Unhealthy
+
+	summary, err := updateContainer("org/app", "1.0.1", updateOptions{})
+	if err == nil {
+		t.Fatal("unhealthy update succeeded")
+	}
+	if summary.Failed != 1 || summary.Updated != 0 {
+		t.Errorf("failed = %d, updated = %d, want only the first batch failed", summary.Failed, summary.Updated)
+	}
+	if stops := f.recorded("stop"); len(stops) != 1 {
+		t.Errorf("stopped = %v, want only the first replica", stops)
+	}
+	for i := 1; i <= 3; i++ {
+		if c := f.container(fmt.Sprintf("app-%d", i)); c == nil || !c.State.Running {
+			t.Errorf("app-%d not running", i)
+		}
+	}
+}
+
+func TestRecreateKeepsRestartPolicyLabelsNetworks(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	old := f.addContainer("app-1", "org/app:1.0.0", map[string]string{"team": "a", "com.example.role": "api"})
+	old.HostConfig.RestartPolicy = container.RestartPolicy{Name: "unless-stopped"}
+	old.NetworkSettings.Networks["backend"] = &network.EndpointSettings{
+		Aliases:    []string{"api", old.ID[:12]},
+		IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "10.1.0.5"},
+	}
+	f.pushImage("org/app:1.0.1", map[string]string{"team": "image-default"})
+
+	if _, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := f.container("app-1")
+	if c == nil || c.ID == old.ID {
+		t.Fatal("app-1 not recreated")
+	}
+	if c.HostConfig.RestartPolicy.Name != "unless-stopped" {
+		t.Errorf("restart policy = %q, want unless-stopped", c.HostConfig.RestartPolicy.Name)
+	}
+	for k, want := range map[string]string{"team": "a", "com.example.role": "api", labelTag: "org/app:1.0.1"} {
+		if got := c.Config.Labels[k]; got != want {
+			t.Errorf("label %s = %q, want %q", k, got, want)
+		}
+	}
+	if _, ok := c.NetworkSettings.Networks["bridge"]; !ok {
+		t.Error("bridge network not attached")
+	}
+	backend, ok := c.NetworkSettings.Networks["backend"]
+	if !ok {
+		t.Fatalf("backend network not attached: %v", c.NetworkSettings.Networks)
+	}
+	if len(backend.Aliases) != 1 || backend.Aliases[0] != "api" {
+		t.Errorf("backend aliases = %v, want api only", backend.Aliases)
+	}
+	if backend.IPAMConfig == nil || backend.IPAMConfig.IPv4Address != "10.1.0.5" {
+		t.Errorf("backend static IP not kept: %+v", backend.IPAMConfig)
+	}
+	if calls := f.recorded("connect"); len(calls) != 1 || calls[0] != "connect app-1 backend" {
+		t.Errorf("connects = %v, want backend connected after create", calls)
+	}
+}
+
+func TestGracefulStopBeforeRemove(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.StopTimeout = 25 * time.Second })()
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	f.addContainer("app-2", "org/app:1.0.0", map[string]string{labelStopTimeout: "1m"})
+	f.pushImage("org/app:1.0.1", nil)
+
+	if _, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	calls := f.recorded()
+	for name, timeout := range map[string]string{"app-1": "25", "app-2": "60"} {
+		stop, remove := callIndex(calls, "stop "+name), callIndex(calls, "remove "+name)
+		if stop < 0 || remove < stop {
+			t.Errorf("%s: stop at %d, remove at %d of %v, want stop first", name, stop, remove, calls)
+		}
+		if f.stopTimeouts[name] != timeout {
+			t.Errorf("%s stopped with timeout %ss, want %ss", name, f.stopTimeouts[name], timeout)
+		}
+		if !f.forced[name] {
+			t.Errorf("%s not force removed after stop", name)
+		}
+	}
+}
+
+func TestShouldUpdatePrereleaseMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		policy         string
+		ignoreMetadata bool
+		cTag, tag      string
+		want           bool
+	}{
+		{prereleaseExact, false, "1.2.3", "1.2.4", true},
+		{prereleaseExact, false, "1.2.3", "1.2.4-rc1", false},
+		{prereleaseExact, false, "1.2.3-rc1", "1.2.3-rc2", false},
+		{prereleaseExact, false, "1.2.3-rc1", "1.2.4-rc1", true},
+		{prereleaseExact, false, "1.2.3+build5", "1.2.4", false},
+		{prereleaseExact, false, "1.2.3+build5", "1.2.4+build5", true},
+		{prereleaseExact, true, "1.2.3+build5", "1.2.4", true},
+		{prereleaseExact, true, "1.2.3", "1.2.4-rc1", false},
+		{prereleaseAllow, false, "1.2.3", "1.2.4-rc1", true},
+		{prereleaseAllow, false, "1.2.3", "1.2.3-rc1", false},
+		{prereleaseAllow, false, "1.2.3+build5", "1.2.4-rc1", false},
+		{prereleaseAllow, true, "1.2.3+build5", "1.2.4-rc1+build6", true},
+		{prereleaseAllow, true, "1.2.4", "1.2.3", false},
+		{prereleaseExact, false, latest, latest, true},
+		{prereleaseExact, false, latest, "1.2.4", false},
+		{prereleaseExact, false, "1.2.3", "stable", false},
+	} {
+		func() {
+			defer withConfig(func(c *Config) { c.IgnoreMetadata = tc.ignoreMetadata })()
+			if got := shouldUpdate(tc.policy, tc.cTag, tc.tag); got != tc.want {
+				t.Errorf("%s, ignore metadata %v: %s -> %s = %v, want %v", tc.policy, tc.ignoreMetadata, tc.cTag, tc.tag, got, tc.want)
+			}
+		}()
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "strconv"
+
+// ======= MANAGED CONTAINERS ======
+
+// "true" opts container (or service) in to updates, "false" opts it out
+const labelEnable = "docker-updater.enable"
+
+// whether container with labels is updated at all: by its enable label,
+// otherwise unless cfg.OptIn
+func managed(labels map[string]string) bool {
+	if enabled, err := strconv.ParseBool(labels[labelEnable]); err == nil {
+		return enabled
+	}
+	return !config().OptIn
+}
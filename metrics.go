@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ======= METRICS ======
+
+var (
+	updatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_updater_updates_total",
+		Help: "Update calls by repo and outcome (success, failure, noop).",
+	}, []string{"repo", "outcome"})
+	updatesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "docker_updater_updates_in_flight",
+		Help: "Updates running now.",
+	})
+	pullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "docker_updater_pull_duration_seconds",
+		Help:    "Image pull duration by repo.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"repo"})
+	recreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "docker_updater_recreate_duration_seconds",
+		Help:    "Container recreate duration (including health check) by repo.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"repo"})
+	webhookRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_updater_webhook_requests_total",
+		Help: "Webhook requests by endpoint and result (accepted, rejected).",
+	}, []string{"endpoint", "result"})
+	prunedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_updater_pruned_total",
+		Help: "Pruned objects by kind (images, networks, volumes).",
+	}, []string{"kind"})
+	prunedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_updater_pruned_bytes_total",
+		Help: "Disk space reclaimed by pruning by kind.",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(updatesTotal, updatesInFlight, pullDuration, recreateDuration, webhookRequests, prunedTotal, prunedBytes)
+}
+
+func observeSince(h *prometheus.HistogramVec, repo string, start time.Time) {
+	h.WithLabelValues(repo).Observe(time.Since(start).Seconds())
+}
+
+// counts webhook requests, ones answered with 4xx/5xx as rejected
+func countWebhook(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			code := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			} else if err != nil {
+				code = http.StatusInternalServerError
+			}
+			result := "accepted"
+			if code >= 400 {
+				result = "rejected"
+			}
+			webhookRequests.WithLabelValues(endpoint, result).Inc()
+			return err
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+)
+
+// ======= REGISTRY MIRRORS ======
+
+// tagged images of a mirrored registry are pulled from its mirror (a
+// pull-through cache) and tagged with their own name, registry API calls go
+// there too; the mirror tag is kept, since the image's repo digest is the
+// mirror one only; images pinned by digest are always pulled from their
+// registry, since the pulled image couldn't be referenced by its own digest
+
+// mirror reference of tagged image whose registry has a mirror
+func mirrored(image string) (string, bool) {
+	pn, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", false
+	}
+	tagged, ok := pn.(reference.NamedTagged)
+	if !ok {
+		return "", false
+	}
+	if _, digest := pn.(reference.Canonical); digest {
+		return "", false
+	}
+	mirror, ok := config().RegistryMirrors[reference.Domain(pn)]
+	if !ok {
+		return "", false
+	}
+	return mirror + "/" + reference.Path(pn) + ":" + tagged.Tag(), true
+}
+
+// reference registry calls for image go to: its mirror one or itself
+func registryRef(image string) string {
+	if ref, ok := mirrored(image); ok {
+		return ref
+	}
+	return image
+}
+
+// "https://mirror:5000/" -> "mirror:5000", docker hub aliases -> docker.io
+func parseMirrors(m map[string]string) map[string]string {
+	mirrors := make(map[string]string)
+	for domain, mirror := range m {
+		domain = strings.TrimSuffix(domain, "/")
+		for _, alias := range append(hubAliases, "index.docker.io/") {
+			if domain+"/" == alias {
+				domain = "docker.io"
+			}
+		}
+		mirror = strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://")
+		mirrors[domain] = strings.TrimSuffix(mirror, "/")
+	}
+	return mirrors
+}
+
+// pulls tagged image through its registry mirror, then tags it as image;
+// falls back to the registry itself when the mirror fails and fallback is on
+func pullMirrored(image string, pull func(ref, auth string) error) (bool, error) {
+	ref, ok := mirrored(image)
+	if !ok {
+		return false, nil
+	}
+	auth, err := registryAuth(ref)
+	if err == nil {
+		logrus.Infof("pulling %s through mirror as %s...", image, ref)
+		err = pull(ref, auth)
+	}
+	if err == nil {
+		if err = cli.ImageTag(ctx, ref, image); err != nil {
+			err = _err("tag image %s as %s error: %s", ref, image, err.Error())
+		}
+	}
+	if err == nil {
+		return true, nil
+	}
+	if !config().RegistryMirrorFallback {
+		return true, err
+	}
+	logrus.Warnf("%s, pulling from the registry itself", err)
+	return false, nil
+}
+
+// registry API client going through cfg.RegistryProxy when set, or the
+// HTTPS_PROXY (HTTP_PROXY, NO_PROXY) env ones
+func setupRegistryClient() {
+	registryClient.Timeout = config().RegistryTimeout
+	proxy := http.ProxyFromEnvironment
+	if config().RegistryProxy != nil {
+		proxy = http.ProxyURL(config().RegistryProxy)
+	}
+	registryClient.Transport = &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func parseProxyURL(name string) (*url.URL, error) {
+	v := envString(name, "")
+	if v == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return nil, _err("%s: invalid proxy URL %q", name, v)
+	}
+	return u, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPullMirroredKeepsMirrorDigest(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.RegistryMirrors = map[string]string{"docker.io": "mirror.internal:5000"}
+		c.RegistryMirrorFallback = false
+		c.MinFreeSpace = 0
+		c.Platform = ""
+	})()
+	pushed := f.pushImage("mirror.internal:5000/library/nginx:1.25", nil)
+	digest := pushed.RepoDigests[0][strings.Index(pushed.RepoDigests[0], "@")+1:]
+
+	if err := pullImage("nginx:1.25"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := f.recorded("pull"); len(calls) != 1 || calls[0] != "pull mirror.internal:5000/library/nginx:1.25" {
+		t.Fatalf("pulls = %v, want the mirror one only", calls)
+	}
+	if calls := f.recorded("rmi"); len(calls) != 0 {
+		t.Fatalf("mirror tag removed: %v", calls)
+	}
+
+	if pinned, want := pinnedImage("nginx:1.25"), "mirror.internal:5000/library/nginx@"+digest; pinned != want {
+		t.Errorf("pinnedImage = %s, want %s", pinned, want)
+	}
+	if err := checkVerifiedDigest("nginx:1.25", digest); err != nil {
+		t.Errorf("checkVerifiedDigest of mirrored pull: %s", err)
+	}
+	if err := checkVerifiedDigest("nginx:1.25", newImageID("other")); err == nil {
+		t.Error("checkVerifiedDigest accepted another digest")
+	}
+	remote := &remoteDigest{image: "nginx:1.25"}
+	if remote.changed(imageDigests("nginx:1.25")) {
+		t.Error("mirrored image reported changed right after its pull")
+	}
+}
+
+func TestParseMirrors(t *testing.T) {
+	got := parseMirrors(map[string]string{
+		"index.docker.io": "https://mirror.internal:5000/",
+		"ghcr.io/":        "harbor.internal/ghcr-proxy",
+	})
+	want := map[string]string{"docker.io": "mirror.internal:5000", "ghcr.io": "harbor.internal/ghcr-proxy"}
+	if len(got) != len(want) {
+		t.Fatalf("parseMirrors = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("parseMirrors[%s] = %q, want %q", k, got[k], v)
+		}
+	}
+}
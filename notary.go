@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+)
+
+// ======= CONTENT TRUST ======
+
+// delegation `docker trust sign` publishes to, preferred over targets
+const releasesRole = "targets/releases"
+
+// signed TUF metadata file
+type tufFile struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []struct {
+		KeyID  string `json:"keyid"`
+		Method string `json:"method"`
+		Sig    string `json:"sig"`
+	} `json:"signatures"`
+	// file as served, for hash checks
+	raw []byte
+}
+
+type tufKey struct {
+	KeyType string `json:"keytype"`
+	KeyVal  struct {
+		Private *string `json:"private"`
+		Public  string  `json:"public"`
+	} `json:"keyval"`
+}
+
+type tufRole struct {
+	Name      string   `json:"name"`
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+// lengths and base64 hashes of files or targets
+type tufMeta map[string]struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+type tufSignedRole struct {
+	Expires time.Time          `json:"expires"`
+	Keys    map[string]tufKey  `json:"keys"`
+	Roles   map[string]tufRole `json:"roles"`
+	Meta    tufMeta            `json:"meta"`
+	Targets tufMeta            `json:"targets"`
+	// of targets role
+	Delegations struct {
+		Keys  map[string]tufKey `json:"keys"`
+		Roles []tufRole         `json:"roles"`
+	} `json:"delegations"`
+}
+
+// root key IDs of trusted collections seen first, by GUN
+var trustedRoots = struct {
+	sync.Mutex
+	keyIDs map[string][]string
+}{keyIDs: make(map[string][]string)}
+
+// notary server of registry: notary.docker.io for docker hub, the registry
+// host on port 4443 otherwise
+func trustServer(domain string) string {
+	if config().ContentTrustServer != "" {
+		return strings.TrimSuffix(config().ContentTrustServer, "/")
+	}
+	if domain == "docker.io" {
+		return "https://notary.docker.io"
+	}
+	return "https://" + strings.SplitN(domain, ":", 2)[0] + ":4443"
+}
+
+// registry digest of fullRepo's tag signed in its trust collection, like
+// docker pull with DOCKER_CONTENT_TRUST=1; every decision is logged as an
+// audit entry
+func verifyContentTrust(fullRepo string) (string, error) {
+	if !config().ContentTrust {
+		return "", nil
+	}
+	repo, tag := splitImage(fullRepo)
+	digest, err := trustedDigest(fullRepo, tag)
+	entry := logrus.WithFields(logrus.Fields{
+		"audit":  "content-trust",
+		"repo":   repo,
+		"tag":    tag,
+		"digest": digest,
+	})
+	if err == nil {
+		var remote string
+		if remote, err = (&remoteDigest{image: fullRepo}).get(); err == nil && remote != digest {
+			err = _err("registry serves %s, signed is %s", remote, digest)
+		}
+	}
+	if err != nil {
+		entry.WithField("error", err.Error()).Error("image trust data rejected")
+		return "", _err("content trust verification of %s failed: %s", fullRepo, err.Error())
+	}
+	entry.Info("image trust data verified")
+	return digest, nil
+}
+
+func trustedDigest(fullRepo, tag string) (string, error) {
+	pn, err := reference.ParseNormalizedNamed(fullRepo)
+	if err != nil {
+		return "", _err("parse container name %s error: %s", fullRepo, err.Error())
+	}
+	gun, domain := pn.Name(), reference.Domain(pn)
+	ac, _, err := domainAuth(domain)
+	if err != nil {
+		return "", err
+	}
+	r := &registryRepo{base: trustServer(domain), path: gun, ac: ac}
+	fetch := func(role string) (*tufFile, *tufSignedRole, error) {
+		return fetchTUF(r, gun, role)
+	}
+
+	rootFile, root, err := fetch("root")
+	if err != nil {
+		return "", err
+	}
+	rootRole, err := checkRootKeys(gun, root)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyTUF("root", rootFile, root, root.Keys, rootRole); err != nil {
+		return "", err
+	}
+	tsFile, ts, err := fetch("timestamp")
+	if err != nil {
+		return "", err
+	}
+	if err := verifyTUF("timestamp", tsFile, ts, root.Keys, root.Roles["timestamp"]); err != nil {
+		return "", err
+	}
+	snapFile, snap, err := fetch("snapshot")
+	if err != nil {
+		return "", err
+	}
+	if err := checkTUFHash("snapshot", snapFile, ts.Meta); err != nil {
+		return "", err
+	}
+	if err := verifyTUF("snapshot", snapFile, snap, root.Keys, root.Roles["snapshot"]); err != nil {
+		return "", err
+	}
+	targetsFile, targets, err := fetch("targets")
+	if err != nil {
+		return "", err
+	}
+	if err := checkTUFHash("targets", targetsFile, snap.Meta); err != nil {
+		return "", err
+	}
+	if err := verifyTUF("targets", targetsFile, targets, root.Keys, root.Roles["targets"]); err != nil {
+		return "", err
+	}
+
+	signed := targets.Targets
+	for _, d := range targets.Delegations.Roles {
+		if d.Name != releasesRole {
+			continue
+		}
+		relFile, rel, err := fetch(releasesRole)
+		if err != nil {
+			return "", err
+		}
+		if err := checkTUFHash(releasesRole, relFile, snap.Meta); err != nil {
+			return "", err
+		}
+		if err := verifyTUF(releasesRole, relFile, rel, targets.Delegations.Keys, d); err != nil {
+			return "", err
+		}
+		if _, ok := rel.Targets[tag]; ok {
+			signed = rel.Targets
+		}
+	}
+	target, ok := signed[tag]
+	if !ok {
+		return "", _err("no trust data for tag %s", tag)
+	}
+	sum, err := base64.StdEncoding.DecodeString(target.Hashes["sha256"])
+	if err != nil || len(sum) != sha256.Size {
+		return "", _err("invalid signed hash of tag %s", tag)
+	}
+	return "sha256:" + hex.EncodeToString(sum), nil
+}
+
+func fetchTUF(r *registryRepo, gun, role string) (*tufFile, *tufSignedRole, error) {
+	resp, err := r.get(r.base+"/v2/"+gun+"/_trust/tuf/"+role+".json", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, _err("no trust data for %s", gun)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, _err("get %s trust data: unexpected response status %s", role, resp.Status)
+	}
+	if err != nil {
+		return nil, nil, _err("get %s trust data: %s", role, err.Error())
+	}
+	f := &tufFile{raw: body}
+	var signed tufSignedRole
+	if err := json.Unmarshal(body, f); err != nil {
+		return nil, nil, _err("parse %s trust data: %s", role, err.Error())
+	}
+	if err := json.Unmarshal(f.Signed, &signed); err != nil {
+		return nil, nil, _err("parse %s trust data: %s", role, err.Error())
+	}
+	return f, &signed, nil
+}
+
+// root keys must be pinned ones or, without pins, the ones seen first
+// (persisted in cfg.ContentTrustDir when set); root key rotation is not
+// followed. Returns root role root must be signed by, only pinned keys count
+// when pinned
+func checkRootKeys(gun string, root *tufSignedRole) (tufRole, error) {
+	role := root.Roles["root"]
+	ids := append([]string(nil), role.KeyIDs...)
+	sort.Strings(ids)
+	for _, id := range ids {
+		key, ok := root.Keys[id]
+		if !ok || tufKeyID(key) != id {
+			return role, _err("root key %s doesn't match its ID", id)
+		}
+	}
+	if len(config().ContentTrustRootKeys) > 0 {
+		pinned := tufRole{Name: role.Name, Threshold: 1}
+		for _, id := range ids {
+			if config().ContentTrustRootKeys[id] {
+				pinned.KeyIDs = append(pinned.KeyIDs, id)
+			}
+		}
+		if len(pinned.KeyIDs) == 0 {
+			return role, _err("root keys %s of %s are not trusted", strings.Join(ids, ", "), gun)
+		}
+		return pinned, nil
+	}
+	trustedRoots.Lock()
+	defer trustedRoots.Unlock()
+	known, ok := trustedRoots.keyIDs[gun]
+	file := ""
+	if config().ContentTrustDir != "" {
+		file = filepath.Join(config().ContentTrustDir, strings.Replace(gun, "/", "_", -1)+".root")
+		if !ok {
+			if data, err := ioutil.ReadFile(file); err == nil {
+				known, ok = strings.Fields(string(data)), true
+			}
+		}
+	}
+	if !ok {
+		logrus.Warnf("trusting root keys %s of %s on first use", strings.Join(ids, ", "), gun)
+		trustedRoots.keyIDs[gun] = ids
+		if file != "" {
+			if err := ioutil.WriteFile(file, []byte(strings.Join(ids, "\n")+"\n"), 0600); err != nil {
+				logrus.Errorf("save trusted root keys of %s error: %s", gun, err)
+			}
+		}
+		return role, nil
+	}
+	trustedRoots.keyIDs[gun] = known
+	if strings.Join(known, ",") != strings.Join(ids, ",") {
+		return role, _err("root keys of %s changed from %s to %s", gun, strings.Join(known, ", "), strings.Join(ids, ", "))
+	}
+	return role, nil
+}
+
+// TUF key ID: sha256 of the key's canonical JSON
+func tufKeyID(key tufKey) string {
+	key.KeyVal.Private = nil
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// whether file's hash listed in meta matches it
+func checkTUFHash(role string, f *tufFile, meta tufMeta) error {
+	m, ok := meta[role]
+	if !ok {
+		return _err("%s trust data is not listed", role)
+	}
+	sum := sha256.Sum256(f.raw)
+	if m.Hashes["sha256"] != base64.StdEncoding.EncodeToString(sum[:]) {
+		return _err("%s trust data hash mismatch", role)
+	}
+	return nil
+}
+
+// whether threshold of role's keys signed f, and it is not expired
+func verifyTUF(name string, f *tufFile, signed *tufSignedRole, keys map[string]tufKey, role tufRole) error {
+	if time.Now().After(signed.Expires) {
+		return _err("%s trust data expired at %s", name, signed.Expires.Format(time.RFC3339))
+	}
+	allowed := make(map[string]bool)
+	for _, id := range role.KeyIDs {
+		allowed[id] = true
+	}
+	hashed := sha256.Sum256(f.Signed)
+	valid := make(map[string]bool)
+	for _, s := range f.Signatures {
+		key, ok := keys[s.KeyID]
+		if !allowed[s.KeyID] || !ok {
+			continue
+		}
+		pub, err := tufPublicKey(key)
+		if err != nil {
+			logrus.Warnf("%s key %s: %s", name, s.KeyID, err)
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && verifyTUFSignature(pub, s.Method, hashed[:], sig) {
+			valid[s.KeyID] = true
+		}
+	}
+	threshold := role.Threshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	if len(valid) < threshold {
+		return _err("%s trust data has %d valid signatures, %d required", name, len(valid), threshold)
+	}
+	return nil
+}
+
+func tufPublicKey(key tufKey) (crypto.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(key.KeyVal.Public)
+	if err != nil {
+		return nil, err
+	}
+	switch key.KeyType {
+	case "ecdsa", "rsa":
+		return x509.ParsePKIXPublicKey(data)
+	case "ecdsa-x509", "rsa-x509":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, _err("invalid certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, _err("unsupported key type %s", key.KeyType)
+}
+
+// notary ecdsa signatures are raw r||s, rsa ones PSS
+func verifyTUFSignature(key crypto.PublicKey, method string, hashed, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if method != "ecdsa" || len(sig)%2 != 0 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:len(sig)/2]), new(big.Int).SetBytes(sig[len(sig)/2:])
+		return ecdsa.Verify(k, hashed, r, s)
+	case *rsa.PublicKey:
+		if method != "rsapss" {
+			return false
+		}
+		return rsa.VerifyPSS(k, crypto.SHA256, hashed, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+	return false
+}
+
+// verifies fullRepo's registry image as configured (cosign signatures,
+// content trust), returns its verified digest, empty when none is required
+func verifyImage(fullRepo string) (string, error) {
+	digest, err := verifyImageSignature(fullRepo)
+	if err != nil {
+		return "", err
+	}
+	trusted, err := verifyContentTrust(fullRepo)
+	if err != nil {
+		return "", err
+	}
+	if digest != "" && trusted != "" && digest != trusted {
+		return "", _err("signed digest %s of %s is not the trusted %s", digest, fullRepo, trusted)
+	}
+	if trusted != "" {
+		return trusted, nil
+	}
+	return digest, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= NOTIFICATIONS ======
+
+const (
+	eventStarted  = "started"
+	eventUpdated  = "updated"
+	eventFailed   = "failed"
+	eventObserved = "observed"
+	// repo:tag failed QUARANTINE_AFTER times in a row
+	eventQuarantined = "quarantined"
+	// update waits for approval
+	eventPending = "pending"
+)
+
+type notification struct {
+	Event   string   `json:"event"`
+	Repo    string   `json:"repo"`
+	Tag     string   `json:"tag"`
+	OldTags []string `json:"old_tags,omitempty"`
+	// matched ones on start, updated ones on result
+	Containers []containerRef `json:"containers,omitempty"`
+	// seconds
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// id to approve update with, of pending event
+	PendingID string    `json:"pending_id,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// sends update start with containers about to be updated, best-effort
+func notifyStarted(summary *updateSummary, containers []containerRef) {
+	n := summaryNotification(eventStarted, summary)
+	n.Containers = containers
+	notify(n)
+}
+
+// sends update result to the repo's notification target, best-effort
+func notifyUpdate(summary *updateSummary, err error) {
+	n := summaryNotification(eventUpdated, summary)
+	n.Containers = summary.UpdatedContainers
+	n.Duration = time.Since(summary.Start).Seconds()
+	if err != nil {
+		n.Event, n.Error = eventFailed, err.Error()
+	}
+	notify(n)
+}
+
+func summaryNotification(event string, summary *updateSummary) notification {
+	n := notification{
+		Event: event,
+		Repo:  summary.Repo,
+		Tag:   summary.Tag,
+		Time:  time.Now(),
+	}
+	for t := range summary.OldTags {
+		n.OldTags = append(n.OldTags, t)
+	}
+	sort.Strings(n.OldTags)
+	return n
+}
+
+func notify(n notification) {
+	if !config().NotifyEvents[n.Event] {
+		return
+	}
+	mailNotification(n)
+	telegramNotification(n)
+	target := config().notifyURL(n.Repo, n.Event)
+	if target == "" {
+		return
+	}
+	for _, t := range notifyTargets(target) {
+		go func(t string) {
+			if err := sendNotification(t, n); err != nil {
+				logrus.Errorf("notification for %s:%s error: %s", n.Repo, n.Tag, err)
+			}
+		}(t)
+	}
+}
+
+func isSlackURL(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && u.Host == "hooks.slack.com"
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// notification receiver, tells which target got which repo's notifications
+func notificationTarget(t *testing.T, name string, got chan<- [2]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("%s target: %s", name, err)
+		}
+		got <- [2]string{name, n.Repo}
+	}))
+}
+
+func TestRepoNotifyURL(t *testing.T) {
+	got := make(chan [2]string, 4)
+	global := notificationTarget(t, "global", got)
+	defer global.Close()
+	teamA := notificationTarget(t, "team-a", got)
+	defer teamA.Close()
+	defer withConfig(func(c *Config) {
+		c.NotifyURL = global.URL
+		c.RepoNotifyURL = map[string]string{"org/app": teamA.URL}
+		c.EventNotifyURL = nil
+		c.NotifyEvents = map[string]bool{eventUpdated: true}
+		c.NotifyTemplate = nil
+	})()
+
+	for _, tc := range []struct{ repo, target string }{
+		{"org/app", "team-a"},
+		{"org/other", "global"},
+	} {
+		notifyUpdate(newUpdateSummary(tc.repo, "1.0.1"), nil)
+		select {
+		case n := <-got:
+			if n != [2]string{tc.target, tc.repo} {
+				t.Errorf("%s notification went to %s, want %s", n[1], n[0], tc.target)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification of %s", tc.repo)
+		}
+	}
+	select {
+	case n := <-got:
+		t.Errorf("extra notification of %s to %s", n[1], n[0])
+	case <-time.After(100 * time.Millisecond):
+	}
+}
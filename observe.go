@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= OBSERVE ONLY ======
+
+const maxObservations = 100
+
+// update which would have been applied in observe-only mode
+type observation struct {
+	Repo       string         `json:"repo"`
+	Tag        string         `json:"tag"`
+	Containers []containerRef `json:"containers"`
+	Time       time.Time      `json:"time"`
+}
+
+// latest observations, oldest first
+var observations = struct {
+	sync.Mutex
+	list []observation
+}{}
+
+// records desired update instead of applying it
+func observe(repo, tag string, containers []containerRef) {
+	for _, cnt := range containers {
+		logrus.Infof("observe only: container %s (%s) would be updated to %s:%s", cnt.Name, cnt.Image, repo, tag)
+	}
+	observations.Lock()
+	observations.list = append(observations.list, observation{
+		Repo:       repo,
+		Tag:        tag,
+		Containers: containers,
+		Time:       time.Now(),
+	})
+	if len(observations.list) > maxObservations {
+		observations.list = observations.list[len(observations.list)-maxObservations:]
+	}
+	observations.Unlock()
+	notify(notification{
+		Event:      eventObserved,
+		Repo:       repo,
+		Tag:        tag,
+		Containers: containers,
+		Time:       time.Now(),
+	})
+}
+
+// observations call: GET /api/v1/observations
+func listObservations(c echo.Context) error {
+	observations.Lock()
+	list := append([]observation{}, observations.list...)
+	observations.Unlock()
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
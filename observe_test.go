@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObserveOnlySkipsMutations(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.ObserveOnly, c.UpdateCooldown = true, time.Hour })()
+	observations.Lock()
+	prev := observations.list
+	observations.list = nil
+	observations.Unlock()
+	defer func() {
+		observations.Lock()
+		observations.list = prev
+		observations.Unlock()
+	}()
+	f.addContainer("app-1", "org/observed:1.0.0", nil)
+	f.addContainer("app-2", "org/observed:1.0.0", nil)
+	f.pushImage("org/observed:1.0.1", nil)
+
+	summary, err := updateContainer("org/observed", "1.0.1", updateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := f.recorded(); len(calls) != 0 {
+		t.Errorf("docker mutated in observe-only mode: %v", calls)
+	}
+	if summary.Matched != 2 || summary.Updated != 0 {
+		t.Errorf("matched = %d, updated = %d, want 2 detected and none applied", summary.Matched, summary.Updated)
+	}
+	observations.Lock()
+	list := observations.list
+	observations.Unlock()
+	if len(list) != 1 || list[0].Repo != "org/observed" || list[0].Tag != "1.0.1" || len(list[0].Containers) != 2 {
+		t.Fatalf("observations = %+v, want the update of both containers", list)
+	}
+	lastUpdates.Lock()
+	_, done := lastUpdates.at["org/observed:1.0.1"]
+	lastUpdates.Unlock()
+	if done {
+		t.Error("observed update marked as done")
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+// ======= OPENAPI ======
+
+// OpenAPI 3 document of the update, job, history and container endpoints,
+// kept with the handlers; info.version is set to the running version
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "docker-updater",
+    "description": "Updates Docker containers (or swarm services) to new image tags on request.",
+    "version": ""
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"token": []}, {}],
+  "paths": {
+    "/update": {
+      "get": {
+        "summary": "Update containers of repo to tag and wait for the result",
+        "operationId": "update",
+        "parameters": [
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/tag"},
+          {"$ref": "#/components/parameters/host"},
+          {"name": "dry_run", "in": "query", "schema": {"type": "boolean"}, "description": "only report which containers would be updated"},
+          {"name": "check_registry", "in": "query", "schema": {"type": "boolean"}, "description": "with dry_run, inspect the image manifest in the registry"},
+          {"name": "async", "in": "query", "schema": {"type": "boolean"}, "description": "queue the update as a job"},
+          {"name": "callback_url", "in": "query", "schema": {"type": "string", "format": "uri"}, "description": "with async, post the finished job there"},
+          {"name": "allow_downgrade", "in": "query", "schema": {"type": "boolean"}, "description": "update containers on higher versions too"}
+        ],
+        "responses": {
+          "200": {"description": "Update done (or dry run result)", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/UpdateSummary"}, {"$ref": "#/components/schemas/DryRunResult"}, {"$ref": "#/components/schemas/Status"}]}}}},
+          "202": {"description": "Queued as a job, until the update window opens or until approved", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/JobID"}, {"$ref": "#/components/schemas/Status"}]}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "500": {"description": "Update failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UpdateSummary"}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Docker Hub (or Harbor) webhook, queued as a job",
+        "operationId": "hubWebhook",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object"}}}},
+        "responses": {
+          "200": {"description": "Skipped (cooldown or duplicate delivery)", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}},
+          "202": {"description": "Queued", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/JobID"}, {"$ref": "#/components/schemas/Status"}]}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/update/manual": {
+      "post": {
+        "summary": "Update like GET /update, with config overrides for recreated containers",
+        "operationId": "updateWithOverrides",
+        "parameters": [
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/tag"},
+          {"$ref": "#/components/parameters/host"},
+          {"name": "allow_downgrade", "in": "query", "schema": {"type": "boolean"}}
+        ],
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Overrides"}}}},
+        "responses": {
+          "200": {"description": "Update done", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UpdateSummary"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"description": "Update failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/UpdateSummary"}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/update/plan": {
+      "get": {
+        "summary": "Report which containers would be updated",
+        "operationId": "plan",
+        "parameters": [
+          {"$ref": "#/components/parameters/repo"},
+          {"$ref": "#/components/parameters/tag"},
+          {"$ref": "#/components/parameters/host"},
+          {"name": "check_registry", "in": "query", "schema": {"type": "boolean"}}
+        ],
+        "responses": {
+          "200": {"description": "Plan", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DryRunResult"}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/update/batch": {
+      "post": {
+        "summary": "Update several repos one by one",
+        "operationId": "updateBatch",
+        "parameters": [
+          {"$ref": "#/components/parameters/host"},
+          {"name": "async", "in": "query", "schema": {"type": "boolean"}, "description": "queue the whole batch as one job"},
+          {"name": "callback_url", "in": "query", "schema": {"type": "string", "format": "uri"}, "description": "with async, post the finished job there"}
+        ],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"oneOf": [
+          {"type": "array", "items": {"$ref": "#/components/schemas/RepoTag"}},
+          {"type": "object", "required": ["updates"], "properties": {
+            "updates": {"type": "array", "items": {"$ref": "#/components/schemas/RepoTag"}},
+            "callback_url": {"type": "string", "format": "uri", "description": "with async, post the finished job there"}
+          }}
+        ]}}}},
+        "responses": {
+          "200": {"description": "Results by pair", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/BatchResult"}}}}},
+          "202": {"description": "Queued as a job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobID"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/jobs": {
+      "get": {
+        "summary": "List jobs, newest first",
+        "operationId": "listJobs",
+        "parameters": [
+          {"name": "repo", "in": "query", "schema": {"type": "string"}},
+          {"name": "status", "in": "query", "schema": {"$ref": "#/components/schemas/JobStatus"}}
+        ],
+        "responses": {
+          "200": {"description": "Jobs", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}}
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "get": {
+        "summary": "Job status",
+        "operationId": "getJob",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "Job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/history": {
+      "get": {
+        "summary": "Past updates, newest first",
+        "operationId": "listHistory",
+        "parameters": [
+          {"name": "repo", "in": "query", "schema": {"type": "string"}},
+          {"name": "since", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "until", "in": "query", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {
+          "200": {"description": "History entries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HistoryEntry"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/audit": {
+      "get": {
+        "summary": "Audit trail export, oldest first",
+        "operationId": "exportAudit",
+        "parameters": [
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["jsonl", "csv"], "default": "jsonl"}},
+          {"name": "since", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "until", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "action", "in": "query", "schema": {"type": "string"}},
+          {"name": "caller", "in": "query", "schema": {"type": "string"}},
+          {"name": "repo", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "Audit entries, one JSON object per line or CSV with a header row", "content": {
+            "application/x-ndjson": {"schema": {"$ref": "#/components/schemas/AuditEntry"}},
+            "text/csv": {"schema": {"type": "string"}}
+          }},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/containers": {
+      "get": {
+        "summary": "Managed containers",
+        "operationId": "listContainers",
+        "parameters": [
+          {"name": "repo", "in": "query", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/host"}
+        ],
+        "responses": {
+          "200": {"description": "Containers", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ManagedContainer"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/rollback": {
+      "post": {
+        "summary": "Recreate container (or containers of repo) from the image it ran before the last update, or its latest snapshot",
+        "operationId": "rollback",
+        "parameters": [
+          {"name": "container", "in": "query", "schema": {"type": "string"}},
+          {"name": "repo", "in": "query", "schema": {"type": "string"}},
+          {"name": "snapshot", "in": "query", "schema": {"type": "boolean"}, "description": "recreate from the latest snapshot"},
+          {"$ref": "#/components/parameters/host"}
+        ],
+        "responses": {
+          "200": {"description": "Results by container", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/RollbackResult"}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/pause": {
+      "get": {
+        "summary": "Maintenance mode status",
+        "operationId": "pauseStatus",
+        "responses": {"200": {"description": "Status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PauseState"}}}}}
+      },
+      "post": {
+        "summary": "Stop applying updates until resumed",
+        "operationId": "pause",
+        "parameters": [{"name": "reason", "in": "query", "schema": {"type": "string"}}],
+        "responses": {"200": {"description": "Status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PauseState"}}}}}
+      }
+    },
+    "/admin/resume": {
+      "post": {
+        "summary": "Leave maintenance mode",
+        "operationId": "resume",
+        "responses": {"200": {"description": "Status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PauseState"}}}}}
+      }
+    },
+    "/admin/reload": {
+      "post": {
+        "summary": "Reload config, applied to updates starting afterwards",
+        "operationId": "reload",
+        "responses": {
+          "200": {"description": "Reloaded", "content": {"application/json": {"schema": {"type": "object", "properties": {"status": {"type": "string"}, "restart_required": {"type": "array", "items": {"type": "string"}}}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/quarantine": {
+      "get": {
+        "summary": "Repo:tag pairs refused after QUARANTINE_AFTER failed updates in a row",
+        "operationId": "listQuarantine",
+        "responses": {"200": {"description": "Quarantined", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/QuarantineEntry"}}}}}}
+      }
+    },
+    "/quarantine/release": {
+      "post": {
+        "summary": "Accept updates of quarantined repo:tag again",
+        "operationId": "releaseQuarantine",
+        "parameters": [{"$ref": "#/components/parameters/repo"}, {"$ref": "#/components/parameters/tag"}],
+        "responses": {
+          "200": {"description": "Released entry", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/QuarantineEntry"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/agents": {
+      "get": {
+        "summary": "Agents of the coordinator with their readiness and version",
+        "operationId": "listAgents",
+        "responses": {"200": {"description": "Agents", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/AgentStatus"}}}}}}
+      }
+    },
+    "/pending": {
+      "get": {
+        "summary": "Updates of APPROVAL_REPOS (or labeled containers) waiting for approval",
+        "operationId": "listPending",
+        "responses": {"200": {"description": "Pending", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/PendingUpdate"}}}}}}
+      }
+    },
+    "/pending/{id}/approve": {
+      "post": {
+        "summary": "Run pending update as a job",
+        "operationId": "approveUpdate",
+        "parameters": [{"$ref": "#/components/parameters/pendingID"}],
+        "responses": {
+          "202": {"description": "Queued as a job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobID"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/pending/{id}/reject": {
+      "post": {
+        "summary": "Drop pending update",
+        "operationId": "rejectUpdate",
+        "parameters": [{"$ref": "#/components/parameters/pendingID"}],
+        "responses": {
+          "200": {"description": "Rejected update", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/PendingUpdate"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer", "description": "one of API_TOKENS, when set"}
+    },
+    "parameters": {
+      "repo": {"name": "repo", "in": "query", "required": true, "schema": {"type": "string"}, "example": "org/app"},
+      "tag": {"name": "tag", "in": "query", "required": true, "schema": {"type": "string"}, "example": "1.2.3"},
+      "host": {"name": "host", "in": "query", "schema": {"type": "string"}, "description": "one of DOCKER_HOSTS (AGENTS of a coordinator), all when empty"},
+      "pendingID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {"type": "object", "properties": {"error": {"type": "string"}}},
+      "Status": {"type": "object", "properties": {"status": {"type": "string"}}},
+      "JobID": {"type": "object", "properties": {"job_id": {"type": "string"}}},
+      "RepoTag": {
+        "type": "object",
+        "required": ["repo", "tag"],
+        "properties": {"repo": {"type": "string"}, "tag": {"type": "string"}, "host": {"type": "string"}}
+      },
+      "BatchResult": {
+        "type": "object",
+        "properties": {
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "host": {"type": "string"},
+          "status": {"type": "string", "enum": ["ok", "failed", "skipped", "queued", "pending"]},
+          "pending_id": {"type": "string"},
+          "error": {"type": "string"}
+        }
+      },
+      "ContainerRef": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "image": {"type": "string"},
+          "health": {"type": "string", "enum": ["none", "healthy", "unhealthy", "exited", "timeout"]},
+          "host": {"type": "string"}
+        }
+      },
+      "SkippedContainer": {
+        "allOf": [{"$ref": "#/components/schemas/ContainerRef"}, {"type": "object", "properties": {"reason": {"type": "string"}}}]
+      },
+      "ContainerResult": {
+        "allOf": [
+          {"$ref": "#/components/schemas/ContainerRef"},
+          {
+            "type": "object",
+            "properties": {
+              "old_image_id": {"type": "string"},
+              "new_image_id": {"type": "string"},
+              "status": {"type": "string", "enum": ["updated", "failed", "rolled_back"]},
+              "error": {"type": "string"}
+            }
+          }
+        ]
+      },
+      "Overrides": {
+        "type": "object",
+        "properties": {
+          "env": {"type": "object", "additionalProperties": {"type": "string"}},
+          "unset_env": {"type": "array", "items": {"type": "string"}},
+          "cmd": {"type": "array", "items": {"type": "string"}},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "UpdateSummary": {
+        "type": "object",
+        "properties": {
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "host": {"type": "string"},
+          "allow_downgrade": {"type": "boolean"},
+          "overrides": {"$ref": "#/components/schemas/Overrides"},
+          "matched": {"type": "integer"},
+          "updated": {"type": "integer"},
+          "updated_containers": {"type": "array", "items": {"$ref": "#/components/schemas/ContainerRef"}},
+          "matched_containers": {"type": "array", "items": {"$ref": "#/components/schemas/ContainerRef"}},
+          "skipped": {"type": "integer"},
+          "skipped_containers": {"type": "array", "items": {"$ref": "#/components/schemas/SkippedContainer"}},
+          "failed": {"type": "integer"},
+          "containers": {"type": "array", "items": {"$ref": "#/components/schemas/ContainerResult"}},
+          "pull_duration": {"type": "number", "description": "seconds"},
+          "duration": {"type": "number", "description": "seconds"},
+          "outcome": {"type": "string", "enum": ["success", "noop", "failure"]},
+          "error": {"type": "string"}
+        }
+      },
+      "RegistryCheck": {
+        "type": "object",
+        "properties": {
+          "image": {"type": "string"},
+          "reachable": {"type": "boolean"},
+          "authorized": {"type": "boolean"},
+          "digest": {"type": "string"},
+          "platforms": {"type": "array", "items": {"type": "string"}},
+          "error": {"type": "string"}
+        }
+      },
+      "DryRunResult": {
+        "type": "object",
+        "properties": {
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "containers": {"type": "array", "items": {"$ref": "#/components/schemas/ContainerRef"}},
+          "pull": {"type": "string"},
+          "registry": {"$ref": "#/components/schemas/RegistryCheck"}
+        }
+      },
+      "JobStatus": {"type": "string", "enum": ["queued", "running", "success", "failed"]},
+      "Job": {
+        "type": "object",
+        "properties": {
+          "job_id": {"type": "string"},
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "host": {"type": "string"},
+          "status": {"$ref": "#/components/schemas/JobStatus"},
+          "error": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "started_at": {"type": "string", "format": "date-time"},
+          "finished_at": {"type": "string", "format": "date-time"},
+          "batch": {"type": "array", "items": {"$ref": "#/components/schemas/RepoTag"}},
+          "results": {"type": "array", "items": {"$ref": "#/components/schemas/BatchResult"}},
+          "caller": {"type": "string"},
+          "trigger": {"type": "string", "enum": ["webhook", "manual", "approval"]}
+        }
+      },
+      "HistoryEntry": {
+        "type": "object",
+        "properties": {
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "old_tags": {"type": "array", "items": {"type": "string"}},
+          "containers": {"type": "array", "items": {"$ref": "#/components/schemas/ContainerRef"}},
+          "matched": {"type": "integer"},
+          "updated": {"type": "integer"},
+          "failed": {"type": "integer"},
+          "outcome": {"type": "string", "enum": ["success", "noop", "failure"]},
+          "downgrade": {"type": "boolean"},
+          "caller": {"type": "string"},
+          "error": {"type": "string"},
+          "started_at": {"type": "string", "format": "date-time"},
+          "finished_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "AuditEntry": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "action": {"type": "string"},
+          "caller": {"type": "string"},
+          "ip": {"type": "string"},
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "host": {"type": "string"},
+          "outcome": {"type": "string"},
+          "error": {"type": "string"},
+          "message": {"type": "string"},
+          "details": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "ManagedContainer": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "host": {"type": "string"},
+          "image": {"type": "string"},
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "digests": {"type": "array", "items": {"type": "string"}},
+          "version": {"type": "string"},
+          "state": {"type": "string"},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "RollbackResult": {
+        "type": "object",
+        "properties": {
+          "container": {"type": "string"},
+          "host": {"type": "string"},
+          "image": {"type": "string"},
+          "status": {"type": "string", "enum": ["ok", "failed"]},
+          "error": {"type": "string"}
+        }
+      },
+      "PauseState": {
+        "type": "object",
+        "properties": {
+          "paused": {"type": "boolean"},
+          "mode": {"type": "string", "enum": ["queue", "reject"]},
+          "since": {"type": "string", "format": "date-time"},
+          "reason": {"type": "string"},
+          "by": {"type": "string"}
+        }
+      },
+      "QuarantineEntry": {
+        "type": "object",
+        "properties": {
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "failures": {"type": "integer"},
+          "last_error": {"type": "string"},
+          "since": {"type": "string", "format": "date-time"}
+        }
+      },
+      "AgentStatus": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "url": {"type": "string"},
+          "ready": {"type": "boolean"},
+          "version": {"type": "object"},
+          "error": {"type": "string"}
+        }
+      },
+      "PendingUpdate": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "repo": {"type": "string"},
+          "tag": {"type": "string"},
+          "host": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "expires_at": {"type": "string", "format": "date-time"}
+        }
+      }
+    }
+  }
+}`
+
+var openAPI struct {
+	sync.Once
+	doc []byte
+	err error
+}
+
+// OpenAPI call: GET /api/v1/openapi.json
+func openAPIHandler(c echo.Context) error {
+	openAPI.Do(func() {
+		var doc map[string]interface{}
+		if openAPI.err = json.Unmarshal([]byte(openAPISpec), &doc); openAPI.err != nil {
+			return
+		}
+		doc["info"].(map[string]interface{})["version"] = version
+		openAPI.doc, openAPI.err = json.MarshalIndent(doc, "", "  ")
+	})
+	if openAPI.err != nil {
+		return _err("OpenAPI document error: %s", openAPI.err.Error())
+	}
+	return c.JSONBlob(http.StatusOK, openAPI.doc)
+}
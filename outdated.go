@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// ======= OUTDATED ======
+
+// managed container with an update available in registry
+type outdatedContainer struct {
+	Name string `json:"name"`
+	Host string `json:"host,omitempty"`
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// tag it would be updated to, the same one when its image changed
+	Available string `json:"available"`
+}
+
+// outdated containers call: GET /api/v1/outdated[?repo=REPO][&host=HOST],
+// registry is checked for each managed container (or service) the way
+// polling does, under its pin, constraint and channel labels
+func listOutdated(c echo.Context) error {
+	host, err := requestHost(c)
+	if err != nil {
+		return err
+	}
+	repo := c.QueryParam("repo")
+	if repo != "" {
+		repo = normalizeRepo(repo)
+	}
+	tags := make(map[string][]string)
+	list := []outdatedContainer{}
+	eachHost(host, func() {
+		targets, targetsErr := pollTargets()
+		if targetsErr != nil {
+			err = targetsErr
+			return
+		}
+		for _, t := range targets {
+			if repo != "" && t.repo != repo {
+				continue
+			}
+			if tag, ok := pollNewTag(t, tags); ok {
+				list = append(list, outdatedContainer{Name: t.name, Host: currentHost, Repo: t.repo, Tag: t.tag, Available: tag})
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Host != list[j].Host {
+			return list[i].Host < list[j].Host
+		}
+		return list[i].Name < list[j].Name
+	})
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+)
+
+// ======= CONFIG OVERRIDES ======
+
+// changes to inspected config of containers recreated by one update, e.g.
+// for a new image version needing another env var; recreated containers keep
+// them, so later updates do too
+type containerOverrides struct {
+	// set env vars, empty value keeps the var empty (it is not removed)
+	Env map[string]string `json:"env,omitempty"`
+	// ones removed
+	UnsetEnv []string `json:"unset_env,omitempty"`
+	// replaces command when set
+	Cmd    []string          `json:"cmd,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// labels the updater sets itself
+var reservedLabels = []string{labelTag, labelPrevImage, labelPrevImageID, labelRollbackImage, labelPrevDigest, labelSmokeTest, labelUpdatedAt, labelTrigger}
+
+func (o *containerOverrides) empty() bool {
+	return len(o.Env) == 0 && len(o.UnsetEnv) == 0 && len(o.Cmd) == 0 && len(o.Labels) == 0
+}
+
+func (o *containerOverrides) validate() error {
+	for name := range o.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return _httpErr(http.StatusBadRequest, "invalid env var name %q", name)
+		}
+	}
+	for _, label := range reservedLabels {
+		if _, ok := o.Labels[label]; ok {
+			return _httpErr(http.StatusBadRequest, "label %s is set by the updater", label)
+		}
+	}
+	return nil
+}
+
+// merges overrides into contConfig, a copy of inspected config with its own
+// labels map; nil overrides change nothing
+func (o *containerOverrides) apply(contConfig *container.Config) {
+	if o == nil {
+		return
+	}
+	if len(o.Env) > 0 || len(o.UnsetEnv) > 0 {
+		drop := make(map[string]bool)
+		for name := range o.Env {
+			drop[name] = true
+		}
+		for _, name := range o.UnsetEnv {
+			drop[name] = true
+		}
+		var env []string
+		for _, kv := range contConfig.Env {
+			if !drop[strings.SplitN(kv, "=", 2)[0]] {
+				env = append(env, kv)
+			}
+		}
+		for _, name := range sortedKeys(o.Env) {
+			env = append(env, name+"="+o.Env[name])
+		}
+		contConfig.Env = env
+	}
+	if len(o.Cmd) > 0 {
+		contConfig.Cmd = strslice.StrSlice(o.Cmd)
+	}
+	// createContainer merges them into inspected ones
+	for k, v := range o.Labels {
+		contConfig.Labels[k] = v
+	}
+}
+
+// names only, env values may be secrets
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
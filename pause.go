@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ======= MAINTENANCE MODE ======
+
+// what happens to updates requested while paused
+const (
+	// queued like ones out of update window, run once resumed
+	pauseQueue = "queue"
+	// answered with 503
+	pauseReject = "reject"
+)
+
+type pauseState struct {
+	Paused bool       `json:"paused"`
+	Mode   string     `json:"mode"`
+	Since  *time.Time `json:"since,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	By     string     `json:"by,omitempty"`
+}
+
+var maintenance = struct {
+	sync.Mutex
+	state pauseState
+}{}
+
+var pausedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "docker_updater_paused",
+	Help: "1 while updates are paused (maintenance mode).",
+})
+
+func init() {
+	prometheus.MustRegister(pausedGauge)
+}
+
+func isPaused() bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	return maintenance.state.Paused
+}
+
+// 503 for update requested while paused in reject mode
+func checkPaused() error {
+	if config().PauseMode != pauseReject || !isPaused() {
+		return nil
+	}
+	return errPaused()
+}
+
+func errPaused() error {
+	return _httpErr(http.StatusServiceUnavailable, "updates are paused (maintenance mode)")
+}
+
+// status of a queued update of repo
+func queuedStatus(repo string) string {
+	if isPaused() {
+		return "queued until updates are resumed"
+	}
+	if until, ok := throttled(repo, time.Now()); ok && config().windowOpen(repo, time.Now()) {
+		return "queued until " + until.Format(time.RFC3339) + ", updates of repo are throttled"
+	}
+	return "queued until update window opens"
+}
+
+// pause call: POST /api/v1/admin/pause[?reason=TEXT], running updates finish
+func pauseUpdates(c echo.Context) error {
+	now := time.Now()
+	maintenance.Lock()
+	if !maintenance.state.Paused {
+		maintenance.state = pauseState{Paused: true, Since: &now, Reason: c.QueryParam("reason"), By: caller(c)}
+	}
+	state := maintenance.state
+	maintenance.Unlock()
+	pausedGauge.Set(1)
+	logrus.WithFields(logrus.Fields{
+		"audit":  "pause",
+		"reason": state.Reason,
+		"caller": caller(c),
+		"ip":     clientIP(c),
+	}).Warnf("updates paused (%s mode)", config().PauseMode)
+	state.Mode = config().PauseMode
+	return c.JSONPretty(http.StatusOK, state, "  ")
+}
+
+// resume call: POST /api/v1/admin/resume, queued updates run with the next
+// check of deferred ones
+func resumeUpdates(c echo.Context) error {
+	maintenance.Lock()
+	maintenance.state = pauseState{}
+	maintenance.Unlock()
+	pausedGauge.Set(0)
+	logrus.WithFields(logrus.Fields{
+		"audit":  "resume",
+		"caller": caller(c),
+		"ip":     clientIP(c),
+	}).Warn("updates resumed")
+	return c.JSONPretty(http.StatusOK, pauseState{Mode: config().PauseMode}, "  ")
+}
+
+// pause status call: GET /api/v1/admin/pause
+func pauseStatus(c echo.Context) error {
+	maintenance.Lock()
+	state := maintenance.state
+	maintenance.Unlock()
+	state.Mode = config().PauseMode
+	return c.JSONPretty(http.StatusOK, state, "  ")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= PINNING ======
+
+// "true" never updates container, a tag allows updating to that tag only
+const labelPin = "docker-updater.pin"
+
+// whether pin label allows moving from cTag to tag, overrides any tag
+// comparison; ok is false when not pinned at all
+func pinDecision(labels map[string]string, cTag, tag string) (update, ok bool) {
+	pin, found := labels[labelPin]
+	if !found || pin == "" {
+		return false, false
+	}
+	if b, err := strconv.ParseBool(pin); err == nil {
+		return false, b
+	}
+	return tag == pin && cTag != pin, true
+}
+
+// forced rollback decision, pin and constraint labels still apply
+func wantDowngrade(name, repo string, labels map[string]string, cTag, tag string) bool {
+	policy := config().prereleasePolicy(repo, labels)
+	if update, ok := pinDecision(labels, cTag, tag); ok {
+		return update && isDowngrade(policy, cTag, tag)
+	}
+	if !constraintAllows(name, labels, tag) {
+		return false
+	}
+	if isDowngrade(policy, cTag, tag) {
+		logrus.Warnf("%s is downgraded %s -> %s", name, cTag, tag)
+		return true
+	}
+	return false
+}
+
+// update decision for container (or service) by its labels and tags
+func wantUpdate(name, repo string, labels map[string]string, cTag, tag string, remote *remoteDigest, digests func() []string) bool {
+	policy := config().prereleasePolicy(repo, labels)
+	if update, ok := pinDecision(labels, cTag, tag); ok {
+		if !update {
+			logrus.Infof("%s is pinned (%s=%s), skipped", name, labelPin, labels[labelPin])
+		}
+		return update
+	}
+	if !constraintAllows(name, labels, tag) {
+		return false
+	}
+	if channel := labels[labelChannel]; channel != "" {
+		return channelDecision(name, policy, channel, cTag, tag, remote, digests)
+	}
+	// same tag pushed again (latest, stable, ...) or rolling tags: only
+	// a changed image is worth a restart
+	if cTag == tag || config().tagMatch(cTag, tag) {
+		update := remote.changed(digests())
+		if !update {
+			logrus.Infof("%s image digest is up to date", name)
+		}
+		return update
+	}
+	return shouldUpdate(policy, cTag, tag)
+}
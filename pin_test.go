@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestPinnedContainerSkipped(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	pinned := f.addContainer("app-2", "org/app:1.0.0", map[string]string{labelPin: "true"})
+	onTag := f.addContainer("app-3", "org/app:1.0.0", map[string]string{labelPin: "1.0.0"})
+	f.pushImage("org/app:1.0.1", nil)
+
+	summary, err := updateContainer("org/app", "1.0.1", updateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Updated != 1 || summary.UpdatedContainers[0].Name != "app-1" {
+		t.Errorf("updated containers = %+v, want the unpinned app-1 only", summary.UpdatedContainers)
+	}
+	if summary.Skipped != 2 {
+		t.Errorf("skipped = %+v, want both pinned ones", summary.SkippedContainers)
+	}
+	for _, c := range []string{pinned.ID, onTag.ID} {
+		if f.container(c) == nil {
+			t.Errorf("pinned container %s replaced", c)
+		}
+	}
+}
+
+func TestPinDecision(t *testing.T) {
+	for _, tc := range []struct {
+		pin, cTag, tag string
+		update, pinned bool
+	}{
+		{"", "1.0.0", "1.0.1", false, false},
+		{"false", "1.0.0", "1.0.1", false, false},
+		{"true", "1.0.0", "1.0.1", false, true},
+		{"1", "1.0.0", "2.0.0", false, true},
+		{"1.2.3", "1.2.0", "1.2.4", false, true},
+		{"1.2.3", "1.2.0", "1.2.3", true, true},
+		{"1.2.3", "1.2.3", "1.2.3", false, true},
+	} {
+		labels := map[string]string{}
+		if tc.pin != "" {
+			labels[labelPin] = tc.pin
+		}
+		update, pinned := pinDecision(labels, tc.cTag, tc.tag)
+		if update != tc.update || pinned != tc.pinned {
+			t.Errorf("pin %q, %s -> %s: update %v, pinned %v, want %v, %v", tc.pin, tc.cTag, tc.tag, update, pinned, tc.update, tc.pinned)
+		}
+	}
+}
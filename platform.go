@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// ======= PLATFORM ======
+
+// PLATFORM value detecting platform of every docker host from its daemon
+const platformAuto = "auto"
+
+// uname machine names reported by docker info to GOARCH[/variant] ones
+var daemonArchs = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"i386":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv7l":  "arm/v7",
+	"armv6l":  "arm/v6",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// detected platforms by docker host
+var hostPlatforms = struct {
+	sync.Mutex
+	byHost map[string]string
+}{byHost: make(map[string]string)}
+
+// os/arch[/variant] images must be of on current host, empty when unknown
+func targetPlatform() string {
+	if config().Platform != platformAuto {
+		return config().Platform
+	}
+	hostPlatforms.Lock()
+	defer hostPlatforms.Unlock()
+	if p, ok := hostPlatforms.byHost[currentHost]; ok {
+		return p
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		logrus.Warnf("unable to detect daemon platform, platform checks skipped: %s", err)
+		return ""
+	}
+	arch, ok := daemonArchs[info.Architecture]
+	if !ok {
+		logrus.Warnf("unknown daemon architecture %s, platform checks skipped", info.Architecture)
+		arch = ""
+	}
+	p := ""
+	if arch != "" {
+		p = info.OSType + "/" + arch
+		logrus.Infof("daemon platform detected: %s", p)
+	}
+	hostPlatforms.byHost[currentHost] = p
+	return p
+}
+
+// platform requested on pull, only a configured one: the daemon pulls its
+// own by default, and older daemons refuse platform selection
+func pullPlatform() string {
+	if config().Platform == platformAuto {
+		return ""
+	}
+	return config().Platform
+}
+
+// whether os/arch/variant is platform, variant is only compared when
+// platform has one
+func platformMatches(platform, os, arch, variant string) bool {
+	parts := strings.SplitN(platform, "/", 3)
+	if len(parts) < 2 || parts[0] != os || parts[1] != arch {
+		return false
+	}
+	return len(parts) < 3 || parts[2] == variant
+}
+
+// fails when registry manifest of fullRepo has no variant for the target
+// platform, so containers are never removed for an image which can't run;
+// unknown platform, unreachable registry or manifests without platforms
+// skip the check
+func checkManifestPlatform(fullRepo string) error {
+	platform := targetPlatform()
+	if platform == "" {
+		return nil
+	}
+	pn, err := reference.ParseNormalizedNamed(registryRef(fullRepo))
+	if err != nil {
+		return _err("parse container name %s error: %s", fullRepo, err.Error())
+	}
+	auth, err := registryAuth(pn.String())
+	if err != nil {
+		return err
+	}
+	var dist registry.DistributionInspect
+	err = retry("registry inspect of "+fullRepo, func() error {
+		inspectCtx, cancel := context.WithTimeout(ctx, config().RegistryTimeout)
+		defer cancel()
+		dist, err = cli.DistributionInspect(inspectCtx, pn.String(), auth)
+		return err
+	})
+	if err != nil {
+		logrus.Warnf("registry inspect of %s failed, platform check skipped: %s", fullRepo, err)
+		return nil
+	}
+	if len(dist.Platforms) == 0 {
+		return nil
+	}
+	var available []string
+	for _, p := range dist.Platforms {
+		if platformMatches(platform, p.OS, p.Architecture, p.Variant) {
+			return nil
+		}
+		name := p.OS + "/" + p.Architecture
+		if p.Variant != "" {
+			name += "/" + p.Variant
+		}
+		available = append(available, name)
+	}
+	return _err("image %s has no manifest for %s, available: %s", fullRepo, platform, strings.Join(available, ", "))
+}
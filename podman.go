@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// ======= PODMAN ======
+
+// engines behind the docker API
+const (
+	engineAuto   = "auto"
+	engineDocker = "docker"
+	enginePodman = "podman"
+)
+
+// network podman attaches bridge mode containers to
+const podmanDefaultNetwork = "podman"
+
+// hosts served by podman (by DOCKER_HOSTS name, empty for single host),
+// filled on init
+var podmanHosts = make(map[string]bool)
+
+// podman serving the API of c, asked by version components
+func detectPodman(c *client.Client) bool {
+	v, err := c.ServerVersion(ctx)
+	if err != nil {
+		logrus.Warnf("get docker version error: %s, assuming %s engine", err, engineDocker)
+		return false
+	}
+	for _, comp := range v.Components {
+		if strings.Contains(strings.ToLower(comp.Name), enginePodman) {
+			return true
+		}
+	}
+	return false
+}
+
+// sets engine of each host, detected in auto mode
+func initEngines(engine string) {
+	hosts := map[string]*client.Client{"": cli}
+	if len(dockerHosts) > 0 {
+		hosts = make(map[string]*client.Client)
+		for _, h := range dockerHosts {
+			hosts[h.name] = h.cli
+		}
+	}
+	for name, c := range hosts {
+		podmanHosts[name] = engine == enginePodman || engine == engineAuto && detectPodman(c)
+		if podmanHosts[name] {
+			logrus.Infof("using %s compatibility for docker host %s", enginePodman, name)
+		}
+	}
+}
+
+// cli points to podman
+func isPodman() bool {
+	return podmanHosts[currentHost]
+}
+
+// rootless podman networking, containers get no endpoints to pass on create
+func isPodmanPrivateNetwork(mode container.NetworkMode) bool {
+	m := string(mode)
+	return m == "slirp4netns" || strings.HasPrefix(m, "slirp4netns:") || m == "pasta" || strings.HasPrefix(m, "pasta:") || m == "private"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestDetectPodman(t *testing.T) {
+	for _, tc := range []struct {
+		components []string
+		podman     bool
+	}{
+		{[]string{"Engine", "containerd"}, false},
+		{[]string{"Podman Engine", "Conmon", "OCI Runtime (crun)"}, true},
+		{nil, false},
+	} {
+		f, restore := newFakeDocker(t)
+		f.components = tc.components
+		if podman := detectPodman(cli); podman != tc.podman {
+			t.Errorf("components %v: podman %v, want %v", tc.components, podman, tc.podman)
+		}
+		restore()
+	}
+}
+
+func TestPodmanRecreate(t *testing.T) {
+	for _, tc := range []struct {
+		mode     container.NetworkMode
+		networks []string
+	}{
+		{"bridge", []string{podmanDefaultNetwork}},
+		{"slirp4netns:allow_host_loopback=true", nil},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			podmanHosts[currentHost] = true
+			old := f.addContainer("app-1", "org/app:1.0.0", nil)
+			old.HostConfig.NetworkMode = tc.mode
+			old.NetworkSettings.Networks = map[string]*network.EndpointSettings{}
+			for _, n := range tc.networks {
+				old.NetworkSettings.Networks[n] = &network.EndpointSettings{Aliases: []string{"app"}}
+			}
+			if len(tc.networks) == 0 {
+				// rootless endpoint without a network to re-attach to
+				old.NetworkSettings.Networks[string(tc.mode)] = &network.EndpointSettings{}
+			}
+			f.pushImage("org/app:1.0.1", nil)
+
+			if _, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			calls := f.recorded()
+			if stop, remove := callIndex(calls, "stop app-1"), callIndex(calls, "remove app-1"); stop < 0 || remove < stop {
+				t.Errorf("calls = %v, want app-1 stopped before removal", calls)
+			}
+			if f.forced["app-1"] {
+				t.Error("podman container removed forcibly")
+			}
+			c := f.container("app-1")
+			if c == nil || c.ID == old.ID {
+				t.Fatal("app-1 not recreated")
+			}
+			if len(c.NetworkSettings.Networks) != len(tc.networks) {
+				t.Errorf("networks = %v, want %v", c.NetworkSettings.Networks, tc.networks)
+			}
+			for _, n := range tc.networks {
+				if _, ok := c.NetworkSettings.Networks[n]; !ok {
+					t.Errorf("network %s not attached", n)
+				}
+			}
+		})
+	}
+}
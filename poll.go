@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= REGISTRY POLLING ======
+
+// image in use by a managed container or service
+type pollTarget struct {
+	// container (or service) name
+	name    string
+	repo    string
+	tag     string
+	labels  map[string]string
+	digests []string
+}
+
+// checks registry for updates of used images every interval, for registries
+// which can't call webhooks
+func runPoller(every time.Duration) {
+	logrus.Infof("polling registries every %v", every)
+	for range time.Tick(every) {
+		if isLeader() {
+			pollOnce(nil)
+		}
+	}
+}
+
+// scheduled check of repos (all when empty) at given time of given days,
+// "<days> <HH:MM> [repo,...]", e.g. "* 03:00 org/app,org/web"
+type pollSchedule struct {
+	days  window
+	at    int // minutes since midnight
+	repos map[string]bool
+}
+
+func parsePollSchedule(s string) ([]pollSchedule, error) {
+	var list []pollSchedule
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, _err("invalid poll schedule %q, expected \"<days> <HH:MM> [repo,...]\"", part)
+		}
+		var ps pollSchedule
+		if err := ps.days.parseDays(fields[0]); err != nil {
+			return nil, _err("invalid poll schedule %q: %s", part, err.Error())
+		}
+		var err error
+		if ps.at, err = parseClock(fields[1]); err != nil || ps.at == 24*60 {
+			return nil, _err("invalid poll schedule %q: invalid time %q", part, fields[1])
+		}
+		if len(fields) == 3 {
+			ps.repos = make(map[string]bool)
+			for _, repo := range strings.Split(fields[2], ",") {
+				ps.repos[normalizeRepo(repo)] = true
+			}
+		}
+		list = append(list, ps)
+	}
+	return list, nil
+}
+
+// runs scheduled checks
+func runScheduledPolls(schedules []pollSchedule) {
+	runSchedule("registry check", schedules, func(ps pollSchedule) {
+		if isLeader() {
+			pollOnce(ps.repos)
+		}
+	})
+}
+
+// runs f for each due schedule, times are in cfg.WindowsTZ; each one runs
+// once per minute it is due even when f is slow
+func runSchedule(what string, schedules []pollSchedule, f func(pollSchedule)) {
+	logrus.Infof("%d scheduled %s runs", len(schedules), what)
+	lastRun := make([]string, len(schedules))
+	for range time.Tick(15 * time.Second) {
+		now := time.Now().In(config().WindowsTZ)
+		minute := now.Format("2006-01-02 15:04")
+		for i, ps := range schedules {
+			if lastRun[i] == minute || !ps.days.onDay(now) || now.Hour()*60+now.Minute() != ps.at {
+				continue
+			}
+			lastRun[i] = minute
+			logrus.Infof("running scheduled %s at %s", what, minute)
+			f(ps)
+		}
+	}
+}
+
+// checks images of repos, all when repos is nil
+func pollOnce(repos map[string]bool) {
+	tags := make(map[string][]string)
+	started := make(map[string]bool)
+	var due []repoTag
+	// checks of every host first, updates take hosts one by one themselves
+	eachHost("", func() {
+		targets, err := pollTargets()
+		if err != nil {
+			logrus.Errorf("poll error: %s", err)
+			return
+		}
+		for _, t := range targets {
+			if repos != nil && !repos[t.repo] {
+				continue
+			}
+			tag, ok := pollNewTag(t, tags)
+			if !ok || started[t.repo+":"+tag] {
+				continue
+			}
+			started[t.repo+":"+tag] = true
+			due = append(due, repoTag{Repo: t.repo, Tag: tag})
+		}
+	})
+	for _, rt := range due {
+		if err := checkRequest(rt.Repo, rt.Tag); err != nil || inCooldown(rt.Repo, rt.Tag) || checkQuarantine(rt.Repo, rt.Tag) != nil ||
+			holdForApproval(rt.Repo, rt.Tag, "", "") != nil || deferUpdate(rt.Repo, rt.Tag, "") {
+			continue
+		}
+		logrus.Infof("poll: %s:%s is available, updating", rt.Repo, rt.Tag)
+		if _, err := runUpdate(rt.Repo, rt.Tag, "", updateOptions{Caller: "poll", Trigger: triggerPoll}); err != nil {
+			logrus.Errorf("polled update %s:%s error: %s", rt.Repo, rt.Tag, err)
+		}
+	}
+}
+
+// images of managed containers (or services in swarm mode)
+func pollTargets() ([]pollTarget, error) {
+	var targets []pollTarget
+	if config().Mode == modeSwarm {
+		services, err := cli.ServiceList(ctx, types.ServiceListOptions{})
+		if err != nil {
+			return nil, _err("get services list error: %s", err.Error())
+		}
+		for _, svc := range services {
+			if svc.Spec.TaskTemplate.ContainerSpec == nil || !managed(svc.Spec.Labels) {
+				continue
+			}
+			image := svc.Spec.TaskTemplate.ContainerSpec.Image
+			repo, tag := splitImage(strings.SplitN(image, "@", 2)[0])
+			targets = append(targets, pollTarget{name: svc.Spec.Name, repo: repo, tag: tag, labels: svc.Spec.Labels, digests: []string{image}})
+		}
+		return targets, nil
+	}
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, _err("get containers list error: %s", err.Error())
+	}
+	for _, cnt := range containers {
+		if !managed(cnt.Labels) || isSelf(cnt.ID) || !includeContainer(cnt) {
+			continue
+		}
+		repo, tag := splitImage(containerImage(cnt))
+		var name string
+		if len(cnt.Names) > 0 {
+			name = strings.TrimPrefix(cnt.Names[0], "/")
+		}
+		targets = append(targets, pollTarget{name: name, repo: repo, tag: tag, labels: cnt.Labels, digests: imageDigests(cnt.ImageID)})
+	}
+	return targets, nil
+}
+
+// tag t should be updated to: same tag with new digest for latest and
+// rolling tags, newest matching semver tag otherwise; registry tags lists
+// are cached in tags
+func pollNewTag(t pollTarget, tags map[string][]string) (string, bool) {
+	if t.tag == latest || config().tagMatch(t.tag, t.tag) {
+		if update, pinned := pinDecision(t.labels, t.tag, t.tag); pinned && !update {
+			return "", false
+		}
+		remote := &remoteDigest{image: fmt.Sprintf("%s:%s", t.repo, t.tag)}
+		differs, err := remote.differs(t.digests)
+		if err != nil {
+			logrus.Warnf("poll: %s", err)
+			return "", false
+		}
+		return t.tag, differs
+	}
+	if _, err := semver.NewVersion(t.tag); err != nil {
+		return "", false
+	}
+	list, ok := tags[t.repo]
+	if !ok {
+		var err error
+		if list, err = listTags(t.repo); err != nil {
+			logrus.Warnf("poll: %s", err)
+		}
+		tags[t.repo] = list
+	}
+	policy := config().prereleasePolicy(t.repo, t.labels)
+	var best *semver.Version
+	for _, candidate := range list {
+		ver, err := semver.NewVersion(candidate)
+		if err != nil || (best != nil && !ver.GreaterThan(best)) {
+			continue
+		}
+		if update, pinned := pinDecision(t.labels, t.tag, candidate); pinned && !update || !tagAllowed(t.labels, candidate) {
+			continue
+		}
+		if shouldUpdate(policy, t.tag, candidate) {
+			best = ver
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.Original(), true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= PRERELEASE POLICY ======
+
+// prerelease policy of container (or service), overrides repo's one
+const labelPrerelease = "docker-updater.prerelease"
+
+// prerelease policies
+const (
+	// prerelease parts must be equal ("1.2.3" never moves to "1.3.0-rc.1")
+	prereleaseExact = "exact"
+	// prerelease tags never trigger updates, prerelease containers move
+	// to stable ones
+	prereleaseStableOnly = "stable-only"
+	// any prerelease is an update when it's a higher version
+	prereleaseAllow = "allow-prerelease"
+	// like stable-only, but release candidates ("-rc", "-rc.1", "-rc1")
+	// trigger updates too
+	prereleaseTrackRC = "track-rc"
+)
+
+func isPrereleasePolicy(s string) bool {
+	switch s {
+	case prereleaseExact, prereleaseStableOnly, prereleaseAllow, prereleaseTrackRC:
+		return true
+	}
+	return false
+}
+
+// label, then per-repo override, then PRERELEASE_POLICY; invalid label falls
+// back to exact
+func (c *Config) prereleasePolicy(repo string, labels map[string]string) string {
+	if v := labels[labelPrerelease]; v != "" {
+		if isPrereleasePolicy(v) {
+			return v
+		}
+		logrus.Errorf("invalid %s=%s, using %s", labelPrerelease, v, prereleaseExact)
+		return prereleaseExact
+	}
+	if policy, ok := c.RepoPrereleasePolicy[repo]; ok {
+		return policy
+	}
+	return c.PrereleasePolicy
+}
+
+// whether policy lets a container on cVer move to ver, prerelease-wise
+func prereleaseAllowed(policy string, cVer, ver *semver.Version) bool {
+	switch policy {
+	case prereleaseAllow:
+		return true
+	case prereleaseStableOnly:
+		return ver.Prerelease() == ""
+	case prereleaseTrackRC:
+		return ver.Prerelease() == "" || strings.HasPrefix(strings.ToLower(ver.Prerelease()), "rc")
+	}
+	return cVer.Prerelease() == ver.Prerelease()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/docker/docker/client"
+	"github.com/labstack/echo"
+)
+
+// ======= PROBES ======
+
+const checkOK = "ok"
+
+// readiness of the updater, checks by name: docker (docker/NAME with
+// DOCKER_HOSTS), registry/DOMAIN and shutdown, "ok" or the error
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// liveness call: GET|HEAD /live, OK while the process serves requests
+func live(c echo.Context) error {
+	return c.String(http.StatusOK, "OK")
+}
+
+// readiness call: GET|HEAD /ready (and /probe), 503 with failed checks
+// unless every docker daemon and cfg.ReadyRegistries registry is reachable
+func ready(c echo.Context) error {
+	r := checkReadiness()
+	code := http.StatusOK
+	if !r.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(code)
+	}
+	return c.JSONPretty(code, r, "  ")
+}
+
+func checkReadiness() readiness {
+	r := readiness{Ready: true, Checks: make(map[string]string)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := checkOK
+			if err := f(); err != nil {
+				res = err.Error()
+			}
+			mu.Lock()
+			r.Checks[name] = res
+			r.Ready = r.Ready && res == checkOK
+			mu.Unlock()
+		}()
+	}
+	for _, a := range config().Agents {
+		a := a
+		check("agent/"+a.name, func() error { return pingAgent(a) })
+	}
+	if len(dockerHosts) == 0 && config().Role != roleCoordinator {
+		single := cli
+		check("docker", func() error { return pingDocker(single) })
+	}
+	for _, h := range dockerHosts {
+		h := h
+		check("docker/"+h.name, func() error { return pingDocker(h.cli) })
+	}
+	for _, domain := range config().ReadyRegistries {
+		domain := domain
+		check("registry/"+domain, func() error { return pingRegistry(domain) })
+	}
+	wg.Wait()
+	if shuttingDown() {
+		r.Ready, r.Checks["shutdown"] = false, "updater is shutting down"
+	}
+	return r
+}
+
+func pingDocker(dc *client.Client) error {
+	pingCtx, cancel := context.WithTimeout(ctx, config().ReadyTimeout)
+	defer cancel()
+	if _, err := dc.Ping(pingCtx); err != nil {
+		return _err("docker daemon ping error: %s", err.Error())
+	}
+	return nil
+}
+
+// registry API v2 base answers, 401 included: reachable, credentials are
+// only checked by pulls
+func pingRegistry(domain string) error {
+	req, err := http.NewRequest(http.MethodGet, "https://"+registryAPIHost(registryHost(domain))+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, config().ReadyTimeout)
+	defer cancel()
+	resp, err := registryClient.Do(req.WithContext(pingCtx))
+	if err != nil {
+		return _err("registry ping error: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return _err("registry ping: unexpected response status %s", resp.Status)
+	}
+	return nil
+}
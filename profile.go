@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ======= CONFIG PROFILES ======
+
+// config file may define named sets of options under profiles; the selected
+// one (--profile flag, PROFILE env or profile option, in that order) overlays
+// the file's top-level options, env vars still take precedence:
+//
+//	profiles:
+//	  staging: {allow_prerelease: true}
+//	  prod: {update_windows: "sat+sun 02:00-05:00", approval_repos: "*"}
+
+// options of every profile of the config file by profile name
+var fileProfiles = make(map[string]map[string]string)
+
+// splits profiles off raw config file options
+func parseProfiles(raw map[string]interface{}) (map[string]map[string]string, error) {
+	profiles := make(map[string]map[string]string)
+	for key, v := range raw {
+		if strings.ToUpper(key) != "PROFILES" {
+			continue
+		}
+		delete(raw, key)
+		list, ok := v.(map[interface{}]interface{})
+		if !ok && v != nil {
+			return nil, _err("profiles must be a mapping of profile names to options")
+		}
+		for name, options := range list {
+			opts, ok := options.(map[interface{}]interface{})
+			if !ok && options != nil {
+				return nil, _err("profile %v must be a mapping of options", name)
+			}
+			values := make(map[string]string)
+			for k, item := range opts {
+				var err error
+				if values[strings.ToUpper(fmt.Sprint(k))], err = configValue(item); err != nil {
+					return nil, _err("profile %v: %v: %s", name, k, err.Error())
+				}
+			}
+			profiles[fmt.Sprint(name)] = values
+		}
+	}
+	return profiles, nil
+}
+
+// selected profile name, file's profile option being the fallback
+func profileName(values map[string]string) string {
+	if name := flagValue("profile"); name != "" {
+		return name
+	}
+	if name := strings.TrimSpace(os.Getenv("PROFILE")); name != "" {
+		return name
+	}
+	return strings.TrimSpace(values["PROFILE"])
+}
+
+// overlays values with options of the selected profile, which must be
+// defined in the file
+func applyProfile(values map[string]string, profiles map[string]map[string]string, file string) error {
+	name := profileName(values)
+	if name == "" {
+		return nil
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return _err("profile %q is not defined in %s, known ones: %s", name, file, strings.Join(profileNames(profiles), ", "))
+	}
+	for k, v := range profile {
+		values[k] = v
+	}
+	return nil
+}
+
+func profileNames(profiles map[string]map[string]string) []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
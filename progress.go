@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= PULL PROGRESS ======
+
+// fan-out of events to subscribers, slow ones miss events instead of
+// blocking publishers
+type eventHub struct {
+	sync.Mutex
+	subs map[chan interface{}]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan interface{}]bool)}
+}
+
+func (h *eventHub) subscribe() chan interface{} {
+	ch := make(chan interface{}, 100)
+	h.Lock()
+	h.subs[ch] = true
+	h.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan interface{}) {
+	h.Lock()
+	delete(h.subs, ch)
+	h.Unlock()
+}
+
+func (h *eventHub) publish(e interface{}) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+var pullEvents = newEventHub()
+
+// progress of a layer (empty for the whole image) of pulled image
+type pullEvent struct {
+	Image   string    `json:"image"`
+	Host    string    `json:"host,omitempty"`
+	Layer   string    `json:"layer,omitempty"`
+	Status  string    `json:"status"`
+	Current int64     `json:"current,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// line of docker pull json stream
+type pullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress *struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// how often pull progress is logged
+const pullLogEvery = 10 * time.Second
+
+// reads pull stream of image to the end, publishing its progress and logging
+// layers summary; error reported in the stream is returned
+func readPullProgress(image string, out io.Reader) error {
+	type layer struct{ current, total int64 }
+	layers := make(map[string]*layer)
+	var order []string
+	logged := time.Now()
+	dec := json.NewDecoder(out)
+	for {
+		var m pullMessage
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return _err("read pull progress of %s error: %s", image, err.Error())
+		}
+		e := pullEvent{Image: image, Host: currentHost, Layer: m.ID, Status: m.Status, Error: m.Error, Time: time.Now()}
+		if m.Progress != nil {
+			e.Current, e.Total = m.Progress.Current, m.Progress.Total
+		}
+		pullEvents.publish(e)
+		if m.Error != "" {
+			return _err("pull image %s error: %s", image, m.Error)
+		}
+		// image level lines: "Pulling from ...", "Digest: ...", "Status: ..."
+		if m.ID == "" || strings.HasPrefix(m.Status, "Pulling from") {
+			continue
+		}
+		l, ok := layers[m.ID]
+		if !ok {
+			l = &layer{}
+			layers[m.ID] = l
+			order = append(order, m.ID)
+		}
+		switch {
+		case m.Status == "Downloading" && m.Progress != nil:
+			l.current, l.total = m.Progress.Current, m.Progress.Total
+		case m.Status == "Download complete" || m.Status == "Pull complete" || m.Status == "Already exists":
+			if l.total == 0 {
+				l.total = -1
+			}
+			l.current = l.total
+		}
+		if time.Since(logged) >= pullLogEvery {
+			logged = time.Now()
+			var done int
+			var current, total int64
+			for _, id := range order {
+				l := layers[id]
+				if l.total != 0 && l.current == l.total {
+					done++
+				}
+				if l.total > 0 {
+					current, total = current+l.current, total+l.total
+				}
+			}
+			logrus.Infof("pulling %s: %d/%d layers done, %s of %s downloaded", image, done, len(order), byteSize(current), byteSize(total))
+		}
+	}
+	return nil
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// pull progress stream call: GET /api/v1/pulls/events[?repo=REPO], server-sent
+// events with pullEvent data of every pull (of repo) until client leaves
+func pullProgress(c echo.Context) error {
+	repo := c.QueryParam("repo")
+	if repo != "" {
+		repo = normalizeRepo(repo)
+	}
+	return streamEvents(c, pullEvents, func(e interface{}) bool {
+		pe, ok := e.(pullEvent)
+		if !ok {
+			return false
+		}
+		r, _ := splitImage(pe.Image)
+		return repo == "" || r == repo
+	})
+}
+
+// how often idle event streams get a keep-alive comment
+const sseKeepAlive = 15 * time.Second
+
+// writes events of hub passing filter as server-sent events until client
+// disconnects
+func streamEvents(c echo.Context, hub *eventHub, filter func(interface{}) bool) error {
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepAlive.C:
+			if _, err := io.WriteString(resp, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case e := <-ch:
+			if !filter(e) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logrus.Errorf("marshal event error: %s", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(resp, "data: %s\n\n", data); err != nil {
+				return nil
+			}
+		}
+		resp.Flush()
+	}
+}
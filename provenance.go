@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// ======= UPDATE PROVENANCE ======
+
+// when (RFC 3339, UTC) and why the labeled container replaced the one on
+// labelPrevImage
+const (
+	labelUpdatedAt = "docker-updater.updated-at"
+	labelTrigger   = "docker-updater.trigger"
+)
+
+// what started an update
+const (
+	// registry webhook
+	triggerWebhook = "webhook"
+	// API or gRPC call
+	triggerManual = "manual"
+	triggerPoll   = "poll"
+	// queued one run once its window opened, updates resumed or repo's
+	// throttling allowed
+	triggerQueued   = "queued"
+	triggerApproval = "approval"
+	triggerCLI      = "cli"
+	triggerRollback = "rollback"
+	// automatic retry of an update with failed containers
+	triggerRetry = "retry"
+)
+
+// trigger of update requested by c: API update endpoints are manual ones,
+// others webhooks
+func requestTrigger(c echo.Context) string {
+	switch c.Path() {
+	case "/api/v1/update/manual", "/api/v1/update/batch":
+		return triggerManual
+	case "/api/v1/update":
+		if c.Request().Method != http.MethodPost {
+			return triggerManual
+		}
+	}
+	return triggerWebhook
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// ======= PRUNING ======
+
+// prunes dangling images, and unused networks and volumes when enabled,
+// on every host at scheduled times
+func runPruning(schedules []pollSchedule) {
+	runSchedule("prune", schedules, func(pollSchedule) {
+		if isLeader() {
+			eachHost("", pruneOnce)
+		}
+	})
+}
+
+func pruneOnce() {
+	host := ""
+	if currentHost != "" {
+		host = " on host " + currentHost
+	}
+	images, err := cli.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
+	if err != nil {
+		logrus.Errorf("image prune error%s: %s", host, err)
+	} else {
+		countPruned("images", len(images.ImagesDeleted), images.SpaceReclaimed)
+		logrus.Infof("pruned %d dangling images%s, %s reclaimed", len(images.ImagesDeleted), host, byteSize(int64(images.SpaceReclaimed)))
+	}
+	if config().PruneNetworks {
+		networks, err := cli.NetworksPrune(ctx, filters.NewArgs())
+		if err != nil {
+			logrus.Errorf("network prune error%s: %s", host, err)
+		} else {
+			countPruned("networks", len(networks.NetworksDeleted), 0)
+			logrus.Infof("pruned %d unused networks%s: %v", len(networks.NetworksDeleted), host, networks.NetworksDeleted)
+		}
+	}
+	if config().PruneVolumes {
+		volumes, err := cli.VolumesPrune(ctx, filters.NewArgs())
+		if err != nil {
+			logrus.Errorf("volume prune error%s: %s", host, err)
+		} else {
+			countPruned("volumes", len(volumes.VolumesDeleted), volumes.SpaceReclaimed)
+			logrus.Infof("pruned %d unused volumes%s, %s reclaimed", len(volumes.VolumesDeleted), host, byteSize(int64(volumes.SpaceReclaimed)))
+		}
+	}
+}
+
+func countPruned(kind string, n int, reclaimed uint64) {
+	prunedTotal.WithLabelValues(kind).Add(float64(n))
+	prunedBytes.WithLabelValues(kind).Add(float64(reclaimed))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/labstack/echo"
+)
+
+// ======= ARTIFACT REGISTRY PUSH EVENTS (PUB/SUB) ======
+
+// pub/sub push subscription request
+type pubsubPush struct {
+	Message struct {
+		Data      []byte `json:"data"` // base64 in json
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// gcr / artifact registry notification, tag is full image reference:
+// us-docker.pkg.dev/project/repo/app:1.2
+type gcrEvent struct {
+	Action string `json:"action"`
+	Digest string `json:"digest"`
+	Tag    string `json:"tag"`
+}
+
+// handler for gcr and artifact registry notifications pushed by pub/sub;
+// events which don't update a tag are acknowledged without update, so pub/sub
+// doesn't redeliver them. Pushes can't be signed, so they are refused unless
+// their tokens are checked (PubSubAudience)
+func updByPubSub(c echo.Context) error {
+	if config().PubSubAudience == "" {
+		logrus.Warnf("pub/sub push to %s from %s rejected, PUBSUB_AUDIENCE is not set", c.Request().URL.Path, c.RealIP())
+		return _httpErr(http.StatusForbidden, "pub/sub pushes are not accepted without PUBSUB_AUDIENCE")
+	}
+	if err := verifyPubSubToken(c.Request().Header.Get("Authorization")); err != nil {
+		logrus.Warnf("invalid pub/sub token, %s from %s rejected: %s", c.Request().URL.Path, c.RealIP(), err)
+		return _httpErr(http.StatusUnauthorized, "invalid token")
+	}
+	var push pubsubPush
+	if err := c.Bind(&push); err != nil {
+		return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+	}
+	var e gcrEvent
+	if err := json.Unmarshal(push.Message.Data, &e); err != nil {
+		return _httpErr(http.StatusBadRequest, "parse message error: %s", err.Error())
+	}
+	if e.Action != "INSERT" || e.Tag == "" {
+		logrus.Debugf("pub/sub message %s skipped: %s %s%s", push.Message.MessageID, e.Action, e.Tag, e.Digest)
+		return c.JSONPretty(http.StatusOK, map[string]string{
+			"status": "no tag inserted, skipped",
+		}, "  ")
+	}
+	ref, err := reference.ParseNamed(e.Tag)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "parse tag %s error: %s", e.Tag, err.Error())
+	}
+	tagged, ok := ref.(reference.Tagged)
+	if !ok {
+		return _httpErr(http.StatusBadRequest, "no tag in %s", e.Tag)
+	}
+	if push.Message.MessageID != "" && duplicateDelivery("pubsub:"+push.Message.MessageID) {
+		return duplicate(c, e.Tag)
+	}
+	return _updAsync(c, ref.Name(), tagged.Tag(), "")
+}
+
+// ======= GOOGLE ID TOKENS ======
+
+const googleCertsURL = "https://www.googleapis.com/oauth2/v1/certs"
+
+var googleClient = &http.Client{Timeout: 10 * time.Second}
+
+// google signing certs by key id
+var googleCerts = struct {
+	sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+}{}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+type jwtClaims struct {
+	Iss           string `json:"iss"`
+	Aud           string `json:"aud"`
+	Exp           int64  `json:"exp"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// checks "Bearer <jwt>" is google-signed for PubSubAudience (and
+// PubSubServiceAccount when set) and not expired
+func verifyPubSubToken(auth string) error {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return _err("no bearer token")
+	}
+	parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+	if len(parts) != 3 {
+		return _err("malformed token")
+	}
+	var h jwtHeader
+	if err := decodeJWTPart(parts[0], &h); err != nil {
+		return err
+	}
+	if h.Alg != "RS256" {
+		return _err("unsupported algorithm %s", h.Alg)
+	}
+	key, err := googleKey(h.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return _err("malformed signature: %s", err.Error())
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return _err("bad signature: %s", err.Error())
+	}
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+	switch {
+	case claims.Iss != "accounts.google.com" && claims.Iss != "https://accounts.google.com":
+		return _err("unexpected issuer %s", claims.Iss)
+	case claims.Aud != config().PubSubAudience:
+		return _err("unexpected audience %s", claims.Aud)
+	case time.Now().Unix() > claims.Exp:
+		return _err("token expired")
+	case config().PubSubServiceAccount != "" && (claims.Email != config().PubSubServiceAccount || !claims.EmailVerified):
+		return _err("unexpected service account %s", claims.Email)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return _err("malformed token: %s", err.Error())
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return _err("malformed token: %s", err.Error())
+	}
+	return nil
+}
+
+// key by id, certs are re-fetched when cache expires or key is unknown
+func googleKey(kid string) (*rsa.PublicKey, error) {
+	googleCerts.Lock()
+	defer googleCerts.Unlock()
+	if key, ok := googleCerts.keys[kid]; ok && time.Now().Before(googleCerts.expires) {
+		return key, nil
+	}
+	keys, err := fetchGoogleCerts()
+	if err != nil {
+		return nil, _err("fetch google certs error: %s", err.Error())
+	}
+	googleCerts.keys, googleCerts.expires = keys, time.Now().Add(time.Hour)
+	key, ok := keys[kid]
+	if !ok {
+		return nil, _err("unknown key id %s", kid)
+	}
+	return key, nil
+}
+
+func fetchGoogleCerts() (map[string]*rsa.PublicKey, error) {
+	resp, err := googleClient.Get(googleCertsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, _err("unexpected response status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var certs map[string]string
+	if err := json.Unmarshal(body, &certs); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(certs))
+	for kid, certPEM := range certs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return nil, _err("bad certificate %s", kid)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, _err("bad certificate %s: %s", kid, err.Error())
+		}
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, _err("certificate %s has no rsa key", kid)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// "Bearer <jwt>" of claims signed with key kid
+func pubsubToken(t *testing.T, key *rsa.PrivateKey, alg, kid string, claims jwtClaims) string {
+	part := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := part(jwtHeader{Alg: alg, Kid: kid}) + "." + part(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// google certs cache holding key as kid, so no certs are fetched
+func withGoogleKey(t *testing.T, kid string) (*rsa.PrivateKey, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	googleCerts.Lock()
+	prevKeys, prevExpires := googleCerts.keys, googleCerts.expires
+	googleCerts.keys = map[string]*rsa.PublicKey{kid: &key.PublicKey}
+	googleCerts.expires = time.Now().Add(time.Hour)
+	googleCerts.Unlock()
+	return key, func() {
+		googleCerts.Lock()
+		googleCerts.keys, googleCerts.expires = prevKeys, prevExpires
+		googleCerts.Unlock()
+	}
+}
+
+func TestVerifyPubSubToken(t *testing.T) {
+	key, restore := withGoogleKey(t, "kid-1")
+	defer restore()
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const audience = "https://updater.example.com/api/v1/update/pubsub"
+	const account = "push@project.iam.gserviceaccount.com"
+	defer withConfig(func(c *Config) {
+		c.PubSubAudience, c.PubSubServiceAccount = audience, account
+	})()
+	valid := jwtClaims{
+		Iss: "https://accounts.google.com", Aud: audience, Exp: time.Now().Add(time.Hour).Unix(),
+		Email: account, EmailVerified: true,
+	}
+	if err := verifyPubSubToken(pubsubToken(t, key, "RS256", "kid-1", valid)); err != nil {
+		t.Fatalf("valid token rejected: %s", err)
+	}
+
+	with := func(change func(*jwtClaims)) jwtClaims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+	token := pubsubToken(t, key, "RS256", "kid-1", valid)
+	parts := strings.Split(token, ".")
+	for name, auth := range map[string]string{
+		"no token":              "",
+		"basic auth":            "Basic dXNlcjpwYXNz",
+		"malformed":             "Bearer abc.def",
+		"algorithm none":        pubsubToken(t, key, "none", "kid-1", valid),
+		"algorithm HS256":       pubsubToken(t, key, "HS256", "kid-1", valid),
+		"unsigned":              parts[0] + "." + parts[1] + ".",
+		"other key":             pubsubToken(t, other, "RS256", "kid-1", valid),
+		"claims changed":        parts[0] + "." + strings.Split(pubsubToken(t, key, "RS256", "kid-1", with(func(c *jwtClaims) { c.Aud = "x" })), ".")[1] + "." + parts[2],
+		"wrong audience":        pubsubToken(t, key, "RS256", "kid-1", with(func(c *jwtClaims) { c.Aud = "https://other.example.com" })),
+		"wrong issuer":          pubsubToken(t, key, "RS256", "kid-1", with(func(c *jwtClaims) { c.Iss = "https://issuer.example.com" })),
+		"expired":               pubsubToken(t, key, "RS256", "kid-1", with(func(c *jwtClaims) { c.Exp = time.Now().Add(-time.Minute).Unix() })),
+		"wrong service account": pubsubToken(t, key, "RS256", "kid-1", with(func(c *jwtClaims) { c.Email = "other@project.iam.gserviceaccount.com" })),
+		"unverified email":      pubsubToken(t, key, "RS256", "kid-1", with(func(c *jwtClaims) { c.EmailVerified = false })),
+	} {
+		if err := verifyPubSubToken(auth); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestPubSubRequiresAudience(t *testing.T) {
+	f, restoreDocker := newFakeDocker(t)
+	defer restoreDocker()
+	_, restore := withGoogleKey(t, "kid-1")
+	defer restore()
+	data, _ := json.Marshal(gcrEvent{Action: "INSERT", Tag: "us-docker.pkg.dev/project/repo/app:1.2"})
+	var push pubsubPush
+	push.Message.Data, push.Message.MessageID = data, "pubsub-audience-1"
+	body, _ := json.Marshal(push)
+	post := func() int {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/update/pubsub", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer forged.token.sig")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := updByPubSub(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+
+	for audience, want := range map[string]int{"": http.StatusForbidden, "https://updater.example.com": http.StatusUnauthorized} {
+		func() {
+			defer withConfig(func(c *Config) { c.PubSubAudience = audience })()
+			if code := post(); code != want {
+				t.Errorf("PUBSUB_AUDIENCE %q: HTTP %d, want %d", audience, code, want)
+			}
+		}()
+	}
+	if calls := f.recorded(); len(calls) > 0 {
+		t.Errorf("docker called for rejected pushes: %v", calls)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ======= QUARANTINE ======
+
+// repo:tag failed cfg.QuarantineAfter times in a row, refused until
+// released through the API
+type quarantineEntry struct {
+	Repo      string    `json:"repo"`
+	Tag       string    `json:"tag"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	Since     time.Time `json:"since"`
+}
+
+// consecutive failures and quarantined entries by repo:tag
+var quarantine = struct {
+	sync.Mutex
+	failures map[string]int
+	entries  map[string]*quarantineEntry
+}{failures: make(map[string]int), entries: make(map[string]*quarantineEntry)}
+
+var quarantinedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "docker_updater_quarantined",
+	Help: "Number of repo:tag pairs quarantined after repeated failed updates.",
+})
+
+func init() {
+	prometheus.MustRegister(quarantinedGauge)
+}
+
+// counts failed update of repo:tag, reset by a successful one
+func recordOutcome(repo, tag string, err error) {
+	if config().QuarantineAfter <= 0 {
+		return
+	}
+	key := repo + ":" + tag
+	quarantine.Lock()
+	if err == nil {
+		delete(quarantine.failures, key)
+		quarantine.Unlock()
+		return
+	}
+	quarantine.failures[key]++
+	failures := quarantine.failures[key]
+	if failures < config().QuarantineAfter || quarantine.entries[key] != nil {
+		quarantine.Unlock()
+		return
+	}
+	quarantine.entries[key] = &quarantineEntry{Repo: repo, Tag: tag, Failures: failures, LastError: err.Error(), Since: time.Now()}
+	quarantinedGauge.Set(float64(len(quarantine.entries)))
+	quarantine.Unlock()
+
+	logrus.Errorf("%s quarantined after %d failed updates in a row, last error: %s", key, failures, err)
+	notify(notification{Event: eventQuarantined, Repo: repo, Tag: tag, Error: err.Error(), Time: time.Now()})
+}
+
+// 409 for update of quarantined repo:tag
+func checkQuarantine(repo, tag string) error {
+	quarantine.Lock()
+	q := quarantine.entries[repo+":"+tag]
+	quarantine.Unlock()
+	if q == nil {
+		return nil
+	}
+	return _httpErr(http.StatusConflict, "%s:%s is quarantined after %d failed updates (last error: %s), release it with POST /api/v1/quarantine/release",
+		repo, tag, q.Failures, q.LastError)
+}
+
+// quarantine list call: GET /api/v1/quarantine
+func listQuarantine(c echo.Context) error {
+	quarantine.Lock()
+	list := make([]quarantineEntry, 0, len(quarantine.entries))
+	for _, q := range quarantine.entries {
+		list = append(list, *q)
+	}
+	quarantine.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return c.JSONPretty(http.StatusOK, list, "  ")
+}
+
+// quarantine release call: POST /api/v1/quarantine/release?repo=REPO&tag=TAG,
+// updates of repo:tag are accepted again with failures counted from zero
+func releaseQuarantine(c echo.Context) error {
+	repo, tag := c.QueryParam("repo"), c.QueryParam("tag")
+	key := repo + ":" + tag
+	quarantine.Lock()
+	q := quarantine.entries[key]
+	delete(quarantine.entries, key)
+	delete(quarantine.failures, key)
+	quarantinedGauge.Set(float64(len(quarantine.entries)))
+	quarantine.Unlock()
+	if q == nil {
+		return _httpErr(http.StatusNotFound, "%s is not quarantined", key)
+	}
+	logrus.WithFields(logrus.Fields{
+		"audit":  "release",
+		"repo":   repo,
+		"tag":    tag,
+		"caller": caller(c),
+		"ip":     clientIP(c),
+	}).Warnf("%s released from quarantine", key)
+	return c.JSONPretty(http.StatusOK, q, "  ")
+}
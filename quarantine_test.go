@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestQuarantine(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.QuarantineAfter, c.Retries = 2, 0 })()
+	defer func() {
+		quarantine.Lock()
+		quarantine.failures, quarantine.entries = make(map[string]int), make(map[string]*quarantineEntry)
+		quarantine.Unlock()
+	}()
+	f.addContainer("app-1", "org/flaky:1.0.0", nil)
+
+	// 1.0.1 isn't pushed yet, so its pulls fail
+	for i := 0; i < 2; i++ {
+		if _, err := runUpdate("org/flaky", "1.0.1", "", updateOptions{}); err == nil {
+			t.Fatal("update of missing tag succeeded")
+		}
+	}
+	f.pushImage("org/flaky:1.0.1", nil)
+	pulls := len(f.recorded("pull"))
+	_, err := runUpdate("org/flaky", "1.0.1", "", updateOptions{})
+	if he, ok := err.(*echo.HTTPError); !ok || he.Code != http.StatusConflict || !strings.Contains(err.Error(), "quarantined after 2 failed updates") {
+		t.Fatalf("update of quarantined tag: %v, want 409", err)
+	}
+	if len(f.recorded("pull")) != pulls {
+		t.Error("quarantined tag pulled")
+	}
+	// other tags of the repo aren't
+	if err := checkQuarantine("org/flaky", "1.0.2"); err != nil {
+		t.Error(err)
+	}
+
+	release := func(repo, tag string) int {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/v1/quarantine/release?repo="+repo+"&tag="+tag, nil), rec)
+		if err := releaseQuarantine(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+	if code := release("org/flaky", "1.0.1"); code != http.StatusOK {
+		t.Fatalf("release: HTTP %d", code)
+	}
+	if code := release("org/flaky", "1.0.1"); code != http.StatusNotFound {
+		t.Errorf("second release: HTTP %d, want 404", code)
+	}
+	if summary, err := runUpdate("org/flaky", "1.0.1", "", updateOptions{}); err != nil || summary.Updated != 1 {
+		t.Errorf("update after release: %+v, %v", summary, err)
+	}
+}
+
+func TestQuarantineCountsFailuresInARow(t *testing.T) {
+	defer withConfig(func(c *Config) { c.QuarantineAfter = 2 })()
+	defer func() {
+		quarantine.Lock()
+		quarantine.failures, quarantine.entries = make(map[string]int), make(map[string]*quarantineEntry)
+		quarantine.Unlock()
+	}()
+	failed := errors.New("start error")
+
+	recordOutcome("org/app", "1.0.1", failed)
+	recordOutcome("org/app", "1.0.1", nil)
+	recordOutcome("org/app", "1.0.1", failed)
+	if err := checkQuarantine("org/app", "1.0.1"); err != nil {
+		t.Errorf("quarantined after failures with a success between: %s", err)
+	}
+	recordOutcome("org/app", "1.0.1", failed)
+	if err := checkQuarantine("org/app", "1.0.1"); err == nil {
+		t.Error("not quarantined after 2 failures in a row")
+	}
+
+	config().QuarantineAfter = 0
+	for i := 0; i < 5; i++ {
+		recordOutcome("org/other", "1.0.1", failed)
+	}
+	if err := checkQuarantine("org/other", "1.0.1"); err != nil {
+		t.Errorf("quarantined with QUARANTINE_AFTER 0: %s", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= PERSISTENT UPDATE QUEUE ======
+
+// accepted updates (queued jobs, synchronous ones, the window queue) are
+// kept in cfg.UpdateQueueFile until they finished, ones left by a crash or
+// restart are replayed as jobs on startup; updates failing while the docker
+// daemon is unreachable are kept too and replayed once it answers again.
+// Caller of a lost synchronous update got no response, so none is sent
+
+// update accepted but not finished yet
+type acceptedUpdate struct {
+	ID   string `json:"id"`
+	Repo string `json:"repo,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+	Host string `json:"host,omitempty"`
+	// pairs of a batch
+	Batch       []repoTag `json:"batch,omitempty"`
+	CallbackURL string    `json:"callback_url,omitempty"`
+	ResultURL   string    `json:"result_url,omitempty"`
+	Caller      string    `json:"caller,omitempty"`
+	Trigger     string    `json:"trigger,omitempty"`
+	AcceptedAt  time.Time `json:"accepted_at"`
+	// failed with the daemon unreachable, waiting for replay
+	kept bool
+}
+
+// update of the window queue, with callbacks of its requests
+type queuedUpdate struct {
+	repoTag
+	Callbacks []string `json:"callbacks,omitempty"`
+}
+
+type updateQueueFile struct {
+	Updates []acceptedUpdate `json:"updates"`
+	Queued  []queuedUpdate   `json:"queued"`
+}
+
+var accepted = struct {
+	sync.Mutex
+	byID map[string]acceptedUpdate
+}{byID: make(map[string]acceptedUpdate)}
+
+// records update about to run synchronously, returns its id (empty without
+// queue file) for finishAccepted
+func acceptUpdate(repo, tag, host string, batch []repoTag, caller, trigger string) string {
+	if config().UpdateQueueFile == "" {
+		return ""
+	}
+	u := acceptedUpdate{ID: newJobID(), Repo: repo, Tag: tag, Host: host, Batch: batch, Caller: caller, Trigger: trigger, AcceptedAt: time.Now()}
+	accepted.Lock()
+	accepted.byID[u.ID] = u
+	accepted.Unlock()
+	saveUpdateQueue()
+	return u.ID
+}
+
+// records queued job
+func acceptJob(j job) {
+	if config().UpdateQueueFile == "" {
+		return
+	}
+	accepted.Lock()
+	accepted.byID[j.ID] = acceptedUpdate{
+		ID: j.ID, Repo: j.Repo, Tag: j.Tag, Host: j.Host, Batch: j.Batch,
+		CallbackURL: j.CallbackURL, ResultURL: j.ResultURL,
+		Caller: j.Caller, Trigger: j.Trigger, AcceptedAt: j.CreatedAt,
+	}
+	accepted.Unlock()
+	saveUpdateQueue()
+}
+
+// drops finished update, unless it failed with the docker daemon down
+func finishAccepted(id string, err error) {
+	if id == "" || config().UpdateQueueFile == "" {
+		return
+	}
+	down := err != nil && daemonDown()
+	accepted.Lock()
+	u, ok := accepted.byID[id]
+	if ok && down {
+		u.kept = true
+		accepted.byID[id] = u
+		logrus.Warnf("docker daemon is unreachable, update %s kept for replay", id)
+	} else {
+		delete(accepted.byID, id)
+	}
+	accepted.Unlock()
+	if ok {
+		saveUpdateQueue()
+	}
+}
+
+func daemonDown() bool {
+	_, err := cli.Ping(ctx)
+	return err != nil
+}
+
+// writes accepted updates and the window queue to the queue file, replacing
+// it at once
+func saveUpdateQueue() {
+	if config().UpdateQueueFile == "" {
+		return
+	}
+	accepted.Lock()
+	defer accepted.Unlock()
+	var state updateQueueFile
+	for _, u := range accepted.byID {
+		state.Updates = append(state.Updates, u)
+	}
+	sort.Slice(state.Updates, func(i, j int) bool {
+		return state.Updates[i].AcceptedAt.Before(state.Updates[j].AcceptedAt)
+	})
+	deferred.Lock()
+	for key, tag := range deferred.tags {
+		state.Queued = append(state.Queued, queuedUpdate{repoTag{Repo: key.repo, Tag: tag, Host: key.host}, deferred.callbacks[key]})
+	}
+	deferred.Unlock()
+	data, err := json.Marshal(state)
+	if err == nil {
+		tmp := config().UpdateQueueFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, config().UpdateQueueFile)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("write update queue file %s error: %s", config().UpdateQueueFile, err)
+	}
+}
+
+// restores the window queue from the queue file and replays updates left
+// unfinished as jobs; job workers must be started
+func loadUpdateQueue() error {
+	if config().UpdateQueueFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(config().UpdateQueueFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state updateQueueFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return _err("update queue file %s: %s", config().UpdateQueueFile, err.Error())
+	}
+	deferred.Lock()
+	for _, q := range state.Queued {
+		key := deferredKey{q.Repo, q.Host}
+		deferred.tags[key], deferred.callbacks[key] = q.Tag, q.Callbacks
+	}
+	deferred.Unlock()
+	accepted.Lock()
+	for _, u := range state.Updates {
+		u.kept = true
+		accepted.byID[u.ID] = u
+	}
+	accepted.Unlock()
+	logrus.Infof("%d queued and %d unfinished updates loaded from %s", len(state.Queued), len(state.Updates), config().UpdateQueueFile)
+	replayAccepted()
+	return nil
+}
+
+// queues kept updates as jobs of their ids, or in the window queue when an
+// update would be queued now; ones not fitting the job queue stay kept
+func replayAccepted() {
+	accepted.Lock()
+	var kept []acceptedUpdate
+	for _, u := range accepted.byID {
+		if u.kept {
+			kept = append(kept, u)
+		}
+	}
+	accepted.Unlock()
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].AcceptedAt.Before(kept[j].AcceptedAt)
+	})
+	for _, u := range kept {
+		if len(u.Batch) == 0 && deferUpdate(u.Repo, u.Tag, u.Host) {
+			deferCallback(u.Repo, u.Host, u.CallbackURL)
+			finishAccepted(u.ID, nil)
+			continue
+		}
+		if !admitUpdate() {
+			logrus.Warnf("too many pending updates, replay of %s postponed", u.ID)
+			return
+		}
+		j := &job{
+			ID:          u.ID,
+			Repo:        u.Repo,
+			Tag:         u.Tag,
+			Host:        u.Host,
+			Status:      jobQueued,
+			CreatedAt:   u.AcceptedAt,
+			Batch:       u.Batch,
+			CallbackURL: u.CallbackURL,
+			ResultURL:   u.ResultURL,
+			Caller:      u.Caller,
+			Trigger:     u.Trigger,
+		}
+		if !queueJob(j) {
+			releaseUpdate()
+			logrus.Warnf("job queue is full, replay of %s postponed", u.ID)
+			return
+		}
+		logrus.Infof("update %s replayed as job", u.ID)
+	}
+}
+
+// replays kept updates every interval once the docker daemon answers
+func runUpdateQueueReplay(every time.Duration) {
+	for range time.Tick(every) {
+		accepted.Lock()
+		n := 0
+		for _, u := range accepted.byID {
+			if u.kept {
+				n++
+			}
+		}
+		accepted.Unlock()
+		if n > 0 && !daemonDown() {
+			replayAccepted()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// ids of the accepted updates in the queue file
+func queueFileIDs(t *testing.T) map[string]bool {
+	data, err := ioutil.ReadFile(config().UpdateQueueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state updateQueueFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, u := range state.Updates {
+		ids[u.ID] = true
+	}
+	return ids
+}
+
+func TestShutdownKeepsQueuedJobs(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer withConfig(func(c *Config) { c.UpdateQueueFile = filepath.Join(dir, "queue.json") })()
+	var callbacks int32
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&callbacks, 1)
+	}))
+	defer hub.Close()
+	prevQueue := jobs.queue
+	jobs.queue = make(chan *job, 1)
+	defer func() {
+		jobs.queue = prevQueue
+		inflight.Lock()
+		inflight.stopping, inflight.idle = false, make(chan struct{})
+		inflight.Unlock()
+	}()
+	f.addContainer("app-1", "org/restarted:1.0.0", nil)
+	f.pushImage("org/restarted:1.0.1", nil)
+
+	if !admitUpdate() {
+		t.Fatal("update not admitted")
+	}
+	j := enqueueJob("org/restarted", "1.0.1", "", hub.URL, "", "", "", nil)
+	if j == nil {
+		t.Fatal("job not queued")
+	}
+	stopUpdates()
+	runJob(<-jobs.queue)
+
+	if !queueFileIDs(t)[j.ID] {
+		t.Error("job refused by shutdown dropped from the queue file")
+	}
+	if n := atomic.LoadInt32(&callbacks); n > 0 {
+		t.Errorf("%d hub callbacks sent for a job left for replay", n)
+	}
+	if snapshot, _ := getJob(j.ID); snapshot.Status != jobQueued {
+		t.Errorf("job %s, want %s", snapshot.Status, jobQueued)
+	}
+	if calls := f.recorded("pull", "stop"); len(calls) > 0 {
+		t.Errorf("job ran while shutting down: %v", calls)
+	}
+
+	// ones refused waiting for an update slot are left too
+	if !leftForReplay(errShuttingDown(), nil) {
+		t.Error("update refused by shutdown not left for replay")
+	}
+	if !leftForReplay(_err("1 of 2 updates failed"), []batchResult{{Status: "ok"}, {Status: "failed", Error: errShuttingDown().Error()}}) {
+		t.Error("batch refused by shutdown not left for replay")
+	}
+	if leftForReplay(_err("pull failed"), nil) {
+		t.Error("failed update left for replay")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= RATE LIMIT ======
+
+// token bucket refilled with rate tokens per second up to burst
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rejects requests over the bucket's limit with 429
+func rateLimit(b *tokenBucket) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !b.allow() {
+				logrus.Warnf("rate limit exceeded, %s %s rejected", c.Request().Method, c.Request().URL.Path)
+				return _httpErr(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+// token buckets per key (client address, repo), created on first use
+type bucketSet struct {
+	sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+}
+
+// buckets refilled up to burst are dropped once there are more than this
+const maxIdleBuckets = 10000
+
+func newBucketSet(rate float64, burst int) *bucketSet {
+	return &bucketSet{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// nil set allows everything
+func (s *bucketSet) allow(key string) bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxIdleBuckets {
+			s.prune()
+		}
+		b = newTokenBucket(s.rate, s.burst)
+		s.buckets[key] = b
+	}
+	s.Unlock()
+	return b.allow()
+}
+
+// drops buckets which would be full by now, so are the same as new ones
+func (s *bucketSet) prune() {
+	now := time.Now()
+	for key, b := range s.buckets {
+		b.Lock()
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(s.buckets, key)
+		}
+		b.Unlock()
+	}
+}
+
+// rejects requests over the limit of their client address with 429
+func rateLimitByIP(s *bucketSet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ip := clientIP(c).String()
+			if !s.allow(ip) {
+				logrus.Warnf("rate limit of %s exceeded, %s %s rejected", ip, c.Request().Method, c.Request().URL.Path)
+				return _httpErr(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+// per-repo limit of update requests, nil when disabled
+var repoLimits *bucketSet
+
+// 429 error when repo's update requests are over the limit
+func checkRepoRate(repo string) error {
+	if !repoLimits.allow(repo) {
+		logrus.Warnf("rate limit of repo %s exceeded, update rejected", repo)
+		return _httpErr(http.StatusTooManyRequests, "rate limit of repo %s exceeded", repo)
+	}
+	return nil
+}
+
+// rejects requests with body over max bytes with 413, bodies without length
+// fail to be read past max
+func limitBody(max int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.ContentLength > max {
+				return _httpErr(http.StatusRequestEntityTooLarge, "request body over %d bytes", max)
+			}
+			req.Body = http.MaxBytesReader(c.Response(), req.Body, max)
+			return next(c)
+		}
+	}
+}
+
+// middleware guarding update requests: allowed networks, rate limits and
+// body size, as configured
+func updateGuards() []echo.MiddlewareFunc {
+	var guards []echo.MiddlewareFunc
+	if len(config().WebhookAllowedNets) > 0 {
+		guards = append(guards, allowNetworks(config().WebhookAllowedNets))
+	}
+	if config().RateLimit > 0 {
+		guards = append(guards, rateLimit(newTokenBucket(config().RateLimit, config().RateLimitBurst)))
+	}
+	if config().IPRateLimit > 0 {
+		guards = append(guards, rateLimitByIP(newBucketSet(config().IPRateLimit, config().RateLimitBurst)))
+	}
+	if config().MaxBodySize > 0 {
+		guards = append(guards, limitBody(int64(config().MaxBodySize)))
+	}
+	return guards
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestRateLimitUpdateRoutes(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	updGroup := e.Group("/api/v1/update", rateLimit(newTokenBucket(1, 5)))
+	updGroup.GET("", ok)
+	e.GET("/probe", ok)
+
+	codes := make(map[int]int)
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/update?repo=org/app&tag=1.0.1", nil))
+		codes[rec.Code]++
+	}
+	// a token may be refilled while hammering
+	if codes[http.StatusOK] < 5 || codes[http.StatusOK] > 6 || codes[http.StatusTooManyRequests] != 20-codes[http.StatusOK] {
+		t.Errorf("response codes = %v, want the burst of 5 passed and 429 past it", codes)
+	}
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("probe throttled: %d", rec.Code)
+		}
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	b := newTokenBucket(10, 1)
+	if !b.allow() || b.allow() {
+		t.Fatal("bucket of burst 1 allowed other than one request")
+	}
+	// 100ms at 10/s is one token
+	b.last = b.last.Add(-100 * time.Millisecond)
+	if !b.allow() {
+		t.Error("bucket not refilled")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ======= REDIS CLIENT ======
+
+// minimal RESP2 client, commands are sent one at a time over a single
+// connection which is redialed after errors
+
+const redisTimeout = 10 * time.Second
+
+type redisClient struct {
+	sync.Mutex
+	addr     string
+	tls      *tls.Config
+	password string
+	db       int
+	conn     net.Conn
+	r        *bufio.Reader
+}
+
+// redis error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redis://[:password@]host[:port][/db], rediss:// for TLS
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, _err("invalid redis URL %q, expected redis://[:password@]host[:port][/db]", rawURL)
+	}
+	c := &redisClient{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, _err("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial() error {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	if c.tls != nil {
+		conn = tls.Client(conn, c.tls)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.send("AUTH", c.password); err != nil {
+			c.close()
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.send("SELECT", strconv.Itoa(c.db)); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// runs command, replies are string, int64, nil or []interface{} of them;
+// error replies are redisError
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, _err("redis %s error: %s", c.addr, err.Error())
+		}
+	}
+	reply, err := c.send(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// connection state is unknown
+		c.close()
+		return nil, _err("redis %s error: %s", c.addr, err.Error())
+	}
+	return reply, err
+}
+
+func (c *redisClient) send(args ...string) (interface{}, error) {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisClient) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, _err("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			// error items are returned as values
+			if list[i], err = c.read(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				list[i] = err
+			}
+		}
+		return list, nil
+	}
+	return nil, _err("unexpected reply %q", line)
+}
+
+// string items of array reply, nil ones are empty
+func redisStrings(reply interface{}) []string {
+	list, _ := reply.([]interface{})
+	values := make([]string, len(list))
+	for i, v := range list {
+		values[i], _ = v.(string)
+	}
+	return values
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= REGISTRY API ======
+
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// max tags/list pages followed
+const maxTagPages = 20
+
+// WWW-Authenticate parameters: key="value"
+var challengeRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Link: </v2/app/tags/list?last=x&n=100>; rel="next"
+var nextLinkRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// registry API v2 endpoint of image repo: repo's base url
+// (https://registry/v2/path), path and credentials
+type registryRepo struct {
+	base  string
+	path  string
+	ac    types.AuthConfig
+	token string
+}
+
+// registry mirror's one when repo's registry has a mirror
+func newRegistryRepo(repo string) (*registryRepo, error) {
+	pn, err := reference.ParseNormalizedNamed(repo)
+	if err != nil {
+		return nil, _err("parse container name %s error: %s", repo, err.Error())
+	}
+	// any tag maps the repo
+	if ref, ok := mirrored(pn.Name() + ":" + latest); ok {
+		if pn, err = reference.ParseNormalizedNamed(ref); err != nil {
+			return nil, _err("parse mirror name %s error: %s", ref, err.Error())
+		}
+	}
+	domain, path := reference.Domain(pn), reference.Path(pn)
+	ac, _, err := domainAuth(domain)
+	if err != nil {
+		return nil, err
+	}
+	return &registryRepo{base: "https://" + registryAPIHost(domain), path: path, ac: ac}, nil
+}
+
+// API host of registry domain
+func registryAPIHost(domain string) string {
+	if domain == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+// GET of target, authorizing with a bearer token from registry's challenge
+// once refused; the token is kept for next requests
+func (r *registryRepo) get(target, accept string) (*http.Response, error) {
+	resp, err := registryGet(target, r.ac, r.token, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if r.token, err = registryToken(challenge, r.path, r.ac); err != nil {
+			return nil, err
+		}
+		return registryGet(target, r.ac, r.token, accept)
+	}
+	return resp, nil
+}
+
+// all tags of image repo from registry API v2
+func listTags(repo string) ([]string, error) {
+	r, err := newRegistryRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	next := r.base + "/v2/" + r.path + "/tags/list"
+	var tags []string
+	for page := 0; next != "" && page < maxTagPages; page++ {
+		resp, err := r.get(next, "")
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, _err("list tags of %s: unexpected response status %s", repo, resp.Status)
+		}
+		if err != nil {
+			return nil, _err("list tags of %s: %s", repo, err.Error())
+		}
+		tags = append(tags, list.Tags...)
+		next = ""
+		if m := nextLinkRe.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = r.base + m[1]
+		}
+	}
+	return tags, nil
+}
+
+// GET with bearer token, or basic auth with credentials when no token;
+// accept is set as Accept header unless empty
+func registryGet(target string, ac types.AuthConfig, token, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case ac.Username != "":
+		req.SetBasicAuth(ac.Username, ac.Password)
+	}
+	var resp *http.Response
+	err = retry("registry request "+target, func() error {
+		if resp, err = registryClient.Do(req); err != nil {
+			return err
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			return _err("registry request %s: unexpected response status %s", target, resp.Status)
+		}
+		return nil
+	})
+	return resp, err
+}
+
+// pull token for repository path from bearer challenge's realm
+func registryToken(challenge, path string, ac types.AuthConfig) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", _err("registry authorization failed")
+	}
+	params := make(map[string]string)
+	for _, m := range challengeRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if ac.RegistryToken != "" {
+		return ac.RegistryToken, nil
+	}
+	if params["realm"] == "" {
+		return "", _err("registry token realm is missing")
+	}
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", "repository:"+path+":pull")
+	target := params["realm"] + "?" + q.Encode()
+	resp, err := registryGet(target, ac, "", "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", _err("registry token request: unexpected response status %s", resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", _err("registry token response: %s", err.Error())
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+	return t.AccessToken, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ======= CONFIG RELOAD ======
+
+// held (read) by running updates and rollbacks, so each one works with a
+// single config; reload swaps cfg once they are done, updates starting
+// meanwhile wait for it
+var configLock sync.RWMutex
+
+// one reload at a time, loadConfig fills fileConfig and fileProfiles
+var reloadLock sync.Mutex
+
+// options taken at startup (listener, TLS, routes, workers, schedules),
+// their fields keep the values cfg started with and a change is logged
+var restartOptions = map[string][]string{
+	"LISTEN_ADDRESS":              {"ListenAddress"},
+	"LISTEN_SOCKET":               {"ListenSocket"},
+	"LISTEN_SOCKET_MODE":          {"ListenSocketMode"},
+	"LISTEN_SOCKET_GROUP":         {"ListenSocketGroup"},
+	"HA_REDIS_URL":                {"HARedisURL"},
+	"HA_LEASE_TTL":                {"HALeaseTTL"},
+	"HA_KEY_PREFIX":               {"HAKeyPrefix"},
+	"MODE":                        {"Mode"},
+	"ROLE":                        {"Role"},
+	"ENGINE":                      {"Engine"},
+	"DOCKER_HOSTS":                {"DockerHosts"},
+	"TLS_CERT_FILE":               {"TLSCertFile"},
+	"TLS_KEY_FILE":                {"TLSKeyFile"},
+	"TLS_AUTOCERT_HOSTS":          {"TLSAutocertHosts"},
+	"TLS_AUTOCERT_CACHE_DIR":      {"TLSAutocertCacheDir"},
+	"TLS_CLIENT_CA_FILE":          {"TLSClientCAFile"},
+	"GRPC":                        {"GRPC"},
+	"DASHBOARD":                   {"Dashboard"},
+	"LOG_REQUESTS":                {"LogRequests"},
+	"LOG_FILE":                    {"LogFile"},
+	"LOG_FILE_MAX_SIZE":           {"LogFileMaxSize"},
+	"LOG_FILE_MAX_AGE":            {"LogFileMaxAge"},
+	"LOG_FILE_MAX_BACKUPS":        {"LogFileMaxBackups"},
+	"LOG_SYSLOG":                  {"LogSyslog"},
+	"LOG_SYSLOG_TAG":              {"LogSyslogTag"},
+	"OTEL_EXPORTER_OTLP_ENDPOINT": {"OTLPEndpoint"},
+	"OTEL_EXPORTER_OTLP_HEADERS":  {"OTLPHeaders"},
+	"OTEL_SERVICE_NAME":           {"OTelServiceName"},
+	"AGENT_TIMEOUT":               {"AgentTimeout"},
+	"AGENT_CA_FILE":               {"AgentCAFile"},
+	"AGENT_CERT_FILE":             {"AgentCertFile"},
+	"AGENT_KEY_FILE":              {"AgentKeyFile"},
+	"WEBHOOK_ALLOWED_IPS":         {"WebhookAllowedNets"},
+	"RATE_LIMIT":                  {"RateLimit"},
+	"RATE_LIMIT_BURST":            {"RateLimitBurst"},
+	"IP_RATE_LIMIT":               {"IPRateLimit"},
+	"REPO_RATE_LIMIT":             {"RepoRateLimit"},
+	"MAX_BODY_SIZE":               {"MaxBodySize"},
+	"CUSTOM_WEBHOOKS":             {"CustomWebhooks"},
+	"JOB_WORKERS":                 {"JobWorkers"},
+	"JOB_QUEUE_SIZE":              {"JobQueueSize"},
+	"HISTORY_FILE":                {"HistoryFile"},
+	"UPDATE_QUEUE_FILE":           {"UpdateQueueFile"},
+	"POLL_INTERVAL":               {"PollInterval"},
+	"POLL_SCHEDULE":               {"PollSchedule"},
+	"PRUNE_SCHEDULE":              {"PruneSchedule"},
+	"IMAGE_RETENTION_COUNT":       {"ImageRetentionCount"},
+	"IMAGE_RETENTION_AGE":         {"ImageRetentionAge"},
+	"IMAGE_CLEANUP_INTERVAL":      {"ImageCleanupInterval"},
+	"EMAIL_MODE":                  {"EmailMode"},
+	"EMAIL_DIGEST_SCHEDULE":       {"EmailDigestSchedule"},
+	"TELEGRAM_BOT_TOKEN":          {"TelegramToken"},
+	"CONFIG_WATCH_INTERVAL":       {"ConfigWatchInterval"},
+	"AUDIT_FILE":                  {"AuditFile"},
+	"AUDIT_FILE_MAX_SIZE":         {"AuditFileMaxSize"},
+}
+
+var configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "docker_updater_config_reloads_total",
+	Help: "Config reloads by result (success, failure).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(configReloads)
+}
+
+// loads config file and env again and applies them to updates starting
+// afterwards; returns restart options which changed, invalid config keeps
+// the current one
+func reloadConfig() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	oldFile, oldProfiles := fileConfig, fileProfiles
+	next, err := loadConfig()
+	if err != nil {
+		fileConfig, fileProfiles = oldFile, oldProfiles
+		configReloads.WithLabelValues("failure").Inc()
+		logrus.Errorf("config reload error: %s, keeping current config", err)
+		return nil, err
+	}
+	var changed []string
+	for name := range restartOptions {
+		// env can't change while running
+		if os.Getenv(name) == "" && oldFile[name] != fileConfig[name] {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	configLock.Lock()
+	prev, nv := reflect.ValueOf(config()).Elem(), reflect.ValueOf(next).Elem()
+	for _, fields := range restartOptions {
+		for _, f := range fields {
+			nv.FieldByName(f).Set(prev.FieldByName(f))
+		}
+	}
+	currentConfig.Store(next)
+	applyLogSettings()
+	setupRegistryClient()
+	configLock.Unlock()
+	// credentials file is read and ecr tokens requested again with the new config
+	authCache.Lock()
+	authCache.auths, authCache.helped = nil, nil
+	authCache.Unlock()
+	ecrCache.Lock()
+	ecrCache.tokens, ecrCache.creds = make(map[string]ecrToken), nil
+	ecrCache.Unlock()
+
+	configReloads.WithLabelValues("success").Inc()
+	if len(changed) > 0 {
+		logrus.Warnf("config reloaded, changes of %v apply after a restart", changed)
+	} else {
+		logrus.Info("config reloaded")
+	}
+	return changed, nil
+}
+
+// reloads config on SIGHUP and, when a config file is used, once its
+// modification time or size changes (checked every cfg.ConfigWatchInterval)
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	file := configFilePath()
+	if file != "" && config().ConfigWatchInterval > 0 {
+		tick = time.NewTicker(config().ConfigWatchInterval).C
+		logrus.Infof("watching config file %s for changes", file)
+	}
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	mtime, size := stat()
+	for {
+		select {
+		case <-hup:
+			logrus.Info("SIGHUP received, reloading config...")
+		case <-tick:
+			m, s := stat()
+			// a file being replaced is missing for a moment
+			if s < 0 || m.Equal(mtime) && s == size {
+				continue
+			}
+			mtime, size = m, s
+			logrus.Infof("config file %s changed, reloading config...", file)
+		}
+		reloadConfig()
+		mtime, size = stat()
+	}
+}
+
+// reload call: POST /api/v1/admin/reload
+func reloadHandler(c echo.Context) error {
+	logrus.WithFields(logrus.Fields{
+		"audit":  "reload",
+		"caller": caller(c),
+		"ip":     clientIP(c),
+	}).Warn("config reload requested")
+	changed, err := reloadConfig()
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "config reload error: %s", err.Error())
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"status":           "reloaded",
+		"restart_required": changed,
+	}, "  ")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// run with -race: requests and updates read config while it reloads
+func TestReloadConfigConcurrent(t *testing.T) {
+	prev := config()
+	defer currentConfig.Store(prev)
+	defer withConfig(func(c *Config) { c.ListenAddress = ":8080" })()
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(file, []byte("MAX_QUEUE: 7\nLISTEN_ADDRESS: \":9999\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CONFIG_FILE", file)
+	defer os.Unsetenv("CONFIG_FILE")
+	prevFile, prevProfiles := fileConfig, fileProfiles
+	defer func() { fileConfig, fileProfiles = prevFile, prevProfiles }()
+
+	e := echo.New()
+	e.GET("/api/v1/status", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, requireToken)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := reloadConfig(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+			withUpdateSlot(func() { _ = config().MaxQueue })
+		}()
+	}
+	wg.Wait()
+
+	if config().MaxQueue != 7 {
+		t.Errorf("MAX_QUEUE %d after reload, want 7", config().MaxQueue)
+	}
+	if config().ListenAddress != ":8080" {
+		t.Errorf("LISTEN_ADDRESS %q after reload, restart options keep their values", config().ListenAddress)
+	}
+}
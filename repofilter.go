@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ======= REPO FILTERS ======
+
+// repo name patterns: /regexp/ or glob where * matches any characters
+// (slashes too) and ? a single one, e.g. mycorp/* or */postgres
+type repoPatterns []*regexp.Regexp
+
+func parseRepoPatterns(list []string) (repoPatterns, error) {
+	var patterns repoPatterns
+	for _, p := range list {
+		expr := p
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			expr = p[1 : len(p)-1]
+		} else {
+			expr = strings.Replace(regexp.QuoteMeta(p), `\*`, `.*`, -1)
+			expr = strings.Replace(expr, `\?`, `.`, -1)
+		}
+		re, err := regexp.Compile(`^(?:` + expr + `)$`)
+		if err != nil {
+			return nil, _err("invalid repo pattern %q: %s", p, err.Error())
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// whether any pattern matches repo by its short (library/postgres too for
+// official images) or fully qualified name
+func (patterns repoPatterns) match(repo string) bool {
+	names := []string{repo}
+	if named, err := parseRepoName(repo); err == nil {
+		full, short := named.Name(), reference.FamiliarName(named)
+		names = append(names, full, short)
+		if !strings.Contains(short, "/") {
+			names = append(names, "library/"+short)
+		}
+	}
+	for _, re := range patterns {
+		for _, name := range names {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= REPO MAPPING ======
+
+// pushes of images retagged before they are run (ci pushes
+// registry.corp/app-build, containers run app:prod) update the images
+// containers use: REPO_MAP entries are repo[:tag]=image[:tag], a pushed tag
+// is kept unless the image sets one, entries with a tag win over repo ones
+
+type repoTarget struct {
+	repo string
+	// empty keeps pushed tag
+	tag string
+}
+
+// targets by normalized pushed repo, or repo:tag
+type repoMap map[string]repoTarget
+
+// "registry.local:5000/app:1" -> "registry.local:5000/app", "1"
+func splitRepoTag(ref string) (string, string) {
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+func parseRepoMap(m map[string]string) (repoMap, error) {
+	rm := make(repoMap, len(m))
+	for from, to := range m {
+		repo, tag := splitRepoTag(from)
+		toRepo, toTag := splitRepoTag(to)
+		if repo == "" || toRepo == "" {
+			return nil, _err("REPO_MAP: invalid mapping %s=%s", from, to)
+		}
+		for _, t := range []string{tag, toTag} {
+			if t != "" && !tagRe.MatchString(t) {
+				return nil, _err("REPO_MAP: invalid tag %q in %s=%s", t, from, to)
+			}
+		}
+		key := normalizeRepo(repo)
+		if tag != "" {
+			key += ":" + tag
+		}
+		rm[key] = repoTarget{repo: toRepo, tag: toTag}
+	}
+	return rm, nil
+}
+
+// repo and tag containers are updated to for pushed repo and tag, the same
+// ones unless cfg.RepoMap maps them; repo is normalized, so requests for
+// docker.io/library/nginx and nginx are the same everywhere (locks,
+// cooldown, per-repo config...)
+func mapRepo(repo, tag string) (string, string) {
+	if repo == "" {
+		return repo, tag
+	}
+	key := normalizeRepo(repo)
+	t, ok := config().RepoMap[key+":"+tag]
+	if !ok {
+		if t, ok = config().RepoMap[key]; !ok {
+			return key, tag
+		}
+	}
+	toTag := tag
+	if t.tag != "" {
+		toTag = t.tag
+	}
+	logrus.Infof("%s:%s is mapped to %s:%s", repo, tag, t.repo, toTag)
+	return normalizeRepo(t.repo), toTag
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= FAILED UPDATE RETRIES ======
+
+// an update leaving failed containers behind is run again later; containers
+// already on the new image need no update then, so only the failed ones are
+// retried. A newer update of the repo replaces its pending retry
+
+// pending retry of repo's update
+type failedRetry struct {
+	attempt int
+	timer   *time.Timer
+}
+
+var failedRetries = struct {
+	sync.Mutex
+	pending map[string]*failedRetry
+}{pending: make(map[string]*failedRetry)}
+
+// whether the rest of the update goes on after a container failed, never
+// for all-or-nothing ones; with max failures set, until failed containers
+// exceed them
+func (s *updateSummary) continueOnFailure() bool {
+	if s.allOrNothing() {
+		return false
+	}
+	if _, ok := config().maxFailures(s.Repo, s.Matched); ok {
+		return !s.failuresExceeded()
+	}
+	return config().ContinueOnFailure
+}
+
+// recreates container removed for the update after its new one failed to
+// be created or started
+func restoreFailed(prev types.ContainerJSON, newID string) {
+	name := strings.TrimPrefix(prev.Name, "/")
+	if err := rollbackContainer(prev, newID); err != nil {
+		logrus.Errorf("restore container %s error: %s", name, err)
+		return
+	}
+	logrus.Warnf("container %s restored to previous image, update goes on", name)
+}
+
+// number of failed containers in summary
+func failedCount(summary *updateSummary) int {
+	if summary == nil {
+		return 0
+	}
+	n := 0
+	for _, c := range summary.Containers {
+		if c.Status == containerFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// schedules retry of finished update of repo when it left failed
+// containers, dropping the pending one
+func retryFailed(repo, tag, host string, opts updateOptions, summary *updateSummary) {
+	failedRetries.Lock()
+	defer failedRetries.Unlock()
+	if r, ok := failedRetries.pending[repo]; ok {
+		r.timer.Stop()
+		delete(failedRetries.pending, repo)
+	}
+	failed := failedCount(summary)
+	if failed == 0 || config().FailedRetries == 0 {
+		return
+	}
+	if opts.Attempt >= config().FailedRetries {
+		logrus.Errorf("update %s:%s still has %d failed containers after %d retries, giving up", repo, tag, failed, opts.Attempt)
+		return
+	}
+	wait := config().FailedRetryBackoff << uint(opts.Attempt)
+	logrus.Warnf("update %s:%s has %d failed containers, retrying in %v (%d of %d)", repo, tag, failed, wait, opts.Attempt+1, config().FailedRetries)
+	r := &failedRetry{attempt: opts.Attempt + 1}
+	r.timer = time.AfterFunc(wait, func() {
+		failedRetries.Lock()
+		current := failedRetries.pending[repo] == r
+		if current {
+			delete(failedRetries.pending, repo)
+		}
+		failedRetries.Unlock()
+		if !current {
+			return
+		}
+		logrus.Infof("retrying update %s:%s (%d of %d)...", repo, tag, r.attempt, config().FailedRetries)
+		opts.Caller, opts.Trigger, opts.Attempt, opts.Trace = "retry", triggerRetry, r.attempt, nil
+		if _, err := runUpdate(repo, tag, host, opts); err != nil {
+			logrus.Errorf("retry %d of update %s:%s error: %s", r.attempt, repo, tag, err)
+		}
+	})
+	failedRetries.pending[repo] = r
+}
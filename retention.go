@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= IMAGE RETENTION ======
+
+// images are kept after updates and cleaned by runRetention instead
+func (c *Config) retainImages() bool {
+	return c.ImageRetentionCount > 0 || c.ImageRetentionAge > 0
+}
+
+// applies retention policy on every host each interval
+func runRetention(every time.Duration) {
+	logrus.Infof("image retention: keeping %d latest images per repo, images younger than %v, cleanup every %v",
+		config().ImageRetentionCount, config().ImageRetentionAge, every)
+	for range time.Tick(every) {
+		if isLeader() {
+			eachHost("", applyRetention)
+		}
+	}
+}
+
+// removes images of managed repos beyond the latest cfg.ImageRetentionCount
+// ones which are older than cfg.ImageRetentionAge, images in use are kept;
+// images tagged for several repos are never removed
+func applyRetention() {
+	targets, err := pollTargets()
+	if err != nil {
+		logrus.Errorf("image retention error: %s", err)
+		return
+	}
+	managedRepos := make(map[string]bool)
+	for _, t := range targets {
+		managedRepos[t.repo] = true
+	}
+	images, err := cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		logrus.Errorf("image retention: list images error: %s", err)
+		return
+	}
+	byRepo := make(map[string][]types.ImageSummary)
+	for _, img := range images {
+		repos := imageRepos(img)
+		if len(repos) != 1 {
+			continue
+		}
+		for repo := range repos {
+			if managedRepos[repo] {
+				byRepo[repo] = append(byRepo[repo], img)
+			}
+		}
+	}
+	var expired []string
+	for _, list := range byRepo {
+		sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+		for i, img := range list {
+			if !retained(i, time.Unix(img.Created, 0)) {
+				expired = append(expired, img.ID)
+			}
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	logrus.Infof("image retention: removing %d expired images...", len(expired))
+	removeImages(expired)
+}
+
+// whether image at index (newest first) in its repo created at t is kept
+func retained(index int, created time.Time) bool {
+	return index < config().ImageRetentionCount ||
+		config().ImageRetentionAge > 0 && time.Since(created) < config().ImageRetentionAge
+}
+
+// repos image is tagged (or pulled by digest) for
+func imageRepos(img types.ImageSummary) map[string]bool {
+	repos := make(map[string]bool)
+	for _, ref := range append(append([]string{}, img.RepoTags...), img.RepoDigests...) {
+		if ref == "<none>:<none>" || ref == "<none>@<none>" {
+			continue
+		}
+		repo, _ := splitImage(ref)
+		repos[repo] = true
+	}
+	return repos
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/client"
+)
+
+// ======= RETRIES ======
+
+// runs f until it succeeds, at most cfg.Retries more times, waiting
+// cfg.RetryBackoff doubled after each failure up to cfg.RetryBackoffMax;
+// not found and unauthorized errors are returned at once
+func retry(what string, f func() error) error {
+	wait := config().RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if attempt >= config().Retries || client.IsErrNotFound(err) || client.IsErrUnauthorized(err) {
+			return err
+		}
+		logrus.Warnf("%s failed (attempt %d of %d), retrying in %v: %s", what, attempt+1, config().Retries+1, wait, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > config().RetryBackoffMax {
+			wait = config().RetryBackoffMax
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/labstack/echo"
+)
+
+// ======= MANUAL ROLLBACK ======
+
+// image (as referenced, tag for digest-pinned containers) and image ID of
+// the container replaced by the labeled one
+const (
+	labelPrevImage   = "docker-updater.previous-image"
+	labelPrevImageID = "docker-updater.previous-image-id"
+)
+
+// with cfg.RollbackTags: local tag keeping the previous image and its
+// repo digest, pulled on rollback when the image is gone anyway
+const (
+	labelRollbackImage = "docker-updater.rollback-image"
+	labelPrevDigest    = "docker-updater.previous-digest"
+)
+
+type rollbackResult struct {
+	Container string `json:"container"`
+	Host      string `json:"host,omitempty"`
+	Image     string `json:"image"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// labels of container replacing inspected one now for trigger, its image
+// is tagged as rollback reference first with cfg.RollbackTags
+func previousLabels(inspect types.ContainerJSON, trigger string) map[string]string {
+	var image string
+	if inspect.Config != nil {
+		image = inspect.Config.Image
+		if tag, ok := inspect.Config.Labels[labelTag]; ok && (strings.Contains(image, "@") || isSnapshotImage(image)) {
+			image = tag
+		}
+	}
+	labels := map[string]string{
+		labelPrevImage:   image,
+		labelPrevImageID: inspect.Image,
+		labelUpdatedAt:   time.Now().UTC().Format(time.RFC3339),
+		labelTrigger:     trigger,
+	}
+	if config().RollbackTags && image != "" {
+		ref, digest := tagRollback(inspect, image)
+		labels[labelRollbackImage], labels[labelPrevDigest] = ref, digest
+	}
+	return labels
+}
+
+// tags image of inspected container as REPO:rollback-NAME, moving the tag
+// from the image it got on the previous update; returns the tag ("" when
+// tagging failed) and the repo digest of the image, if any
+func tagRollback(inspect types.ContainerJSON, image string) (string, string) {
+	repo, _ := splitImage(image)
+	var digest string
+	if img, _, err := cli.ImageInspectWithRaw(ctx, inspect.Image); err == nil {
+		for _, d := range img.RepoDigests {
+			if dRepo, _ := splitImage(d); dRepo == repo {
+				digest = d
+				break
+			}
+		}
+	}
+	tag := "rollback-" + strings.TrimPrefix(inspect.Name, "/")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	ref := repo + ":" + tag
+	if err := cli.ImageTag(ctx, inspect.Image, ref); err != nil {
+		logrus.Warnf("tag previous image %s as %s error: %s", inspect.Image, ref, err)
+		return "", digest
+	}
+	return ref, digest
+}
+
+// rollback call: POST /api/v1/rollback?container=NAME or ?repo=REPO
+// [&snapshot=true], recreates container (all containers of repo) from the
+// image it ran before the last update, or from its latest snapshot
+func rollback(c echo.Context) error {
+	name, repo := c.QueryParam("container"), c.QueryParam("repo")
+	if (name == "") == (repo == "") {
+		return _httpErr(http.StatusBadRequest, "either container or repo must be set")
+	}
+	if repo != "" && !config().repoAllowed(repo) {
+		return _httpErr(http.StatusForbidden, "repo %s is not allowed", repo)
+	}
+	host, err := requestHost(c)
+	if err != nil {
+		return err
+	}
+	if !admitUpdate() {
+		return overloaded(c)
+	}
+	defer releaseUpdate()
+	snapshot := c.QueryParam("snapshot") == "true"
+	results, err := runRollback(name, repo, host, snapshot)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 && snapshot {
+		return _httpErr(http.StatusNotFound, "no containers with snapshot found")
+	}
+	if len(results) == 0 {
+		return _httpErr(http.StatusNotFound, "no containers with previous image found")
+	}
+	return c.JSONPretty(http.StatusOK, results, "  ")
+}
+
+// rolls back container name or containers of repo on host (every one when
+// empty), to their snapshots when set, in an update slot, after updates of
+// repo requested earlier
+func runRollback(name, repo, host string, snapshot bool) (results []rollbackResult, err error) {
+	if repo != "" {
+		lockRepo(repo)
+		defer unlockRepo(repo)
+		_, release, err := lockRepoLease(repo)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	if slotErr := withUpdateSlot(func() {
+		if config().Role == roleCoordinator {
+			results, err = rollbackAgents(name, repo, host, snapshot)
+			return
+		}
+		eachHost(host, func() {
+			res, hostErr := rollbackContainers(name, repo, snapshot)
+			if hostErr != nil && err == nil {
+				err = hostErr
+			}
+			results = append(results, res...)
+		})
+	}); slotErr != nil {
+		return nil, slotErr
+	}
+	return results, err
+}
+
+func rollbackContainers(name, repo string, snapshot bool) ([]rollbackResult, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, _err("get containers list error: %s", err.Error())
+	}
+	var results []rollbackResult
+	for _, cnt := range containers {
+		if !snapshot && cnt.Labels[labelPrevImageID] == "" || !managed(cnt.Labels) || isSelf(cnt.ID) {
+			continue
+		}
+		cRepo, _ := splitImage(containerImage(cnt))
+		if repo != "" && cRepo != normalizeRepo(repo) || name != "" && !hasName(cnt, name) {
+			continue
+		}
+		res := rollbackResult{Container: cnt.ID, Host: currentHost, Image: cnt.Labels[labelPrevImage], Status: "ok"}
+		if len(cnt.Names) > 0 {
+			res.Container = strings.TrimPrefix(cnt.Names[0], "/")
+		}
+		rollbackTo := rollbackToPrevious
+		if snapshot {
+			snapshots, err := containerSnapshots(res.Container)
+			if err != nil {
+				return results, _err("list snapshots of %s error: %s", res.Container, err.Error())
+			}
+			if len(snapshots) == 0 {
+				continue
+			}
+			res.Image = snapshots[0]
+			rollbackTo = func(id string) error {
+				return rollbackToSnapshot(id, snapshots[0])
+			}
+		}
+		if err := rollbackTo(cnt.ID); err != nil {
+			logrus.Errorf("rollback container %s error: %s", res.Container, err)
+			res.Status, res.Error = "failed", err.Error()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func hasName(cnt types.Container, name string) bool {
+	for _, n := range cnt.Names {
+		if strings.TrimPrefix(n, "/") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// replaces container with one on its previous image, which is pulled again
+// (by repo digest when recorded, by tag otherwise) when removed meanwhile;
+// the replacement points back to the current image, so rolling back again
+// rolls forward
+func rollbackToPrevious(id string) error {
+	inspect, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return _err("inspect container %s error: %s", id, err.Error())
+	}
+	prevImage, prevID := inspect.Config.Labels[labelPrevImage], inspect.Config.Labels[labelPrevImageID]
+	image := prevID
+	if img, _, err := cli.ImageInspectWithRaw(ctx, prevImage); err == nil && img.ID == prevID {
+		image = prevImage
+	} else if _, _, err := cli.ImageInspectWithRaw(ctx, prevID); err != nil {
+		pull := prevImage
+		if digest := inspect.Config.Labels[labelPrevDigest]; digest != "" {
+			pull = digest
+		}
+		logrus.Warnf("previous image %s of container %s was removed, pulling %s again", prevID, id, pull)
+		if err := pullImage(pull); err != nil {
+			return err
+		}
+		image = pull
+	}
+
+	contConfig := *inspect.Config
+	contConfig.Image = image
+	contConfig.Labels = previousLabels(inspect, triggerRollback)
+	contConfig.Labels[labelTag] = prevImage
+	return recreateOn(inspect, contConfig)
+}
+
+// replaces container with one from its snapshot ref, which keeps the tag
+// of the current image, so the next update still matches it
+func rollbackToSnapshot(id, ref string) error {
+	inspect, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return _err("inspect container %s error: %s", id, err.Error())
+	}
+	contConfig := *inspect.Config
+	contConfig.Image = ref
+	contConfig.Labels = previousLabels(inspect, triggerRollback)
+	contConfig.Labels[labelTag] = contConfig.Labels[labelPrevImage]
+	return recreateOn(inspect, contConfig)
+}
+
+// replaces inspected container with one of contConfig, started when it ran;
+// the inspected one is brought back when that fails
+func recreateOn(inspect types.ContainerJSON, contConfig container.Config) error {
+	image := contConfig.Image
+	if err := removeContainer(inspect); err != nil {
+		return err
+	}
+	restored, err := createContainer(&contConfig, inspect)
+	if err == nil && isRunning(inspect) {
+		err = cli.ContainerStart(ctx, restored, types.ContainerStartOptions{})
+	}
+	if err != nil {
+		// bring the current one back
+		if rErr := rollbackContainer(inspect, restored); rErr != nil {
+			return _err("recreate container on image %s error: %s, restore error: %s", image, err, rErr)
+		}
+		return _err("recreate container on image %s error: %s", image, err.Error())
+	}
+	logrus.Infof("container %s rolled back to image %s", strings.TrimPrefix(inspect.Name, "/"), image)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// runs rollback request with query, returns response code and results
+func requestRollback(query string) (int, []rollbackResult) {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/v1/rollback?"+query, nil), rec)
+	if err := rollback(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	var results []rollbackResult
+	json.Unmarshal(rec.Body.Bytes(), &results)
+	return rec.Code, results
+}
+
+func TestRollback(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.AllowedRepos = map[string]bool{"org/app": true, "org/fresh": true} })()
+	f.addContainer("app-1", "org/app:1.0.0", map[string]string{"team": "core"})
+	f.addContainer("app-2", "org/app:1.0.0", nil)
+	f.pushImage("org/app:1.0.1", nil)
+	// pulled again on rollback, the update removes unused images
+	f.pushImage("org/app:1.0.0", nil)
+	f.addContainer("fresh-1", "org/fresh:1.0.0", nil)
+	if summary, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil || summary.Updated != 2 {
+		t.Fatalf("update: %+v, %v", summary, err)
+	}
+
+	for query, want := range map[string]int{
+		"":                             http.StatusBadRequest,
+		"container=app-1&repo=org/app": http.StatusBadRequest,
+		"repo=org/other":               http.StatusForbidden,
+		// never updated
+		"container=fresh-1": http.StatusNotFound,
+		"container=app-9":   http.StatusNotFound,
+	} {
+		if code, _ := requestRollback(query); code != want {
+			t.Errorf("rollback ?%s: HTTP %d, want %d", query, code, want)
+		}
+	}
+
+	code, results := requestRollback("container=app-1")
+	if code != http.StatusOK || len(results) != 1 || results[0].Container != "app-1" || results[0].Status != "ok" || results[0].Image != "org/app:1.0.0" {
+		t.Fatalf("rollback of app-1: HTTP %d %+v", code, results)
+	}
+	// updated containers run digest-pinned images
+	tag := func(name string) string {
+		return f.container(name).Config.Labels[labelTag]
+	}
+	c := f.container("app-1")
+	if tag("app-1") != "org/app:1.0.0" || c.Config.Labels["team"] != "core" || c.Config.Labels[labelTrigger] != triggerRollback {
+		t.Errorf("app-1 after rollback: image %s, labels %v", c.Config.Image, c.Config.Labels)
+	}
+	if tag("app-2") != "org/app:1.0.1" {
+		t.Errorf("app-2 rolled back with app-1: %s", tag("app-2"))
+	}
+
+	// the rollback is undone by another one
+	if code, results := requestRollback("repo=org/app"); code != http.StatusOK || len(results) != 2 {
+		t.Fatalf("rollback of org/app: HTTP %d %+v", code, results)
+	}
+	for name, want := range map[string]string{"app-1": "org/app:1.0.1", "app-2": "org/app:1.0.0"} {
+		if tag(name) != want {
+			t.Errorf("%s after repo rollback: %s, want %s", name, tag(name), want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= ROLLING UPDATES ======
+
+// replicas of a compose service are rolled in batches bounded by the
+// service's own size, batches are paced by the batch pause, and the rollout
+// goes on past failed batches until the failed containers exceed max
+// failures
+
+// max replicas of service (of replicas ones) in one batch, replicas when
+// unbounded; cfg.ComposeSerial is one at a time
+func (c *Config) replicaBatchSize(repo string, replicas int) int {
+	if c.ComposeSerial {
+		return 1
+	}
+	v, ok := c.RepoReplicaMaxUnavailable[repo]
+	if !ok {
+		v = c.ReplicaMaxUnavailable
+	}
+	size, _ := parseMaxUnavailable(v, replicas)
+	return size
+}
+
+// pause between batches of repo, 0 when not paced
+func (c *Config) batchPause(repo string) time.Duration {
+	if pause, ok := c.RepoBatchPause[repo]; ok {
+		return pause
+	}
+	return c.BatchPause
+}
+
+// failed containers tolerated in an update of total ones of repo, false
+// when max failures are not set
+func (c *Config) maxFailures(repo string, total int) (int, bool) {
+	v, ok := c.RepoMaxFailures[repo]
+	if !ok {
+		v = c.MaxFailures
+	}
+	if v == "" {
+		return 0, false
+	}
+	n, _ := parseMaxFailures(v, total)
+	return n, true
+}
+
+// "N" or "P%" of total (rounded down), 0 stops at the first failure
+func parseMaxFailures(v string, total int) (int, error) {
+	if strings.HasSuffix(v, "%") {
+		p, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil || p < 0 || p > 100 {
+			return 0, _err("invalid max failures %q", v)
+		}
+		return total * p / 100, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, _err("invalid max failures %q", v)
+	}
+	return n, nil
+}
+
+// whether failed containers of the update are over repo's max failures
+func (s *updateSummary) failuresExceeded() bool {
+	max, ok := config().maxFailures(s.Repo, s.Matched)
+	return ok && failedCount(s) > max
+}
+
+// replicas of each compose service among inspects
+func serviceReplicas(inspects []types.ContainerJSON) map[string]int {
+	replicas := make(map[string]int)
+	for _, inspect := range inspects {
+		if svc := composeService(inspect); svc != "" {
+			replicas[svc]++
+		}
+	}
+	return replicas
+}
+
+// waits repo's batch pause before the next batch, telling how many
+// containers are left
+func pauseBatch(repo string, left int) {
+	pause := config().batchPause(repo)
+	if pause <= 0 || left == 0 {
+		return
+	}
+	logrus.Infof("pausing %s before next batch of repo %s, %d containers left...", pause, repo, left)
+	time.Sleep(pause)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ======= SELF ======
+
+// ID (or its HOSTNAME prefix) of the container updater runs in, empty if unknown
+var selfID string
+
+var (
+	containerIDRe = regexp.MustCompile(`[0-9a-f]{64}`)
+	shortIDRe     = regexp.MustCompile(`^[0-9a-f]{12}$`)
+)
+
+func init() {
+	selfID = detectSelfID()
+	if selfID != "" {
+		logrus.Infof("running in container %s, it is only updated with SELF_UPDATE", selfID)
+	}
+}
+
+func detectSelfID() string {
+	// cgroup v1: .../docker/<id>
+	if id := findContainerID("/proc/self/cgroup"); id != "" {
+		return id
+	}
+	// cgroup v2: .../docker/containers/<id>/hostname
+	if id := findContainerID("/proc/self/mountinfo"); id != "" {
+		return id
+	}
+	if hostname := os.Getenv("HOSTNAME"); shortIDRe.MatchString(hostname) {
+		return hostname
+	}
+	return ""
+}
+
+func findContainerID(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, "docker") {
+			continue
+		}
+		if id := containerIDRe.FindString(line); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func isSelf(id string) bool {
+	return selfID != "" && strings.HasPrefix(id, selfID)
+}
+
+// name suffix of the helper container updating the updater
+const selfUpdateSuffix = "-self-update"
+
+// container id prefix the update command is restricted to, for self-update
+// helper
+var onlyContainer string
+
+// updates the updater's own container to repo:tag from a helper container
+// run on the new image with the updater's env and binds (docker socket,
+// config file): removing its own container would kill the update midway
+func startSelfUpdate(repo, tag string) error {
+	fullRepo := fmt.Sprintf("%s:%s", repo, tag)
+	digest, err := verifyImage(fullRepo)
+	if err != nil {
+		return err
+	}
+	if err := pullImage(fullRepo); err != nil {
+		return err
+	}
+	if err := checkVerifiedDigest(fullRepo, digest); err != nil {
+		return err
+	}
+	self, err := cli.ContainerInspect(ctx, selfID)
+	if err != nil {
+		return _err("inspect updater container %s error: %s", selfID, err.Error())
+	}
+	args := []string{"update", "--repo", repo, "--tag", tag, "--container", self.ID}
+	if currentHost != "" {
+		args = append(args, "--host", currentHost)
+	}
+	contConfig := &container.Config{
+		Image:      pinnedImage(fullRepo),
+		Entrypoint: []string{self.Path},
+		Cmd:        args,
+		Labels:     map[string]string{labelEnable: "false"},
+	}
+	hostConfig := &container.HostConfig{AutoRemove: true}
+	if self.Config != nil {
+		contConfig.Env = self.Config.Env
+	}
+	if self.HostConfig != nil {
+		hostConfig.Binds, hostConfig.NetworkMode = self.HostConfig.Binds, self.HostConfig.NetworkMode
+	}
+	name := strings.TrimPrefix(self.Name, "/") + selfUpdateSuffix
+	created, err := cli.ContainerCreate(ctx, contConfig, hostConfig, nil, name)
+	if err != nil {
+		return _err("create self-update container error: %s", err.Error())
+	}
+	if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		if rmErr := cli.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true}); rmErr != nil {
+			logrus.Errorf("remove self-update container %s error: %s", created.ID, rmErr)
+		}
+		return _err("start self-update container error: %s", err.Error())
+	}
+	logrus.Infof("self-update to %s handed off to container %s", fullRepo, name)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfContainerFiltered(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) { c.SelfUpdate = false })()
+	self := f.addContainer("updater", "org/app:1.0.0", nil)
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	f.pushImage("org/app:1.0.1", nil)
+	prev := selfID
+	// HOSTNAME of the container
+	selfID = self.ID[:12]
+	defer func() { selfID = prev }()
+
+	summary, err := updateContainer("org/app", "1.0.1", updateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Updated != 1 || summary.UpdatedContainers[0].Name != "app-1" {
+		t.Errorf("updated containers = %+v, want app-1 only", summary.UpdatedContainers)
+	}
+	if len(summary.SkippedContainers) != 1 || summary.SkippedContainers[0].ID != self.ID {
+		t.Fatalf("skipped containers = %+v, want the updater", summary.SkippedContainers)
+	}
+	for _, call := range f.recorded() {
+		if strings.HasSuffix(call, " updater") {
+			t.Errorf("updater container touched: %s", call)
+		}
+	}
+}
+
+func TestFindContainerID(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	dir, err := ioutil.TempDir("", "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"cgroup v1": "12:pids:/docker/" + id + "\n1:name=systemd:/docker/" + id + "\n",
+		"cgroup v2": "0::/\n",
+		"mountinfo": "1021 1003 0:23 /docker/containers/" + id + "/hostname /etc/hostname rw,relatime - ext4 /dev/sda1 rw\n",
+		"host":      "0::/init.scope\n",
+	} {
+		file := filepath.Join(dir, strings.Replace(name, " ", "-", -1))
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := id
+		if name == "cgroup v2" || name == "host" {
+			want = ""
+		}
+		if got := findContainerID(file); got != want {
+			t.Errorf("%s: container ID %q, want %q", name, got, want)
+		}
+	}
+}
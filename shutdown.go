@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= GRACEFUL SHUTDOWN ======
+
+// updates and rollbacks holding an update slot; once stopping no new ones
+// start, and shutdown waits for running ones so no container is left
+// removed without its replacement
+var inflight = struct {
+	sync.Mutex
+	n        int
+	stopping bool
+	// closed once stopping with none running
+	idle chan struct{}
+}{idle: make(chan struct{})}
+
+// the same error each time, so jobs stopped by it are told apart
+var errShutdown = _httpErr(http.StatusServiceUnavailable, "updater is shutting down")
+
+func errShuttingDown() error {
+	return errShutdown
+}
+
+func shuttingDown() bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+	return inflight.stopping
+}
+
+// false once shutting down
+func beginUpdate() bool {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if inflight.stopping {
+		return false
+	}
+	inflight.n++
+	return true
+}
+
+func endUpdate() {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if inflight.n--; inflight.stopping && inflight.n == 0 {
+		close(inflight.idle)
+	}
+}
+
+// no update starts afterwards
+func stopUpdates() {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if !inflight.stopping {
+		inflight.stopping = true
+		if inflight.n == 0 {
+			close(inflight.idle)
+		}
+	}
+}
+
+// waits for running updates until deadline, returns how many are left
+func waitUpdates(deadline time.Time) int {
+	select {
+	case <-inflight.idle:
+		return 0
+	case <-time.After(time.Until(deadline)):
+		inflight.Lock()
+		defer inflight.Unlock()
+		return inflight.n
+	}
+}
+
+// on SIGTERM or SIGINT stops accepting requests and drains updates within
+// cfg.ShutdownTimeout, then closes done; a second signal exits right away
+func handleShutdown(e *echo.Echo, done chan<- struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logrus.Warnf("%s received, shutting down (%s at most)...", sig, config().ShutdownTimeout)
+	go func() {
+		sig := <-signals
+		logrus.Fatalf("%s received again, exiting with updates running", sig)
+	}()
+	deadline := time.Now().Add(config().ShutdownTimeout)
+	// queued and new updates are refused first, so synchronous update
+	// requests already running are the only ones server shutdown waits for
+	stopUpdates()
+	shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("server shutdown error: %s", err)
+	}
+	if socketServer != nil {
+		if err := socketServer.Shutdown(shutdownCtx); err != nil {
+			logrus.Warnf("unix socket server shutdown error: %s", err)
+		}
+	}
+	if n := waitUpdates(deadline); n > 0 {
+		logrus.Errorf("%d updates still running after %s, their containers may need attention", n, config().ShutdownTimeout)
+	} else {
+		logrus.Info("all updates finished")
+	}
+	resignLeader()
+	close(done)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= WEBHOOK SIGNATURES ======
+
+// rejects requests to webhook endpoint whose body is not signed with its
+// secret: X-Hub-Signature-256: sha256=<hex hmac> (or X-Hub-Signature with sha1);
+// gitlab, registry, acr and sns can't sign, their requests may carry the secret
+// itself in a header instead (see tokenHeader)
+func verifySignature(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			secret := config().webhookSecret(endpoint)
+			if secret == "" {
+				return next(c)
+			}
+			req := c.Request()
+			if validToken(tokenHeader(req.Header, endpoint), secret) {
+				return next(c)
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if !validSignature(req.Header, body, secret) {
+				logrus.Warnf("invalid webhook signature, %s %s from %s rejected", req.Method, req.URL.Path, c.RealIP())
+				return _httpErr(http.StatusUnauthorized, "invalid signature")
+			}
+			return next(c)
+		}
+	}
+}
+
+func validSignature(h http.Header, body []byte, secret string) bool {
+	sig, newHash := h.Get("X-Hub-Signature-256"), sha256.New
+	if sig == "" {
+		sig, newHash = h.Get("X-Hub-Signature"), sha1.New
+	}
+	parts := strings.SplitN(sig, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	got, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, signature(newHash, body, secret))
+}
+
+// secret sent as X-Gitlab-Token by gitlab, as Authorization: Bearer <secret>
+// set in registry notification endpoint or acr webhook custom headers or as
+// basic auth password from sns subscription url (https://user:<secret>@host/...)
+func tokenHeader(h http.Header, endpoint string) string {
+	switch endpoint {
+	case "gitlab":
+		return h.Get("X-Gitlab-Token")
+	case "ecr":
+		req := http.Request{Header: h}
+		_, password, _ := req.BasicAuth()
+		return password
+	case "registry", "acr":
+		if auth := h.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			return strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	return ""
+}
+
+func validToken(token, secret string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func signature(newHash func() hash.Hash, body []byte, secret string) []byte {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// basic auth credentials of sns subscription urls
+func basicAuth(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+// "<prefix>=<hex hmac>" of body
+func signBody(newHash func() hash.Hash, prefix, body, secret string) string {
+	return prefix + "=" + hex.EncodeToString(signature(newHash, []byte(body), secret))
+}
+
+func TestVerifySignature(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.WebhookSecret = "shared-secret"
+		c.WebhookSecrets = map[string]string{"gitlab": "gitlab-secret", "batch": ""}
+	})()
+	const body = `{"push_data": {"tag": "1.0.1"}, "repository": {"repo_name": "org/app"}}`
+	send := func(endpoint string, header http.Header) (int, bool) {
+		e := echo.New()
+		reached := false
+		e.POST("/hook", func(c echo.Context) error {
+			reached = true
+			return c.NoContent(http.StatusOK)
+		}, verifySignature(endpoint))
+		req := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+		for name, v := range header {
+			req.Header[name] = v
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code, reached
+	}
+	h := func(kv ...string) http.Header {
+		header := make(http.Header)
+		for i := 0; i < len(kv); i += 2 {
+			header.Set(kv[i], kv[i+1])
+		}
+		return header
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		header   http.Header
+		ok       bool
+	}{
+		{"sha256", "hub", h("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "shared-secret")), true},
+		{"sha1", "hub", h("X-Hub-Signature", signBody(sha1.New, "sha1", body, "shared-secret")), true},
+		{"sha256 preferred", "hub", h("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "shared-secret"), "X-Hub-Signature", "sha1=00"), true},
+		{"missing", "hub", h(), false},
+		{"wrong secret", "hub", h("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "other-secret")), false},
+		{"other body", "hub", h("X-Hub-Signature-256", signBody(sha256.New, "sha256", body+" ", "shared-secret")), false},
+		{"not hex", "hub", h("X-Hub-Signature-256", "sha256=zz"), false},
+		{"no prefix", "hub", h("X-Hub-Signature-256", hex.EncodeToString(signature(sha256.New, []byte(body), "shared-secret"))), false},
+		{"secret as signature", "hub", h("X-Hub-Signature-256", "sha256=shared-secret"), false},
+		// per-endpoint secrets replace the shared one
+		{"endpoint secret", "gitlab", h("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "gitlab-secret")), true},
+		{"shared secret of endpoint with its own", "gitlab", h("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "shared-secret")), false},
+		{"endpoint without secret", "batch", h(), true},
+		// secret itself in a header, by endpoint
+		{"gitlab token", "gitlab", h("X-Gitlab-Token", "gitlab-secret"), true},
+		{"wrong gitlab token", "gitlab", h("X-Gitlab-Token", "shared-secret"), false},
+		{"gitlab token of hub", "hub", h("X-Gitlab-Token", "shared-secret"), false},
+		{"registry bearer", "registry", h("Authorization", "Bearer shared-secret"), true},
+		{"acr bearer", "acr", h("Authorization", "Bearer shared-secret"), true},
+		{"wrong registry bearer", "registry", h("Authorization", "Bearer other-secret"), false},
+		{"bearer of hub", "hub", h("Authorization", "Bearer shared-secret"), false},
+		{"ecr basic auth", "ecr", h("Authorization", "Basic "+basicAuth("sns", "shared-secret")), true},
+		{"wrong ecr password", "ecr", h("Authorization", "Basic "+basicAuth("sns", "other-secret")), false},
+		{"ecr bearer", "ecr", h("Authorization", "Bearer shared-secret"), false},
+	} {
+		code, reached := send(tc.endpoint, tc.header)
+		if tc.ok && (!reached || code != http.StatusOK) {
+			t.Errorf("%s: HTTP %d, request rejected", tc.name, code)
+		}
+		if !tc.ok && (reached || code != http.StatusUnauthorized) {
+			t.Errorf("%s: HTTP %d, handler reached %v, want 401", tc.name, code, reached)
+		}
+	}
+
+	// forged hub webhook doesn't reach the update
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	f.pushImage("org/app:1.0.1", nil)
+	e := echo.New()
+	e.POST("/api/v1/update", updByHook, verifySignature("hub"))
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/update", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "other-secret"))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("forged hub webhook: HTTP %d, want 401", rec.Code)
+	}
+	if calls := f.recorded(); len(calls) > 0 {
+		t.Errorf("docker called for rejected webhooks: %v", calls)
+	}
+}
+
+func TestVerifySignatureKeepsBody(t *testing.T) {
+	defer withConfig(func(c *Config) { c.WebhookSecret, c.WebhookSecrets = "shared-secret", nil })()
+	const body = `{"repo": "org/app", "tag": "1.0.1"}`
+	e := echo.New()
+	var got string
+	e.POST("/hook", func(c echo.Context) error {
+		b, _ := ioutil.ReadAll(c.Request().Body)
+		got = string(b)
+		return c.NoContent(http.StatusOK)
+	}, verifySignature("hub"))
+	req := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", signBody(sha256.New, "sha256", body, "shared-secret"))
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	if got != body {
+		t.Errorf("handler read %q, want the signed body", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+)
+
+// ======= SMOKE TEST ======
+
+// set on temporary smoke test containers (to the tested image), which are
+// never updated themselves
+const labelSmokeTest = "docker-updater.smoke-test"
+
+// runs the pulled image as a temporary container before any production one
+// is replaced, with env of the first matched container but no mounts or
+// ports: with a command it must exit 0 within the timeout, without one the
+// image's own command must become healthy (or keep running) meanwhile
+func smokeTest(repo, fullRepo string, inspect types.ContainerJSON) error {
+	timeout := config().smokeTestTimeout(repo)
+	if timeout <= 0 {
+		return nil
+	}
+	contConfig := &container.Config{
+		Image:  pinnedImage(fullRepo),
+		Labels: map[string]string{labelSmokeTest: fullRepo},
+	}
+	if inspect.Config != nil {
+		contConfig.Env = inspect.Config.Env
+	}
+	command := config().smokeTestCommand(repo)
+	if command != "" {
+		contConfig.Entrypoint = strslice.StrSlice{"sh", "-c"}
+		contConfig.Cmd = strslice.StrSlice{command}
+	}
+	logrus.Infof("smoke testing image %s for up to %v...", fullRepo, timeout)
+	created, err := cli.ContainerCreate(ctx, contConfig, &container.HostConfig{}, nil, "")
+	if err != nil {
+		return _err("create smoke test container error: %s", err.Error())
+	}
+	defer func() {
+		if err := cli.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			logrus.Warnf("remove smoke test container %s error: %s", created.ID, err)
+		}
+	}()
+	if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return _err("start smoke test container error: %s", err.Error())
+	}
+
+	if command == "" {
+		status, err := waitHealthy(created.ID, timeout)
+		if err != nil {
+			return err
+		}
+		if status != healthOK && status != healthNone {
+			return _err("smoke test of image %s failed: container is %s", fullRepo, status)
+		}
+		logrus.Infof("smoke test of image %s passed (health: %s)", fullRepo, status)
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	okC, errC := cli.ContainerWait(waitCtx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case res := <-okC:
+		if res.StatusCode != 0 {
+			return _err("smoke test of image %s failed: %q exited with code %d", fullRepo, command, res.StatusCode)
+		}
+	case err := <-errC:
+		if waitCtx.Err() != nil {
+			return _err("smoke test of image %s failed: %q did not exit in %v", fullRepo, command, timeout)
+		}
+		return _err("wait for smoke test container error: %s", err.Error())
+	}
+	logrus.Infof("smoke test of image %s passed", fullRepo)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// smoke test container among removed ones
+func (f *fakeDocker) smokeContainer() *types.ContainerJSON {
+	f.Lock()
+	defer f.Unlock()
+	for _, c := range f.removed {
+		if _, ok := c.Config.Labels[labelSmokeTest]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSmokeTestGatesUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		command string
+		exit    int
+		health  string
+		updated bool
+	}{
+		{"command exits 0", "./selftest", 0, "", true},
+		{"command fails", "./selftest", 3, "", false},
+		{"command hangs", "./selftest", -1, "", false},
+		{"healthy", "", 0, types.Healthy, true},
+		{"unhealthy", "", 0, types.Unhealthy, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, restore := newFakeDocker(t)
+			defer restore()
+			defer withConfig(func(c *Config) {
+				c.SmokeTestTimeout, c.RepoSmokeTestTimeout = 100*time.Millisecond, nil
+				c.SmokeTestCommand, c.RepoSmokeTestCommand = "", map[string]string{"org/app": tc.command}
+				c.PullOrder, c.RepoPullOrder = orderStopFirst, nil
+			})()
+			f.exits = map[string]int{tc.command: tc.exit}
+			old := f.addContainer("app-1", "org/app:1.0.0", nil)
+			old.Config.Env = []string{"DB_URL=postgres://db"}
+			pushed := f.pushImage("org/app:1.0.1", nil)
+			if tc.health != "" {
+				f.health[pushed.ID] = tc.health
+			}
+
+			_, err := updateContainer("org/app", "1.0.1", updateOptions{})
+			if tc.updated != (err == nil) {
+				t.Fatalf("update error = %v", err)
+			}
+			smoke := f.smokeContainer()
+			if smoke == nil {
+				t.Fatal("smoke test container not removed")
+			}
+			if smoke.Config.Labels[labelSmokeTest] != "org/app:1.0.1" || smoke.Image != pushed.ID {
+				t.Errorf("smoke test container %+v, want one of image %s", smoke.Config, pushed.ID)
+			}
+			if strings.Join(smoke.Config.Env, " ") != "DB_URL=postgres://db" || len(smoke.HostConfig.Binds) > 0 || len(smoke.HostConfig.PortBindings) > 0 {
+				t.Errorf("smoke test container env %v, binds %v, ports %v", smoke.Config.Env, smoke.HostConfig.Binds, smoke.HostConfig.PortBindings)
+			}
+			if tc.command != "" && strings.Join(smoke.Config.Cmd, " ") != tc.command {
+				t.Errorf("smoke test command = %v, want %s", smoke.Config.Cmd, tc.command)
+			}
+
+			// smoke test forces pull first, app-1 is stopped only once it passed
+			calls := f.recorded("pull", "stop app-1")
+			if tc.updated && (len(calls) != 2 || calls[0] != "pull org/app:1.0.1") {
+				t.Errorf("calls = %v, want pull before app-1 stop", calls)
+			}
+			if !tc.updated && len(calls) != 1 {
+				t.Errorf("calls = %v, want app-1 untouched", calls)
+			}
+			if c := f.container("app-1"); c == nil || (c.Image == pushed.ID) != tc.updated {
+				t.Errorf("app-1 = %+v, updated want %v", c, tc.updated)
+			}
+		})
+	}
+}
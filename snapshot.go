@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// ======= SNAPSHOTS ======
+
+// containers labeled docker-updater.snapshot=true are committed to a local
+// image before they are removed for an update, an exact filesystem-level
+// restore point independent of the registry; POST /api/v1/rollback with
+// snapshot=true recreates a container from its latest snapshot
+const (
+	labelSnapshot = "docker-updater.snapshot"
+	// set on snapshot images: name of the committed container
+	labelSnapshotOf = "docker-updater.snapshot-of"
+)
+
+// snapshots are tagged snapshotRepo/NAME:20060102-150405 (UTC)
+const (
+	snapshotRepo   = "docker-updater-snapshot"
+	snapshotLayout = "20060102-150405"
+)
+
+var invalidRepoChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// snapshot repo of container name
+func snapshotName(name string) string {
+	return snapshotRepo + "/" + strings.Trim(invalidRepoChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// whether container runs a snapshot; it is matched by its tag label then,
+// like digest-pinned ones
+func isSnapshotImage(image string) bool {
+	return strings.HasPrefix(image, snapshotRepo+"/")
+}
+
+func wantsSnapshot(inspect types.ContainerJSON) bool {
+	if inspect.Config == nil {
+		return false
+	}
+	on, _ := strconv.ParseBool(inspect.Config.Labels[labelSnapshot])
+	return on
+}
+
+// commits inspected container about to be removed when labeled so (paused
+// meanwhile when running), keeping its latest cfg.SnapshotKeep snapshots
+func snapshotContainer(inspect types.ContainerJSON) error {
+	if !wantsSnapshot(inspect) {
+		return nil
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+	ref := snapshotName(name) + ":" + time.Now().UTC().Format(snapshotLayout)
+	logrus.Infof("committing container %s as %s...", name, ref)
+	_, err := cli.ContainerCommit(ctx, inspect.ID, types.ContainerCommitOptions{
+		Reference: ref,
+		Comment:   "docker-updater snapshot before update",
+		Changes:   []string{"LABEL " + labelSnapshotOf + "=" + strconv.Quote(name)},
+		Pause:     true,
+	})
+	if err != nil {
+		return _err("snapshot of container %s error: %s", name, err.Error())
+	}
+	snapshots, err := containerSnapshots(name)
+	if err != nil {
+		logrus.Warnf("list snapshots of %s error: %s", name, err)
+		return nil
+	}
+	if len(snapshots) <= config().SnapshotKeep {
+		return nil
+	}
+	for _, s := range snapshots[config().SnapshotKeep:] {
+		if _, err := cli.ImageRemove(ctx, s, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+			logrus.Warnf("remove snapshot %s error: %s", s, err)
+		}
+	}
+	return nil
+}
+
+// snapshot references of container name, latest first
+func containerSnapshots(name string) ([]string, error) {
+	repo := snapshotName(name)
+	images, err := cli.ImageList(ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("reference", repo))})
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, img := range images {
+		for _, t := range img.RepoTags {
+			if strings.HasPrefix(t, repo+":") {
+				refs = append(refs, t)
+			}
+		}
+	}
+	// timestamp tags sort by time
+	sort.Sort(sort.Reverse(sort.StringSlice(refs)))
+	return refs, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= ECR PUSH EVENTS (SNS) ======
+
+// sns http(s) message envelope
+type snsMessage struct {
+	Type         string `json:"Type"`
+	TopicArn     string `json:"TopicArn"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// eventbridge "ECR Image Action" event
+type ecrEvent struct {
+	DetailType string `json:"detail-type"`
+	Account    string `json:"account"`
+	Region     string `json:"region"`
+	Detail     struct {
+		ActionType     string `json:"action-type"`
+		Result         string `json:"result"`
+		RepositoryName string `json:"repository-name"`
+		ImageTag       string `json:"image-tag"`
+	} `json:"detail"`
+}
+
+var snsClient = &http.Client{Timeout: 10 * time.Second}
+
+// handler for ecr push events delivered by sns subscription, also accepts
+// bare eventbridge events (api destinations)
+func updByECR(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+	}
+	var msg snsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+	}
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if err := confirmSubscription(msg.SubscribeURL); err != nil {
+			return _httpErr(http.StatusBadRequest, "confirm subscription error: %s", err.Error())
+		}
+		logrus.Infof("sns subscription to %s confirmed", msg.TopicArn)
+		return c.NoContent(http.StatusOK)
+	case "UnsubscribeConfirmation":
+		logrus.Infof("sns subscription to %s removed", msg.TopicArn)
+		return c.NoContent(http.StatusOK)
+	case "Notification":
+		body = []byte(msg.Message)
+	}
+	repo, tag, err := ecrAdapter{}.Extract(body)
+	if err != nil {
+		return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+	}
+	if duplicateDelivery(payloadKey(body)) {
+		return duplicate(c, repo+":"+tag)
+	}
+	return _updAsync(c, repo, tag, "")
+}
+
+// subscribe url must point to sns itself: https://sns.<region>.amazonaws.com/...
+// (other amazonaws.com hosts like sns.<bucket>.s3.amazonaws.com are not)
+func confirmSubscription(subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil {
+		return err
+	}
+	region := strings.TrimSuffix(strings.TrimPrefix(u.Host, "sns."), ".amazonaws.com")
+	if u.Scheme != "https" || region == "" || strings.ContainsAny(region, ".:") || u.Host != "sns."+region+".amazonaws.com" {
+		return _err("unexpected subscribe url host %s", u.Host)
+	}
+	resp, err := snsClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return _err("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+// successful ecr image push
+type ecrAdapter struct{}
+
+// repo is the repository uri: <account>.dkr.ecr.<region>.amazonaws.com/app
+func (ecrAdapter) Extract(body []byte) (string, string, error) {
+	var e ecrEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return "", "", err
+	}
+	d := e.Detail
+	if d.ActionType != "PUSH" || d.Result != "SUCCESS" {
+		return "", "", _err("unsupported event %s %s %s", e.DetailType, d.ActionType, d.Result)
+	}
+	if e.Account == "" || e.Region == "" || d.RepositoryName == "" || d.ImageTag == "" {
+		return "", "", _err("no repository or tag in event")
+	}
+	return e.Account + ".dkr.ecr." + e.Region + ".amazonaws.com/" + d.RepositoryName, d.ImageTag, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestConfirmSubscription(t *testing.T) {
+	var mu sync.Mutex
+	var confirmed []string
+	code := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		confirmed = append(confirmed, r.Host+r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	defer redirectClient(snsClient, srv)()
+
+	if err := confirmSubscription("https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription&Token=t1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{
+		"http://sns.eu-west-1.amazonaws.com/",
+		"https://sns.amazonaws.com/",
+		// s3 bucket named sns.attacker
+		"https://sns.attacker.s3.amazonaws.com/",
+		"https://sns.eu-west-1.amazonaws.com.attacker.example.com/",
+		"https://sns.eu-west-1.amazonaws.com:8443/",
+		"https://sns.eu-west-1.amazonaws.com@attacker.example.com/",
+		"https://attacker.example.com/sns.eu-west-1.amazonaws.com",
+		"://sns.eu-west-1.amazonaws.com/",
+	} {
+		if err := confirmSubscription(u); err == nil {
+			t.Errorf("subscribe url %s confirmed", u)
+		}
+	}
+	mu.Lock()
+	if len(confirmed) != 1 || confirmed[0] != "sns.eu-west-1.amazonaws.com/" {
+		t.Errorf("requested %v, want the sns subscribe url only", confirmed)
+	}
+	mu.Unlock()
+
+	code = http.StatusForbidden
+	if err := confirmSubscription("https://sns.eu-west-1.amazonaws.com/?Action=ConfirmSubscription&Token=t2"); err == nil {
+		t.Error("refused confirmation succeeded")
+	}
+}
+
+func TestUpdByECR(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	prevQueue := jobs.queue
+	jobs.queue = make(chan *job, 2)
+	defer func() { jobs.queue = prevQueue }()
+	post := func(body string) *httptest.ResponseRecorder {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/v1/update/ecr", strings.NewReader(body)), rec)
+		if err := updByECR(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+	event := `{"detail-type": "ECR Image Action", "account": "123456789012", "region": "eu-west-1",
+		"detail": {"action-type": "PUSH", "result": "SUCCESS", "repository-name": "app", "image-tag": "1.0.1"}}`
+	notification, _ := json.Marshal(snsMessage{Type: "Notification", TopicArn: "arn:aws:sns:eu-west-1:123456789012:ecr", Message: event})
+
+	if rec := post(string(notification)); rec.Code != http.StatusAccepted {
+		t.Fatalf("notification: HTTP %d %s", rec.Code, rec.Body)
+	}
+	j := <-jobs.queue
+	releaseUpdate()
+	if j.Repo != "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app" || j.Tag != "1.0.1" {
+		t.Errorf("job of %s:%s", j.Repo, j.Tag)
+	}
+
+	for name, body := range map[string]string{
+		"failed push":   strings.Replace(event, "SUCCESS", "FAILURE", 1),
+		"deleted image": strings.Replace(event, "PUSH", "DELETE", 1),
+		"no tag":        strings.Replace(event, `"1.0.1"`, `""`, 1),
+		"not json":      "push",
+		"subscription":  `{"Type": "SubscriptionConfirmation", "SubscribeURL": "https://attacker.example.com/"}`,
+	} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: HTTP %d, want 400", name, rec.Code)
+		}
+	}
+	if len(jobs.queue) > 0 {
+		t.Error("job queued for a rejected event")
+	}
+	if calls := f.recorded(); len(calls) > 0 {
+		t.Errorf("docker called for ecr events: %v", calls)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= UNIX SOCKET ======
+
+// LISTEN_ADDRESS value serving the API on cfg.ListenSocket only
+const listenNone = "none"
+
+// serves unix socket requests, plain HTTP next to the TCP server
+var socketServer *http.Server
+
+// creates cfg.ListenSocket with cfg.ListenSocketMode permissions, owned by
+// cfg.ListenSocketGroup when it's set; a socket left by a previous run is removed
+func listenSocket() (net.Listener, error) {
+	path := config().ListenSocket
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, _err("LISTEN_SOCKET %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, _err("remove stale socket %s error: %s", path, err.Error())
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, _err("listen on socket %s error: %s", path, err.Error())
+	}
+	// closing the listener removes the socket file
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	if err := os.Chmod(path, config().ListenSocketMode); err != nil {
+		l.Close()
+		return nil, _err("chmod socket %s error: %s", path, err.Error())
+	}
+	if config().ListenSocketGroup != "" {
+		gid, err := lookupGroup(config().ListenSocketGroup)
+		if err == nil {
+			err = os.Chown(path, -1, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, _err("chown socket %s error: %s", path, err.Error())
+		}
+	}
+	return l, nil
+}
+
+// group id by name or number
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// serves e on the socket until shutdown, in background unless TCP
+// listener is disabled
+func startSocketServer(e *echo.Echo) error {
+	l, err := listenSocket()
+	if err != nil {
+		return err
+	}
+	socketServer = &http.Server{Handler: e}
+	logrus.Infof("starting docker-updater API server on unix socket %s (mode %04o)", config().ListenSocket, config().ListenSocketMode)
+	if config().ListenAddress == listenNone {
+		return socketServer.Serve(l)
+	}
+	go func() {
+		if err := socketServer.Serve(l); err != http.ErrServerClosed {
+			logrus.Fatalf("unix socket server error: %s", err)
+		}
+	}()
+	return nil
+}
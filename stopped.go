@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= STOPPED CONTAINERS ======
+
+// what an update does with a stopped (exited or created) container, it
+// overrides cfg.IncludeStopped and cfg.StoppedPolicy
+const labelStopped = "docker-updater.stopped"
+
+// stopped container policies
+const (
+	// not updated
+	stoppedSkip = "skip"
+	// recreated on the new image and left stopped
+	stoppedKeep = "keep"
+	// recreated and started
+	stoppedStart = "start"
+)
+
+func validateStoppedPolicy(policy string) error {
+	switch policy {
+	case stoppedKeep, stoppedStart:
+		return nil
+	}
+	return _err("unknown stopped policy %q, expected %s or %s", policy, stoppedKeep, stoppedStart)
+}
+
+// policy for stopped container with labels
+func stoppedPolicy(labels map[string]string) string {
+	switch v := labels[labelStopped]; v {
+	case stoppedSkip, stoppedKeep, stoppedStart:
+		return v
+	case "":
+	default:
+		logrus.Warnf("unknown %s label value %q, ignored", labelStopped, v)
+	}
+	if !config().IncludeStopped {
+		return stoppedSkip
+	}
+	return config().StoppedPolicy
+}
+
+// whether listed container is updated: running (paused, restarting) ones
+// always, stopped ones by their policy
+func includeContainer(cnt types.Container) bool {
+	switch cnt.State {
+	case "running", "paused", "restarting":
+		return true
+	}
+	return stoppedPolicy(cnt.Labels) != stoppedSkip
+}
+
+// whether container recreated from inspected one is started: when it was
+// running or its stopped policy says so
+func startRecreated(inspect types.ContainerJSON) bool {
+	if isRunning(inspect) {
+		return true
+	}
+	return inspect.Config != nil && stoppedPolicy(inspect.Config.Labels) == stoppedStart
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= START-FIRST STRATEGY ======
+
+// update strategies
+const (
+	// remove old containers, then create new ones
+	strategyRecreate = "recreate"
+	// start new container next to the old one, remove old one once new one
+	// is up
+	strategyStartFirst = "start-first"
+	// verify new container unrouted first, then replace like start-first
+	strategyBlueGreen = "blue-green"
+)
+
+// suffix of new container name until the old one is removed
+const startFirstSuffix = "-docker-updater-new"
+
+// replaces containers one by one, each old one keeps running until its
+// replacement is up (healthy when health wait is set); update stops at the
+// first failed container, which keeps running on the old image
+func startFirstUpdate(inspects []types.ContainerJSON, repo, tag string, summary *updateSummary) error {
+	fullRepo := fmt.Sprintf("%s:%s", repo, tag)
+	var prevImages []string
+	var failures []string
+	// containers on new image, for ROLLBACK_MODE=all
+	var updated []recreatedContainer
+	replace := replaceStartFirst
+	if config().updateStrategy(repo) == strategyBlueGreen {
+		replace = replaceBlueGreen
+	}
+	for i, inspect := range inspects {
+		if i > 0 {
+			pauseBatch(repo, len(inspects)-i)
+		}
+		if err := summary.stopped(); err != nil {
+			logrus.Warnf("%d containers left not updated", len(inspects)-i)
+			return err
+		}
+		start := time.Now()
+		s := startSpan(summary.span, "replace container", "container", strings.TrimPrefix(inspect.Name, "/"))
+		created, health, removed, err := replace(inspect, repo, tag, summary.Overrides, summary.trigger)
+		s.end(err)
+		observeSince(recreateDuration, repo, start)
+		if removed {
+			updated = append(updated, recreatedContainer{prev: inspect, newID: created.ID})
+		}
+		canary := i == 0 && config().canaryWait(repo) > 0 && len(inspects) > 1
+		if err != nil {
+			summary.Failed++
+			summary.containerFailed(inspect, created, err)
+			// a failed canary calls the rest off
+			if summary.continueOnFailure() && !canary {
+				failures = append(failures, err.Error())
+				continue
+			}
+			if summary.failuresExceeded() {
+				logrus.Warnf("%d containers of repo %s failed, over max failures, rollout aborted", failedCount(summary), repo)
+			}
+			if left := len(inspects) - i - 1; left > 0 {
+				logrus.Warnf("%d containers left not updated", left)
+			}
+			return rollbackAll(updated, summary, _err("updating containers for repo %s failed: %s", fullRepo, err))
+		}
+		summary.containerUpdated(inspect, created, health)
+		if canary {
+			if err := canaryPassed(repo, summary, &updated); err != nil {
+				logrus.Warnf("%d containers left not updated", len(inspects)-1)
+				return rollbackAll(updated, summary, err)
+			}
+		}
+		if img := cleanupCandidate(inspect); img != "" && created.Image != inspect.Image {
+			prevImages = append(prevImages, img)
+		}
+	}
+	if err := restartDependents(summary.dependents); err != nil {
+		return rollbackAll(updated, summary, err)
+	}
+	if len(prevImages) > 0 {
+		logrus.Infof("clearing previous not actual images for %s...", fullRepo)
+		removeImages(prevImages)
+	}
+	if len(failures) > 0 {
+		return _err("updating containers for repo %s failed: %s", fullRepo, strings.Join(failures, "; "))
+	}
+	logrus.Infof("updating containers for repo %s done!", fullRepo)
+	return nil
+}
+
+// starts replacement of inspected container under a temporary name, then
+// removes the old one and renames the new one; returns health wait outcome
+// (empty when not waited) and whether the old container is gone
+func replaceStartFirst(inspect types.ContainerJSON, repo, tag string, overrides *containerOverrides, trigger string) (created types.ContainerJSON, health string, removed bool, err error) {
+	name := strings.TrimPrefix(inspect.Name, "/")
+	tmp := inspect
+	base := *inspect.ContainerJSONBase
+	base.Name = "/" + name + startFirstSuffix
+	tmp.ContainerJSONBase = &base
+
+	id, err := createContainer(newContainerConfig(inspect, fmt.Sprintf("%s:%s", repo, tag), overrides, trigger), tmp)
+	// drops new container while the old one is still there
+	discard := func(err error) (types.ContainerJSON, string, bool, error) {
+		if id != "" {
+			if rmErr := cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); rmErr != nil {
+				logrus.Errorf("remove new container %s error: %s", id, rmErr)
+			}
+		}
+		return types.ContainerJSON{}, "", false, _err("container %s: %s, old one kept", name, err)
+	}
+	if err != nil {
+		return discard(_err("create new container error: %s", err.Error()))
+	}
+	if startRecreated(inspect) {
+		if err := cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+			return discard(_err("start new container error: %s", err.Error()))
+		}
+		emitContainerEvent(eventTypeContainerStarted, tmp.Name, fmt.Sprintf("%s:%s", repo, tag))
+		if health, err = waitStarted(id, config().healthWait(repo)); err != nil {
+			return discard(err)
+		}
+	}
+	if err := runHook(hookPre, repo, tag, inspect, inspect); err != nil {
+		return discard(err)
+	}
+	if err := drainContainer(repo, tag, inspect); err != nil {
+		return discard(err)
+	}
+	if err := runLifecycleHook(hookPre, inspect); err != nil {
+		registerContainer(repo, tag, inspect, inspect)
+		return discard(err)
+	}
+	if err := snapshotContainer(inspect); err != nil {
+		registerContainer(repo, tag, inspect, inspect)
+		return discard(err)
+	}
+	if err := removeContainer(inspect); err != nil {
+		return discard(err)
+	}
+	if err := cli.ContainerRename(ctx, id, name); err != nil {
+		created.ContainerJSONBase = &types.ContainerJSONBase{ID: id}
+		return created, health, true, _err("rename new container %s to %s error: %s", id, name, err.Error())
+	}
+	if created, err = cli.ContainerInspect(ctx, id); err != nil {
+		created.ContainerJSONBase = &types.ContainerJSONBase{ID: id}
+		return created, health, true, _err("inspect container %s error: %s", id, err.Error())
+	}
+	if err := runLifecycleHook(hookPost, created); err != nil {
+		return types.ContainerJSON{}, health, false, lifecycleRollback(inspect, created, err)
+	}
+	if err := runHook(hookPost, repo, tag, created, inspect); err != nil {
+		logrus.Errorln(err)
+	}
+	registerContainer(repo, tag, created, inspect)
+	logrus.Infof("container %s replaced by new one", name)
+	return created, health, true, nil
+}
+
+// new container must become healthy within wait (keep running for it when it
+// has no healthcheck), returns health wait outcome; without wait it only has
+// to be running shortly after start
+func waitStarted(id string, wait time.Duration) (string, error) {
+	if wait <= 0 {
+		time.Sleep(healthPollInterval)
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return "", _err("inspect container %s error: %s", id, err.Error())
+		}
+		if !isRunning(inspect) || inspect.State.Restarting {
+			return healthExited, _err("new container is %s", healthExited)
+		}
+		return "", nil
+	}
+	status, err := waitHealthy(id, wait)
+	if err != nil {
+		return "", err
+	}
+	if status != healthOK && status != healthNone {
+		return status, _err("new container is %s", status)
+	}
+	return status, nil
+}
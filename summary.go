@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= SUMMARY ======
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeNoop    = "noop"
+)
+
+// machine-parseable result of a single update call
+type updateSummary struct {
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// DOCKER_HOSTS one update targeted, empty when all
+	Host string `json:"host,omitempty"`
+	// lower versions were allowed, a deliberate rollback
+	AllowDowngrade bool            `json:"allow_downgrade,omitempty"`
+	OldTags        map[string]bool `json:"-"`
+	// env, cmd and labels set on recreated containers
+	Overrides *containerOverrides `json:"overrides,omitempty"`
+	Matched   int                 `json:"matched"`
+	Updated   int                 `json:"updated"`
+	// containers (or services) running the new image
+	UpdatedContainers []containerRef `json:"updated_containers"`
+	// containers (or services) to be updated
+	MatchedContainers []containerRef `json:"matched_containers"`
+	// already current ones
+	Skipped           int                `json:"skipped"`
+	SkippedContainers []skippedContainer `json:"skipped_containers"`
+	Failed            int                `json:"failed"`
+	// outcome of every touched container
+	Containers []containerResult `json:"containers"`
+	Start      time.Time         `json:"-"`
+	// updater's own container is to be updated by a helper
+	selfUpdate bool
+	// root span of the update, nil when tracing is off
+	span *span
+	// who requested the update
+	caller string
+	// what started it
+	trigger string
+	// done when no more containers may be replaced, nil never is
+	ctx context.Context
+	// running containers depending on updated ones, restarted after them
+	dependents []types.Container
+	// updated containers depend on each other or have dependents, the
+	// update is all or nothing
+	dependencyGroup bool
+	// signed registry digest pulled image must be, empty when not verified
+	verifiedDigest string
+	// seconds
+	PullDuration float64 `json:"pull_duration"`
+	// seconds, set with outcome and error by finish
+	Duration float64 `json:"duration"`
+	Outcome  string  `json:"outcome"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type skippedContainer struct {
+	containerRef
+	Reason string `json:"reason"`
+}
+
+// container statuses
+const (
+	containerUpdated    = "updated"
+	containerFailed     = "failed"
+	containerRolledBack = "rolled_back"
+)
+
+type containerResult struct {
+	containerRef
+	OldImageID string `json:"old_image_id"`
+	NewImageID string `json:"new_image_id,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newUpdateSummary(repo, tag string) *updateSummary {
+	return &updateSummary{
+		Repo:    repo,
+		Tag:     tag,
+		OldTags: make(map[string]bool),
+		Start:   time.Now(),
+
+		UpdatedContainers: []containerRef{},
+		MatchedContainers: []containerRef{},
+		SkippedContainers: []skippedContainer{},
+		Containers:        []containerResult{},
+	}
+}
+
+// every updated container is restored when any one fails
+func (s *updateSummary) allOrNothing() bool {
+	return config().RollbackMode == rollbackModeAll || s.dependencyGroup
+}
+
+func (s *updateSummary) skip(ref containerRef, reason string) {
+	s.Skipped++
+	s.SkippedContainers = append(s.SkippedContainers, skippedContainer{ref, reason})
+}
+
+// prev container replaced by healthy created one
+func (s *updateSummary) containerUpdated(prev, created types.ContainerJSON, health string) {
+	s.Updated++
+	ref := inspectRef(created)
+	ref.Health = health
+	s.UpdatedContainers = append(s.UpdatedContainers, ref)
+	s.Containers = append(s.Containers, containerResult{
+		containerRef: ref,
+		OldImageID:   prev.Image,
+		NewImageID:   created.Image,
+		Status:       containerUpdated,
+	})
+}
+
+// prev container not updated, its replacement (if any) created
+// was dropped
+func (s *updateSummary) containerFailed(prev, created types.ContainerJSON, err error) {
+	var newImageID string
+	// failed creates leave none or an ID only
+	if created.ContainerJSONBase != nil {
+		newImageID = created.Image
+	}
+	s.Containers = append(s.Containers, containerResult{
+		containerRef: inspectRef(prev),
+		OldImageID:   prev.Image,
+		NewImageID:   newImageID,
+		Status:       containerFailed,
+		Error:        err.Error(),
+	})
+}
+
+// pulls fullRepo, timing it
+func (s *updateSummary) pull(fullRepo string) (err error) {
+	start := time.Now()
+	pullSpan := startSpan(s.span, "pull", "image", fullRepo)
+	defer func() {
+		s.PullDuration += time.Since(start).Seconds()
+		pullSpan.end(err)
+	}()
+	if err := pullImage(fullRepo); err != nil {
+		return err
+	}
+	return checkVerifiedDigest(fullRepo, s.verifiedDigest)
+}
+
+// sets duration, outcome and error
+// adds counts and containers of the update on another host
+func (s *updateSummary) merge(o *updateSummary) {
+	for t := range o.OldTags {
+		s.OldTags[t] = true
+	}
+	s.Matched += o.Matched
+	s.Updated += o.Updated
+	s.Skipped += o.Skipped
+	s.Failed += o.Failed
+	s.UpdatedContainers = append(s.UpdatedContainers, o.UpdatedContainers...)
+	s.MatchedContainers = append(s.MatchedContainers, o.MatchedContainers...)
+	s.SkippedContainers = append(s.SkippedContainers, o.SkippedContainers...)
+	s.Containers = append(s.Containers, o.Containers...)
+	s.PullDuration += o.PullDuration
+}
+
+func (s *updateSummary) finish(err error) {
+	s.Duration = time.Since(s.Start).Seconds()
+	s.Outcome = s.outcome(err)
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+func (s *updateSummary) outcome(err error) string {
+	switch {
+	case err != nil:
+		return outcomeFailure
+	case s.Updated == 0:
+		return outcomeNoop
+	}
+	return outcomeSuccess
+}
+
+// emits a single structured log entry, on error all matched
+// but not updated containers are counted as failed
+func (s *updateSummary) log(err error) {
+	var oldTags []string
+	for t := range s.OldTags {
+		oldTags = append(oldTags, t)
+	}
+	sort.Strings(oldTags)
+	failed := s.Failed
+	if err != nil {
+		failed = s.Matched - s.Updated
+	}
+	s.finish(err)
+	entry := logrus.WithFields(logrus.Fields{
+		"repo":     s.Repo,
+		"old_tag":  strings.Join(oldTags, ","),
+		"new_tag":  s.Tag,
+		"updated":  s.Updated,
+		"skipped":  s.Skipped,
+		"failed":   failed,
+		"duration": s.Duration,
+		"outcome":  s.Outcome,
+	})
+	if err != nil {
+		entry.WithField("error", err.Error()).Error("update summary")
+	} else {
+		entry.Info("update summary")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+func TestContainerFailedWithoutCreated(t *testing.T) {
+	s := newUpdateSummary("org/app", "1.0.1")
+	prev := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{ID: "abc", Name: "/app-1", Image: "sha256:old"}}
+	s.containerFailed(prev, types.ContainerJSON{}, errors.New("create new container error"))
+	if len(s.Containers) != 1 {
+		t.Fatalf("containers = %+v, want the failed one", s.Containers)
+	}
+	res := s.Containers[0]
+	if res.Status != containerFailed || res.OldImageID != "sha256:old" || res.NewImageID != "" || res.Error != "create new container error" {
+		t.Errorf("failed container = %+v", res)
+	}
+}
+
+// log entries of the standard logger
+type entryRecorder struct {
+	sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (r *entryRecorder) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (r *entryRecorder) Fire(e *logrus.Entry) error {
+	r.Lock()
+	defer r.Unlock()
+	r.entries = append(r.entries, e)
+	return nil
+}
+
+// recorder of entries logged until the returned func is called
+func recordEntries() (*entryRecorder, func()) {
+	r := &entryRecorder{}
+	logger := logrus.StandardLogger()
+	prev := logger.Hooks
+	logger.Hooks = make(logrus.LevelHooks)
+	for level, hooks := range prev {
+		logger.Hooks[level] = append([]logrus.Hook(nil), hooks...)
+	}
+	logger.Hooks.Add(r)
+	return r, func() { logger.Hooks = prev }
+}
+
+// last entry logged with msg
+func (r *entryRecorder) last(msg string) *logrus.Entry {
+	r.Lock()
+	defer r.Unlock()
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if r.entries[i].Message == msg {
+			return r.entries[i]
+		}
+	}
+	return nil
+}
+
+func TestSummaryLogFields(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	rec, stop := recordEntries()
+	defer stop()
+	f.addContainer("app-1", "org/app:1.0.0", nil)
+	f.addContainer("app-2", "org/app:1.0.0", nil)
+	f.addContainer("app-3", "org/app:1.0.0", map[string]string{labelPin: "true"})
+	f.pushImage("org/app:1.0.1", nil)
+	if _, err := updateContainer("org/app", "1.0.1", updateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := rec.last("update summary")
+	if entry == nil {
+		t.Fatal("no update summary logged")
+	}
+	if entry.Level != logrus.InfoLevel {
+		t.Errorf("summary logged at %s", entry.Level)
+	}
+	for field, want := range map[string]interface{}{
+		"repo":    "org/app",
+		"old_tag": "1.0.0",
+		"new_tag": "1.0.1",
+		"updated": 2,
+		"skipped": 1,
+		"failed":  0,
+		"outcome": "success",
+	} {
+		if got, ok := entry.Data[field]; !ok || got != want {
+			t.Errorf("field %s = %v, want %v", field, got, want)
+		}
+	}
+	if d, ok := entry.Data["duration"].(float64); !ok || d <= 0 {
+		t.Errorf("field duration = %v, want seconds", entry.Data["duration"])
+	}
+}
+
+func TestSummaryLogFieldsOnFailure(t *testing.T) {
+	rec, stop := recordEntries()
+	defer stop()
+	s := newUpdateSummary("org/app", "1.0.1")
+	s.Matched, s.Updated = 3, 1
+	s.log(errors.New("pull image error"))
+
+	entry := rec.last("update summary")
+	if entry == nil {
+		t.Fatal("no update summary logged")
+	}
+	if entry.Level != logrus.ErrorLevel || entry.Data["failed"] != 2 || entry.Data["error"] != "pull image error" || entry.Data["outcome"] != "failure" {
+		t.Errorf("failure summary = %s %v", entry.Level, entry.Data)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// ======= SWARM ======
+
+// set on swarm task containers, swarm replaces them itself
+const labelSwarmService = "com.docker.swarm.service.id"
+
+// mode to run in, auto one detected; swarm mode updates services of a
+// single daemon, so containers mode is used with DOCKER_HOSTS
+func resolveMode(mode string) string {
+	if mode != modeAuto {
+		return mode
+	}
+	if len(dockerHosts) > 0 {
+		logrus.Infof("DOCKER_HOSTS set, using %s mode", modeContainers)
+		return modeContainers
+	}
+	return detectMode()
+}
+
+// swarm mode on swarm manager, containers mode otherwise (also when the
+// daemon can't be asked)
+func detectMode() string {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		logrus.Warnf("get docker info error: %s, using %s mode", err, modeContainers)
+		return modeContainers
+	}
+	if info.Swarm.ControlAvailable {
+		logrus.Infof("docker is a swarm manager, using %s mode", modeSwarm)
+		return modeSwarm
+	}
+	logrus.Infof("using %s mode", modeContainers)
+	return modeContainers
+}
+
+// rolling update of swarm services running repo, used instead of
+// containers recreation in swarm mode
+func updateServices(repo, tag string, summary *updateSummary) (err error) {
+
+	var fullRepo = fmt.Sprintf("%s:%s", repo, tag)
+	logrus.Infof("updating services for repo %s...", fullRepo)
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return _err("get services list error: %s", err.Error())
+	}
+
+	var toUpdate []string
+	var refs []containerRef
+	remote := &remoteDigest{image: fullRepo}
+	for _, svc := range services {
+		if svc.Spec.TaskTemplate.ContainerSpec == nil {
+			continue
+		}
+		// service images are usually pinned: repo:tag@sha256:...
+		image := strings.SplitN(svc.Spec.TaskTemplate.ContainerSpec.Image, "@", 2)[0]
+		sRepo, sTag := splitImage(image)
+		if sRepo != normalizeRepo(repo) {
+			continue
+		}
+		ref := containerRef{ID: svc.ID, Name: svc.Spec.Name, Image: image}
+		if !managed(svc.Spec.Labels) {
+			logrus.Infof("service %s is not managed (%s), skipped", svc.Spec.Name, labelEnable)
+			summary.skip(ref, "not managed")
+			continue
+		}
+		digests := func() []string { return []string{svc.Spec.TaskTemplate.ContainerSpec.Image} }
+		if wantUpdate("service "+svc.Spec.Name, sRepo, svc.Spec.Labels, sTag, tag, remote, digests) ||
+			summary.AllowDowngrade && wantDowngrade("service "+svc.Spec.Name, sRepo, svc.Spec.Labels, sTag, tag) {
+			toUpdate = append(toUpdate, svc.ID)
+			refs = append(refs, ref)
+			summary.MatchedContainers = append(summary.MatchedContainers, ref)
+			summary.Matched++
+			summary.OldTags[sTag] = true
+			logrus.Infof("to update service %s %s:%s -> %s", svc.Spec.Name, sRepo, sTag, tag)
+		} else {
+			summary.skip(ref, "no update needed")
+		}
+	}
+	if len(toUpdate) == 0 {
+		logrus.Infof("no services should be updated with image %s found, skipped", fullRepo)
+		return nil
+	}
+	if config().ObserveOnly {
+		observe(repo, tag, refs)
+		return nil
+	}
+	defer func() {
+		notifyUpdate(summary, err)
+	}()
+	notifyStarted(summary, refs)
+
+	pn, err := reference.ParseNormalizedNamed(fullRepo)
+	if err != nil {
+		return _err("parse container name %s error: %s", fullRepo, err.Error())
+	}
+	auth, err := registryAuth(fullRepo)
+	if err != nil {
+		return err
+	}
+	// services resolve the tag on update, verified ones are pinned to the
+	// signed digest instead
+	image := reference.FamiliarString(pn)
+	digest, err := verifyImage(fullRepo)
+	if err != nil {
+		return err
+	}
+	if digest != "" {
+		image += "@" + digest
+	}
+	for _, id := range toUpdate {
+		// re-inspect to get the current version index
+		svc, _, err := cli.ServiceInspectWithRaw(ctx, id, types.ServiceInspectOptions{})
+		if err != nil {
+			return _err("inspect service %s error: %s", id, err.Error())
+		}
+		spec := svc.Spec
+		spec.TaskTemplate.ContainerSpec.Image = image
+		resp, err := cli.ServiceUpdate(ctx, svc.ID, svc.Version, spec, types.ServiceUpdateOptions{
+			QueryRegistry:       true,
+			EncodedRegistryAuth: auth,
+		})
+		if err != nil {
+			return _err("update service %s error: %s", svc.Spec.Name, err.Error())
+		}
+		for _, w := range resp.Warnings {
+			logrus.Warnf("service %s: %s", svc.Spec.Name, w)
+		}
+		summary.Updated++
+		summary.UpdatedContainers = append(summary.UpdatedContainers, containerRef{
+			ID:    svc.ID,
+			Name:  svc.Spec.Name,
+			Image: spec.TaskTemplate.ContainerSpec.Image,
+		})
+		logrus.Infof("service %s updated to %s", svc.Spec.Name, fullRepo)
+	}
+
+	logrus.Infof("updating services for repo %s done!", fullRepo)
+	return nil
+}
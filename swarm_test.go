@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolveMode(t *testing.T) {
+	os.Unsetenv("MODE")
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mode != modeContainers {
+		t.Errorf("default mode %s, want %s", c.Mode, modeContainers)
+	}
+
+	f, restore := newFakeDocker(t)
+	defer restore()
+	f.swarmManager = true
+	for mode, want := range map[string]string{modeAuto: modeSwarm, modeContainers: modeContainers, modeSwarm: modeSwarm} {
+		if got := resolveMode(mode); got != want {
+			t.Errorf("mode %s on a swarm manager resolved to %s, want %s", mode, got, want)
+		}
+	}
+	f.swarmManager = false
+	if got := resolveMode(modeAuto); got != modeContainers {
+		t.Errorf("auto mode on a worker resolved to %s, want %s", got, modeContainers)
+	}
+
+	// swarm mode can't span DOCKER_HOSTS
+	f.swarmManager = true
+	prev := dockerHosts
+	dockerHosts = []*dockerHost{{name: "edge-1", cli: cli}}
+	defer func() { dockerHosts = prev }()
+	if got := resolveMode(modeAuto); got != modeContainers {
+		t.Errorf("auto mode with DOCKER_HOSTS resolved to %s, want %s", got, modeContainers)
+	}
+}
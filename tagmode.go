@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= TAG MODES ======
+
+// which tag requests update containers to
+const (
+	// the requested (pushed) one
+	tagModePushed = "pushed"
+	// the highest registry tag each container may move to, like polling
+	// picks it; requests only trigger the check, so pushes arriving out of
+	// order don't move containers back
+	tagModeHighest = "highest"
+)
+
+func validateTagMode(mode string) error {
+	if mode != tagModePushed && mode != tagModeHighest {
+		return _err("unknown tag mode %q, expected %s or %s", mode, tagModePushed, tagModeHighest)
+	}
+	return nil
+}
+
+// tag mode of repo: per-repo override or global one
+func (c *Config) tagMode(repo string) string {
+	if mode, ok := c.RepoTagMode[repo]; ok {
+		return mode
+	}
+	return c.TagMode
+}
+
+// updateContainer to the tags containers of repo on current host may move
+// to in highest tag mode, highest first, merging their summaries; tag
+// itself when they move to none of these or the update is a downgrade
+func updateToHighest(repo, tag string, opts updateOptions) (*updateSummary, error) {
+	if config().tagMode(repo) != tagModeHighest || opts.AllowDowngrade {
+		return updateContainer(repo, tag, opts)
+	}
+	tags, err := highestTags(repo)
+	if err != nil {
+		logrus.Warnf("highest tags of %s error: %s, updating to %s", repo, err, tag)
+	}
+	if len(tags) == 0 {
+		return updateContainer(repo, tag, opts)
+	}
+	logrus.Infof("%s:%s requested, updating to highest tags %s", repo, tag, strings.Join(tags, ", "))
+	if len(tags) == 1 {
+		return updateContainer(repo, tags[0], opts)
+	}
+	merged := newUpdateSummary(repo, tags[0])
+	merged.AllowDowngrade, merged.Overrides = opts.AllowDowngrade, opts.Overrides
+	var errs []string
+	for _, t := range tags {
+		summary, err := updateContainer(repo, t, opts)
+		if summary == nil {
+			return nil, err
+		}
+		if err != nil {
+			errs = append(errs, t+": "+err.Error())
+		}
+		merged.merge(summary)
+	}
+	if len(errs) > 0 {
+		err = _err("%s", strings.Join(errs, "; "))
+	}
+	merged.finish(err)
+	return merged, err
+}
+
+// tags managed containers (or services) of repo should be updated to, as
+// polling picks them: semver ones highest first, then rolling ones with a
+// new digest; quarantined tags are left out
+func highestTags(repo string) ([]string, error) {
+	targets, err := pollTargets()
+	if err != nil {
+		return nil, err
+	}
+	cache := make(map[string][]string)
+	found := make(map[string]bool)
+	var tags []string
+	for _, t := range targets {
+		if t.repo != repo {
+			continue
+		}
+		tag, ok := pollNewTag(t, cache)
+		if !ok || found[tag] {
+			continue
+		}
+		found[tag] = true
+		if checkQuarantine(repo, tag) != nil {
+			logrus.Warnf("%s:%s is quarantined, skipped", repo, tag)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, errI := semver.NewVersion(tags[i])
+		vj, errJ := semver.NewVersion(tags[j])
+		if errI != nil || errJ != nil {
+			return errJ != nil && errI == nil
+		}
+		return vi.GreaterThan(vj)
+	})
+	return tags, nil
+}
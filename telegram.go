@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= TELEGRAM BOT ======
+
+// notifications sent to cfg.TelegramChats with buttons acting on them:
+// rollback of updated containers and approval of queued updates, pressed
+// buttons are received by long polling so no public endpoint is needed
+
+const telegramAPI = "https://api.telegram.org"
+
+// button actions
+const (
+	actionApprove  = "approve"
+	actionRollback = "rollback"
+	// of updates waiting for approval
+	actionApprovePending = "approve-pending"
+	actionRejectPending  = "reject-pending"
+)
+
+// buttons are answered for a week
+const actionTTL = 7 * 24 * time.Hour
+
+type telegramAction struct {
+	kind    string
+	repo    string
+	tag     string
+	host    string
+	pending string
+	created time.Time
+}
+
+// button actions by callback data
+var telegramActions = struct {
+	sync.Mutex
+	byID map[string]telegramAction
+}{byID: make(map[string]telegramAction)}
+
+var telegramClient = &http.Client{Timeout: 70 * time.Second}
+
+type telegramButton struct {
+	Text string `json:"text"`
+	Data string `json:"callback_data"`
+}
+
+type telegramMarkup struct {
+	Keyboard [][]telegramButton `json:"inline_keyboard"`
+}
+
+type telegramMessage struct {
+	ID   int `json:"message_id"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+}
+
+type telegramCallback struct {
+	ID   string `json:"id"`
+	From struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"from"`
+	Message *telegramMessage `json:"message"`
+	Data    string           `json:"data"`
+}
+
+type telegramUpdate struct {
+	ID       int               `json:"update_id"`
+	Callback *telegramCallback `json:"callback_query"`
+}
+
+func telegramEnabled() bool {
+	return config().TelegramToken != "" && len(config().TelegramChats) > 0
+}
+
+// calls bot API method, decoding its result into result unless nil
+func telegramCall(method string, payload, result interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := telegramClient.Post(fmt.Sprintf("%s/bot%s/%s", telegramAPI, config().TelegramToken, method),
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		// the error holds the URL with the token
+		return _err("telegram %s request failed", method)
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return _err("telegram %s: unexpected response status %s", method, resp.Status)
+	}
+	if !answer.OK {
+		return _err("telegram %s: %s", method, answer.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(answer.Result, result)
+	}
+	return nil
+}
+
+// sends text with buttons (if any) to every chat
+func telegramSend(text string, buttons ...telegramButton) {
+	for _, chat := range config().TelegramChats {
+		payload := map[string]interface{}{"chat_id": chat, "text": text}
+		if len(buttons) > 0 {
+			payload["reply_markup"] = telegramMarkup{Keyboard: [][]telegramButton{buttons}}
+		}
+		if err := telegramCall("sendMessage", payload, nil); err != nil {
+			logrus.Errorf("telegram message to %s error: %s", chat, err)
+		}
+	}
+}
+
+// button running action once pressed
+func actionButton(text string, a telegramAction) telegramButton {
+	a.created = time.Now()
+	id := randomHex(8)
+	telegramActions.Lock()
+	for key, old := range telegramActions.byID {
+		if time.Since(old.created) > actionTTL {
+			delete(telegramActions.byID, key)
+		}
+	}
+	telegramActions.byID[id] = a
+	telegramActions.Unlock()
+	return telegramButton{Text: text, Data: id}
+}
+
+// notification message, updated containers get a rollback button and
+// updates waiting for approval approve and reject ones
+func telegramNotification(n notification) {
+	if !telegramEnabled() {
+		return
+	}
+	text, err := notificationText(n)
+	if err != nil {
+		logrus.Errorf("telegram notification for %s:%s error: %s", n.Repo, n.Tag, err)
+		return
+	}
+	go func() {
+		if n.Event == eventPending {
+			a := telegramAction{repo: n.Repo, tag: n.Tag, pending: n.PendingID}
+			approve, reject := a, a
+			approve.kind, reject.kind = actionApprovePending, actionRejectPending
+			telegramSend(text, actionButton("Approve", approve), actionButton("Reject", reject))
+			return
+		}
+		if n.Event != eventUpdated || len(n.Containers) == 0 {
+			telegramSend(text)
+			return
+		}
+		// one host when all containers are on it
+		host := n.Containers[0].Host
+		for _, cnt := range n.Containers {
+			if cnt.Host != host {
+				host = ""
+			}
+		}
+		telegramSend(text, actionButton("Rollback", telegramAction{kind: actionRollback, repo: n.Repo, tag: n.Tag, host: host}))
+	}()
+}
+
+// message with a button running queued update right away
+func offerApproval(repo, tag, host string) {
+	if !telegramEnabled() {
+		return
+	}
+	text := fmt.Sprintf("docker-updater: %s:%s %s", repo, tag, queuedStatus(repo))
+	go telegramSend(text, actionButton("Approve now", telegramAction{kind: actionApprove, repo: repo, tag: tag, host: host}))
+}
+
+// receives pressed buttons until the process exits
+func runTelegramBot() {
+	logrus.Infof("telegram bot answering buttons in %d chats", len(config().TelegramChats))
+	offset := 0
+	for {
+		// one replica gets the updates
+		if !isLeader() {
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		var updates []telegramUpdate
+		err := telegramCall("getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         50,
+			"allowed_updates": []string{"callback_query"},
+		}, &updates)
+		if err != nil {
+			logrus.Warnf("telegram updates error: %s", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.ID + 1
+			if u.Callback != nil {
+				go handleTelegramCallback(*u.Callback)
+			}
+		}
+	}
+}
+
+func handleTelegramCallback(cb telegramCallback) {
+	user := cb.From.Username
+	if user == "" {
+		user = strconv.FormatInt(cb.From.ID, 10)
+	}
+	answer := func(text string) {
+		if err := telegramCall("answerCallbackQuery", map[string]string{"callback_query_id": cb.ID, "text": text}, nil); err != nil {
+			logrus.Warnf("telegram answer error: %s", err)
+		}
+	}
+	if cb.Message == nil || !telegramChatAllowed(cb.Message.Chat.ID) || !telegramUserAllowed(cb.From.ID, cb.From.Username) {
+		logrus.Warnf("telegram button pressed by %s not allowed", user)
+		answer("not allowed")
+		return
+	}
+	telegramActions.Lock()
+	a, ok := telegramActions.byID[cb.Data]
+	delete(telegramActions.byID, cb.Data)
+	telegramActions.Unlock()
+	if !ok {
+		answer("expired or already done")
+		return
+	}
+	answer("on it")
+	// buttons are pressed once
+	if err := telegramCall("editMessageReplyMarkup", map[string]interface{}{
+		"chat_id":      cb.Message.Chat.ID,
+		"message_id":   cb.Message.ID,
+		"reply_markup": telegramMarkup{Keyboard: [][]telegramButton{}},
+	}, nil); err != nil {
+		logrus.Warnf("telegram buttons removal error: %s", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"audit":  "telegram-" + a.kind,
+		"repo":   a.repo,
+		"tag":    a.tag,
+		"caller": "telegram:" + user,
+	}).Warnf("%s of %s:%s requested from telegram", a.kind, a.repo, a.tag)
+	var result string
+	switch a.kind {
+	case actionApprove:
+		result = approveQueued(a, "telegram:"+user)
+	case actionRollback:
+		result = rollbackFromTelegram(a)
+	case actionApprovePending:
+		result = approveFromTelegram(a, "telegram:"+user)
+	case actionRejectPending:
+		result = rejectFromTelegram(a)
+	}
+	payload := map[string]interface{}{
+		"chat_id":             cb.Message.Chat.ID,
+		"text":                fmt.Sprintf("%s (by %s)", result, user),
+		"reply_to_message_id": cb.Message.ID,
+	}
+	if err := telegramCall("sendMessage", payload, nil); err != nil {
+		logrus.Errorf("telegram result message error: %s", err)
+	}
+}
+
+func approveQueued(a telegramAction, caller string) string {
+	if !admitUpdate() {
+		return "updater overloaded, try again later"
+	}
+	defer releaseUpdate()
+	rt, callbacks, ok := takeDeferred(a.repo, a.tag, a.host)
+	if !ok {
+		return fmt.Sprintf("%s:%s is no longer queued", a.repo, a.tag)
+	}
+	if err := runQueued(rt, callbacks, caller, triggerApproval); err != nil {
+		return fmt.Sprintf("%s:%s update failed: %s", a.repo, a.tag, err)
+	}
+	return fmt.Sprintf("%s:%s updated", a.repo, a.tag)
+}
+
+func approveFromTelegram(a telegramAction, caller string) string {
+	p := takePending(a.pending)
+	if p == nil {
+		return fmt.Sprintf("%s:%s is no longer waiting for approval", a.repo, a.tag)
+	}
+	j, err := approvePending(p, caller, nil)
+	if err != nil {
+		pending.Lock()
+		pending.byID[p.ID] = p
+		pending.Unlock()
+		return fmt.Sprintf("%s:%s approval failed: %s", a.repo, a.tag, err)
+	}
+	return fmt.Sprintf("%s:%s approved, job %s", a.repo, a.tag, j.ID)
+}
+
+func rejectFromTelegram(a telegramAction) string {
+	p := takePending(a.pending)
+	if p == nil {
+		return fmt.Sprintf("%s:%s is no longer waiting for approval", a.repo, a.tag)
+	}
+	if p.callbackURL != "" {
+		go sendHubCallback(p.callbackURL, p.Repo, p.Tag, _err("update was rejected"))
+	}
+	return fmt.Sprintf("%s:%s rejected", a.repo, a.tag)
+}
+
+func rollbackFromTelegram(a telegramAction) string {
+	if !admitUpdate() {
+		return "updater overloaded, try again later"
+	}
+	defer releaseUpdate()
+	results, err := runRollback("", a.repo, a.host, false)
+	if err != nil {
+		return fmt.Sprintf("%s rollback failed: %s", a.repo, err)
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("%s: no containers with previous image found", a.repo)
+	}
+	lines := []string{a.repo + " rollback:"}
+	for _, r := range results {
+		line := fmt.Sprintf("%s %s", r.Container, r.Status)
+		if r.Error != "" {
+			line += ": " + r.Error
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func telegramChatAllowed(id int64) bool {
+	for _, chat := range config().TelegramChats {
+		if chat == strconv.FormatInt(id, 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyone in the chats unless cfg.TelegramUsers lists ids or usernames
+func telegramUserAllowed(id int64, username string) bool {
+	if len(config().TelegramUsers) == 0 {
+		return true
+	}
+	for _, u := range config().TelegramUsers {
+		if u == strconv.FormatInt(id, 10) || username != "" && strings.TrimPrefix(u, "@") == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bot API answering every method, recording "<method> <text>" of calls
+type fakeTelegram struct {
+	sync.Mutex
+	srv   *httptest.Server
+	calls []string
+}
+
+func newFakeTelegram() (*fakeTelegram, func()) {
+	tg := &fakeTelegram{}
+	tg.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		method := strings.TrimPrefix(r.URL.Path, "/bot"+config().TelegramToken+"/")
+		tg.Lock()
+		tg.calls = append(tg.calls, strings.TrimSpace(method+" "+payload.Text))
+		tg.Unlock()
+		w.Write([]byte(`{"ok": true, "result": true}`))
+	}))
+	restore := redirectClient(telegramClient, tg.srv)
+	return tg, func() {
+		restore()
+		tg.srv.Close()
+	}
+}
+
+// calls since the last one taken
+func (tg *fakeTelegram) take() []string {
+	tg.Lock()
+	defer tg.Unlock()
+	calls := tg.calls
+	tg.calls = nil
+	return calls
+}
+
+func TestTelegramCallbackAuthorization(t *testing.T) {
+	tg, restore := newFakeTelegram()
+	defer restore()
+	defer withConfig(func(c *Config) {
+		c.TelegramToken, c.TelegramChats, c.TelegramUsers = "bot-token", []string{"100"}, []string{"@ops", "42"}
+	})()
+	p := &pendingUpdate{ID: "tg-pending-1", Repo: "org/app", Tag: "1.0.1", ExpiresAt: time.Now().Add(time.Hour)}
+	pending.Lock()
+	pending.byID[p.ID] = p
+	pending.Unlock()
+	defer takePending(p.ID)
+	button := actionButton("Reject", telegramAction{kind: actionRejectPending, repo: p.Repo, tag: p.Tag, pending: p.ID})
+	press := func(chat, user int64, username string) []string {
+		cb := telegramCallback{ID: "cb", Data: button.Data}
+		cb.From.ID, cb.From.Username = user, username
+		if chat != 0 {
+			cb.Message = &telegramMessage{ID: 1}
+			cb.Message.Chat.ID = chat
+		}
+		handleTelegramCallback(cb)
+		return tg.take()
+	}
+
+	for name, calls := range map[string][]string{
+		"other chat":   press(200, 42, "ops"),
+		"no message":   press(0, 42, "ops"),
+		"unlisted":     press(100, 7, "eve"),
+		"unlisted id":  press(100, 7, ""),
+		"ops username": press(100, 7, "ops-bot"),
+	} {
+		if strings.Join(calls, ", ") != "answerCallbackQuery not allowed" {
+			t.Errorf("%s: calls %v, want the press refused", name, calls)
+		}
+	}
+	pending.Lock()
+	_, ok := pending.byID[p.ID]
+	pending.Unlock()
+	if !ok {
+		t.Fatal("refused press rejected the update")
+	}
+
+	calls := press(100, 7, "ops")
+	want := []string{"answerCallbackQuery on it", "editMessageReplyMarkup", "sendMessage org/app:1.0.1 rejected (by ops)"}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("allowed press: calls %v, want %v", calls, want)
+	}
+	// buttons act once
+	if calls := press(100, 42, ""); strings.Join(calls, ", ") != "answerCallbackQuery expired or already done" {
+		t.Errorf("second press: calls %v", calls)
+	}
+}
+
+func TestTelegramUserAllowed(t *testing.T) {
+	defer withConfig(func(c *Config) { c.TelegramUsers = nil })()
+	if !telegramUserAllowed(7, "") {
+		t.Error("user of an allowed chat refused without TELEGRAM_ALLOWED_USERS")
+	}
+	config().TelegramUsers = []string{"@ops", "42", "dev"}
+	for _, tc := range []struct {
+		id       int64
+		username string
+		ok       bool
+	}{
+		{42, "", true},
+		{7, "ops", true},
+		{7, "dev", true},
+		{7, "", false},
+		{7, "@ops", false},
+		{420, "other", false},
+	} {
+		if got := telegramUserAllowed(tc.id, tc.username); got != tc.ok {
+			t.Errorf("user %d %q allowed %v, want %v", tc.id, tc.username, got, tc.ok)
+		}
+	}
+}
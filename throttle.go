@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ======= THROTTLING ======
+
+// repo throttled to one update per interval: requests arriving sooner are
+// queued like the ones out of the update window, the latest queued tag
+// wins, so a burst of pushes restarts containers once more at most
+
+// start time of last update by repo
+var repoUpdates = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// update interval of repo: per-repo override or global one, 0 when not
+// throttled
+func (c *Config) updateThrottle(repo string) time.Duration {
+	if interval, ok := c.RepoUpdateThrottle[repo]; ok {
+		return interval
+	}
+	return c.UpdateThrottle
+}
+
+// whether repo was updated within its interval, until when
+func throttled(repo string, now time.Time) (time.Time, bool) {
+	repoUpdates.Lock()
+	defer repoUpdates.Unlock()
+	return _throttled(repo, now)
+}
+
+func _throttled(repo string, now time.Time) (time.Time, bool) {
+	at, ok := repoUpdates.at[repo]
+	if !ok {
+		return time.Time{}, false
+	}
+	until := at.Add(config().updateThrottle(repo))
+	return until, now.Before(until)
+}
+
+// reserves repo's next update at now unless it is throttled, so concurrent
+// requests don't both get through
+func reserveUpdate(repo string, now time.Time) bool {
+	if config().updateThrottle(repo) <= 0 {
+		return true
+	}
+	repoUpdates.Lock()
+	defer repoUpdates.Unlock()
+	if _, ok := _throttled(repo, now); ok {
+		return false
+	}
+	repoUpdates.at[repo] = now
+	return true
+}
+
+// records start of repo's update, also of ones not checked for throttling
+// (approved, forced...)
+func markUpdateStarted(repo string) {
+	if config().updateThrottle(repo) <= 0 {
+		return
+	}
+	now := time.Now()
+	repoUpdates.Lock()
+	defer repoUpdates.Unlock()
+	for r, at := range repoUpdates.at {
+		if now.Sub(at) > config().updateThrottle(r) {
+			delete(repoUpdates.at, r)
+		}
+	}
+	repoUpdates.at[repo] = now
+}
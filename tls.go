@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ======= TLS ======
+
+// serves e on cfg.ListenAddress, over HTTPS with let's encrypt certificates
+// when autocert hosts are set or with given certificate when it's set, and
+// on cfg.ListenSocket when it's set
+func startServer(e *echo.Echo) error {
+	if config().ListenSocket != "" {
+		if err := startSocketServer(e); err != nil || config().ListenAddress == listenNone {
+			return err
+		}
+	}
+	address := config().ListenAddress
+	var tc *tls.Config
+	switch {
+	case len(config().TLSAutocertHosts) > 0:
+		// certificates are only issued for listed hosts, so random SNI names
+		// can't exhaust let's encrypt rate limits
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(config().TLSAutocertHosts...)
+		if config().TLSAutocertCacheDir != "" {
+			e.AutoTLSManager.Cache = autocert.DirCache(config().TLSAutocertCacheDir)
+		} else {
+			logrus.Warnf("TLS_AUTOCERT_CACHE_DIR is not set, certificates are requested again on every start")
+		}
+		// has tls-alpn challenge protocol enabled
+		tc = e.AutoTLSManager.TLSConfig()
+		logrus.Infof("starting docker-updater API server on %s (TLS, let's encrypt certificates for %v)", address, config().TLSAutocertHosts)
+	case config().TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(config().TLSCertFile, config().TLSKeyFile)
+		if err != nil {
+			return _err("load TLS certificate error: %s", err.Error())
+		}
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}}
+		logrus.Infof("starting docker-updater API server on %s (TLS)", address)
+	default:
+		logrus.Infof("starting docker-updater API server on %s", address)
+		return e.Start(address)
+	}
+	if config().TLSClientCAFile != "" {
+		pool, err := loadCertPool(config().TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		tc.ClientCAs, tc.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		logrus.Infof("client certificates signed by %s are required", config().TLSClientCAFile)
+	}
+	if !e.DisableHTTP2 {
+		tc.NextProtos = append(tc.NextProtos, "h2")
+	}
+	e.TLSServer.TLSConfig, e.TLSServer.Addr = tc, address
+	return e.StartServer(e.TLSServer)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, _err("read CA file %s error: %s", file, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, _err("no certificates found in CA file %s", file)
+	}
+	return pool, nil
+}
+
+// common name of verified client certificate, empty without one
+func clientCN(c echo.Context) string {
+	if st := c.Request().TLS; st != nil && len(st.VerifiedChains) > 0 && len(st.VerifiedChains[0]) > 0 {
+		return st.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= TRACING ======
+
+// spans of the update pipeline exported as OTLP/HTTP JSON to
+// cfg.OTLPEndpoint; with no endpoint spans are nil and cost nothing
+type span struct {
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	// OTLP span kind
+	kind  int
+	start time.Time
+	attrs map[string]string
+	mu    sync.Mutex
+}
+
+const spanKey = "span"
+
+const (
+	spanInternal = 1
+	spanServer   = 2
+)
+
+// finished spans waiting for export, dropped when full
+var spanQueue chan otlpSpan
+
+// child of parent (a new trace without one), nil when tracing is off;
+// attrs are key, value pairs
+func startSpan(parent *span, name string, attrs ...string) *span {
+	if spanQueue == nil {
+		return nil
+	}
+	s := &span{spanID: randomHex(8), name: name, kind: spanInternal, start: time.Now(), attrs: make(map[string]string)}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	return s
+}
+
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// ends span, failed with err if set, and queues it for export
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:      s.traceID,
+		SpanID:       s.spanID,
+		ParentSpanID: s.parentID,
+		Name:         s.name,
+		Kind:         s.kind,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Status:       otlpStatus{Code: 1},
+	}
+	for k, v := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	if err != nil {
+		o.Status = otlpStatus{Code: 2, Message: err.Error()}
+	}
+	select {
+	case spanQueue <- o:
+	default:
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Panicf("unable to generate span id: %s", err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// span of API request, continuing the trace of a W3C traceparent header
+func traceRequest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		s := startSpan(parentFromHeader(req.Header.Get("traceparent")), req.Method+" "+c.Path(),
+			"http.method", req.Method, "http.target", req.URL.Path)
+		if s == nil {
+			return next(c)
+		}
+		s.kind = spanServer
+		c.Set(spanKey, s)
+		err := next(c)
+		s.set("http.status_code", strconv.Itoa(responseStatus(c, err)))
+		s.end(err)
+		return err
+	}
+}
+
+// span of request context, nil if none
+func requestSpan(c echo.Context) *span {
+	s, _ := c.Get(spanKey).(*span)
+	return s
+}
+
+// "00-<trace id>-<span id>-<flags>", nil when not valid
+func parentFromHeader(h string) *span {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return nil
+	}
+	return &span{traceID: parts[1], spanID: parts[2]}
+}
+
+// ======= OTLP EXPORT ======
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// spans exported at once at most
+const otlpBatchSize = 512
+
+func startTracing() {
+	if config().OTLPEndpoint == "" {
+		return
+	}
+	spanQueue = make(chan otlpSpan, 4*otlpBatchSize)
+	logrus.Infof("exporting traces to %s as %s", config().OTLPEndpoint, config().OTelServiceName)
+	go exportSpans(5 * time.Second)
+}
+
+// sends queued spans every interval, or once a batch is full
+func exportSpans(every time.Duration) {
+	var batch []otlpSpan
+	tick := time.NewTicker(every)
+	for {
+		select {
+		case s := <-spanQueue:
+			if batch = append(batch, s); len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := sendSpans(batch); err != nil {
+			logrus.Warnf("export %d spans error: %s", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+func sendSpans(spans []otlpSpan) error {
+	doc := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					{Key: "service.name", Value: otlpValue{StringValue: config().OTelServiceName}},
+					{Key: "service.version", Value: otlpValue{StringValue: version}},
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "docker-updater"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(config().OTLPEndpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range config().OTLPHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return _err("collector responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/labstack/echo"
+)
+
+// ======= VERSION ======
+
+// set at build time:
+//
+//	go install -ldflags "-X main.version=1.2.3 -X main.commit=abc123 -X main.buildDate=2019-01-01T00:00:00Z"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	// config file profile applied
+	Profile string `json:"profile,omitempty"`
+	// negotiated with the daemon, per host with DOCKER_HOSTS
+	DockerAPIVersion  string            `json:"docker_api_version,omitempty"`
+	DockerAPIVersions map[string]string `json:"docker_api_versions,omitempty"`
+}
+
+// version call: GET /version
+func versionHandler(c echo.Context) error {
+	info := versionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version(), Profile: config().Profile}
+	if len(dockerHosts) == 0 {
+		info.DockerAPIVersion = cli.ClientVersion()
+	} else {
+		info.DockerAPIVersions = make(map[string]string)
+		for _, h := range dockerHosts {
+			info.DockerAPIVersions[h.name] = h.cli.ClientVersion()
+		}
+	}
+	return c.JSONPretty(http.StatusOK, info, "  ")
+}
+
+// docker-updater version
+func versionCommand() int {
+	fmt.Printf("docker-updater %s", version)
+	if commit != "" {
+		fmt.Printf(" (commit %s)", commit)
+	}
+	if buildDate != "" {
+		fmt.Printf(", built %s", buildDate)
+	}
+	fmt.Printf(", %s\n", runtime.Version())
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// ======= ANONYMOUS VOLUMES ======
+
+// mounts anonymous volumes of inspected container (image VOLUMEs, -v /path,
+// --mount without source) by name into the one replacing it, docker would
+// create empty ones instead; hostConfig is a copy of inspected one, its
+// slices are replaced, not changed
+func keepAnonymousVolumes(hostConfig *container.HostConfig, inspect types.ContainerJSON) {
+	anon := make(map[string]types.MountPoint)
+	for _, m := range inspect.Mounts {
+		if m.Type == mount.TypeVolume && m.Name != "" {
+			anon[m.Destination] = m
+		}
+	}
+	if len(anon) == 0 {
+		return
+	}
+
+	var binds []string
+	for _, b := range hostConfig.Binds {
+		parts := strings.Split(b, ":")
+		if len(parts) == 1 {
+			if _, ok := anon[parts[0]]; ok {
+				continue
+			}
+		} else {
+			delete(anon, parts[1])
+		}
+		binds = append(binds, b)
+	}
+	var mounts []mount.Mount
+	for _, m := range hostConfig.Mounts {
+		if m.Type == mount.TypeVolume && m.Source == "" {
+			if _, ok := anon[m.Target]; ok {
+				continue
+			}
+		} else {
+			delete(anon, m.Target)
+		}
+		mounts = append(mounts, m)
+	}
+	// mounted again by --volumes-from itself
+	for _, from := range hostConfig.VolumesFrom {
+		src, err := cli.ContainerInspect(ctx, strings.Split(from, ":")[0])
+		if err != nil {
+			continue
+		}
+		for _, m := range src.Mounts {
+			delete(anon, m.Destination)
+		}
+	}
+
+	var targets []string
+	for target := range anon {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		m := anon[target]
+		logrus.Infof("keeping anonymous volume %s at %s of container %s", m.Name, target, strings.TrimPrefix(inspect.Name, "/"))
+		mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: m.Name, Target: target, ReadOnly: !m.RW})
+	}
+	hostConfig.Binds, hostConfig.Mounts = binds, mounts
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// ======= WEBHOOK ADAPTERS ======
+
+// maps registry webhook payload to repo and tag to update
+type WebhookAdapter interface {
+	Extract(body []byte) (repo, tag string, err error)
+}
+
+// handler queuing update of repo and tag extracted from payload by a, like
+// docker hub webhooks
+func updByAdapter(a WebhookAdapter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+		}
+		repo, tag, err := a.Extract(body)
+		if err != nil {
+			return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+		}
+		if duplicateDelivery(payloadKey(body)) {
+			return duplicate(c, repo+":"+tag)
+		}
+		return _updAsync(c, repo, tag, "")
+	}
+}
+
+// maps payload carrying several pushes at once to every repo and tag to update
+type MultiWebhookAdapter interface {
+	ExtractAll(body []byte) ([]repoTag, error)
+}
+
+// handler updating all repos and tags extracted from payload by a, like an
+// async batch unless async=false is given
+func updByMultiAdapter(a MultiWebhookAdapter) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return _httpErr(http.StatusBadRequest, "read payload error: %s", err.Error())
+		}
+		pairs, err := a.ExtractAll(body)
+		if err != nil {
+			return _httpErr(http.StatusBadRequest, "parse payload error: %s", err.Error())
+		}
+		if duplicateDelivery(payloadKey(body)) {
+			return duplicate(c, "payload")
+		}
+		return _updBatch(c, pairs, true)
+	}
+}
+
+// docker distribution (registry) notifications envelope:
+// application/vnd.docker.distribution.events.v1+json
+type distributionAdapter struct{}
+
+type distributionEvents struct {
+	Events []distributionEvent `json:"events"`
+}
+type distributionEvent struct {
+	Action string `json:"action"`
+	Target struct {
+		MediaType  string `json:"mediaType"`
+		Repository string `json:"repository"`
+		Tag        string `json:"tag"`
+	} `json:"target"`
+	Request struct {
+		Host string `json:"host"`
+	} `json:"request"`
+}
+
+// tag pushes of manifests (blob pushes and pulls are skipped), each repo and
+// tag once; repo is prefixed with registry host: registry.example.com/app
+func (distributionAdapter) ExtractAll(body []byte) ([]repoTag, error) {
+	var p distributionEvents
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	var pairs []repoTag
+	seen := make(map[repoTag]bool)
+	for _, e := range p.Events {
+		if e.Action != "push" || e.Target.Tag == "" || e.Target.Repository == "" || !isManifestType(e.Target.MediaType) {
+			continue
+		}
+		rt := repoTag{Repo: e.Target.Repository, Tag: e.Target.Tag}
+		if e.Request.Host != "" {
+			rt.Repo = e.Request.Host + "/" + rt.Repo
+		}
+		if !seen[rt] {
+			seen[rt] = true
+			pairs = append(pairs, rt)
+		}
+	}
+	return pairs, nil
+}
+
+// docker and oci manifests and manifest lists, empty media type is accepted
+func isManifestType(mt string) bool {
+	return mt == "" || strings.Contains(mt, "manifest") || strings.HasSuffix(mt, "image.index.v1+json")
+}
+
+// azure container registry webhook, a single distribution event without envelope
+type acrAdapter struct{}
+
+// repo is prefixed with registry host: myregistry.azurecr.io/app,
+// chart pushes and deletes are rejected
+func (acrAdapter) Extract(body []byte) (string, string, error) {
+	var e distributionEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return "", "", err
+	}
+	if e.Action != "push" {
+		return "", "", _err("unsupported action %s", e.Action)
+	}
+	if e.Target.Tag == "" || e.Target.Repository == "" || e.Request.Host == "" {
+		return "", "", _err("no repository or tag in event")
+	}
+	return e.Request.Host + "/" + e.Target.Repository, e.Target.Tag, nil
+}
+
+// gitlab container registry notifications (docker distribution envelope)
+type gitlabAdapter struct{}
+
+// first tag push event, repo is prefixed with registry host:
+// registry.gitlab.com/group/project
+func (gitlabAdapter) Extract(body []byte) (string, string, error) {
+	pairs, err := distributionAdapter{}.ExtractAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	if len(pairs) == 0 {
+		return "", "", _err("no tag push event found")
+	}
+	return pairs[0].Repo, pairs[0].Tag, nil
+}
+
+// docker hub push payload
+type hubAdapter struct{}
+
+func (hubAdapter) Extract(body []byte) (string, string, error) {
+	p, err := parsePush(body)
+	return p.Repository.RepoName, p.Data.Tag, err
+}
+
+func parsePush(body []byte) (push, error) {
+	var p push
+	err := json.Unmarshal(body, &p)
+	return p, err
+}
+
+// where docker hub waits for update result, empty if not set or not pointing
+// to docker hub (callback is never sent elsewhere)
+func hubCallbackURL(body []byte) string {
+	p, _ := parsePush(body)
+	if p.CallbackURL != "" && !isHubCallbackURL(p.CallbackURL) {
+		logrus.Warnf("callback url %s of %s push is not a docker hub one, ignored", p.CallbackURL, p.Repository.RepoName)
+		return ""
+	}
+	return p.CallbackURL
+}
+
+// harbor v2 PUSH_ARTIFACT (pushImage in harbor 1.x) notification
+type harborAdapter struct{}
+
+var harborPushTypes = map[string]bool{"PUSH_ARTIFACT": true, "pushImage": true}
+
+type harborEvent struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+	} `json:"event_data"`
+}
+
+// repo from first tagged resource url: harbor.example.com/project/app:tag
+func (harborAdapter) Extract(body []byte) (string, string, error) {
+	var e harborEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return "", "", err
+	}
+	if e.Type != "" && !harborPushTypes[e.Type] {
+		return "", "", _err("unsupported event type %s", e.Type)
+	}
+	for _, r := range e.EventData.Resources {
+		if r.Tag == "" || !strings.HasSuffix(r.ResourceURL, ":"+r.Tag) {
+			continue
+		}
+		return strings.TrimSuffix(r.ResourceURL, ":"+r.Tag), r.Tag, nil
+	}
+	return "", "", _err("no tagged resource found")
+}
+
+// quay repository push notification
+type quayAdapter struct{}
+
+type quayPush struct {
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+// docker_url (quay.io/namespace/app) with each of updated tags
+func (quayAdapter) ExtractAll(body []byte) ([]repoTag, error) {
+	var p quayPush
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	if len(p.UpdatedTags) == 0 {
+		return nil, _err("no updated tags")
+	}
+	pairs := make([]repoTag, 0, len(p.UpdatedTags))
+	for _, tag := range p.UpdatedTags {
+		pairs = append(pairs, repoTag{Repo: p.DockerURL, Tag: tag})
+	}
+	return pairs, nil
+}
+
+// tells harbor notification from docker hub one posted to the hub endpoint
+func isHarborPayload(body []byte) bool {
+	var p struct {
+		Type      string          `json:"type"`
+		EventData json.RawMessage `json:"event_data"`
+		PushData  json.RawMessage `json:"push_data"`
+	}
+	return json.Unmarshal(body, &p) == nil && p.Type != "" && len(p.EventData) > 0 && len(p.PushData) == 0
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// gitlab container registry notification of docker push, blob upload first
+const gitlabPush = `{
+  "events": [
+    {
+      "id": "9d50b94a-1b57-4d3f-8d5c-6b1f0f1e7a01",
+      "timestamp": "2026-10-14T08:12:31.104310563Z",
+      "action": "push",
+      "target": {
+        "mediaType": "application/octet-stream",
+        "size": 2811478,
+        "digest": "sha256:c9b1b535fdd91a9855fb7f82348177e5f019329a58c53c47272962dd60f71fc9",
+        "length": 2811478,
+        "repository": "group/project/app",
+        "url": "https://registry.gitlab.example.com/v2/group/project/app/blobs/sha256:c9b1b535fdd91a9855fb7f82348177e5f019329a58c53c47272962dd60f71fc9"
+      },
+      "request": {"id": "1b6b5a5e-3c0e-4a1d-9a7e-4f3d2b1c0a99", "addr": "10.0.3.17:53412", "host": "registry.gitlab.example.com", "method": "PUT", "useragent": "docker/24.0.7 go/go1.20.10"},
+      "actor": {"name": "gitlab-ci-token"},
+      "source": {"addr": "registry-5d8c7b9f6-x2k8q:5000", "instanceID": "3f1e6c1b-0b51-4d61-a64e-2f8b4a436e1c"}
+    },
+    {
+      "id": "0f7e2a6c-4e0b-4b5e-9f7d-2c1a3b4d5e6f",
+      "timestamp": "2026-10-14T08:12:31.592359962Z",
+      "action": "push",
+      "target": {
+        "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+        "size": 528,
+        "digest": "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+        "length": 528,
+        "repository": "group/project/app",
+        "url": "https://registry.gitlab.example.com/v2/group/project/app/manifests/sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270",
+        "tag": "1.4.2"
+      },
+      "request": {"id": "2c7c6b6f-4d1f-4b2e-8b8f-5a4e3c2d1b0a", "addr": "10.0.3.17:53412", "host": "registry.gitlab.example.com", "method": "PUT", "useragent": "docker/24.0.7 go/go1.20.10"},
+      "actor": {"name": "gitlab-ci-token"},
+      "source": {"addr": "registry-5d8c7b9f6-x2k8q:5000", "instanceID": "3f1e6c1b-0b51-4d61-a64e-2f8b4a436e1c"}
+    }
+  ]
+}`
+
+func TestGitlabAdapter(t *testing.T) {
+	repo, tag, err := gitlabAdapter{}.Extract([]byte(gitlabPush))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo != "registry.gitlab.example.com/group/project/app" || tag != "1.4.2" {
+		t.Errorf("extracted %s:%s, want registry.gitlab.example.com/group/project/app:1.4.2", repo, tag)
+	}
+	for name, body := range map[string]string{
+		"pull only": `{"events": [{"action": "pull", "target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "repository": "group/app", "tag": "1.0"}}]}`,
+		"no events": `{"events": []}`,
+		"not json":  `push`,
+	} {
+		if _, _, err := (gitlabAdapter{}).Extract([]byte(body)); err == nil {
+			t.Errorf("%s payload accepted", name)
+		}
+	}
+}
+
+func TestWebhookAdapters(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		adapter   WebhookAdapter
+		body      string
+		repo, tag string
+	}{
+		{
+			"docker hub", hubAdapter{}, `{
+  "callback_url": "https://registry.hub.docker.com/u/svendowideit/testhook/hook/2141b5bi5i5b02bec211i4eeih0242eg11000a/",
+  "push_data": {"pushed_at": 1417566161, "pusher": "trustedbuilder", "tag": "latest"},
+  "repository": {
+    "comment_count": 0, "date_created": 1417494799, "description": "", "dockerfile": "FROM busybox",
+    "full_description": "Docker Hub based automated build from a GitHub repo", "is_official": false,
+    "is_private": true, "is_trusted": true, "name": "testhook", "namespace": "svendowideit",
+    "owner": "svendowideit", "repo_name": "svendowideit/testhook",
+    "repo_url": "https://registry.hub.docker.com/u/svendowideit/testhook/", "star_count": 0, "status": "Active"
+  }
+}`, "svendowideit/testhook", "latest",
+		},
+		{
+			"harbor v2", harborAdapter{}, `{
+  "type": "PUSH_ARTIFACT",
+  "occur_at": 1680501893,
+  "operator": "harbor-jobservice",
+  "event_data": {
+    "resources": [{
+      "digest": "sha256:954b378c375d852eb3c63ab88978f640b4348b01c1b3456a024a81536dafbbf4",
+      "tag": "1.25.4",
+      "resource_url": "harbor.example.com/web/nginx:1.25.4"
+    }],
+    "repository": {"date_created": 1680501893, "name": "nginx", "namespace": "web", "repo_full_name": "web/nginx", "repo_type": "private"}
+  }
+}`, "harbor.example.com/web/nginx", "1.25.4",
+		},
+		{
+			"harbor 1.x", harborAdapter{}, `{
+  "type": "pushImage",
+  "occur_at": 1582617762,
+  "operator": "admin",
+  "event_data": {
+    "resources": [{"digest": "sha256:ae5d2e6e6a9b2b5b4f2c9a8d1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c", "tag": "v2", "resource_url": "harbor.example.com:8443/library/app:v2"}],
+    "repository": {"date_created": 1582617757, "name": "app", "namespace": "library", "repo_full_name": "library/app", "repo_type": "public"}
+  }
+}`, "harbor.example.com:8443/library/app", "v2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, tag, err := tc.adapter.Extract([]byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repo != tc.repo || tag != tc.tag {
+				t.Errorf("extracted %s:%s, want %s:%s", repo, tag, tc.repo, tc.tag)
+			}
+		})
+	}
+}
+
+func TestWebhookAdaptersRejectPayloads(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		adapter WebhookAdapter
+		body    string
+	}{
+		{"harbor delete", harborAdapter{}, `{"type": "DELETE_ARTIFACT", "event_data": {"resources": [{"tag": "v1", "resource_url": "harbor.example.com/web/app:v1"}]}}`},
+		{"harbor digest only", harborAdapter{}, `{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"digest": "sha256:954b", "resource_url": "harbor.example.com/web/app@sha256:954b"}]}}`},
+		{"hub not json", hubAdapter{}, `repo=org/app&tag=1.0`},
+	} {
+		if _, _, err := tc.adapter.Extract([]byte(tc.body)); err == nil {
+			t.Errorf("%s payload accepted", tc.name)
+		}
+	}
+}
+
+func TestQuayAdapter(t *testing.T) {
+	body := `{
+  "repository": "mynamespace/repository",
+  "namespace": "mynamespace",
+  "name": "repository",
+  "docker_url": "quay.io/mynamespace/repository",
+  "homepage": "https://quay.io/repository/mynamespace/repository",
+  "updated_tags": ["latest", "1.2.0"]
+}`
+	pairs, err := quayAdapter{}.ExtractAll([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []repoTag{{Repo: "quay.io/mynamespace/repository", Tag: "latest"}, {Repo: "quay.io/mynamespace/repository", Tag: "1.2.0"}}
+	if len(pairs) != len(want) || pairs[0] != want[0] || pairs[1] != want[1] {
+		t.Errorf("extracted %+v, want %+v", pairs, want)
+	}
+	if _, err := (quayAdapter{}).ExtractAll([]byte(`{"docker_url": "quay.io/ns/app", "updated_tags": []}`)); err == nil {
+		t.Error("push without tags accepted")
+	}
+}
+
+func TestIsHarborPayload(t *testing.T) {
+	if !isHarborPayload([]byte(`{"type": "PUSH_ARTIFACT", "event_data": {"resources": []}}`)) {
+		t.Error("harbor payload not detected")
+	}
+	if isHarborPayload([]byte(`{"push_data": {"tag": "1.0"}, "repository": {"repo_name": "org/app"}}`)) {
+		t.Error("docker hub payload taken for harbor one")
+	}
+}
+
+func TestAdapterWebhooksQueue(t *testing.T) {
+	f, restore := newFakeDocker(t)
+	defer restore()
+	prevQueue := jobs.queue
+	jobs.queue = make(chan *job, 4)
+	defer func() { jobs.queue = prevQueue }()
+	post := func(h echo.HandlerFunc, target, body string) *httptest.ResponseRecorder {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)), rec)
+		if err := h(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+	queued := func(name string, rec *httptest.ResponseRecorder) *job {
+		var res map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != http.StatusAccepted || res["job_id"] == "" {
+			t.Fatalf("%s: HTTP %d %s, want 202 with a job", name, rec.Code, rec.Body)
+		}
+		j := <-jobs.queue
+		releaseUpdate()
+		if j.ID != res["job_id"] {
+			t.Errorf("%s: job %s queued, %s answered", name, j.ID, res["job_id"])
+		}
+		return j
+	}
+
+	j := queued("gitlab", post(updByAdapter(gitlabAdapter{}), "/api/v1/update/gitlab", gitlabPush))
+	if j.Repo != "registry.gitlab.example.com/group/project/app" || j.Tag != "1.4.2" {
+		t.Errorf("gitlab: job of %s:%s", j.Repo, j.Tag)
+	}
+	quay := `{"docker_url": "quay.io/ns/queued", "updated_tags": ["1.0.1", "1.0.2"]}`
+	if j := queued("quay", post(updByMultiAdapter(quayAdapter{}), "/api/v1/update/quay", quay)); len(j.Batch) != 2 {
+		t.Errorf("quay: job batch %+v", j.Batch)
+	}
+	if calls := f.recorded("pull", "stop", "create"); len(calls) > 0 {
+		t.Errorf("webhooks updated synchronously: %v", calls)
+	}
+
+	// async=false runs the batch right away
+	rec := post(updByMultiAdapter(quayAdapter{}), "/api/v1/update/quay?async=false", `{"docker_url": "quay.io/ns/sync", "updated_tags": ["1.0.1"]}`)
+	var results []batchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); rec.Code != http.StatusOK || err != nil || len(results) != 1 {
+		t.Errorf("async=false: HTTP %d %s, want batch results", rec.Code, rec.Body)
+	}
+	if len(jobs.queue) > 0 {
+		t.Error("async=false queued a job")
+	}
+}
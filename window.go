@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ======= UPDATE WINDOWS ======
+
+// time window on given week days or dates, e.g. "mon-fri 22:00-06:00" or
+// "2026-11-27..2026-11-30 00:00-24:00"; window ending before it starts
+// continues to the next day
+type window struct {
+	days     [7]bool
+	from, to int // minutes since midnight
+	// inclusive date range, "2006-01-02", empty for week days windows
+	dateFrom, dateTo string
+}
+
+const dateLayout = "2006-01-02"
+
+// set of windows, empty schedule is always open
+type schedule []window
+
+var weekDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// "sat+sun 00:00-24:00;mon-fri 22:00-06:00"
+func parseSchedule(s string) (schedule, error) {
+	var sch schedule
+	for _, part := range strings.Split(s, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		sch = append(sch, w)
+	}
+	return sch, nil
+}
+
+// "<days> <HH:MM>-<HH:MM>", days: "*", "mon-fri", "sat+sun", "2026-11-27",
+// "2026-11-27..2026-11-30"
+func parseWindow(s string) (window, error) {
+	var w window
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, _err("invalid window %q, expected \"<days> <HH:MM>-<HH:MM>\"", s)
+	}
+	if err := w.parseDays(fields[0]); err != nil {
+		return w, _err("invalid window %q: %s", s, err.Error())
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return w, _err("invalid window %q: time range expected", s)
+	}
+	var err error
+	if w.from, err = parseClock(times[0]); err != nil {
+		return w, _err("invalid window %q: %s", s, err.Error())
+	}
+	if w.to, err = parseClock(times[1]); err != nil {
+		return w, _err("invalid window %q: %s", s, err.Error())
+	}
+	return w, nil
+}
+
+func (w *window) parseDays(s string) error {
+	if dates := strings.Split(s, ".."); len(dates) <= 2 && isDate(dates[0]) {
+		w.dateFrom, w.dateTo = dates[0], dates[len(dates)-1]
+		if !isDate(w.dateTo) || w.dateTo < w.dateFrom {
+			return _err("invalid dates %q", s)
+		}
+		s = "*"
+	}
+	if s == "*" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+		return nil
+	}
+	for _, item := range strings.Split(strings.ToLower(s), "+") {
+		bounds := strings.Split(item, "-")
+		from, ok := weekDays[bounds[0]]
+		if !ok || len(bounds) > 2 {
+			return _err("unknown days %q", item)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekDays[bounds[1]]; !ok {
+				return _err("unknown days %q", item)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, _err("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func isDate(s string) bool {
+	_, err := time.Parse(dateLayout, s)
+	return err == nil
+}
+
+func (w window) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return w.onDay(t) && m >= w.from && m < w.to
+	}
+	// crosses midnight
+	return (w.onDay(t) && m >= w.from) || (w.onDay(t.AddDate(0, 0, -1)) && m < w.to)
+}
+
+// whether window starts on t's day
+func (w window) onDay(t time.Time) bool {
+	if w.dateFrom != "" {
+		d := t.Format(dateLayout)
+		return d >= w.dateFrom && d <= w.dateTo
+	}
+	return w.days[t.Weekday()]
+}
+
+func (sch schedule) open(t time.Time) bool {
+	return len(sch) == 0 || sch.active(t)
+}
+
+// whether t is in any window, empty schedule is never active
+func (sch schedule) active(t time.Time) bool {
+	for _, w := range sch {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ======= DEFERRED UPDATES ======
+
+// updates waiting for their window by repo and host (empty for all hosts),
+// latest tag per repo wins on every host; docker hub callbacks of all
+// requests for repo and host get the result of the update run
+var deferred = struct {
+	sync.Mutex
+	tags      map[deferredKey]string
+	callbacks map[deferredKey][]string
+}{tags: make(map[deferredKey]string), callbacks: make(map[deferredKey][]string)}
+
+type deferredKey struct{ repo, host string }
+
+// queues update when repo's window is closed, updates are paused (in
+// queue mode) or repo is throttled, returns whether it was queued
+func deferUpdate(repo, tag, host string) bool {
+	now := time.Now()
+	paused := isPaused() && config().PauseMode == pauseQueue
+	open := config().windowOpen(repo, now)
+	if !paused && open && reserveUpdate(repo, now) {
+		return false
+	}
+	key := deferredKey{repo, host}
+	deferred.Lock()
+	queued := deferred.tags[key] != tag
+	for k := range deferred.tags {
+		if k.repo == repo {
+			deferred.tags[k] = tag
+		}
+	}
+	deferred.tags[key] = tag
+	deferred.Unlock()
+	saveUpdateQueue()
+	switch {
+	case paused:
+		logrus.Infof("updates are paused, %s:%s queued", repo, tag)
+	case !open:
+		logrus.Infof("repo %s is out of update window, %s:%s queued", repo, repo, tag)
+	default:
+		until, _ := throttled(repo, now)
+		logrus.Infof("repo %s is throttled until %s, %s:%s queued", repo, until.Format(time.RFC3339), repo, tag)
+		// runs once the interval ends, nothing to approve
+		return true
+	}
+	if queued {
+		offerApproval(repo, tag, host)
+	}
+	return true
+}
+
+// takes queued update of repo on host out of the queue while it is still
+// for tag, with callbacks of its requests
+func takeDeferred(repo, tag, host string) (repoTag, []string, bool) {
+	defer saveUpdateQueue()
+	key := deferredKey{repo, host}
+	deferred.Lock()
+	defer deferred.Unlock()
+	if deferred.tags[key] != tag {
+		return repoTag{}, nil, false
+	}
+	callbacks := deferred.callbacks[key]
+	delete(deferred.tags, key)
+	delete(deferred.callbacks, key)
+	return repoTag{Repo: repo, Tag: tag, Host: host}, callbacks, true
+}
+
+// reports result of queued update of repo on host to callbackURL once it
+// runs
+func deferCallback(repo, host, callbackURL string) {
+	if callbackURL == "" {
+		return
+	}
+	key := deferredKey{repo, host}
+	deferred.Lock()
+	deferred.callbacks[key] = append(deferred.callbacks[key], callbackURL)
+	deferred.Unlock()
+	saveUpdateQueue()
+}
+
+// runs queued updates once their windows open and throttling allows, none
+// while paused
+func runDeferredUpdates(every time.Duration) {
+	for range time.Tick(every) {
+		if isPaused() {
+			continue
+		}
+		now := time.Now()
+		var due []repoTag
+		callbacks := make(map[deferredKey][]string)
+		reserved := make(map[string]bool)
+		deferred.Lock()
+		for key, tag := range deferred.tags {
+			// updates of repo on other hosts run with the one reserved
+			if reserved[key.repo] || config().windowOpen(key.repo, now) && reserveUpdate(key.repo, now) {
+				reserved[key.repo] = true
+				due = append(due, repoTag{Repo: key.repo, Tag: tag, Host: key.host})
+				callbacks[key] = deferred.callbacks[key]
+				delete(deferred.tags, key)
+				delete(deferred.callbacks, key)
+			}
+		}
+		deferred.Unlock()
+		if len(due) > 0 {
+			saveUpdateQueue()
+		}
+		for _, rt := range due {
+			logrus.Infof("running queued update of repo %s to %s", rt.Repo, rt.Tag)
+			runQueued(rt, callbacks[deferredKey{rt.Repo, rt.Host}], "window", triggerQueued)
+		}
+	}
+}
+
+// runs update taken out of the queue for caller, reporting to callbacks of
+// its requests
+func runQueued(rt repoTag, callbacks []string, caller, trigger string) error {
+	_, err := runUpdate(rt.Repo, rt.Tag, rt.Host, updateOptions{Caller: caller, Trigger: trigger})
+	if err != nil {
+		logrus.Errorf("queued update %s:%s error: %s", rt.Repo, rt.Tag, err)
+	}
+	for _, callbackURL := range callbacks {
+		sendHubCallback(callbackURL, rt.Repo, rt.Tag, err)
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mustSchedule(t *testing.T, s string) schedule {
+	sch, err := parseSchedule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sch
+}
+
+func TestWindowOpenTimeZone(t *testing.T) {
+	// 23:30 UTC on a wednesday is 01:30 thursday at UTC+2
+	at := time.Date(2026, 10, 14, 23, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		tz   *time.Location
+		sch  string
+		open bool
+	}{
+		{"utc inside", time.UTC, "wed 23:00-24:00", true},
+		{"utc+2 outside", time.FixedZone("EET", 2*3600), "wed 23:00-24:00", false},
+		{"utc+2 next day", time.FixedZone("EET", 2*3600), "thu 01:00-02:00", true},
+		{"utc-5 evening", time.FixedZone("EST", -5*3600), "mon-fri 18:00-19:00", true},
+		{"past midnight", time.FixedZone("EET", 2*3600), "wed 22:00-02:00", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer withConfig(func(c *Config) {
+				c.WindowsTZ, c.Windows = tc.tz, mustSchedule(t, tc.sch)
+				c.RepoWindows, c.Blackouts, c.RepoBlackouts = nil, nil, nil
+			})()
+			if open := config().windowOpen("org/app", at); open != tc.open {
+				t.Errorf("window %q at %s in %s open = %v, want %v", tc.sch, at, tc.tz, open, tc.open)
+			}
+		})
+	}
+}
+
+func TestRepoWindows(t *testing.T) {
+	defer withConfig(func(c *Config) {
+		c.WindowsTZ, c.Windows = time.UTC, mustSchedule(t, "mon-fri 12:00-13:00")
+		c.RepoWindows = map[string]schedule{
+			"org/a": mustSchedule(t, "sat+sun 00:00-24:00"),
+			"org/b": mustSchedule(t, "mon-fri 22:00-06:00"),
+		}
+		c.Blackouts, c.RepoBlackouts = nil, nil
+	})()
+	saturday := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	tuesdayNight := time.Date(2026, 10, 13, 23, 0, 0, 0, time.UTC)
+	wednesdayMorning := time.Date(2026, 10, 14, 5, 0, 0, 0, time.UTC)
+	tuesdayNoon := time.Date(2026, 10, 13, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		repo string
+		at   time.Time
+		open bool
+	}{
+		{"org/a", saturday, true},
+		{"org/a", tuesdayNight, false},
+		{"org/a", tuesdayNoon, false},
+		{"org/b", tuesdayNight, true},
+		{"org/b", wednesdayMorning, true},
+		{"org/b", saturday, false},
+		{"org/c", tuesdayNoon, true},
+		{"org/c", saturday, false},
+	} {
+		if open := config().windowOpen(tc.repo, tc.at); open != tc.open {
+			t.Errorf("repo %s at %s open = %v, want %v", tc.repo, tc.at.Format(time.RFC1123), open, tc.open)
+		}
+	}
+}
+
+func TestDeferUpdateOutOfWindow(t *testing.T) {
+	defer withConfig(func(c *Config) {
+		c.WindowsTZ, c.Windows = time.UTC, nil
+		// never open again
+		c.RepoWindows = map[string]schedule{"org/closed": mustSchedule(t, "2020-01-01 00:00-24:00")}
+		c.Blackouts, c.RepoBlackouts = nil, nil
+		c.UpdateQueueFile = ""
+	})()
+	defer takeDeferred("org/closed", "1.0.2", "")
+
+	if deferUpdate("org/open", "1.0.1", "") {
+		t.Error("update in window queued")
+	}
+	if !deferUpdate("org/closed", "1.0.1", "") || !deferUpdate("org/closed", "1.0.2", "") {
+		t.Fatal("update out of window not queued")
+	}
+	if _, _, ok := takeDeferred("org/closed", "1.0.1", ""); ok {
+		t.Error("superseded tag still queued")
+	}
+	if rt, _, ok := takeDeferred("org/closed", "1.0.2", ""); !ok || rt.Repo != "org/closed" {
+		t.Errorf("latest tag not queued: %+v", rt)
+	}
+}
+
+func TestDeferUpdateByHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer withConfig(func(c *Config) {
+		c.WindowsTZ, c.Windows = time.UTC, nil
+		c.RepoWindows = map[string]schedule{"org/edge": mustSchedule(t, "2020-01-01 00:00-24:00")}
+		c.Blackouts, c.RepoBlackouts = nil, nil
+		c.UpdateQueueFile = filepath.Join(dir, "queue.json")
+	})()
+	for _, host := range []string{"", "edge-1", "edge-2"} {
+		defer takeDeferred("org/edge", "1.0.2", host)
+	}
+
+	deferUpdate("org/edge", "1.0.1", "edge-1")
+	deferUpdate("org/edge", "1.0.1", "")
+	deferUpdate("org/edge", "1.0.2", "edge-2")
+	deferCallback("org/edge", "edge-2", "https://hub.example.com/callback")
+
+	// queue file keeps every host
+	deferred.Lock()
+	deferred.tags, deferred.callbacks = make(map[deferredKey]string), make(map[deferredKey][]string)
+	deferred.Unlock()
+	if err := loadUpdateQueue(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"", "edge-1", "edge-2"} {
+		// all are moved to the latest tag
+		if _, _, ok := takeDeferred("org/edge", "1.0.1", host); ok {
+			t.Errorf("host %q: superseded tag still queued", host)
+		}
+		rt, callbacks, ok := takeDeferred("org/edge", "1.0.2", host)
+		if !ok || rt.Host != host {
+			t.Errorf("host %q: update not queued: %+v", host, rt)
+		}
+		if host == "edge-2" && len(callbacks) != 1 || host != "edge-2" && len(callbacks) != 0 {
+			t.Errorf("host %q: callbacks %v", host, callbacks)
+		}
+	}
+}